@@ -0,0 +1,263 @@
+package assetstore
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+//Aliases are stable names, like "latest-firmware", for whichever asset is current, optionally pinned to a version of
+//it, current or kept (see AssetStorage.Replace).  Every change to an alias is a new revision, swapped in atomically
+//only if the alias is still at the revision it was changed from, and every revision is kept as its history.  Deleting
+//an alias is a revision too, so its history outlives it.
+
+var (
+	//ErrAliasExists is returned creating an alias whose slug is already in use
+	ErrAliasExists = errors.New("alias already exists")
+	//ErrAliasConflict is returned changing an alias that's been changed since the revision the change was made to
+	ErrAliasConflict = errors.New("alias has been changed")
+)
+
+//aliasSlugPattern is what slugs can be, so they're safe in urls
+var aliasSlugPattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9._-]{0,127}$`)
+
+//Alias points a slug at an asset, as of a revision
+type Alias struct {
+	Slug string `json:"slug"`
+	//Tenant/namespace of the alias and its asset
+	Tenant string `json:"tenant,omitempty"`
+	AssetID string `json:"asset_id,omitempty"`
+	//Version of the asset the alias is pinned to, if it's pinned to one.  Every replacement of the asset's data is a
+	//new version (see AssetStorage.Replace).
+	Version *int `json:"version,omitempty"`
+	//User who created the alias, if known
+	Owner string `json:"owner,omitempty"`
+	//Revision counts changes to the alias, from 1
+	Revision int64 `json:"revision"`
+	//Unix timestamp the revision was made at, and the user who made it, if known
+	Updated int64 `json:"updated,omitempty"`
+	UpdatedBy string `json:"updated_by,omitempty"`
+	//Whether the revision deleted the alias
+	Deleted bool `json:"deleted,omitempty"`
+}
+
+func (a Alias) Valid() bool {
+	return aliasSlugPattern.MatchString(a.Slug) && ValidTenant(a.Tenant) && (a.AssetID != "" || a.Deleted)
+}
+
+//Key is the tenant scoped key the alias is stored under
+func (a Alias) Key() string {
+	return ScopedKey(a.Tenant, a.Slug)
+}
+
+//AssetKey is the tenant scoped key of the asset the alias points at
+func (a Alias) AssetKey() string {
+	return ScopedKey(a.Tenant, a.AssetID)
+}
+
+//AliasHandler stores aliases and their history, by their tenant scoped keys
+type AliasHandler interface {
+	//GetAlias gets the current revision of an alias, even if it's deleted
+	GetAlias(slug string) (alias Alias, err error)
+	//SwapAlias atomically stores alias as the current revision, only if the current revision is prev (0 if there
+	//isn't one yet), and adds it to the alias's history.  It returns ErrAliasConflict otherwise.
+	SwapAlias(alias Alias, prev int64) (err error)
+	//AliasHistory gets every revision of an alias, newest first
+	AliasHistory(slug string) (history []Alias, err error)
+}
+
+//AssetAliaser manages aliases of assets, and retrieves assets by them, returning data still encoded when it's stored
+//in one of the accepted encodings, like EncodedAssetRetriever
+type AssetAliaser interface {
+	GetAlias(slug string) (alias Alias, err error)
+	CreateAlias(alias Alias) (created Alias, err error)
+	UpdateAlias(alias Alias, ifRevision int64) (updated Alias, err error)
+	DeleteAlias(slug string, ifRevision int64, by string) (err error)
+	AliasHistory(slug string) (history []Alias, err error)
+	GetEncodedByAlias(slug string, accept ...string) (meta AssetMeta, asset io.ReadCloser, encoding string, err error)
+}
+
+//AliasURLSigner signs urls for the data of the assets aliases point at, like SignedURLRetriever
+type AliasURLSigner interface {
+	SignedURLByAlias(slug string, ttl time.Duration) (meta AssetMeta, url string, err error)
+}
+
+//WithAliasStore enables aliases, stored by aliases
+func WithAliasStore(aliases AliasHandler) AssetStorageOption {
+	return func(s *AssetStorage) {
+		s.aliases = aliases
+	}
+}
+
+//GetAlias gets the current revision of an alias by its tenant scoped slug, if it hasn't been deleted
+func (s *AssetStorage) GetAlias(slug string) (alias Alias, err error) {
+	if s.aliases == nil {
+		return alias, fmt.Errorf("%w: aliases aren't enabled", ErrNotFound)
+	}
+	alias, err = s.aliases.GetAlias(slug)
+	if err == nil && alias.Deleted {
+		err = fmt.Errorf("%w: alias %s was deleted", ErrNotFound, slug)
+	}
+	return
+}
+
+//CreateAlias creates an alias for an asset in its tenant, as its first revision (or the one after it was deleted)
+func (s *AssetStorage) CreateAlias(alias Alias) (created Alias, err error) {
+	if s.aliases == nil {
+		return alias, fmt.Errorf("aliases aren't enabled")
+	}
+	var prev int64
+	existing, err := s.aliases.GetAlias(alias.Key())
+	switch {
+	case err == nil && !existing.Deleted:
+		return alias, fmt.Errorf("%w: %s", ErrAliasExists, alias.Slug)
+	case err == nil:
+		prev = existing.Revision
+	case !errors.Is(err, ErrNotFound):
+		return alias, err
+	}
+	alias.UpdatedBy = alias.Owner
+	return s.swapAlias(alias, prev)
+}
+
+//UpdateAlias points an alias at another asset or version, if it's still at ifRevision (any revision if 0).  Its owner
+//is kept.
+func (s *AssetStorage) UpdateAlias(alias Alias, ifRevision int64) (updated Alias, err error) {
+	existing, err := s.GetAlias(alias.Key())
+	if err != nil {
+		return alias, err
+	}
+	if ifRevision != 0 && ifRevision != existing.Revision {
+		return alias, fmt.Errorf("%w: it's at revision %d, not %d", ErrAliasConflict, existing.Revision, ifRevision)
+	}
+	alias.Owner = existing.Owner
+	return s.swapAlias(alias, existing.Revision)
+}
+
+//DeleteAlias deletes an alias by its tenant scoped slug, if it's still at ifRevision (any revision if 0), recording
+//the user who deleted it, if known, in its history
+func (s *AssetStorage) DeleteAlias(slug string, ifRevision int64, by string) (err error) {
+	existing, err := s.GetAlias(slug)
+	if err != nil {
+		return err
+	}
+	if ifRevision != 0 && ifRevision != existing.Revision {
+		return fmt.Errorf("%w: it's at revision %d, not %d", ErrAliasConflict, existing.Revision, ifRevision)
+	}
+	deleted := Alias{Slug: existing.Slug, Tenant: existing.Tenant, Owner: existing.Owner, UpdatedBy: by, Deleted: true}
+	_, err = s.swapAlias(deleted, existing.Revision)
+	return
+}
+
+//AliasHistory gets every revision of an alias by its tenant scoped slug, newest first, even if it's been deleted
+func (s *AssetStorage) AliasHistory(slug string) (history []Alias, err error) {
+	if s.aliases == nil {
+		return nil, fmt.Errorf("%w: aliases aren't enabled", ErrNotFound)
+	}
+	history, err = s.aliases.AliasHistory(slug)
+	if err == nil && len(history) == 0 {
+		err = fmt.Errorf("%w: alias %s", ErrNotFound, slug)
+	}
+	return
+}
+
+//ResolveAlias gets the meta of the retrievable asset an alias, by its tenant scoped slug, points at, or of the
+//previous version of it the alias is pinned to
+func (s *AssetStorage) ResolveAlias(slug string) (meta AssetMeta, err error) {
+	meta, _, err = s.resolveAlias(slug)
+	return
+}
+
+//resolveAlias is ResolveAlias, also returning the meta of the asset's current version
+func (s *AssetStorage) resolveAlias(slug string) (meta, current AssetMeta, err error) {
+	alias, err := s.GetAlias(slug)
+	if err != nil {
+		return
+	}
+	current, err = s.metaHandler.GetMeta(alias.AssetKey())
+	if err != nil {
+		return
+	}
+	meta = current
+	if alias.Version != nil && current.Version != *alias.Version {
+		if meta, err = s.getVersion(alias.AssetKey(), *alias.Version); err != nil {
+			return
+		}
+	}
+	return meta, current, s.checkRetrievable(meta)
+}
+
+//getVersion gets the meta of a previous version of an asset, by its tenant scoped key
+func (s *AssetStorage) getVersion(id string, version int) (meta AssetMeta, err error) {
+	handler, ok := s.metaHandler.(VersionHandler)
+	if !ok {
+		return meta, fmt.Errorf("%w: previous versions of asset %s aren't kept", ErrNotFound, id)
+	}
+	return handler.GetVersion(id, version)
+}
+
+//GetEncodedByAlias gets the asset, or previous version of it, an alias by its tenant scoped slug points at, returning
+//data still encoded if it's in an accepted encoding, like GetEncodedByID.  The data served is always that of the
+//version the alias was resolved to.
+func (s *AssetStorage) GetEncodedByAlias(slug string, accept ...string) (meta AssetMeta, asset io.ReadCloser, encoding string, err error) {
+	meta, current, err := s.resolveAlias(slug)
+	if err != nil {
+		return
+	}
+	s.recordAccess(current)
+	asset, encoding, err = readDecoded(s.dataHandler, meta, meta.DataKey(), accept...)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"context": "AssetStorage.GetEncodedByAlias()",
+			"dataHandler": s.dataHandler,
+			"slug": slug,
+			"meta": meta,
+		}).Error(err)
+	}
+	return
+}
+
+//SignedURLByAlias signs a url for the data of the asset, or previous version of it, an alias points at, like
+//SignedURLByID
+func (s *AssetStorage) SignedURLByAlias(slug string, ttl time.Duration) (meta AssetMeta, url string, err error) {
+	meta, current, err := s.resolveAlias(slug)
+	if err != nil {
+		return
+	}
+	s.recordAccess(current)
+	return meta, s.signURL(meta, ttl), nil
+}
+
+//swapAlias checks the asset a new revision of an alias points at exists, then swaps it in after revision prev
+func (s *AssetStorage) swapAlias(alias Alias, prev int64) (Alias, error) {
+	if !alias.Valid() {
+		return alias, fmt.Errorf("alias invalid")
+	}
+	if !alias.Deleted {
+		meta, err := s.metaHandler.GetMeta(alias.AssetKey())
+		if err != nil {
+			return alias, err
+		}
+		if alias.Version != nil && meta.Version != *alias.Version {
+			if _, err = s.getVersion(alias.AssetKey(), *alias.Version); err != nil {
+				return alias, err
+			}
+		}
+	}
+	alias.Revision = prev + 1
+	alias.Updated = time.Now().Unix()
+	err := s.aliases.SwapAlias(alias, prev)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"context": "AssetStorage.swapAlias()",
+			"aliases": s.aliases,
+			"alias": alias,
+			"prev": prev,
+		}).Error(err)
+	}
+	return alias, err
+}
@@ -0,0 +1,267 @@
+package assetstore
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+type memAliases struct {
+	mu sync.Mutex
+	current map[string]Alias
+	history map[string][]Alias
+}
+
+func newMemAliases() *memAliases {
+	return &memAliases{current: map[string]Alias{}, history: map[string][]Alias{}}
+}
+
+func (m *memAliases) GetAlias(slug string) (Alias, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	alias, ok := m.current[slug]
+	if !ok {
+		return alias, fmt.Errorf("%w: alias %s", ErrNotFound, slug)
+	}
+	return alias, nil
+}
+
+func (m *memAliases) SwapAlias(alias Alias, prev int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.current[alias.Key()].Revision != prev {
+		return fmt.Errorf("%w: %s", ErrAliasConflict, alias.Slug)
+	}
+	m.current[alias.Key()] = alias
+	m.history[alias.Key()] = append([]Alias{alias}, m.history[alias.Key()]...)
+	return nil
+}
+
+func (m *memAliases) AliasHistory(slug string) ([]Alias, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.history[slug], nil
+}
+
+func TestAssetStorage_Aliases(t *testing.T) {
+	db := newMemMetaTokenStore()
+	s := NewAssetStorage(db, db, newMemDataStore(), WithAliasStore(newMemAliases()))
+	store := func(name, content string) AssetMeta {
+		meta, err := s.Store(AssetMeta{ID: uuid.New().String(), Name: name}, AssetToken{}, ioutil.NopCloser(strings.NewReader(content)))
+		assert.NoError(t, err)
+		return meta
+	}
+	v1 := store("firmware-1.bin", "v1")
+	v2 := store("firmware-2.bin", "v2")
+	version := 0
+	wrongVersion := 3
+
+	alias, err := s.CreateAlias(Alias{Slug: "latest-firmware", AssetID: v1.ID, Owner: "alice"})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), alias.Revision)
+	meta, err := s.ResolveAlias(alias.Key())
+	assert.NoError(t, err)
+	assert.Equal(t, v1.ID, meta.ID)
+
+	tests := []struct {
+		name    string
+		alias   Alias
+		wantErr error
+	}{
+		{"slug in use", Alias{Slug: "latest-firmware", AssetID: v2.ID}, ErrAliasExists},
+		{"missing asset", Alias{Slug: "missing", AssetID: uuid.New().String()}, ErrNotFound},
+		{"missing version", Alias{Slug: "pinned", AssetID: v1.ID, Version: &wrongVersion}, ErrNotFound},
+		{"bad slug", Alias{Slug: "../latest", AssetID: v1.ID}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := s.CreateAlias(tt.alias)
+			assert.Error(t, err)
+			if tt.wantErr != nil {
+				assert.True(t, errors.Is(err, tt.wantErr))
+			}
+		})
+	}
+
+	//updates only apply to the revision they were made to
+	_, err = s.UpdateAlias(Alias{Slug: "latest-firmware", AssetID: v2.ID}, 2)
+	assert.True(t, errors.Is(err, ErrAliasConflict))
+	updated, err := s.UpdateAlias(Alias{Slug: "latest-firmware", AssetID: v2.ID, Version: &version, UpdatedBy: "bob"}, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), updated.Revision)
+	assert.Equal(t, "alice", updated.Owner)
+	meta, err = s.ResolveAlias(alias.Key())
+	assert.NoError(t, err)
+	assert.Equal(t, v2.ID, meta.ID)
+
+	//of concurrent updates of the same revision, only one wins
+	var wg sync.WaitGroup
+	errs := make([]error, 2)
+	for i, asset := range []AssetMeta{v1, v2} {
+		wg.Add(1)
+		go func(i int, asset AssetMeta) {
+			defer wg.Done()
+			_, errs[i] = s.swapAlias(Alias{Slug: "latest-firmware", AssetID: asset.ID}, 2)
+		}(i, asset)
+	}
+	wg.Wait()
+	assert.True(t, (errs[0] == nil) != (errs[1] == nil))
+
+	//deleting keeps the history, and the alias can be created again after it
+	assert.True(t, errors.Is(s.DeleteAlias(alias.Key(), 1, "bob"), ErrAliasConflict))
+	assert.NoError(t, s.DeleteAlias(alias.Key(), 3, "bob"))
+	_, err = s.ResolveAlias(alias.Key())
+	assert.True(t, errors.Is(err, ErrNotFound))
+	recreated, err := s.CreateAlias(Alias{Slug: "latest-firmware", AssetID: v1.ID})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(5), recreated.Revision)
+	history, err := s.AliasHistory(alias.Key())
+	assert.NoError(t, err)
+	if assert.Len(t, history, 5) {
+		assert.True(t, history[1].Deleted)
+		assert.Equal(t, "bob", history[1].UpdatedBy)
+		assert.Equal(t, v1.ID, history[4].AssetID)
+	}
+
+	//aliases pinned to a version keep resolving to it once the asset's replaced, as it's kept, unpinned ones follow the
+	//replacement
+	pinned, err := s.CreateAlias(Alias{Slug: "pinned", AssetID: v1.ID, Version: &version})
+	assert.NoError(t, err)
+	meta, err = s.ResolveAlias(pinned.Key())
+	assert.NoError(t, err)
+	assert.Equal(t, v1.ID, meta.ID)
+	_, err = s.Replace(v1.Key(), v1.Revision, ioutil.NopCloser(strings.NewReader("v1.1")))
+	assert.NoError(t, err)
+	meta, asset, _, err := s.GetEncodedByAlias(pinned.Key())
+	if assert.NoError(t, err) {
+		assert.Equal(t, 0, meta.Version)
+		assert.Equal(t, "v1", readAll(t, asset))
+	}
+	meta, asset, _, err = s.GetEncodedByAlias(recreated.Key())
+	if assert.NoError(t, err) {
+		assert.Equal(t, 1, meta.Version)
+		assert.Equal(t, "v1.1", readAll(t, asset))
+	}
+
+	//they can be pinned to kept versions too, but not to versions that don't exist, and stop resolving once the
+	//version's deleted
+	pinnedAfter, err := s.CreateAlias(Alias{Slug: "pinned-after", AssetID: v1.ID, Version: &version})
+	assert.NoError(t, err)
+	_, err = s.CreateAlias(Alias{Slug: "pinned-ahead", AssetID: v1.ID, Version: &wrongVersion})
+	assert.True(t, errors.Is(err, ErrNotFound))
+	kept, err := s.Versions(v1.Key())
+	assert.NoError(t, err)
+	if assert.Len(t, kept, 1) {
+		assert.NoError(t, s.DeleteVersion(kept[0]))
+	}
+	_, err = s.ResolveAlias(pinnedAfter.Key())
+	assert.True(t, errors.Is(err, ErrNotFound))
+}
+
+//racyMetaStore replaces an asset just after its meta's been got, once
+type racyMetaStore struct {
+	*memMetaTokenStore
+	replace func()
+}
+
+func (r *racyMetaStore) GetMeta(id string) (AssetMeta, error) {
+	meta, err := r.memMetaTokenStore.GetMeta(id)
+	if r.replace != nil {
+		replace := r.replace
+		r.replace = nil
+		replace()
+	}
+	return meta, err
+}
+
+func TestAssetStorage_GetEncodedByAlias_Replaced(t *testing.T) {
+	db := &racyMetaStore{memMetaTokenStore: newMemMetaTokenStore()}
+	s := NewAssetStorage(db, db, newMemDataStore(), WithAliasStore(newMemAliases()))
+	meta, err := s.Store(AssetMeta{ID: uuid.New().String(), Name: "fw.bin"}, AssetToken{}, ioutil.NopCloser(strings.NewReader("v1")))
+	assert.NoError(t, err)
+	version := 0
+	pinned, err := s.CreateAlias(Alias{Slug: "pinned", AssetID: meta.ID, Version: &version})
+	assert.NoError(t, err)
+
+	//an alias's asset being replaced while it's resolved still gets the version it was resolved to
+	db.replace = func() {
+		_, err := s.Replace(meta.Key(), 0, ioutil.NopCloser(strings.NewReader("v2")))
+		assert.NoError(t, err)
+	}
+	resolved, asset, _, err := s.GetEncodedByAlias(pinned.Key())
+	if assert.NoError(t, err) {
+		assert.Equal(t, 0, resolved.Version)
+		assert.Equal(t, "v1", readAll(t, asset))
+	}
+	current, err := db.GetMeta(meta.Key())
+	assert.NoError(t, err)
+	assert.Equal(t, 1, current.Version)
+}
+
+func TestAPI_Aliases(t *testing.T) {
+	db := newMemMetaTokenStore()
+	s := NewAssetStorage(db, db, newMemDataStore(), WithAliasStore(newMemAliases()))
+	api := testAPI(s, WithAliases(s), WithAPIKeys(map[string]Principal{
+		"alice-key": {User: "alice"},
+		"bob-key":   {User: "bob"},
+	}))
+	meta, err := s.Store(AssetMeta{ID: uuid.New().String(), Owner: "alice", Name: "fw.bin"}, AssetToken{}, ioutil.NopCloser(strings.NewReader("v1")))
+	assert.NoError(t, err)
+	body := func() *strings.Reader {
+		return strings.NewReader(`{"slug": "latest-firmware", "asset_id": "` + meta.ID + `"}`)
+	}
+
+	//changing aliases needs an api key, and the owner's if there is one
+	changes := []struct {
+		name   string
+		method string
+		path   string
+		apiKey string
+		want   int
+	}{
+		{"anonymous create", http.MethodPost, "/aliases", "", http.StatusUnauthorized},
+		{"create", http.MethodPost, "/aliases", "alice-key", http.StatusOK},
+		{"anonymous update", http.MethodPut, "/aliases/latest-firmware", "", http.StatusUnauthorized},
+		{"someone else's update", http.MethodPut, "/aliases/latest-firmware", "bob-key", http.StatusForbidden},
+		{"anonymous delete", http.MethodDelete, "/aliases/latest-firmware", "", http.StatusUnauthorized},
+		{"someone else's delete", http.MethodDelete, "/aliases/latest-firmware", "bob-key", http.StatusForbidden},
+		{"owner's update", http.MethodPut, "/aliases/latest-firmware", "alice-key", http.StatusOK},
+	}
+	for _, tt := range changes {
+		t.Run(tt.name, func(t *testing.T) {
+			w := serve(api, tt.method, tt.path, tt.apiKey, body())
+			assert.Equal(t, tt.want, w.Code, w.Body.String())
+		})
+	}
+
+	//the alias resolves for anyone, but only those who may change it see what it points at
+	w := serve(api, http.MethodGet, "/a/latest-firmware", "", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "v1", w.Body.String())
+	views := []struct {
+		name      string
+		path      string
+		apiKey    string
+		wantAsset bool
+	}{
+		{"anonymous", "/aliases/latest-firmware", "", false},
+		{"someone else", "/aliases/latest-firmware", "bob-key", false},
+		{"owner", "/aliases/latest-firmware", "alice-key", true},
+		{"anonymous history", "/aliases/latest-firmware/history", "", false},
+		{"owner's history", "/aliases/latest-firmware/history", "alice-key", true},
+	}
+	for _, tt := range views {
+		t.Run(tt.name, func(t *testing.T) {
+			w := serve(api, http.MethodGet, tt.path, tt.apiKey, nil)
+			assert.Equal(t, http.StatusOK, w.Code)
+			assert.Equal(t, tt.wantAsset, strings.Contains(w.Body.String(), meta.ID), w.Body.String())
+		})
+	}
+}
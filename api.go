@@ -1,15 +1,17 @@
 package assetstore
 
 import (
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
-	"github.com/google/uuid"
 )
 
 //idRetriever gets assets by id
@@ -19,79 +21,660 @@ var tokenRetriever AssetTokenRetriever
 //assetStorer stores assets given metadata and data
 var assetStorer AssetStorer
 
+//metaRetriever gets asset meta without data, for authorization checks
+var metaRetriever MetaRetriever
+//assetDeleter deletes assets, if deletion is enabled
+var assetDeleter AssetDeleter
+//tokenRevoker revokes tokens, if revocation is enabled
+var tokenRevoker AssetTokenRevoker
+//usageReporter reports usage and checks quotas, if they're enabled
+var usageReporter UsageReporter
+//signedURLRetriever redirects downloads to presigned urls, if redirects are enabled
+var signedURLRetriever SignedURLRetriever
+//signedURLTTL is how long presigned urls are valid for
+var signedURLTTL time.Duration
+//directUploader reserves and completes uploads straight to storage, if direct uploads are enabled
+var directUploader DirectUploader
+//uploadReservationTTL is how long reserved uploads have to be completed
+var uploadReservationTTL time.Duration
+//multipartUploader handles multipart uploads through the api, if they're enabled
+var multipartUploader MultipartUploader
+//multipartUploadTTL is how long multipart uploads have to be completed
+var multipartUploadTTL time.Duration
+//resumableUploader handles tus uploads, if they're enabled
+var resumableUploader ResumableUploader
+//assetArchiver streams archives of assets, if archives are enabled
+var assetArchiver AssetArchiver
+//assetCollector manages collections of assets, if they're enabled
+var assetCollector AssetCollector
+//lifecycleReporter reports what lifecycle policies would delete, if reports are enabled
+var lifecycleReporter LifecycleReporter
+//metaUpdater changes the names, content types and user metadata of assets, if it's enabled
+var metaUpdater MetaUpdater
+//assetReplacer replaces the data of assets, if it's enabled
+var assetReplacer AssetReplacer
+//assetAliaser manages aliases of assets, if they're enabled
+var assetAliaser AssetAliaser
+//idGenerator makes the ids of uploaded assets and collections
+var idGenerator IDGenerator = UUIDGenerator{}
+//tokenGenerator makes the tokens of uploaded assets, archives and collections
+var tokenGenerator IDGenerator = UUIDGenerator{}
+//maxUploadBytes is the global upload size limit, 0 for unlimited
+var maxUploadBytes int64
+
+//APIOption enables optional api features when passed to RunAPI
+type APIOption func()
+
+//WithAssetDeleter enables DELETE /asset/:id.  Deleting needs an api key, and owned assets may only be deleted by their
+//owner.
+func WithAssetDeleter(mr MetaRetriever, d AssetDeleter) APIOption {
+	return func() {
+		metaRetriever = mr
+		assetDeleter = d
+	}
+}
+
+//WithTokenRevoker enables DELETE /asset-token/:token.  Revoking needs an api key, and tokens for owned assets may only
+//be revoked by their owner.
+func WithTokenRevoker(mr MetaRetriever, r AssetTokenRevoker) APIOption {
+	return func() {
+		metaRetriever = mr
+		tokenRevoker = r
+	}
+}
+
+//WithPresignedRedirects checks downloads are authorized, then redirects them to presigned urls valid for ttl, so data
+//doesn't stream through the api.  Assets whose storage can't sign urls, or which are stored encoded, are still streamed.
+func WithPresignedRedirects(r SignedURLRetriever, ttl time.Duration) APIOption {
+	return func() {
+		signedURLRetriever = r
+		signedURLTTL = ttl
+	}
+}
+
+//WithDirectUploads enables POST /asset/uploads, which reserves an upload and signs urls its data can be uploaded to
+//directly, and POST /asset/uploads/:id/complete, which checks and commits it.  Reservations expire after ttl.  Assets
+//can no longer be uploaded with the name "uploads" through POST /asset/:assetname.
+func WithDirectUploads(u DirectUploader, ttl time.Duration) APIOption {
+	return func() {
+		directUploader = u
+		uploadReservationTTL = ttl
+	}
+}
+
+//WithMultipartUploads enables POST /multipart, which starts a multipart upload, PUT /multipart/:id/:part, which
+//uploads a part of it, and POST /multipart/:id/complete and DELETE /multipart/:id, which complete and abort it.
+//Uploads expire after ttl.
+func WithMultipartUploads(u MultipartUploader, ttl time.Duration) APIOption {
+	return func() {
+		multipartUploader = u
+		multipartUploadTTL = ttl
+	}
+}
+
+//WithTusUploads enables resumable uploads with the tus protocol under /files
+func WithTusUploads(u ResumableUploader) APIOption {
+	return func() {
+		resumableUploader = u
+	}
+}
+
+//WithArchives enables POST /assets/archive, which streams an archive of assets by id or token, or shares one with an
+//archive token, and GET /assets/archive/:token, which streams a shared archive
+func WithArchives(a AssetArchiver) APIOption {
+	return func() {
+		assetArchiver = a
+	}
+}
+
+//WithCollections enables CRUD of collections of assets under /collections, POST /collections/:id/token, which shares
+//a collection with a collection token, and GET /asset-token/:token/*name, which gets an asset in a shared collection
+//by its name or id.  Creating, changing, deleting and sharing collections need an api key, and owned collections may
+//only be changed, deleted or shared by their owner.
+func WithCollections(c AssetCollector) APIOption {
+	return func() {
+		assetCollector = c
+	}
+}
+
+//WithAliases enables GET /a/:slug, which gets the asset an alias points at, POST /aliases, which creates an alias,
+//GET, PUT and DELETE /aliases/:slug, and GET /aliases/:slug/history.  Changes can be made conditional on the alias's
+//revision with If-Match.  Creating, changing and deleting aliases need an api key, and owned aliases may only be
+//changed or deleted by their owner.  The asset an alias points at is only shown to callers who may change it.
+func WithAliases(a AssetAliaser) APIOption {
+	return func() {
+		assetAliaser = a
+	}
+}
+
+//WithMetaUpdater enables PATCH /asset/:id, which changes an asset's name, content type and/or user metadata.  Changes
+//can be made conditional on the asset's revision with If-Match.  Changes need an api key, and owned assets may only
+//be changed by their owner.
+func WithMetaUpdater(mr MetaRetriever, u MetaUpdater) APIOption {
+	return func() {
+		metaRetriever = mr
+		metaUpdater = u
+	}
+}
+
+//WithAssetReplacer enables PUT /asset/:id, which replaces an asset's data with the request body, keeping its id and
+//tokens.  Replacements can be made conditional on the asset's revision with If-Match.  Replacing needs an api key,
+//and owned assets may only be replaced by their owner.
+func WithAssetReplacer(mr MetaRetriever, r AssetReplacer) APIOption {
+	return func() {
+		metaRetriever = mr
+		assetReplacer = r
+	}
+}
+
+//WithLifecycleReports enables GET /lifecycle/report, which reports what lifecycle policies would delete in the
+//request's tenant, without deleting anything.  Reports need an api key.
+func WithLifecycleReports(r LifecycleReporter) APIOption {
+	return func() {
+		lifecycleReporter = r
+	}
+}
+
+//WithIDGenerators makes the ids of new assets and collections with ids, and every asset, archive and collection token
+//with tokens, instead of uuids.  Either can be nil, to keep uuids.
+func WithIDGenerators(ids, tokens IDGenerator) APIOption {
+	return func() {
+		if ids != nil {
+			idGenerator = ids
+		}
+		if tokens != nil {
+			tokenGenerator = tokens
+		}
+	}
+}
+
+//WithUploadLimit limits the size of every upload.  API keys may have lower limits of their own.
+func WithUploadLimit(maxBytes int64) APIOption {
+	return func() {
+		maxUploadBytes = maxBytes
+	}
+}
+
+//WithUsageReporter checks uploads against quotas, and enables GET /usage
+func WithUsageReporter(r UsageReporter) APIOption {
+	return func() {
+		usageReporter = r
+	}
+}
+
 // For uptime watchers
 func ping(c *gin.Context) {
 	c.String(http.StatusOK, "OK")
 }
 
+//addResp is the result of storing an asset
+type addResp struct {
+	Meta AssetMeta `json:"asset"`
+	Token AssetToken `json:"token,omitempty"`
+	Error string `json:"error"`
+}
+
 func addAsset(c *gin.Context) {
+	//POST /asset/uploads can't have a route of its own, as it'd conflict with POST /asset/:assetname
+	if directUploader != nil && c.Param("assetname") == "uploads" {
+		reserveUpload(c)
+		return
+	}
+	if strings.Contains(strings.ToLower(c.ContentType()), "multipart") {
+		addFormAssets(c)
+		return
+	}
+
 	type input struct {
 		Name string `json:"name" form:"name"`
 		Token bool `json:"token" form:"token"`
 		Expiry int `json:"expiry" form:"expiry"`
-	}
-
-	type addResp struct {
-		Meta AssetMeta `json:"asset"`
-		Token AssetToken `json:"token,omitempty"`
-		Error string `json:"error"`
+		TTL int `json:"ttl" form:"ttl"`
+		Extract bool `json:"extract" form:"extract"`
 	}
 
 	i := input{}
 
+	//enforce upload limits while streaming, since chunked uploads have no Content-Length to check up front
+	p, _ := requestPrincipal(c)
+	limit := uploadLimit(maxUploadBytes, p.MaxUploadBytes)
+	if limit > 0 && c.Request.ContentLength > limit {
+		c.JSON(http.StatusRequestEntityTooLarge, addResp{Error: ErrUploadTooLarge.Error()})
+		return
+	}
+	c.Request.Body = NewLimitedReadCloser(c.Request.Body, limit)
+
 	c.Bind(&i)
 
-	isForm := strings.Contains(strings.ToLower(c.ContentType()), "multipart")
-	name := c.Param("assetname")
-	if !isForm && name == "" {
+	i.Name = c.Param("assetname")
+	if i.Name == "" {
 		c.JSON(http.StatusBadRequest, addResp{Error: "asset name not specified"})
 		return
-	}else{
-		i.Name = name
 	}
 
+	//refuse uploads that won't fit before reading any of them
+	if !checkRequestQuota(c, requestMeta(c, i.Name)) {
+		return
+	}
+
+	if i.Extract {
+		extractAssets(c, i.Token, i.Expiry, i.TTL, limit)
+		return
+	}
+
+	meta, token, err := newRequestAsset(c, i.Name, i.Token, i.Expiry, i.TTL)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, addResp{Error: err.Error()})
+		return
+	}
+	meta.Size = int(c.Request.ContentLength)
+	meta, err = assetStorer.Store(meta, token, c.Request.Body)
+	if errors.Is(err, ErrTokenNotStored) {
+		//the asset exists, so the client needs its id, even though it didn't get a token
+		c.JSON(http.StatusOK, addResp{Meta: meta, Error: err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(storeErrorStatus(err), addResp{Error: err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, addResp{Meta: meta, Token: token})
+}
 
-	if i.Token == false {
-		i.Expiry = 0
+//extractAssets stores each file in an uploaded zip, tar or tar.gz archive as an asset, named for its path in the
+//archive, with the upload's token, expiry and ttl options.  The response is a manifest of the results, with an error if
+//the archive couldn't be read, or expanded too far, after which nothing more was stored.
+func extractAssets(c *gin.Context, wantToken bool, expiry, ttl int, limit int64) {
+	type extractResp struct {
+		Manifest []ExtractedAsset `json:"manifest"`
+		Error string `json:"error,omitempty"`
 	}
 
+	manifest, err := ExtractArchive(assetStorer, c.Request.Body, limit, func(path string) (AssetMeta, AssetToken, error) {
+		return newRequestAsset(c, path, wantToken, expiry, ttl)
+	})
+	if manifest == nil {
+		manifest = []ExtractedAsset{}
+	}
+	if err != nil {
+		status := http.StatusBadRequest
+		if errors.Is(err, ErrUploadTooLarge) || errors.Is(err, ErrExtractLimit) {
+			status = http.StatusRequestEntityTooLarge
+		}
+		//anything stored before the archive failed was still stored, so the client needs to know about it
+		if len(manifest) > 0 {
+			status = http.StatusOK
+		}
+		c.JSON(status, extractResp{Manifest: manifest, Error: err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, extractResp{Manifest: manifest})
+}
+
+//addFormAssets stores every file in a multipart form, streaming them one after another.  The token and expiry
+//options, from the query or from fields before the files, apply to each file.  A form with one file gets the same
+//response as any other upload, and one with several an array of results, each with any error storing its file.
+func addFormAssets(c *gin.Context) {
+	type input struct {
+		Token bool `form:"token"`
+		Expiry int `form:"expiry"`
+		TTL int `form:"ttl"`
+	}
+
+	i := input{}
+	c.ShouldBindQuery(&i)
+	//limits apply to the whole form, as to any upload, as well as to each file, as they're streamed
+	p, _ := requestPrincipal(c)
+	limit := uploadLimit(maxUploadBytes, p.MaxUploadBytes)
+	if limit > 0 && c.Request.ContentLength > limit {
+		c.JSON(http.StatusRequestEntityTooLarge, addResp{Error: ErrUploadTooLarge.Error()})
+		return
+	}
+	c.Request.Body = NewLimitedReadCloser(c.Request.Body, limit)
+	form, err := c.Request.MultipartReader()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, addResp{Error: err.Error()})
+		return
+	}
+	if !checkRequestQuota(c, requestMeta(c, "form")) {
+		return
+	}
+
+	results := []addResp{}
+	statuses := []int{}
+	for {
+		part, err := form.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			//a file cut short by the form's limit has already been reported
+			if !errors.Is(err, ErrUploadTooLarge) || len(statuses) == 0 || statuses[len(statuses)-1] != http.StatusRequestEntityTooLarge {
+				results = append(results, addResp{Error: err.Error()})
+				statuses = append(statuses, storeErrorStatus(err))
+			}
+			break
+		}
+		if part.FileName() == "" {
+			value, _ := ioutil.ReadAll(io.LimitReader(part, 64))
+			switch part.FormName() {
+			case "token":
+				i.Token, _ = strconv.ParseBool(string(value))
+			case "expiry":
+				i.Expiry, _ = strconv.Atoi(string(value))
+			case "ttl":
+				i.TTL, _ = strconv.Atoi(string(value))
+			}
+			continue
+		}
+
+		meta, token, err := newRequestAsset(c, part.FileName(), i.Token, i.Expiry, i.TTL)
+		if err == nil {
+			meta, err = assetStorer.Store(meta, token, NewLimitedReadCloser(part, limit))
+		}
+		switch {
+		case errors.Is(err, ErrTokenNotStored):
+			results = append(results, addResp{Meta: meta, Error: err.Error()})
+			statuses = append(statuses, http.StatusOK)
+		case err != nil:
+			results = append(results, addResp{Error: err.Error()})
+			statuses = append(statuses, storeErrorStatus(err))
+		default:
+			results = append(results, addResp{Meta: meta, Token: token})
+			statuses = append(statuses, http.StatusOK)
+		}
+	}
+
+	switch len(results) {
+	case 0:
+		c.JSON(http.StatusBadRequest, addResp{Error: "no files in form"})
+	case 1:
+		c.JSON(statuses[0], results[0])
+	default:
+		//the request only fails if every file did
+		status := statuses[0]
+		for _, s := range statuses {
+			if s == http.StatusOK {
+				status = s
+			}
+		}
+		c.JSON(status, results)
+	}
+}
+
+//requestMeta is the meta of an asset uploaded by a request, in its tenant and owned by its principal's user, but
+//without an id
+func requestMeta(c *gin.Context, name string) AssetMeta {
 	meta := AssetMeta{
-		ID: uuid.New().String(),
-		Name: i.Name,
-		Size: int(c.Request.ContentLength),
+		Tenant: requestTenant(c),
+		Name: name,
 		Version: 0,
 	}
+	if p, ok := requestPrincipal(c); ok {
+		meta.Owner = p.User
+	}
+	return meta
+}
+
+//newRequestAsset is the meta of a new asset uploaded by a request, with a new id, expiring after ttl minutes (never if
+//0), and a new token to access it for expiry minutes, if one's wanted
+func newRequestAsset(c *gin.Context, name string, wantToken bool, expiry, ttl int) (meta AssetMeta, token AssetToken, err error) {
+	meta = requestMeta(c, name)
+	if ttl > 0 {
+		meta.Expires = time.Now().Add(time.Minute * time.Duration(ttl)).Unix()
+	}
+	meta.ID, err = newAssetID(meta.Tenant)
+	if err != nil || !wantToken || expiry == 0 {
+		return
+	}
+	token.Token, err = newToken(meta.Tenant)
+	token.Expiry = time.Now().Add(time.Minute * time.Duration(expiry)).Unix()
+	token.AssetID = meta.ID
+	token.Tenant = meta.Tenant
+	return
+}
+
+//newAssetID is a new id for an asset in tenant
+func newAssetID(tenant string) (string, error) {
+	return idGenerator.NewID(ScopedKey(tenant, "asset"))
+}
+
+//newToken is a new token, of an asset, archive or collection, in tenant
+func newToken(tenant string) (string, error) {
+	return tokenGenerator.NewID(ScopedKey(tenant, "token"))
+}
+
+//checkRequestQuota refuses a request whose Content-Length won't fit in meta's quota before any of it's read,
+//responding with an error if it won't
+func checkRequestQuota(c *gin.Context, meta AssetMeta) bool {
+	if usageReporter != nil && c.Request.ContentLength > 0 {
+		if err := usageReporter.CheckQuota(meta, c.Request.ContentLength); err != nil {
+			c.JSON(storeErrorStatus(err), addResp{Error: err.Error()})
+			return false
+		}
+	}
+	return true
+}
+
+//reserveUpload reserves an upload of a declared size, returning where to upload its data to
+func reserveUpload(c *gin.Context) {
+	type input struct {
+		Name string `json:"name"`
+		Size int64 `json:"size"`
+		//optional hex sha256 the data must have
+		Checksum string `json:"checksum"`
+	}
+
+	type reserveResp struct {
+		UploadReservation
+		Error string `json:"error,omitempty"`
+	}
+
+	i := input{}
+	if err := c.ShouldBindJSON(&i); err != nil || i.Name == "" {
+		c.JSON(http.StatusBadRequest, reserveResp{Error: "asset name and size not specified"})
+		return
+	}
+	p, ok := requestPrincipal(c)
+	if limit := uploadLimit(maxUploadBytes, p.MaxUploadBytes); limit > 0 && i.Size > limit {
+		c.JSON(http.StatusRequestEntityTooLarge, reserveResp{Error: ErrUploadTooLarge.Error()})
+		return
+	}
+	id, err := newAssetID(requestTenant(c))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, reserveResp{Error: err.Error()})
+		return
+	}
+	meta := AssetMeta{
+		ID: id,
+		Tenant: requestTenant(c),
+		Name: i.Name,
+		Size: int(i.Size),
+		Checksum: i.Checksum,
+	}
+	if ok {
+		meta.Owner = p.User
+	}
+	reservation, err := directUploader.ReserveUpload(meta, uploadReservationTTL)
+	if err != nil {
+		c.JSON(storeErrorStatus(err), reserveResp{Error: err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, reserveResp{UploadReservation: reservation})
+}
+
+//completeUpload checks and commits a reserved upload's data, once it's been uploaded
+func completeUpload(c *gin.Context) {
+	//registered as POST /asset/:assetname/:id/complete, as POST /asset/uploads/:id/complete would conflict
+	if c.Param("assetname") != "uploads" {
+		c.JSON(http.StatusNotFound, "not found")
+		return
+	}
+	finishUpload(c, directUploader)
+}
+
+//finishUpload completes the upload in the id param with u, with a token if one is requested
+func finishUpload(c *gin.Context, u UploadCompleter) {
+	type input struct {
+		//the parts of a multipart upload
+		Parts []UploadPart `json:"parts"`
+		Token bool `json:"token"`
+		Expiry int `json:"expiry"`
+	}
+
+	type completeResp struct {
+		Meta AssetMeta `json:"asset"`
+		Token AssetToken `json:"token,omitempty"`
+		Error string `json:"error"`
+	}
+
+	i := input{}
+	if err := c.ShouldBindJSON(&i); err != nil && err != io.EOF {
+		c.JSON(http.StatusBadRequest, completeResp{Error: err.Error()})
+		return
+	}
+	key := scopedParam(c, "id")
+	meta, err := u.GetMeta(key)
+	if err != nil {
+		c.JSON(http.StatusNotFound, completeResp{Error: err.Error()})
+		return
+	}
+	if meta.Owner != "" {
+		if p, ok := requestPrincipal(c); !ok || p.User != meta.Owner {
+			c.JSON(http.StatusForbidden, completeResp{Error: "only the owner may complete this upload"})
+			return
+		}
+	}
 
 	token := AssetToken{}
 	if i.Token && i.Expiry != 0 {
-		//populate a new token
-		token.Token = uuid.New().String()
+		if token.Token, err = newToken(meta.Tenant); err != nil {
+			c.JSON(http.StatusInternalServerError, completeResp{Error: err.Error()})
+			return
+		}
 		token.Expiry = time.Now().Add(time.Minute * time.Duration(i.Expiry)).Unix()
 		token.AssetID = meta.ID
+		token.Tenant = meta.Tenant
 	}
 
-	var reader io.ReadCloser
+	meta, err = u.CompleteUpload(key, i.Parts, token)
+	if errors.Is(err, ErrTokenNotStored) {
+		c.JSON(http.StatusOK, completeResp{Meta: meta, Error: err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(storeErrorStatus(err), completeResp{Error: err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, completeResp{Meta: meta, Token: token})
+}
 
-	if !isForm {
-		reader = c.Request.Body
-	}else {
-		ff, err := c.FormFile("file")
-		if err == nil {
-			reader, _ = ff.Open()
-			meta.Name = ff.Filename
-			meta.Size = int(ff.Size)
-		} else {
-			c.JSON(http.StatusBadRequest, addResp{Error: err.Error()})
-			return
-		}
+//startMultipart starts a multipart upload of a declared size, whose parts can then be uploaded in any order
+func startMultipart(c *gin.Context) {
+	type input struct {
+		Name string `json:"name"`
+		Size int64 `json:"size"`
+		//optional hex sha256 the data must have
+		Checksum string `json:"checksum"`
+	}
+
+	type startResp struct {
+		Meta AssetMeta `json:"asset"`
+		//Unix timestamp the upload must be completed by
+		Expires int64 `json:"expires,omitempty"`
+		Error string `json:"error,omitempty"`
 	}
 
-	err := assetStorer.Store(meta, token, reader)
+	i := input{}
+	if err := c.ShouldBindJSON(&i); err != nil || i.Name == "" {
+		c.JSON(http.StatusBadRequest, startResp{Error: "asset name and size not specified"})
+		return
+	}
+	p, ok := requestPrincipal(c)
+	if limit := uploadLimit(maxUploadBytes, p.MaxUploadBytes); limit > 0 && i.Size > limit {
+		c.JSON(http.StatusRequestEntityTooLarge, startResp{Error: ErrUploadTooLarge.Error()})
+		return
+	}
+	id, err := newAssetID(requestTenant(c))
 	if err != nil {
-		c.JSON(http.StatusBadRequest, addResp{Error: err.Error()})
+		c.JSON(http.StatusInternalServerError, startResp{Error: err.Error()})
 		return
 	}
-	c.JSON(http.StatusOK, addResp{Meta: meta, Token: token})
+	meta := AssetMeta{
+		ID: id,
+		Tenant: requestTenant(c),
+		Name: i.Name,
+		Size: int(i.Size),
+		Checksum: i.Checksum,
+	}
+	if ok {
+		meta.Owner = p.User
+	}
+	meta, err = multipartUploader.StartMultipart(meta, multipartUploadTTL)
+	if err != nil {
+		c.JSON(storeErrorStatus(err), startResp{Error: err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, startResp{Meta: meta, Expires: meta.ReservedUntil})
+}
+
+//uploadPart uploads a part of a multipart upload, checked against its Upload-Checksum (as for tus) if it has one
+func uploadPart(c *gin.Context) {
+	number, err := strconv.ParseInt(c.Param("part"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, "part number invalid")
+		return
+	}
+	checksum, err := parseTusChecksum(c.GetHeader("Upload-Checksum"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, err.Error())
+		return
+	}
+	meta, ok := multipartUpload(c)
+	if !ok {
+		return
+	}
+	part, err := multipartUploader.UploadPart(meta.Key(), number, c.Request.Body, checksum)
+	if err != nil {
+		c.JSON(storeErrorStatus(err), err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, part)
+}
+
+//completeMultipart puts a multipart upload's parts together, then checks and commits it
+func completeMultipart(c *gin.Context) {
+	finishUpload(c, multipartUploader)
+}
+
+//abortMultipart abandons a multipart upload, removing any parts uploaded
+func abortMultipart(c *gin.Context) {
+	meta, ok := multipartUpload(c)
+	if !ok {
+		return
+	}
+	if err := multipartUploader.AbortUpload(meta.Key()); err != nil {
+		c.JSON(storeErrorStatus(err), err.Error())
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+//multipartUpload gets the meta of the upload a request is for, which the principal must own if it has an owner,
+//responding with an error if it can't
+func multipartUpload(c *gin.Context) (meta AssetMeta, ok bool) {
+	meta, err := multipartUploader.GetMeta(scopedParam(c, "id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, err.Error())
+		return meta, false
+	}
+	if meta.Owner != "" {
+		if p, ok := requestPrincipal(c); !ok || p.User != meta.Owner {
+			c.JSON(http.StatusForbidden, "only the owner may access this upload")
+			return meta, false
+		}
+	}
+	return meta, true
 }
 
 func getAssetByID(c *gin.Context) {
@@ -100,14 +683,29 @@ func getAssetByID(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, "asset id not specified")
 		return
 	}
-	meta, asset, err := idRetriever.GetByID(id)
+	sendAssetByID(c, scopedParam(c, "id"))
+}
+
+//sendAssetByID transfers the asset with a tenant scoped id to the client, or redirects them to a presigned url of it
+func sendAssetByID(c *gin.Context, id string) {
+	if signedURLRetriever != nil && redirectToSignedURL(c, signedURLRetriever.SignedURLByID, id) {
+		return
+	}
+	var meta AssetMeta
+	var asset io.ReadCloser
+	var encoding string
+	var err error
+	if r, ok := idRetriever.(EncodedAssetRetriever); ok {
+		meta, asset, encoding, err = r.GetEncodedByID(id, acceptedEncodings(c)...)
+	} else {
+		meta, asset, err = idRetriever.GetByID(id)
+	}
 	if err != nil {
-		c.JSON(http.StatusNoContent, err.Error())
+		c.JSON(retrieveErrorStatus(c, err), err.Error())
 		return
 	}
 	defer asset.Close()
-	sendAsset(c, asset, meta)
-	return
+	sendAsset(c, asset, meta, encoding)
 }
 
 func getAssetByToken(c *gin.Context) {
@@ -116,49 +714,766 @@ func getAssetByToken(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, "token not specified")
 		return
 	}
-	meta, asset, err := tokenRetriever.GetByToken(token)
+	if signedURLRetriever != nil && redirectToSignedURL(c, signedURLRetriever.SignedURLByToken, scopedParam(c, "token")) {
+		return
+	}
+	var meta AssetMeta
+	var asset io.ReadCloser
+	var encoding string
+	var err error
+	if r, ok := tokenRetriever.(EncodedAssetRetriever); ok {
+		meta, asset, encoding, err = r.GetEncodedByToken(scopedParam(c, "token"), acceptedEncodings(c)...)
+	} else {
+		meta, asset, err = tokenRetriever.GetByToken(scopedParam(c, "token"))
+	}
 	if err != nil {
-		c.JSON(http.StatusNoContent, err.Error())
+		c.JSON(retrieveErrorStatus(c, err), err.Error())
 		return
 	}
 	defer asset.Close()
-	sendAsset(c, asset, meta)
+	sendAsset(c, asset, meta, encoding)
 	return
 }
 
-//sendAsset transfers asset/file to the client as a download
-func sendAsset(c *gin.Context, asset io.ReadCloser, meta AssetMeta) {
+//archiveAssets streams an archive of assets, listed by id and/or token, or if a token is requested, shares it
+func archiveAssets(c *gin.Context) {
+	type input struct {
+		IDs []string `json:"ids"`
+		Tokens []string `json:"tokens"`
+		//"zip" (the default) or "tar.gz"
+		Format string `json:"format"`
+		Token bool `json:"token"`
+		Expiry int `json:"expiry"`
+	}
+
+	type archiveResp struct {
+		Token ArchiveToken `json:"token,omitempty"`
+		Error string `json:"error,omitempty"`
+	}
+
+	i := input{}
+	if err := c.ShouldBindJSON(&i); err != nil {
+		c.JSON(http.StatusBadRequest, archiveResp{Error: err.Error()})
+		return
+	}
+	//ids and tokens come from the body, so have to be kept to the request's tenant
+	tenant := requestTenant(c)
+	for _, keys := range [][]string{i.IDs, i.Tokens} {
+		for n, key := range keys {
+			if key == "" || strings.Contains(key, tenantSeparator) {
+				c.JSON(http.StatusBadRequest, archiveResp{Error: fmt.Sprintf("invalid id or token %q", key)})
+				return
+			}
+			keys[n] = ScopedKey(tenant, key)
+		}
+	}
+	archive, err := assetArchiver.OpenArchive(i.Format, i.IDs, i.Tokens)
+	if err != nil {
+		c.JSON(archiveErrorStatus(c, err), archiveResp{Error: err.Error()})
+		return
+	}
+	if !i.Token {
+		sendArchive(c, archive)
+		return
+	}
+	if i.Expiry <= 0 {
+		c.JSON(http.StatusBadRequest, archiveResp{Error: "expiry not specified"})
+		return
+	}
+	id, err := newToken(requestTenant(c))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, archiveResp{Error: err.Error()})
+		return
+	}
+	token, err := assetArchiver.ShareArchive(archive, ArchiveToken{
+		Token: id,
+		Expiry: time.Now().Add(time.Minute * time.Duration(i.Expiry)).Unix(),
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, archiveResp{Error: err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, archiveResp{Token: token})
+}
+
+//getArchiveByToken streams a shared archive
+func getArchiveByToken(c *gin.Context) {
+	archive, err := assetArchiver.OpenArchiveByToken(scopedParam(c, "token"))
+	if err != nil {
+		c.JSON(archiveErrorStatus(c, err), err.Error())
+		return
+	}
+	sendArchive(c, archive)
+}
+
+//sendArchive streams an archive to the client as a download.  If an asset can't be read part way, the archive's
+//left unfinished, so it's unreadable rather than silently missing data.
+func sendArchive(c *gin.Context, archive *AssetArchive) {
+	c.Header("Content-Type", archive.ContentType())
+	c.Header("Content-Disposition", attachmentDisposition(archive.Filename()))
+	c.Status(http.StatusOK)
+	if err := archive.Write(c.Writer); err != nil {
+		c.Error(err)
+	}
+}
+
+//archiveErrorStatus maps errors opening archives to http statuses
+func archiveErrorStatus(c *gin.Context, err error) int {
+	if errors.Is(err, ErrNotFound) {
+		return http.StatusNotFound
+	}
+	if status := retrieveErrorStatus(c, err); status != http.StatusNoContent {
+		return status
+	}
+	return http.StatusBadRequest
+}
+
+//collectionInput is the name and assets of a collection being created or updated
+type collectionInput struct {
+	Name string `json:"name" binding:"required"`
+	AssetIDs []string `json:"asset_ids"`
+}
+
+func createCollection(c *gin.Context) {
+	if !mayChange(c, "", "create collections") {
+		return
+	}
+	i := collectionInput{}
+	if err := c.ShouldBindJSON(&i); err != nil {
+		c.JSON(http.StatusBadRequest, err.Error())
+		return
+	}
+	id, err := idGenerator.NewID(ScopedKey(requestTenant(c), "collection"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+	p, _ := requestPrincipal(c)
+	coll := Collection{ID: id, Tenant: requestTenant(c), Owner: p.User, Name: i.Name, AssetIDs: i.AssetIDs}
+	coll, err = assetCollector.SaveCollection(coll)
+	if err != nil {
+		c.JSON(storeErrorStatus(err), err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, coll)
+}
+
+func getCollection(c *gin.Context) {
+	coll, err := assetCollector.GetCollection(scopedParam(c, "id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, coll)
+}
+
+//updateCollection replaces the name and assets of a collection
+func updateCollection(c *gin.Context) {
+	coll, ok := ownedCollection(c)
+	if !ok {
+		return
+	}
+	i := collectionInput{}
+	if err := c.ShouldBindJSON(&i); err != nil {
+		c.JSON(http.StatusBadRequest, err.Error())
+		return
+	}
+	coll.Name, coll.AssetIDs = i.Name, i.AssetIDs
+	coll, err := assetCollector.SaveCollection(coll)
+	if err != nil {
+		c.JSON(storeErrorStatus(err), err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, coll)
+}
+
+func deleteCollection(c *gin.Context) {
+	coll, ok := ownedCollection(c)
+	if !ok {
+		return
+	}
+	if err := assetCollector.DeleteCollection(coll.Key()); err != nil {
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+//ownedCollection gets the collection a request's for, responding with an error if it doesn't exist, or the caller may
+//not change it
+func ownedCollection(c *gin.Context) (coll Collection, ok bool) {
+	coll, err := assetCollector.GetCollection(scopedParam(c, "id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, err.Error())
+		return coll, false
+	}
+	return coll, mayChange(c, coll.Owner, "change or share this collection")
+}
+
+//shareCollection makes a collection token, which gives access to every asset in the collection for expiry minutes.
+//Only the collection's owner can share it.
+func shareCollection(c *gin.Context) {
+	coll, ok := ownedCollection(c)
+	if !ok {
+		return
+	}
+	type input struct {
+		Expiry int `json:"expiry" binding:"required"`
+	}
+
+	i := input{}
+	if err := c.ShouldBindJSON(&i); err != nil || i.Expiry <= 0 {
+		c.JSON(http.StatusBadRequest, "expiry not specified")
+		return
+	}
+	id, err := newToken(requestTenant(c))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+	token, err := assetCollector.ShareCollection(coll.Key(), CollectionToken{
+		Token: id,
+		Expiry: time.Now().Add(time.Minute * time.Duration(i.Expiry)).Unix(),
+	})
+	if err != nil {
+		c.JSON(storeErrorStatus(err), err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, token)
+}
+
+//getAssetByCollectionToken gets an asset in a shared collection, by its name (which may be a path) or id
+func getAssetByCollectionToken(c *gin.Context) {
+	name := strings.TrimPrefix(c.Param("name"), "/")
+	if name == "" {
+		c.JSON(http.StatusBadRequest, "asset name not specified")
+		return
+	}
+	meta, asset, encoding, err := assetCollector.GetEncodedByCollectionToken(scopedParam(c, "token"), name, acceptedEncodings(c)...)
+	if err != nil {
+		c.JSON(retrieveErrorStatus(c, err), err.Error())
+		return
+	}
+	defer asset.Close()
+	sendAsset(c, asset, meta, encoding)
+}
+
+//getAssetByAlias gets the asset, or version of it, an alias points at, or redirects to a presigned url of it
+func getAssetByAlias(c *gin.Context) {
+	slug := scopedParam(c, "slug")
+	if signer, ok := signedURLRetriever.(AliasURLSigner); ok && redirectToSignedURL(c, signer.SignedURLByAlias, slug) {
+		return
+	}
+	meta, asset, encoding, err := assetAliaser.GetEncodedByAlias(slug, acceptedEncodings(c)...)
+	if err != nil {
+		c.JSON(retrieveErrorStatus(c, err), err.Error())
+		return
+	}
+	defer asset.Close()
+	sendAsset(c, asset, meta, encoding)
+}
+
+//aliasInput is what an alias being created or updated points at
+type aliasInput struct {
+	Slug string `json:"slug"`
+	AssetID string `json:"asset_id" binding:"required"`
+	Version *int `json:"version"`
+}
+
+func createAlias(c *gin.Context) {
+	if !mayChange(c, "", "create aliases") {
+		return
+	}
+	i := aliasInput{}
+	if err := c.ShouldBindJSON(&i); err != nil {
+		c.JSON(http.StatusBadRequest, err.Error())
+		return
+	}
+	if strings.Contains(i.AssetID, tenantSeparator) {
+		c.JSON(http.StatusBadRequest, "invalid asset id")
+		return
+	}
+	p, _ := requestPrincipal(c)
+	alias := Alias{Slug: i.Slug, Tenant: requestTenant(c), AssetID: i.AssetID, Version: i.Version, Owner: p.User}
+	alias, err := assetAliaser.CreateAlias(alias)
+	if err != nil {
+		c.JSON(aliasErrorStatus(err), err.Error())
+		return
+	}
+	sendAlias(c, alias)
+}
+
+func getAlias(c *gin.Context) {
+	alias, err := assetAliaser.GetAlias(scopedParam(c, "slug"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, err.Error())
+		return
+	}
+	sendAlias(c, alias)
+}
+
+//updateAlias points an alias at another asset or version, if it's at the revision in If-Match, when there is one
+func updateAlias(c *gin.Context) {
+	alias, ok := ownedAlias(c)
+	if !ok {
+		return
+	}
+	i := aliasInput{}
+	if err := c.ShouldBindJSON(&i); err != nil {
+		c.JSON(http.StatusBadRequest, err.Error())
+		return
+	}
+	if strings.Contains(i.AssetID, tenantSeparator) {
+		c.JSON(http.StatusBadRequest, "invalid asset id")
+		return
+	}
+	revision, ok := ifMatchRevision(c)
+	if !ok {
+		return
+	}
+	alias.AssetID, alias.Version = i.AssetID, i.Version
+	alias.UpdatedBy = ""
+	if p, ok := requestPrincipal(c); ok {
+		alias.UpdatedBy = p.User
+	}
+	alias, err := assetAliaser.UpdateAlias(alias, revision)
+	if err != nil {
+		c.JSON(aliasErrorStatus(err), err.Error())
+		return
+	}
+	sendAlias(c, alias)
+}
+
+//deleteAlias deletes an alias, if it's at the revision in If-Match, when there is one
+func deleteAlias(c *gin.Context) {
+	alias, ok := ownedAlias(c)
+	if !ok {
+		return
+	}
+	revision, ok := ifMatchRevision(c)
+	if !ok {
+		return
+	}
+	p, _ := requestPrincipal(c)
+	if err := assetAliaser.DeleteAlias(alias.Key(), revision, p.User); err != nil {
+		c.JSON(aliasErrorStatus(err), err.Error())
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+//getAliasHistory lists every revision of an alias, newest first
+func getAliasHistory(c *gin.Context) {
+	history, err := assetAliaser.AliasHistory(scopedParam(c, "slug"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, err.Error())
+		return
+	}
+	if !mayViewAliasAsset(c, history[0]) {
+		hidden := make([]Alias, len(history))
+		for i, alias := range history {
+			alias.AssetID, alias.Version = "", nil
+			hidden[i] = alias
+		}
+		history = hidden
+	}
+	c.JSON(http.StatusOK, history)
+}
+
+//ownedAlias gets the alias a request's for, responding with an error if it doesn't exist, or is owned by someone else
+func ownedAlias(c *gin.Context) (alias Alias, ok bool) {
+	alias, err := assetAliaser.GetAlias(scopedParam(c, "slug"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, err.Error())
+		return alias, false
+	}
+	return alias, mayChange(c, alias.Owner, "change this alias")
+}
+
+//mayViewAliasAsset is whether the caller may see the asset an alias points at, which they may if they may change it.
+//Anyone else only gets the asset through the alias, so its id isn't given away to change or delete it by.
+func mayViewAliasAsset(c *gin.Context, alias Alias) bool {
+	p, ok := requestPrincipal(c)
+	return ok && (alias.Owner == "" || p.User == alias.Owner)
+}
+
+//sendAlias responds with an alias, and its revision as its ETag, leaving out the asset it points at if the caller may
+//not see it
+func sendAlias(c *gin.Context, alias Alias) {
+	if !mayViewAliasAsset(c, alias) {
+		alias.AssetID, alias.Version = "", nil
+	}
+	c.Header("ETag", fmt.Sprintf(`"%d"`, alias.Revision))
+	c.JSON(http.StatusOK, alias)
+}
+
+//ifMatchRevision is the revision in a request's If-Match header, 0 if it has none, responding with an error if it's
+//not a revision
+func ifMatchRevision(c *gin.Context) (revision int64, ok bool) {
+	match := c.GetHeader("If-Match")
+	if match == "" || match == "*" {
+		return 0, true
+	}
+	revision, err := strconv.ParseInt(strings.Trim(strings.TrimPrefix(match, "W/"), `"`), 10, 64)
+	if err != nil || revision <= 0 {
+		c.JSON(http.StatusPreconditionFailed, "If-Match isn't a revision")
+		return 0, false
+	}
+	return revision, true
+}
+
+//updateAsset changes an asset's name, content type and/or user metadata, if it's at the revision in If-Match, when
+//there is one
+func updateAsset(c *gin.Context) {
+	meta, revision, ok := changedAsset(c)
+	if !ok {
+		return
+	}
+	update := MetaUpdate{}
+	if err := c.ShouldBindJSON(&update); err != nil {
+		c.JSON(http.StatusBadRequest, err.Error())
+		return
+	}
+	meta, err := metaUpdater.UpdateMeta(meta.Key(), update, revision)
+	if err != nil {
+		c.JSON(storeErrorStatus(err), err.Error())
+		return
+	}
+	sendChangedAsset(c, meta)
+}
+
+//replaceAsset replaces an asset's data with the request body, if it's at the revision in If-Match, when there is one
+func replaceAsset(c *gin.Context) {
+	meta, revision, ok := changedAsset(c)
+	if !ok {
+		return
+	}
+	p, _ := requestPrincipal(c)
+	limit := uploadLimit(maxUploadBytes, p.MaxUploadBytes)
+	if limit > 0 && c.Request.ContentLength > limit {
+		c.JSON(http.StatusRequestEntityTooLarge, ErrUploadTooLarge.Error())
+		return
+	}
+	meta, err := assetReplacer.Replace(meta.Key(), revision, NewLimitedReadCloser(c.Request.Body, limit))
+	if err != nil {
+		c.JSON(storeErrorStatus(err), err.Error())
+		return
+	}
+	sendChangedAsset(c, meta)
+}
+
+//changedAsset gets the asset a request changes, and the revision it's changing, from If-Match, or the asset's
+//current revision.  It responds with an error if the asset doesn't exist, or the caller may not change it.
+func changedAsset(c *gin.Context) (meta AssetMeta, revision int64, ok bool) {
+	meta, err := metaRetriever.GetMeta(scopedParam(c, "id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, err.Error())
+		return meta, 0, false
+	}
+	if !mayChange(c, meta.Owner, "change this asset") {
+		return meta, 0, false
+	}
+	//assets start at revision 0, so unlike aliases an If-Match of "0" is a revision
+	revision = meta.Revision
+	if match := c.GetHeader("If-Match"); match != "" && match != "*" {
+		revision, err = strconv.ParseInt(strings.Trim(strings.TrimPrefix(match, "W/"), `"`), 10, 64)
+		if err != nil || revision < 0 {
+			c.JSON(http.StatusPreconditionFailed, "If-Match isn't a revision")
+			return meta, 0, false
+		}
+	}
+	return meta, revision, true
+}
+
+//sendChangedAsset responds with a changed asset's meta, and its revision as its ETag
+func sendChangedAsset(c *gin.Context, meta AssetMeta) {
+	c.Header("ETag", fmt.Sprintf(`"%d"`, meta.Revision))
+	c.JSON(http.StatusOK, meta)
+}
+
+//aliasErrorStatus maps errors changing aliases to http statuses
+func aliasErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrAliasExists):
+		return http.StatusConflict
+	case errors.Is(err, ErrAliasConflict):
+		return http.StatusPreconditionFailed
+	case errors.Is(err, ErrNotFound):
+		return http.StatusNotFound
+	default:
+		return http.StatusBadRequest
+	}
+}
+
+//mayChange checks the caller may make a change, described by what, to something owned by owner: they need an api key,
+//and to be the owner if there is one.  It responds with an error if they may not.
+func mayChange(c *gin.Context, owner, what string) bool {
+	p, ok := requestPrincipal(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, "an api key is required to "+what)
+		return false
+	}
+	if owner != "" && p.User != owner {
+		c.JSON(http.StatusForbidden, "only the owner may "+what)
+		return false
+	}
+	return true
+}
+
+func deleteAsset(c *gin.Context) {
+	id := scopedParam(c, "id")
+	meta, err := metaRetriever.GetMeta(id)
+	if err != nil {
+		c.JSON(http.StatusNotFound, err.Error())
+		return
+	}
+	if !mayChange(c, meta.Owner, "delete this asset") {
+		return
+	}
+	if err = assetDeleter.Delete(id); err != nil {
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+func revokeToken(c *gin.Context) {
+	key := scopedParam(c, "token")
+	token, err := tokenRevoker.GetToken(key)
+	if err != nil {
+		c.JSON(http.StatusNotFound, err.Error())
+		return
+	}
+	//tokens of assets that are already gone can be revoked by anyone in the tenant with an api key
+	owner := ""
+	if meta, err := metaRetriever.GetMeta(token.AssetKey()); err == nil {
+		owner = meta.Owner
+	}
+	if !mayChange(c, owner, "revoke this asset's tokens") {
+		return
+	}
+	if err = tokenRevoker.RevokeToken(key); err != nil {
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+//getUsage reports the usage and quota of the request's tenant, and its api key's user
+func getUsage(c *gin.Context) {
+	p, _ := requestPrincipal(c)
+	report, err := usageReporter.Usage(requestTenant(c), p.User)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, report)
+}
+
+//getLifecycleReport reports what lifecycle policies would delete in the request's tenant.  It needs an api key, as
+//it's a pass over every asset: one for the tenant, or for every tenant.
+func getLifecycleReport(c *gin.Context) {
+	if _, ok := requestPrincipal(c); !ok {
+		c.JSON(http.StatusUnauthorized, "an api key is required for lifecycle reports")
+		return
+	}
+	report, err := lifecycleReporter.DryRun(requestTenant(c))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, report)
+}
+
+//retrieveErrorStatus maps errors retrieving assets to http statuses.  Anything unexpected is a 204, as
+//missing assets always have been.
+func retrieveErrorStatus(c *gin.Context, err error) int {
+	switch {
+	case errors.Is(err, ErrAssetInfected):
+		return http.StatusForbidden
+	case errors.Is(err, ErrAssetPending):
+		c.Header("Retry-After", "10")
+		return http.StatusServiceUnavailable
+	case errors.Is(err, ErrAssetCorrupt):
+		return http.StatusInternalServerError
+	default:
+		return http.StatusNoContent
+	}
+}
+
+//storeErrorStatus maps errors storing assets to http statuses
+func storeErrorStatus(err error) int {
+	var qerr *QuotaError
+	switch {
+	case errors.As(err, &qerr) && qerr.TooLarge():
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, ErrQuotaExceeded):
+		return http.StatusInsufficientStorage
+	case errors.Is(err, ErrUploadTooLarge):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, ErrContentRejected):
+		return http.StatusUnsupportedMediaType
+	case errors.Is(err, ErrAssetInfected):
+		return http.StatusUnprocessableEntity
+	case errors.Is(err, ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, ErrReservationExpired):
+		return http.StatusGone
+	case errors.Is(err, ErrUploadMismatch):
+		return http.StatusConflict
+	case errors.Is(err, ErrRevisionMismatch):
+		return http.StatusPreconditionFailed
+	case errors.Is(err, ErrSigningUnsupported), errors.Is(err, ErrMultipartUnsupported):
+		return http.StatusNotImplemented
+	default:
+		return http.StatusBadRequest
+	}
+}
+
+//sendAsset transfers asset/file to the client as a download, with a Content-Encoding if it's still encoded
+func sendAsset(c *gin.Context, asset io.ReadCloser, meta AssetMeta, encoding string) {
+	size := int64(meta.Size)
+	if meta.Encoding != "" {
+		c.Header("Vary", "Accept-Encoding")
+	}
+	if encoding != "" {
+		c.Header("Content-Encoding", encoding)
+		size = meta.EncodedSize
+	}
 	c.Header("Content-Type", "application/octet-stream")
-	c.Header("Content-Disposition", "attachment; filename="+ meta.Name)
-	c.Header("Content-Length", fmt.Sprintf("%d", meta.Size))
-	c.DataFromReader(http.StatusOK, int64(meta.Size), "application/octet-stream", asset, map[string]string{})
+	c.Header("Content-Disposition", attachmentDisposition(meta.Name))
+	c.Header("Content-Length", fmt.Sprintf("%d", size))
+	c.DataFromReader(http.StatusOK, size, "application/octet-stream", asset, map[string]string{})
+}
+
+//redirectToSignedURL redirects to a presigned url of an asset's data, if it has one, reporting whether it's responded
+func redirectToSignedURL(c *gin.Context, sign func(string, time.Duration) (AssetMeta, string, error), key string) bool {
+	_, url, err := sign(key, signedURLTTL)
+	if err != nil {
+		c.JSON(retrieveErrorStatus(c, err), err.Error())
+		return true
+	}
+	if url == "" {
+		return false
+	}
+	c.Redirect(http.StatusFound, url)
+	return true
+}
+
+//acceptedEncodings are the stored encodings the client accepts downloads in, per its Accept-Encoding
+func acceptedEncodings(c *gin.Context) (accept []string) {
+	for _, part := range strings.Split(c.GetHeader("Accept-Encoding"), ",") {
+		fields := strings.Split(part, ";")
+		name := strings.ToLower(strings.TrimSpace(fields[0]))
+		if name != GzipEncoding {
+			continue
+		}
+		//"gzip;q=0" means anything but gzip
+		if len(fields) > 1 && strings.Replace(strings.TrimSpace(fields[1]), " ", "", -1) == "q=0" {
+			continue
+		}
+		accept = append(accept, name)
+	}
+	return
 }
 
 
 func initCORS(server gin.IRouter) {
 	corsconfig := cors.DefaultConfig()
 	corsconfig.AllowAllOrigins = true
-	corsconfig.AddAllowMethods([]string{"GET", "POST", "HEAD"}...)
+	corsconfig.AddAllowMethods([]string{"GET", "POST", "HEAD", "DELETE", "PATCH", "PUT"}...)
 	//supporting auth would be a next step
 	corsconfig.AddAllowHeaders("authorization")
 	corsconfig.AddAllowHeaders("x-api-key")
+	//for tus uploads
+	corsconfig.AddAllowHeaders("Tus-Resumable", "Upload-Length", "Upload-Metadata", "Upload-Offset", "Upload-Checksum")
+	corsconfig.AddExposeHeaders("Location", "Tus-Resumable", "Tus-Version", "Tus-Extension", "Tus-Max-Size",
+		"Tus-Checksum-Algorithm", "Upload-Offset", "Upload-Length", "Upload-Expires", "Asset-Token")
+	//for conditional changes to aliases and assets
+	corsconfig.AddAllowHeaders("If-Match")
+	corsconfig.AddExposeHeaders("ETag")
 	server.Use(cors.New(corsconfig))
 }
 
-func RunAPI(idr AssetIDRetriever, tor AssetTokenRetriever, storer AssetStorer, basePath string, port int) {
+//registerAssetRoutes registers the asset routes on a (possibly tenant scoped) group
+func registerAssetRoutes(r gin.IRouter) {
+	r.GET("/asset/:id", getAssetByID)
+	r.GET("/asset-token/:token", getAssetByToken)
+	r.POST("/asset", addAsset)
+	r.POST("/asset/:assetname", addAsset)
+	if directUploader != nil {
+		r.POST("/asset/:assetname/:id/complete", completeUpload)
+	}
+	if assetDeleter != nil {
+		r.DELETE("/asset/:id", deleteAsset)
+	}
+	if metaUpdater != nil {
+		r.PATCH("/asset/:id", updateAsset)
+	}
+	if assetReplacer != nil {
+		r.PUT("/asset/:id", replaceAsset)
+	}
+	if tokenRevoker != nil {
+		r.DELETE("/asset-token/:token", revokeToken)
+	}
+	if usageReporter != nil {
+		r.GET("/usage", getUsage)
+	}
+	if lifecycleReporter != nil {
+		r.GET("/lifecycle/report", getLifecycleReport)
+	}
+	if assetArchiver != nil {
+		r.POST("/assets/archive", archiveAssets)
+		r.GET("/assets/archive/:token", getArchiveByToken)
+	}
+	if assetCollector != nil {
+		r.GET("/asset-token/:token/*name", getAssetByCollectionToken)
+		r.POST("/collections", createCollection)
+		r.GET("/collections/:id", getCollection)
+		r.PUT("/collections/:id", updateCollection)
+		r.DELETE("/collections/:id", deleteCollection)
+		r.POST("/collections/:id/token", shareCollection)
+	}
+	if assetAliaser != nil {
+		r.GET("/a/:slug", getAssetByAlias)
+		r.POST("/aliases", createAlias)
+		r.GET("/aliases/:slug", getAlias)
+		r.PUT("/aliases/:slug", updateAlias)
+		r.DELETE("/aliases/:slug", deleteAlias)
+		r.GET("/aliases/:slug/history", getAliasHistory)
+	}
+	if multipartUploader != nil {
+		r.POST("/multipart", startMultipart)
+		r.PUT("/multipart/:id/:part", uploadPart)
+		r.POST("/multipart/:id/complete", completeMultipart)
+		r.DELETE("/multipart/:id", abortMultipart)
+	}
+	if resumableUploader != nil {
+		r.OPTIONS("/files", tusOptions)
+		r.POST("/files", tusCreate)
+		r.HEAD("/files/:id", tusHead)
+		r.PATCH("/files/:id", tusPatch)
+		r.DELETE("/files/:id", tusTerminate)
+	}
+}
+
+func RunAPI(idr AssetIDRetriever, tor AssetTokenRetriever, storer AssetStorer, basePath string, port int, opts ...APIOption) {
 	idRetriever = idr
 	tokenRetriever = tor
 	assetStorer = storer
+	for _, opt := range opts {
+		opt()
+	}
 
 	server := gin.Default()
 	initCORS(server)
 	base := server.Group(basePath)
 	base.GET("/ping", ping)
 
-	base.GET("/asset/:id", getAssetByID)
-	base.GET("/asset-token/:token", getAssetByToken)
-	base.POST("/asset", addAsset)
-	base.POST("/asset/:assetname", addAsset)
+	base.Use(authenticate)
+	//assets in the default tenant (or the api key's tenant), and explicitly tenant scoped assets
+	registerAssetRoutes(base.Group("", resolveTenant))
+	registerAssetRoutes(base.Group("/t/:tenant", resolveTenant))
 
 
 	server.Run(fmt.Sprintf("0.0.0.0:%d", port))
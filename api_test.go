@@ -0,0 +1,268 @@
+package assetstore
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+//testAPI routes requests to storage like RunAPI does, with opts applied
+func testAPI(s *AssetStorage, opts ...APIOption) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	idRetriever, tokenRetriever, assetStorer = s, s, s
+	for _, opt := range opts {
+		opt()
+	}
+	server := gin.New()
+	server.Use(authenticate)
+	registerAssetRoutes(server.Group("", resolveTenant))
+	registerAssetRoutes(server.Group("/t/:tenant", resolveTenant))
+	return server
+}
+
+//serve makes a request to an api, as the caller with apiKey ("" for anonymous)
+func serve(api http.Handler, method, path, apiKey string, body io.Reader, header ...string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, body)
+	if apiKey != "" {
+		req.Header.Set("x-api-key", apiKey)
+	}
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, req)
+	return w
+}
+
+func TestAPI_GetAssetDisposition(t *testing.T) {
+	db := newMemMetaTokenStore()
+	s := NewAssetStorage(db, db, newMemDataStore())
+	api := testAPI(s, WithAPIKeys(map[string]Principal{"alice-key": {User: "alice"}}))
+	tests := []string{"report.pdf", "q3 report.pdf", "a; filename=evil.exe", "rapport été.pdf", `"quoted".txt`}
+	for _, name := range tests {
+		t.Run(name, func(t *testing.T) {
+			meta, err := s.Store(AssetMeta{ID: uuid.New().String(), Owner: "alice", Name: name}, AssetToken{}, ioutil.NopCloser(strings.NewReader("data")))
+			assert.NoError(t, err)
+			w := serve(api, http.MethodGet, "/asset/"+meta.ID, "alice-key", nil)
+			assert.Equal(t, http.StatusOK, w.Code)
+			disposition, params, err := mime.ParseMediaType(w.Header().Get("Content-Disposition"))
+			if assert.NoError(t, err) {
+				assert.Equal(t, "attachment", disposition)
+				assert.Equal(t, name, params["filename"])
+			}
+		})
+	}
+}
+
+//formField is a field of a multipart form, a file if it has a filename
+type formField struct {
+	name     string
+	filename string
+	value    string
+}
+
+func multipartForm(t *testing.T, fields ...formField) (body *bytes.Buffer, contentType string) {
+	body = &bytes.Buffer{}
+	form := multipart.NewWriter(body)
+	for _, f := range fields {
+		var w io.Writer
+		var err error
+		if f.filename != "" {
+			w, err = form.CreateFormFile(f.name, f.filename)
+		} else {
+			w, err = form.CreateFormField(f.name)
+		}
+		assert.NoError(t, err)
+		io.WriteString(w, f.value)
+	}
+	assert.NoError(t, form.Close())
+	return body, form.FormDataContentType()
+}
+
+func TestAPI_AddFormAssets(t *testing.T) {
+	defer WithUploadLimit(0)()
+	db := newMemMetaTokenStore()
+	s := NewAssetStorage(db, db, newMemDataStore(), WithUploadValidator(ContentPolicies{
+		Default: ContentPolicy{DenyExtensions: []string{".exe"}},
+	}))
+	api := testAPI(s, WithAPIKeys(map[string]Principal{"alice-key": {User: "alice"}}))
+	large := strings.Repeat("x", 200)
+	tests := []struct {
+		name   string
+		fields []formField
+		//limit is the upload limit, as a number of bytes less than the whole form
+		limit int
+		//unsized forms are sent without a Content-Length
+		unsized bool
+		want    int
+		//wantErrs is whether each file failed to store, for forms with several
+		wantErrs  []bool
+		wantToken bool
+	}{
+		{"one file", []formField{{"file", "a.txt", "a"}}, 0, false, http.StatusOK, nil, false},
+		{"several files, options first", []formField{
+			{"token", "", "true"}, {"expiry", "", "60"}, {"file", "a.txt", "a"}, {"file", "b.txt", "b"},
+		}, 0, false, http.StatusOK, []bool{false, false}, true},
+		{"one file rejected", []formField{{"file", "a.txt", "a"}, {"file", "setup.exe", "MZ"}}, 0, false, http.StatusOK, []bool{false, true}, false},
+		{"every file rejected", []formField{{"file", "setup.exe", "MZ"}, {"file", "run.exe", "MZ"}}, 0, false, http.StatusUnsupportedMediaType, []bool{true, true}, false},
+		{"no files", []formField{{"token", "", "true"}}, 0, false, http.StatusBadRequest, nil, false},
+		{"declared over the limit", []formField{{"file", "a.txt", large}}, 150, false, http.StatusRequestEntityTooLarge, nil, false},
+		{"streamed over the limit", []formField{{"file", "a.txt", large}, {"file", "b.txt", large}}, 150, true, http.StatusOK, []bool{false, true}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body, contentType := multipartForm(t, tt.fields...)
+			maxUploadBytes = 0
+			if tt.limit > 0 {
+				maxUploadBytes = int64(body.Len() - tt.limit)
+			}
+			var r io.Reader = body
+			if tt.unsized {
+				r = io.MultiReader(body)
+			}
+			w := serve(api, http.MethodPost, "/asset", "alice-key", r, "Content-Type", contentType)
+			assert.Equal(t, tt.want, w.Code)
+			if tt.wantErrs == nil {
+				return
+			}
+			var results []addResp
+			if !assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &results)) || !assert.Len(t, results, len(tt.wantErrs)) {
+				return
+			}
+			for i, result := range results {
+				assert.Equal(t, tt.wantErrs[i], result.Error != "", result.Error)
+				if !tt.wantErrs[i] {
+					assert.NotEmpty(t, result.Meta.ID)
+					assert.Equal(t, tt.wantToken, result.Token.Token != "")
+				}
+			}
+		})
+	}
+}
+
+func TestAPI_DeleteAsset(t *testing.T) {
+	db := newMemMetaTokenStore()
+	s := NewAssetStorage(db, db, newMemDataStore())
+	api := testAPI(s, WithAssetDeleter(s, s), WithAPIKeys(map[string]Principal{
+		"alice-key": {User: "alice"},
+		"bob-key":   {User: "bob"},
+	}))
+	store := func(owner string) AssetMeta {
+		meta, err := s.Store(AssetMeta{ID: uuid.New().String(), Owner: owner, Name: "a.txt"}, AssetToken{}, ioutil.NopCloser(strings.NewReader("data")))
+		assert.NoError(t, err)
+		return meta
+	}
+	owned, unowned := store("alice"), store("")
+
+	//deleting needs an api key, and the owner's if there is one
+	tests := []struct {
+		name   string
+		meta   AssetMeta
+		apiKey string
+		want   int
+	}{
+		{"anonymous, unowned", unowned, "", http.StatusUnauthorized},
+		{"anonymous, owned", owned, "", http.StatusUnauthorized},
+		{"someone else", owned, "bob-key", http.StatusForbidden},
+		{"owner", owned, "alice-key", http.StatusNoContent},
+		{"anyone with a key, unowned", unowned, "bob-key", http.StatusNoContent},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := serve(api, http.MethodDelete, "/asset/"+tt.meta.ID, tt.apiKey, nil)
+			assert.Equal(t, tt.want, w.Code)
+			_, err := db.GetMeta(tt.meta.Key())
+			assert.Equal(t, tt.want == http.StatusNoContent, errors.Is(err, ErrNotFound))
+		})
+	}
+}
+
+func TestAPI_UpdateAsset(t *testing.T) {
+	db := newMemMetaTokenStore()
+	s := NewAssetStorage(db, db, newMemDataStore())
+	api := testAPI(s, WithMetaUpdater(s, s), WithAPIKeys(map[string]Principal{
+		"alice-key": {User: "alice"},
+		"bob-key":   {User: "bob"},
+	}))
+	store := func(owner string) AssetMeta {
+		meta, err := s.Store(AssetMeta{ID: uuid.New().String(), Owner: owner, Name: "a.txt"}, AssetToken{}, ioutil.NopCloser(strings.NewReader("data")))
+		assert.NoError(t, err)
+		return meta
+	}
+	owned, unowned := store("alice"), store("")
+
+	//changing an asset needs an api key, and the owner's if there is one
+	tests := []struct {
+		name   string
+		meta   AssetMeta
+		apiKey string
+		want   int
+	}{
+		{"anonymous, unowned", unowned, "", http.StatusUnauthorized},
+		{"anonymous, owned", owned, "", http.StatusUnauthorized},
+		{"someone else", owned, "bob-key", http.StatusForbidden},
+		{"owner", owned, "alice-key", http.StatusOK},
+		{"anyone with a key, unowned", unowned, "bob-key", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := serve(api, http.MethodPatch, "/asset/"+tt.meta.ID, tt.apiKey, strings.NewReader(`{"name": "b.txt"}`))
+			assert.Equal(t, tt.want, w.Code)
+			meta, err := db.GetMeta(tt.meta.Key())
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want == http.StatusOK, meta.Name == "b.txt")
+		})
+	}
+}
+
+func TestAPI_RevokeToken(t *testing.T) {
+	db := newMemMetaTokenStore()
+	s := NewAssetStorage(db, db, newMemDataStore())
+	api := testAPI(s, WithTokenRevoker(s, s), WithAPIKeys(map[string]Principal{
+		"alice-key": {User: "alice"},
+		"bob-key":   {User: "bob"},
+	}))
+	store := func(owner string) AssetToken {
+		meta := AssetMeta{ID: uuid.New().String(), Owner: owner, Name: "a.txt"}
+		token := AssetToken{Token: uuid.New().String(), AssetID: meta.ID, Expiry: time.Now().Add(time.Minute).Unix()}
+		_, err := s.Store(meta, token, ioutil.NopCloser(strings.NewReader("data")))
+		assert.NoError(t, err)
+		return token
+	}
+	owned, unowned := store("alice"), store("")
+
+	//revoking needs an api key, and the asset owner's if there is one
+	tests := []struct {
+		name   string
+		token  AssetToken
+		apiKey string
+		want   int
+	}{
+		{"anonymous, unowned", unowned, "", http.StatusUnauthorized},
+		{"anonymous, owned", owned, "", http.StatusUnauthorized},
+		{"someone else", owned, "bob-key", http.StatusForbidden},
+		{"owner", owned, "alice-key", http.StatusNoContent},
+		{"anyone with a key, unowned", unowned, "bob-key", http.StatusNoContent},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := serve(api, http.MethodDelete, "/asset-token/"+tt.token.Token, tt.apiKey, nil)
+			assert.Equal(t, tt.want, w.Code)
+			_, err := db.GetToken(tt.token.Key())
+			assert.Equal(t, tt.want == http.StatusNoContent, errors.Is(err, ErrNotFound))
+		})
+	}
+}
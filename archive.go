@@ -0,0 +1,279 @@
+package assetstore
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+//Assets can be downloaded together as one zip or tar.gz archive, built on the fly from their data as it's streamed,
+//so nothing's staged.  An archive can be shared with an archive token, which refers to the assets in it.
+
+const (
+	ArchiveZip = "zip"
+	ArchiveTarGz = "tar.gz"
+)
+
+//maxArchiveAssets is the most assets an archive can have
+const maxArchiveAssets = 1000
+
+//ArchiveToken grants access to an archive of assets, until it expires
+type ArchiveToken struct {
+	Token string `json:"token,omitempty"`
+	//Tenant/namespace of the token and the assets in the archive
+	Tenant string `json:"tenant,omitempty"`
+	//Expiry unix timestamp
+	Expiry int64 `json:"expiry,omitempty"`
+	//ids of the assets in the archive, in order
+	AssetIDs []string `json:"asset_ids,omitempty"`
+	Format string `json:"format,omitempty"`
+}
+
+func (t ArchiveToken) Valid() bool {
+	return len(t.AssetIDs) > 0 && t.Token != "" && time.Now().Before(time.Unix(t.Expiry, 0)) &&
+		ValidTenant(t.Tenant) && !strings.Contains(t.Token, tenantSeparator)
+}
+
+//Key is the tenant scoped key the token is stored under
+func (t ArchiveToken) Key() string {
+	return ScopedKey(t.Tenant, t.Token)
+}
+
+//ArchiveTokenHandler stores and gets archive tokens, by their tenant scoped key
+type ArchiveTokenHandler interface {
+	StoreArchiveToken(token ArchiveToken) (err error)
+	GetArchiveToken(token string) (t ArchiveToken, err error)
+}
+
+//AssetArchiver opens archives of assets, and shares them with archive tokens
+type AssetArchiver interface {
+	OpenArchive(format string, ids, tokens []string) (archive *AssetArchive, err error)
+	OpenArchiveByToken(token string) (archive *AssetArchive, err error)
+	ShareArchive(archive *AssetArchive, token ArchiveToken) (shared ArchiveToken, err error)
+}
+
+//WithArchiveTokens enables sharing archives, with tokens stored by tokens
+func WithArchiveTokens(tokens ArchiveTokenHandler) AssetStorageOption {
+	return func(s *AssetStorage) {
+		s.archiveTokens = tokens
+	}
+}
+
+//AssetArchive is an archive of assets that can all be retrieved, ready to be written
+type AssetArchive struct {
+	Format string
+	//the assets in the archive, in order
+	Metas []AssetMeta
+	//Unix timestamp the earliest of the tokens the archive was opened with expires, 0 if it wasn't opened with any
+	Expires int64
+	dataHandler AssetDataHandler
+}
+
+//OpenArchive checks the assets with tenant scoped ids, then those tokens refer to, can all be retrieved, and returns
+//an archive of them in format ("zip" if empty).  Assets listed more than once are archived once.
+func (s *AssetStorage) OpenArchive(format string, ids, tokens []string) (archive *AssetArchive, err error) {
+	switch format {
+	case "", ArchiveZip:
+		format = ArchiveZip
+	case ArchiveTarGz, "tgz":
+		format = ArchiveTarGz
+	default:
+		return nil, fmt.Errorf("unsupported archive format %s", format)
+	}
+	if len(ids)+len(tokens) == 0 {
+		return nil, fmt.Errorf("no assets to archive")
+	}
+	if len(ids)+len(tokens) > maxArchiveAssets {
+		return nil, fmt.Errorf("archives can have at most %d assets", maxArchiveAssets)
+	}
+	archive = &AssetArchive{Format: format, dataHandler: s.dataHandler}
+	ids = append([]string{}, ids...)
+	for _, token := range tokens {
+		t, err := s.tokenHandler.GetToken(token)
+		if err == nil && !t.Valid() {
+			err = fmt.Errorf("%w: token %s expired", ErrNotFound, token)
+		}
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, t.AssetKey())
+		if archive.Expires == 0 || t.Expiry < archive.Expires {
+			archive.Expires = t.Expiry
+		}
+	}
+	archived := map[string]bool{}
+	for _, id := range ids {
+		if archived[id] {
+			continue
+		}
+		archived[id] = true
+		meta, err := s.retrievableMeta(id)
+		if err != nil {
+			return nil, err
+		}
+		s.recordAccess(meta)
+		archive.Metas = append(archive.Metas, meta)
+	}
+	return archive, nil
+}
+
+//OpenArchiveByToken opens the archive an archive token, by its tenant scoped key, refers to
+func (s *AssetStorage) OpenArchiveByToken(token string) (archive *AssetArchive, err error) {
+	if s.archiveTokens == nil {
+		return nil, fmt.Errorf("%w: archives can't be shared", ErrNotFound)
+	}
+	t, err := s.archiveTokens.GetArchiveToken(token)
+	if err == nil && !t.Valid() {
+		err = fmt.Errorf("%w: archive token %s expired", ErrNotFound, token)
+	}
+	if err != nil {
+		log.WithFields(log.Fields{
+			"context": "AssetStorage.OpenArchiveByToken()",
+			"archiveTokens": s.archiveTokens,
+			"token": token,
+		}).Error(err)
+		return
+	}
+	ids := make([]string, len(t.AssetIDs))
+	for i, id := range t.AssetIDs {
+		ids[i] = ScopedKey(t.Tenant, id)
+	}
+	return s.OpenArchive(t.Format, ids, nil)
+}
+
+//ShareArchive stores token, which needs its Token and Expiry set, for an archive.  An archive opened with tokens
+//can't be shared for longer than they last.
+func (s *AssetStorage) ShareArchive(archive *AssetArchive, token ArchiveToken) (shared ArchiveToken, err error) {
+	if s.archiveTokens == nil {
+		return token, fmt.Errorf("archives can't be shared")
+	}
+	token.Format = archive.Format
+	token.AssetIDs = nil
+	for _, meta := range archive.Metas {
+		token.Tenant = meta.Tenant
+		token.AssetIDs = append(token.AssetIDs, meta.ID)
+	}
+	if archive.Expires != 0 && archive.Expires < token.Expiry {
+		token.Expiry = archive.Expires
+	}
+	if !token.Valid() {
+		return token, fmt.Errorf("archive token invalid")
+	}
+	err = s.archiveTokens.StoreArchiveToken(token)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"context": "AssetStorage.ShareArchive()",
+			"archiveTokens": s.archiveTokens,
+			"token": token,
+		}).Error(err)
+	}
+	return token, err
+}
+
+func (a *AssetArchive) ContentType() string {
+	if a.Format == ArchiveTarGz {
+		return "application/gzip"
+	}
+	return "application/zip"
+}
+
+//Filename is what the archive's downloaded as
+func (a *AssetArchive) Filename() string {
+	return "assets." + a.Format
+}
+
+//Write writes the archive, streaming each asset's data into it in turn.  Each asset is named for its meta, with any
+//path separators replaced, and numbered if its name's already been used.
+func (a *AssetArchive) Write(w io.Writer) (err error) {
+	names := archiveNames(a.Metas)
+	if a.Format == ArchiveTarGz {
+		gz := gzip.NewWriter(w)
+		tw := tar.NewWriter(gz)
+		for i, meta := range a.Metas {
+			err = a.writeEntry(meta, func() (io.Writer, error) {
+				return tw, tw.WriteHeader(&tar.Header{
+					Typeflag: tar.TypeReg,
+					Name: names[i],
+					Mode: 0644,
+					Size: int64(meta.Size),
+					ModTime: time.Unix(meta.Created, 0),
+				})
+			})
+			if err != nil {
+				return
+			}
+		}
+		if err = tw.Close(); err != nil {
+			return
+		}
+		return gz.Close()
+	}
+	zw := zip.NewWriter(w)
+	for i, meta := range a.Metas {
+		err = a.writeEntry(meta, func() (io.Writer, error) {
+			return zw.CreateHeader(&zip.FileHeader{
+				Name: names[i],
+				Method: zip.Deflate,
+				Modified: time.Unix(meta.Created, 0),
+			})
+		})
+		if err != nil {
+			return
+		}
+	}
+	return zw.Close()
+}
+
+//writeEntry copies an asset's data to the archive entry create starts
+func (a *AssetArchive) writeEntry(meta AssetMeta, create func() (io.Writer, error)) (err error) {
+	reader, _, err := readDecoded(a.dataHandler, meta, meta.DataKey())
+	if err != nil {
+		return
+	}
+	defer reader.Close()
+	entry, err := create()
+	if err != nil {
+		return
+	}
+	n, err := io.Copy(entry, reader)
+	if err == nil && n != int64(meta.Size) {
+		err = fmt.Errorf("asset %s is %d bytes, not %d", meta.ID, n, meta.Size)
+	}
+	if err != nil {
+		log.WithFields(log.Fields{
+			"context": "AssetArchive.Write()",
+			"dataHandler": a.dataHandler,
+			"meta": meta,
+		}).Error(err)
+	}
+	return
+}
+
+//archiveNames names each asset in an archive uniquely, ignoring case, numbering repeated names like "a (1).txt"
+func archiveNames(metas []AssetMeta) (names []string) {
+	used := map[string]bool{}
+	for _, meta := range metas {
+		name := strings.NewReplacer("/", "_", "\\", "_").Replace(meta.Name)
+		if strings.Trim(name, ".") == "" {
+			name = meta.ID
+		}
+		ext := path.Ext(name)
+		base := strings.TrimSuffix(name, ext)
+		if base == "" {
+			base, ext = name, ""
+		}
+		for n := 1; used[strings.ToLower(name)]; n++ {
+			name = fmt.Sprintf("%s (%d)%s", base, n, ext)
+		}
+		used[strings.ToLower(name)] = true
+		names = append(names, name)
+	}
+	return
+}
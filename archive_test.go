@@ -0,0 +1,151 @@
+package assetstore
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+type memArchiveTokens struct {
+	tokens map[string]ArchiveToken
+}
+
+func (m *memArchiveTokens) StoreArchiveToken(token ArchiveToken) error {
+	m.tokens[token.Key()] = token
+	return nil
+}
+
+func (m *memArchiveTokens) GetArchiveToken(token string) (ArchiveToken, error) {
+	t, ok := m.tokens[token]
+	if !ok {
+		return t, fmt.Errorf("%w: archive token %s", ErrNotFound, token)
+	}
+	return t, nil
+}
+
+//readArchive reads the names and contents of the entries in an archive, in order
+func readArchive(t *testing.T, format string, data []byte) (entries [][2]string) {
+	if format == ArchiveTarGz {
+		gz, err := gzip.NewReader(bytes.NewReader(data))
+		assert.NoError(t, err)
+		tr := tar.NewReader(gz)
+		for {
+			h, err := tr.Next()
+			if err == io.EOF {
+				return
+			}
+			assert.NoError(t, err)
+			content, _ := ioutil.ReadAll(tr)
+			entries = append(entries, [2]string{h.Name, string(content)})
+		}
+	}
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	assert.NoError(t, err)
+	for _, f := range zr.File {
+		r, err := f.Open()
+		assert.NoError(t, err)
+		content, _ := ioutil.ReadAll(r)
+		r.Close()
+		entries = append(entries, [2]string{f.Name, string(content)})
+	}
+	return
+}
+
+func TestAssetStorage_Archive(t *testing.T) {
+	db := newMemMetaTokenStore()
+	tokens := &memArchiveTokens{tokens: map[string]ArchiveToken{}}
+	s := NewAssetStorage(db, db, newMemDataStore(), WithArchiveTokens(tokens))
+	store := func(name, content string, token AssetToken) AssetMeta {
+		meta := AssetMeta{ID: uuid.New().String(), Name: name}
+		token.AssetID = meta.ID
+		meta, err := s.Store(meta, token, ioutil.NopCloser(strings.NewReader(content)))
+		assert.NoError(t, err)
+		return meta
+	}
+	a := store("a.txt", "first", AssetToken{})
+	b := store("A.txt", "second", AssetToken{})
+	c := store("../../etc/passwd", "third", AssetToken{})
+	tokenExpiry := time.Now().Add(time.Hour).Unix()
+	token := AssetToken{Token: uuid.New().String(), Expiry: tokenExpiry}
+	store("a.txt", "by token", token)
+
+	want := [][2]string{
+		{"a.txt", "first"},
+		{"A (1).txt", "second"},
+		{".._.._etc_passwd", "third"},
+		{"a (2).txt", "by token"},
+	}
+	for _, format := range []string{"", ArchiveZip, ArchiveTarGz} {
+		t.Run("format "+format, func(t *testing.T) {
+			//assets listed twice are archived once
+			archive, err := s.OpenArchive(format, []string{a.Key(), b.Key(), c.Key(), a.Key()}, []string{token.Key()})
+			assert.NoError(t, err)
+			assert.Equal(t, tokenExpiry, archive.Expires)
+			buf := &bytes.Buffer{}
+			assert.NoError(t, archive.Write(buf))
+			assert.Equal(t, want, readArchive(t, archive.Format, buf.Bytes()))
+		})
+	}
+
+	_, err := s.OpenArchive("rar", []string{a.Key()}, nil)
+	assert.Error(t, err)
+	_, err = s.OpenArchive("", []string{a.Key(), uuid.New().String()}, nil)
+	assert.True(t, errors.Is(err, ErrNotFound))
+	_, err = s.OpenArchive("", nil, []string{uuid.New().String()})
+	assert.Error(t, err)
+
+	//shared archives last no longer than the tokens they were opened with
+	archive, err := s.OpenArchive(ArchiveTarGz, []string{a.Key()}, []string{token.Key()})
+	assert.NoError(t, err)
+	shared, err := s.ShareArchive(archive, ArchiveToken{Token: uuid.New().String(), Expiry: time.Now().Add(48 * time.Hour).Unix()})
+	assert.NoError(t, err)
+	assert.Equal(t, tokenExpiry, shared.Expiry)
+	archive, err = s.OpenArchiveByToken(shared.Key())
+	assert.NoError(t, err)
+	buf := &bytes.Buffer{}
+	assert.NoError(t, archive.Write(buf))
+	assert.Equal(t, [][2]string{{"a.txt", "first"}, {"a (1).txt", "by token"}}, readArchive(t, ArchiveTarGz, buf.Bytes()))
+	_, err = s.OpenArchiveByToken(uuid.New().String())
+	assert.True(t, errors.Is(err, ErrNotFound))
+
+	//deleted assets can't be archived through a shared archive any more
+	assert.NoError(t, s.Delete(a.Key()))
+	_, err = s.OpenArchiveByToken(shared.Key())
+	assert.True(t, errors.Is(err, ErrNotFound))
+}
+
+func TestArchiveNames(t *testing.T) {
+	tests := []struct {
+		name  string
+		names []string
+		want  []string
+	}{
+		{"unique", []string{"a.txt", "b.txt"}, []string{"a.txt", "b.txt"}},
+		{"repeated", []string{"a.txt", "a.txt", "a (1).txt"}, []string{"a.txt", "a (1).txt", "a (1) (1).txt"}},
+		{"case insensitive", []string{"Report.PDF", "report.pdf"}, []string{"Report.PDF", "report (1).pdf"}},
+		{"no extension", []string{"README", "README"}, []string{"README", "README (1)"}},
+		{"dotfiles", []string{".env", ".env"}, []string{".env", ".env (1)"}},
+		{"paths", []string{"a/b.txt", "..\\b.txt"}, []string{"a_b.txt", ".._b.txt"}},
+		{"unnamed", []string{"..", ""}, []string{"id0", "id1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			metas := make([]AssetMeta, len(tt.names))
+			for i, name := range tt.names {
+				metas[i] = AssetMeta{ID: fmt.Sprintf("id%d", i), Name: name}
+			}
+			assert.Equal(t, tt.want, archiveNames(metas))
+		})
+	}
+}
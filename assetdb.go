@@ -1,12 +1,15 @@
 package assetstore
 
 import (
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
 	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
@@ -15,10 +18,23 @@ import (
 
 //many adapters/backends could exist for storing asset meta and tokens
 //dynamodb will do nicely
+//ids and tokens passed in are tenant scoped keys (see ScopedKey), so tenants are part of every ObjID
 
 const (
 	ASSET_KEY_PREFIX = "ASSET_"
 	TOKEN_KEY_PREFIX = "TOKEN_"
+	USAGE_KEY_PREFIX = "USAGE_"
+	CHECKPOINT_KEY_PREFIX = "CHECKPOINT_"
+	BLOB_KEY_PREFIX = "BLOB_"
+	ARCHIVE_KEY_PREFIX = "ARCHIVE_"
+	COLLECTION_KEY_PREFIX = "COLL_"
+	COLLECTION_TOKEN_KEY_PREFIX = "COLLTOKEN_"
+	ID_KEY_PREFIX = "ID_"
+	ALIAS_KEY_PREFIX = "ALIAS_"
+	//sort key prefix of the rows of an alias's history, after the row of its current revision
+	ALIAS_REVISION_SORT_PREFIX = "REV_"
+	//previous versions of assets, sorted by version
+	VERSION_KEY_PREFIX = "VERSION_"
 )
 
 type DynamoDBMetaTokenStore struct {
@@ -50,7 +66,7 @@ func (s *DynamoDBMetaTokenStore) GetMeta(id string) (meta AssetMeta, err error)
 		return
 	}
 	if *result.Count != int64(1) {
-		return meta, fmt.Errorf("could not find result for asset with id %s", id)
+		return meta, fmt.Errorf("%w: could not find result for asset with id %s", ErrNotFound, id)
 	}
 	obj := result.Items[0]
 	return dynamoAssetAttrMapToMeta(obj), err
@@ -67,55 +83,940 @@ func (s *DynamoDBMetaTokenStore) StoreMeta(meta AssetMeta) (err error) {
 	return
 }
 
+func (s *DynamoDBMetaTokenStore) DeleteMeta(id string) (err error) {
+	if id == "" {
+		return fmt.Errorf("zero-length id")
+	}
+	meta, err := s.GetMeta(id)
+	if err != nil {
+		return
+	}
+	_, err = s.DeleteItem(&dynamodb.DeleteItemInput{
+		Key: map[string]*dynamodb.AttributeValue{
+			"ObjID": {
+				S: aws.String(ASSET_KEY_PREFIX + id),
+			},
+			"ObjSort": {
+				S: aws.String(strconv.Itoa(meta.Version)),
+			},
+		},
+		TableName: aws.String(s.table),
+	})
+	return
+}
+
+//UpdateMeta applies an update to an asset's meta, and bumps its revision, with a conditional update that fails if
+//it's no longer at revision
+func (s *DynamoDBMetaTokenStore) UpdateMeta(id string, update MetaUpdate, revision int64) (meta AssetMeta, err error) {
+	meta, err = s.GetMeta(id)
+	if err != nil {
+		return
+	}
+	set := []string{"Revision = :next"}
+	remove := []string{}
+	condition, values := revisionCondition(revision)
+	values[":next"] = &dynamodb.AttributeValue{S: aws.String(strconv.FormatInt(revision+1, 10))}
+	if update.Name != nil {
+		set = append(set, "AssetName = :name")
+		values[":name"] = &dynamodb.AttributeValue{S: aws.String(*update.Name)}
+	}
+	//dynamodb doesn't allow empty strings, so attributes being emptied are removed
+	if update.ContentType != nil && *update.ContentType != "" {
+		set = append(set, "ContentType = :ct")
+		values[":ct"] = &dynamodb.AttributeValue{S: aws.String(*update.ContentType)}
+	} else if update.ContentType != nil {
+		remove = append(remove, "ContentType")
+	}
+	if len(update.Metadata) > 0 {
+		set = append(set, "Metadata = :md")
+		values[":md"] = &dynamodb.AttributeValue{S: aws.String(encodeMetadata(update.Metadata))}
+	} else if update.Metadata != nil {
+		remove = append(remove, "Metadata")
+	}
+	expression := "SET " + strings.Join(set, ", ")
+	if len(remove) > 0 {
+		expression += " REMOVE " + strings.Join(remove, ", ")
+	}
+	result, err := s.UpdateItem(&dynamodb.UpdateItemInput{
+		Key: map[string]*dynamodb.AttributeValue{
+			"ObjID": {
+				S: aws.String(ASSET_KEY_PREFIX + id),
+			},
+			"ObjSort": {
+				S: aws.String(strconv.Itoa(meta.Version)),
+			},
+		},
+		UpdateExpression: aws.String(expression),
+		ConditionExpression: aws.String(condition),
+		ExpressionAttributeValues: values,
+		ReturnValues: aws.String(dynamodb.ReturnValueAllNew),
+		TableName: aws.String(s.table),
+	})
+	if isConditionFailed(err) {
+		return meta, fmt.Errorf("%w: %s is no longer at revision %d", ErrRevisionMismatch, id, revision)
+	}
+	if err != nil {
+		return
+	}
+	return dynamoAssetAttrMapToMeta(result.Attributes), nil
+}
+
+//SwapMeta stores meta with a conditional put that fails if the stored meta is no longer at revision.  Meta at a new
+//version is put under its own sort key, and the old version's row moved to a VERSION_ row, in one transaction.
+func (s *DynamoDBMetaTokenStore) SwapMeta(meta AssetMeta, revision int64) (err error) {
+	if !meta.Valid() {
+		return fmt.Errorf("meta invalid")
+	}
+	stored, err := s.GetMeta(meta.Key())
+	if err != nil {
+		return
+	}
+	condition, values := revisionCondition(revision)
+	if stored.Version == meta.Version {
+		_, err = s.PutItem(&dynamodb.PutItemInput{
+			Item: assetMetaToDynamoAttrMap(meta),
+			ConditionExpression: aws.String(condition),
+			ExpressionAttributeValues: values,
+			TableName: aws.String(s.table),
+		})
+		if isConditionFailed(err) {
+			return fmt.Errorf("%w: %s is no longer at revision %d", ErrRevisionMismatch, meta.Key(), revision)
+		}
+		return
+	}
+	_, err = s.TransactWriteItems(&dynamodb.TransactWriteItemsInput{
+		TransactItems: []*dynamodb.TransactWriteItem{
+			{Delete: &dynamodb.Delete{
+				Key: map[string]*dynamodb.AttributeValue{
+					"ObjID": {
+						S: aws.String(ASSET_KEY_PREFIX + meta.Key()),
+					},
+					"ObjSort": {
+						S: aws.String(strconv.Itoa(stored.Version)),
+					},
+				},
+				ConditionExpression: aws.String(condition),
+				ExpressionAttributeValues: values,
+				TableName: aws.String(s.table),
+			}},
+			{Put: &dynamodb.Put{
+				Item: assetMetaToDynamoAttrMap(meta),
+				ConditionExpression: aws.String("attribute_not_exists(ObjID)"),
+				TableName: aws.String(s.table),
+			}},
+			{Put: &dynamodb.Put{
+				Item: versionToDynamoAttrMap(stored),
+				TableName: aws.String(s.table),
+			}},
+		},
+	})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == dynamodb.ErrCodeTransactionCanceledException {
+		return fmt.Errorf("%w: %s is no longer at revision %d", ErrRevisionMismatch, meta.Key(), revision)
+	}
+	return
+}
+
+//GetVersion gets the meta of a previous version of an asset, from its VERSION_ row
+func (s *DynamoDBMetaTokenStore) GetVersion(id string, version int) (meta AssetMeta, err error) {
+	if id == "" {
+		return meta, fmt.Errorf("zero-length id")
+	}
+	result, err := s.GetItem(&dynamodb.GetItemInput{
+		Key: assetVersionKey(id, version),
+		TableName: aws.String(s.table),
+	})
+	if err != nil {
+		return
+	}
+	if result.Item == nil {
+		return meta, fmt.Errorf("%w: could not find version %d of asset with id %s", ErrNotFound, version, id)
+	}
+	return dynamoAssetAttrMapToMeta(result.Item), nil
+}
+
+//ListVersions lists the meta of every previous version of an asset, oldest first
+func (s *DynamoDBMetaTokenStore) ListVersions(id string) (metas []AssetMeta, err error) {
+	if id == "" {
+		return nil, fmt.Errorf("zero-length id")
+	}
+	input := &dynamodb.QueryInput{
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":v1": {
+				S: aws.String(VERSION_KEY_PREFIX + id),
+			},
+		},
+		KeyConditionExpression: aws.String("ObjID = :v1"),
+		TableName: aws.String(s.table),
+	}
+	err = s.QueryPages(input, func(page *dynamodb.QueryOutput, last bool) bool {
+		for _, item := range page.Items {
+			metas = append(metas, dynamoAssetAttrMapToMeta(item))
+		}
+		return true
+	})
+	return
+}
+
+//DeleteVersion deletes the VERSION_ row of a previous version of an asset, with a conditional delete that fails if
+//it's already been deleted
+func (s *DynamoDBMetaTokenStore) DeleteVersion(meta AssetMeta) (err error) {
+	_, err = s.DeleteItem(&dynamodb.DeleteItemInput{
+		Key: assetVersionKey(meta.Key(), meta.Version),
+		ConditionExpression: aws.String("attribute_exists(ObjID)"),
+		TableName: aws.String(s.table),
+	})
+	if isConditionFailed(err) {
+		return fmt.Errorf("%w: version %d of asset with id %s", ErrNotFound, meta.Version, meta.Key())
+	}
+	return
+}
+
+//UpdateVersionKey sets the data key of a previous version of an asset, with a conditional update that fails if the
+//version's been deleted
+func (s *DynamoDBMetaTokenStore) UpdateVersionKey(meta AssetMeta) (err error) {
+	_, err = s.UpdateItem(&dynamodb.UpdateItemInput{
+		Key: assetVersionKey(meta.Key(), meta.Version),
+		UpdateExpression: aws.String("SET KeyID = :key, WrappedKey = :wrapped"),
+		ConditionExpression: aws.String("attribute_exists(ObjID)"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":key": {S: aws.String(meta.KeyID)},
+			":wrapped": {S: aws.String(meta.WrappedKey)},
+		},
+		TableName: aws.String(s.table),
+	})
+	if isConditionFailed(err) {
+		return fmt.Errorf("%w: version %d of asset with id %s", ErrNotFound, meta.Version, meta.Key())
+	}
+	return
+}
+
+//UpdateScanStatus sets an asset's scan status, with a conditional update that fails if it's no longer at meta's
+//revision
+func (s *DynamoDBMetaTokenStore) UpdateScanStatus(meta AssetMeta) (err error) {
+	return s.updateMetaAttr(meta, "ScanStatus", string(meta.ScanStatus))
+}
+
+//UpdateState sets an asset's state, with a conditional update that fails if it's no longer at meta's revision
+func (s *DynamoDBMetaTokenStore) UpdateState(meta AssetMeta) (err error) {
+	return s.updateMetaAttr(meta, "State", string(meta.State))
+}
+
+//updateMetaAttr sets one attribute of an asset's meta, leaving the rest as they are, only if it's still at meta's
+//revision
+func (s *DynamoDBMetaTokenStore) updateMetaAttr(meta AssetMeta, name, value string) (err error) {
+	condition, values := revisionCondition(meta.Revision)
+	//dynamodb doesn't allow empty strings, so attributes being emptied are removed.  STATE is a reserved word, so
+	//the attribute's always named by placeholder.
+	expression := "REMOVE #attr"
+	if value != "" {
+		expression = "SET #attr = :value"
+		values[":value"] = &dynamodb.AttributeValue{S: aws.String(value)}
+	}
+	_, err = s.UpdateItem(&dynamodb.UpdateItemInput{
+		Key: map[string]*dynamodb.AttributeValue{
+			"ObjID": {
+				S: aws.String(ASSET_KEY_PREFIX + meta.Key()),
+			},
+			"ObjSort": {
+				S: aws.String(strconv.Itoa(meta.Version)),
+			},
+		},
+		UpdateExpression: aws.String(expression),
+		ConditionExpression: aws.String(condition),
+		ExpressionAttributeNames: map[string]*string{
+			"#attr": aws.String(name),
+		},
+		ExpressionAttributeValues: values,
+		TableName: aws.String(s.table),
+	})
+	if isConditionFailed(err) {
+		return fmt.Errorf("%w: %s is no longer at revision %d", ErrRevisionMismatch, meta.Key(), meta.Revision)
+	}
+	return
+}
+
+//UpdateMetaKey sets an asset's data key, with a conditional update that fails if it's no longer at meta's revision
+func (s *DynamoDBMetaTokenStore) UpdateMetaKey(meta AssetMeta) (err error) {
+	condition, values := revisionCondition(meta.Revision)
+	values[":key"] = &dynamodb.AttributeValue{S: aws.String(meta.KeyID)}
+	values[":wrapped"] = &dynamodb.AttributeValue{S: aws.String(meta.WrappedKey)}
+	_, err = s.UpdateItem(&dynamodb.UpdateItemInput{
+		Key: map[string]*dynamodb.AttributeValue{
+			"ObjID": {
+				S: aws.String(ASSET_KEY_PREFIX + meta.Key()),
+			},
+			"ObjSort": {
+				S: aws.String(strconv.Itoa(meta.Version)),
+			},
+		},
+		UpdateExpression: aws.String("SET KeyID = :key, WrappedKey = :wrapped"),
+		ConditionExpression: aws.String(condition),
+		ExpressionAttributeValues: values,
+		TableName: aws.String(s.table),
+	})
+	if isConditionFailed(err) {
+		return fmt.Errorf("%w: %s is no longer at revision %d", ErrRevisionMismatch, meta.Key(), meta.Revision)
+	}
+	return
+}
+
+//RecordAccess sets when an asset was last retrieved, leaving its revision alone, as it's not a change to the asset
+func (s *DynamoDBMetaTokenStore) RecordAccess(meta AssetMeta, at int64) (err error) {
+	_, err = s.UpdateItem(&dynamodb.UpdateItemInput{
+		Key: map[string]*dynamodb.AttributeValue{
+			"ObjID": {
+				S: aws.String(ASSET_KEY_PREFIX + meta.Key()),
+			},
+			"ObjSort": {
+				S: aws.String(strconv.Itoa(meta.Version)),
+			},
+		},
+		UpdateExpression: aws.String("SET Accessed = :at"),
+		ConditionExpression: aws.String("attribute_exists(ObjID)"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":at": {S: aws.String(strconv.FormatInt(at, 10))},
+		},
+		TableName: aws.String(s.table),
+	})
+	if isConditionFailed(err) {
+		return fmt.Errorf("%w: could not find result for asset with id %s", ErrNotFound, meta.Key())
+	}
+	return
+}
+
+//revisionCondition is a condition that an asset's meta exists, and is at revision (assets stored before revisions
+//existed are at revision 0)
+func revisionCondition(revision int64) (condition string, values map[string]*dynamodb.AttributeValue) {
+	condition = "attribute_exists(ObjID) AND Revision = :rev"
+	if revision == 0 {
+		condition = "attribute_exists(ObjID) AND (attribute_not_exists(Revision) OR Revision = :rev)"
+	}
+	return condition, map[string]*dynamodb.AttributeValue{
+		":rev": {S: aws.String(strconv.FormatInt(revision, 10))},
+	}
+}
+
+//ListMeta pages through the meta of every asset, in every tenant, via a table scan
+func (s *DynamoDBMetaTokenStore) ListMeta(cursor string, limit int) (metas []AssetMeta, next string, err error) {
+	input := &dynamodb.ScanInput{
+		FilterExpression: aws.String("begins_with(ObjID, :p)"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":p": {
+				S: aws.String(ASSET_KEY_PREFIX),
+			},
+		},
+		Limit: aws.Int64(int64(limit)),
+		TableName: aws.String(s.table),
+	}
+	if input.ExclusiveStartKey, err = decodeCursor(cursor); err != nil {
+		return
+	}
+	result, err := s.Scan(input)
+	if err != nil {
+		return
+	}
+	for _, item := range result.Items {
+		metas = append(metas, dynamoAssetAttrMapToMeta(item))
+	}
+	next, err = encodeCursor(result.LastEvaluatedKey)
+	return
+}
+
 func (s *DynamoDBMetaTokenStore) GetToken(token string) (t AssetToken, err error) {
 	if token == "" {
 		return t, fmt.Errorf("zero-length token")
 	}
-	result, err := s.Query(&dynamodb.QueryInput{
+	result, err := s.Query(&dynamodb.QueryInput{
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":v1": {
+				S: aws.String(TOKEN_KEY_PREFIX + token),
+			},
+		},
+		KeyConditionExpression: aws.String("ObjID = :v1"),
+		TableName: aws.String(s.table),
+	})
+	if err != nil {
+		log.WithFields(log.Fields{
+			"context": "DynamoDBMetaTokenStore.GetToken()",
+			"token": token,
+			"table": s.table,
+			"result": result,
+
+		}).Error(err)
+		return
+	}
+	if *result.Count != int64(1) {
+		return t, fmt.Errorf("%w: could not find result for token %s", ErrNotFound, token)
+	}
+	obj := result.Items[0]
+	t = dynamoTokenAttrMapToAssetToken(obj)
+	if !time.Now().Before(time.Unix(t.Expiry, 0)) {
+		return t, fmt.Errorf("token expired")
+	}
+	return
+}
+
+func (s *DynamoDBMetaTokenStore) StoreToken(token AssetToken) (err error) {
+	if !token.Valid() {
+		return fmt.Errorf("token invalid")
+	}
+	_, err = s.PutItem(&dynamodb.PutItemInput{
+		Item:      assetTokenToDynamoAttrMap(token),
+		TableName: aws.String(s.table),
+	})
+	return
+}
+
+//RevokeToken deletes a token's row(s), so it can no longer be used
+func (s *DynamoDBMetaTokenStore) RevokeToken(token string) (err error) {
+	if token == "" {
+		return fmt.Errorf("zero-length token")
+	}
+	result, err := s.Query(&dynamodb.QueryInput{
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":v1": {
+				S: aws.String(TOKEN_KEY_PREFIX + token),
+			},
+		},
+		KeyConditionExpression: aws.String("ObjID = :v1"),
+		TableName: aws.String(s.table),
+	})
+	if err != nil {
+		return
+	}
+	if len(result.Items) == 0 {
+		return fmt.Errorf("%w: could not find token %s", ErrNotFound, token)
+	}
+	for _, item := range result.Items {
+		_, err = s.DeleteItem(&dynamodb.DeleteItemInput{
+			Key: map[string]*dynamodb.AttributeValue{
+				"ObjID": item["ObjID"],
+				"ObjSort": item["ObjSort"],
+			},
+			TableName: aws.String(s.table),
+		})
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (s *DynamoDBMetaTokenStore) GetArchiveToken(token string) (t ArchiveToken, err error) {
+	if token == "" {
+		return t, fmt.Errorf("zero-length token")
+	}
+	result, err := s.Query(&dynamodb.QueryInput{
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":v1": {
+				S: aws.String(ARCHIVE_KEY_PREFIX + token),
+			},
+		},
+		KeyConditionExpression: aws.String("ObjID = :v1"),
+		TableName: aws.String(s.table),
+	})
+	if err != nil {
+		log.WithFields(log.Fields{
+			"context": "DynamoDBMetaTokenStore.GetArchiveToken()",
+			"token": token,
+			"table": s.table,
+		}).Error(err)
+		return
+	}
+	if *result.Count != int64(1) {
+		return t, fmt.Errorf("%w: could not find result for archive token %s", ErrNotFound, token)
+	}
+	t = dynamoArchiveAttrMapToArchiveToken(result.Items[0])
+	if !time.Now().Before(time.Unix(t.Expiry, 0)) {
+		return t, fmt.Errorf("%w: archive token expired", ErrNotFound)
+	}
+	return
+}
+
+func (s *DynamoDBMetaTokenStore) StoreArchiveToken(token ArchiveToken) (err error) {
+	if !token.Valid() {
+		return fmt.Errorf("archive token invalid")
+	}
+	_, err = s.PutItem(&dynamodb.PutItemInput{
+		Item: archiveTokenToDynamoAttrMap(token),
+		TableName: aws.String(s.table),
+	})
+	return
+}
+
+func (s *DynamoDBMetaTokenStore) GetCollection(id string) (coll Collection, err error) {
+	if id == "" {
+		return coll, fmt.Errorf("zero-length id")
+	}
+	result, err := s.GetItem(&dynamodb.GetItemInput{
+		Key: collectionKey(id),
+		TableName: aws.String(s.table),
+	})
+	if err != nil {
+		return
+	}
+	if result.Item == nil {
+		return coll, fmt.Errorf("%w: could not find collection with id %s", ErrNotFound, id)
+	}
+	return dynamoCollectionAttrMapToCollection(result.Item), nil
+}
+
+func (s *DynamoDBMetaTokenStore) StoreCollection(coll Collection) (err error) {
+	if !coll.Valid() {
+		return fmt.Errorf("collection invalid")
+	}
+	_, err = s.PutItem(&dynamodb.PutItemInput{
+		Item: collectionToDynamoAttrMap(coll),
+		TableName: aws.String(s.table),
+	})
+	return
+}
+
+func (s *DynamoDBMetaTokenStore) DeleteCollection(id string) (err error) {
+	if id == "" {
+		return fmt.Errorf("zero-length id")
+	}
+	_, err = s.DeleteItem(&dynamodb.DeleteItemInput{
+		Key: collectionKey(id),
+		ConditionExpression: aws.String("attribute_exists(ObjID)"),
+		TableName: aws.String(s.table),
+	})
+	if isConditionFailed(err) {
+		return fmt.Errorf("%w: could not find collection with id %s", ErrNotFound, id)
+	}
+	return
+}
+
+func (s *DynamoDBMetaTokenStore) GetCollectionToken(token string) (t CollectionToken, err error) {
+	if token == "" {
+		return t, fmt.Errorf("zero-length token")
+	}
+	result, err := s.Query(&dynamodb.QueryInput{
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":v1": {
+				S: aws.String(COLLECTION_TOKEN_KEY_PREFIX + token),
+			},
+		},
+		KeyConditionExpression: aws.String("ObjID = :v1"),
+		TableName: aws.String(s.table),
+	})
+	if err != nil {
+		log.WithFields(log.Fields{
+			"context": "DynamoDBMetaTokenStore.GetCollectionToken()",
+			"token": token,
+			"table": s.table,
+		}).Error(err)
+		return
+	}
+	if *result.Count != int64(1) {
+		return t, fmt.Errorf("%w: could not find result for collection token %s", ErrNotFound, token)
+	}
+	t = dynamoCollectionTokenAttrMapToCollectionToken(result.Items[0])
+	if !time.Now().Before(time.Unix(t.Expiry, 0)) {
+		return t, fmt.Errorf("%w: collection token expired", ErrNotFound)
+	}
+	return
+}
+
+func (s *DynamoDBMetaTokenStore) StoreCollectionToken(token CollectionToken) (err error) {
+	if !token.Valid() {
+		return fmt.Errorf("collection token invalid")
+	}
+	_, err = s.PutItem(&dynamodb.PutItemInput{
+		Item: collectionTokenToDynamoAttrMap(token),
+		TableName: aws.String(s.table),
+	})
+	return
+}
+
+//ClaimID claims an id in scope with an ID_{scope/id} row, put only if it doesn't exist yet
+func (s *DynamoDBMetaTokenStore) ClaimID(scope, id string) (err error) {
+	if id == "" {
+		return fmt.Errorf("zero-length id")
+	}
+	_, err = s.PutItem(&dynamodb.PutItemInput{
+		Item: map[string]*dynamodb.AttributeValue{
+			"ObjID": {
+				S: aws.String(ID_KEY_PREFIX + scope + "/" + id),
+			},
+			"ObjSort": {
+				S: aws.String("0"),
+			},
+		},
+		ConditionExpression: aws.String("attribute_not_exists(ObjID)"),
+		TableName: aws.String(s.table),
+	})
+	if isConditionFailed(err) {
+		return fmt.Errorf("%w: %s in %s", ErrIDTaken, id, scope)
+	}
+	return
+}
+
+//GetAlias gets the current revision of an alias, from its ALIAS_{tenant/slug} row with sort key 0
+func (s *DynamoDBMetaTokenStore) GetAlias(slug string) (alias Alias, err error) {
+	if slug == "" {
+		return alias, fmt.Errorf("zero-length slug")
+	}
+	result, err := s.GetItem(&dynamodb.GetItemInput{
+		Key: aliasKey(slug, "0"),
+		ConsistentRead: aws.Bool(true),
+		TableName: aws.String(s.table),
+	})
+	if err != nil {
+		return
+	}
+	if result.Item == nil {
+		return alias, fmt.Errorf("%w: could not find alias %s", ErrNotFound, slug)
+	}
+	return dynamoAliasAttrMapToAlias(result.Item), nil
+}
+
+//SwapAlias replaces an alias's current revision row, conditionally on its revision, and adds a row for the revision
+//to its history, in one transaction
+func (s *DynamoDBMetaTokenStore) SwapAlias(alias Alias, prev int64) (err error) {
+	if !alias.Valid() {
+		return fmt.Errorf("alias invalid")
+	}
+	current := &dynamodb.Put{
+		Item: aliasToDynamoAttrMap(alias, "0"),
+		ConditionExpression: aws.String("attribute_not_exists(ObjID)"),
+		TableName: aws.String(s.table),
+	}
+	if prev != 0 {
+		current.ConditionExpression = aws.String("Revision = :prev")
+		current.ExpressionAttributeValues = map[string]*dynamodb.AttributeValue{
+			":prev": {
+				S: aws.String(strconv.FormatInt(prev, 10)),
+			},
+		}
+	}
+	_, err = s.TransactWriteItems(&dynamodb.TransactWriteItemsInput{
+		TransactItems: []*dynamodb.TransactWriteItem{
+			{Put: current},
+			{Put: &dynamodb.Put{
+				Item: aliasToDynamoAttrMap(alias, aliasRevisionSort(alias.Revision)),
+				ConditionExpression: aws.String("attribute_not_exists(ObjID)"),
+				TableName: aws.String(s.table),
+			}},
+		},
+	})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == dynamodb.ErrCodeTransactionCanceledException {
+		return fmt.Errorf("%w: %s is no longer at revision %d", ErrAliasConflict, alias.Slug, prev)
+	}
+	return
+}
+
+//AliasHistory queries the revision rows of an alias, newest first
+func (s *DynamoDBMetaTokenStore) AliasHistory(slug string) (history []Alias, err error) {
+	if slug == "" {
+		return nil, fmt.Errorf("zero-length slug")
+	}
+	input := &dynamodb.QueryInput{
 		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
 			":v1": {
-				S: aws.String(TOKEN_KEY_PREFIX + token),
+				S: aws.String(ALIAS_KEY_PREFIX + slug),
+			},
+			":rev": {
+				S: aws.String(ALIAS_REVISION_SORT_PREFIX),
 			},
 		},
-		KeyConditionExpression: aws.String("ObjID = :v1"),
+		KeyConditionExpression: aws.String("ObjID = :v1 AND begins_with(ObjSort, :rev)"),
+		ScanIndexForward: aws.Bool(false),
 		TableName: aws.String(s.table),
+	}
+	err = s.QueryPages(input, func(page *dynamodb.QueryOutput, last bool) bool {
+		for _, item := range page.Items {
+			history = append(history, dynamoAliasAttrMapToAlias(item))
+		}
+		return true
 	})
-	if err != nil {
-		log.WithFields(log.Fields{
-			"context": "DynamoDBMetaTokenStore.GetToken()",
-			"token": token,
-			"table": s.table,
-			"result": result,
+	return
+}
 
-		}).Error(err)
+//AddUsage atomically adds to the usage counters in a USAGE_{scope} row, conditionally on quota for increases
+func (s *DynamoDBMetaTokenStore) AddUsage(scope string, delta Usage, quota Quota) (err error) {
+	if !quota.Allows(Usage{}, delta) {
+		return ErrQuotaExceeded
+	}
+	input := &dynamodb.UpdateItemInput{
+		Key: usageKey(scope),
+		UpdateExpression: aws.String("ADD UsedBytes :b, UsedObjects :o"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":b": {
+				N: aws.String(strconv.FormatInt(delta.Bytes, 10)),
+			},
+			":o": {
+				N: aws.String(strconv.FormatInt(delta.Objects, 10)),
+			},
+		},
+		TableName: aws.String(s.table),
+	}
+	var conditions []string
+	if quota.MaxBytes > 0 && delta.Bytes > 0 {
+		conditions = append(conditions, "(attribute_not_exists(UsedBytes) OR UsedBytes <= :maxb)")
+		input.ExpressionAttributeValues[":maxb"] = &dynamodb.AttributeValue{
+			N: aws.String(strconv.FormatInt(quota.MaxBytes-delta.Bytes, 10)),
+		}
+	}
+	if quota.MaxObjects > 0 && delta.Objects > 0 {
+		conditions = append(conditions, "(attribute_not_exists(UsedObjects) OR UsedObjects <= :maxo)")
+		input.ExpressionAttributeValues[":maxo"] = &dynamodb.AttributeValue{
+			N: aws.String(strconv.FormatInt(quota.MaxObjects-delta.Objects, 10)),
+		}
+	}
+	if len(conditions) > 0 {
+		input.ConditionExpression = aws.String(strings.Join(conditions, " AND "))
+	}
+	_, err = s.UpdateItem(input)
+	if isConditionFailed(err) {
+		return ErrQuotaExceeded
+	}
+	return
+}
+
+func (s *DynamoDBMetaTokenStore) GetUsage(scope string) (usage Usage, err error) {
+	result, err := s.GetItem(&dynamodb.GetItemInput{
+		Key: usageKey(scope),
+		ConsistentRead: aws.Bool(true),
+		TableName: aws.String(s.table),
+	})
+	if err != nil || result.Item == nil {
 		return
 	}
-	if *result.Count != int64(1) {
-		return t, fmt.Errorf("could not find result for token %s", token)
+	d := struct {
+		UsedBytes int64
+		UsedObjects int64
+	}{}
+	err = dynamodbattribute.UnmarshalMap(result.Item, &d)
+	return Usage{Bytes: d.UsedBytes, Objects: d.UsedObjects}, err
+}
+
+//AddBlobRef atomically adds to the reference count in a BLOB_{key} row
+func (s *DynamoDBMetaTokenStore) AddBlobRef(key string, delta int64) (refs int64, deleting bool, err error) {
+	result, err := s.UpdateItem(&dynamodb.UpdateItemInput{
+		Key: blobKey(key),
+		UpdateExpression: aws.String("ADD Refs :d"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":d": {
+				N: aws.String(strconv.FormatInt(delta, 10)),
+			},
+		},
+		ReturnValues: aws.String(dynamodb.ReturnValueAllNew),
+		TableName: aws.String(s.table),
+	})
+	if err != nil {
+		return
 	}
-	obj := result.Items[0]
-	t = dynamoTokenAttrMapToAssetToken(obj)
-	if !time.Now().Before(time.Unix(t.Expiry, 0)) {
-		return t, fmt.Errorf("token expired")
+	d := struct {
+		Refs int64
+		Deleting bool
+	}{}
+	err = dynamodbattribute.UnmarshalMap(result.Attributes, &d)
+	return d.Refs, d.Deleting, err
+}
+
+//MarkBlobDeleting flags a BLOB_{key} row as being deleted, only if nothing references the blob
+func (s *DynamoDBMetaTokenStore) MarkBlobDeleting(key string) (err error) {
+	_, err = s.UpdateItem(&dynamodb.UpdateItemInput{
+		Key: blobKey(key),
+		UpdateExpression: aws.String("SET Deleting = :true"),
+		ConditionExpression: aws.String("attribute_not_exists(Refs) OR Refs <= :zero"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":true": {
+				BOOL: aws.Bool(true),
+			},
+			":zero": {
+				N: aws.String("0"),
+			},
+		},
+		TableName: aws.String(s.table),
+	})
+	if isConditionFailed(err) {
+		return ErrBlobInUse
 	}
 	return
 }
 
-func (s *DynamoDBMetaTokenStore) StoreToken(token AssetToken) (err error) {
-	if !token.Valid() {
-		return fmt.Errorf("token invalid")
+//RemoveBlobRef deletes a BLOB_{key} row if nothing references the blob, and otherwise only clears its deleting flag
+func (s *DynamoDBMetaTokenStore) RemoveBlobRef(key string) (err error) {
+	_, err = s.DeleteItem(&dynamodb.DeleteItemInput{
+		Key: blobKey(key),
+		ConditionExpression: aws.String("attribute_not_exists(Refs) OR Refs <= :zero"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":zero": {
+				N: aws.String("0"),
+			},
+		},
+		TableName: aws.String(s.table),
+	})
+	if !isConditionFailed(err) {
+		return
+	}
+	_, err = s.UpdateItem(&dynamodb.UpdateItemInput{
+		Key: blobKey(key),
+		UpdateExpression: aws.String("REMOVE Deleting"),
+		TableName: aws.String(s.table),
+	})
+	return
+}
+
+func (s *DynamoDBMetaTokenStore) LoadCheckpoint(name string) (value string, err error) {
+	result, err := s.GetItem(&dynamodb.GetItemInput{
+		Key: checkpointKey(name),
+		ConsistentRead: aws.Bool(true),
+		TableName: aws.String(s.table),
+	})
+	if err != nil || result.Item == nil {
+		return
+	}
+	d := map[string]string{}
+	err = dynamodbattribute.UnmarshalMap(result.Item, &d)
+	return d["Checkpoint"], err
+}
+
+func (s *DynamoDBMetaTokenStore) SaveCheckpoint(name, value string) (err error) {
+	if value == "" {
+		_, err = s.DeleteItem(&dynamodb.DeleteItemInput{
+			Key: checkpointKey(name),
+			TableName: aws.String(s.table),
+		})
+		return
 	}
+	item := checkpointKey(name)
+	item["Checkpoint"] = &dynamodb.AttributeValue{S: aws.String(value)}
 	_, err = s.PutItem(&dynamodb.PutItemInput{
-		Item:      assetTokenToDynamoAttrMap(token),
+		Item: item,
 		TableName: aws.String(s.table),
 	})
 	return
 }
 
-func assetMetaToDynamoAttrMap(meta AssetMeta) map[string]*dynamodb.AttributeValue {
+func checkpointKey(name string) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		"ObjID": {
+			S: aws.String(CHECKPOINT_KEY_PREFIX + name),
+		},
+		"ObjSort": {
+			S: aws.String("0"),
+		},
+	}
+}
+
+func collectionKey(id string) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		"ObjID": {
+			S: aws.String(COLLECTION_KEY_PREFIX + id),
+		},
+		"ObjSort": {
+			S: aws.String("0"),
+		},
+	}
+}
+
+func aliasKey(slug, sort string) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		"ObjID": {
+			S: aws.String(ALIAS_KEY_PREFIX + slug),
+		},
+		"ObjSort": {
+			S: aws.String(sort),
+		},
+	}
+}
+
+func assetVersionKey(id string, version int) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		"ObjID": {
+			S: aws.String(VERSION_KEY_PREFIX + id),
+		},
+		"ObjSort": {
+			S: aws.String(versionSort(version)),
+		},
+	}
+}
+
+//versionSort is the sort key of a previous version of an asset, zero padded so versions sort in order
+func versionSort(version int) string {
+	return fmt.Sprintf("%010d", version)
+}
+
+//versionToDynamoAttrMap is the VERSION_ row of a previous version of an asset, with the same attributes as its
+//ASSET_ row had
+func versionToDynamoAttrMap(meta AssetMeta) map[string]*dynamodb.AttributeValue {
+	item := assetMetaToDynamoAttrMap(meta)
+	for k, v := range assetVersionKey(meta.Key(), meta.Version) {
+		item[k] = v
+	}
+	return item
+}
+
+//aliasRevisionSort is the sort key of a revision in an alias's history, zero padded so revisions sort in order
+func aliasRevisionSort(revision int64) string {
+	return fmt.Sprintf("%s%010d", ALIAS_REVISION_SORT_PREFIX, revision)
+}
+
+func blobKey(key string) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		"ObjID": {
+			S: aws.String(BLOB_KEY_PREFIX + key),
+		},
+		"ObjSort": {
+			S: aws.String("0"),
+		},
+	}
+}
+
+func usageKey(scope string) map[string]*dynamodb.AttributeValue {
 	return map[string]*dynamodb.AttributeValue{
 		"ObjID": {
-			S:  aws.String(ASSET_KEY_PREFIX + meta.ID),
+			S: aws.String(USAGE_KEY_PREFIX + scope),
+		},
+		"ObjSort": {
+			S: aws.String("0"),
+		},
+	}
+}
+
+//encodeCursor encodes a LastEvaluatedKey as an opaque paging cursor, "" when there are no more pages
+func encodeCursor(key map[string]*dynamodb.AttributeValue) (string, error) {
+	if len(key) == 0 {
+		return "", nil
+	}
+	d := map[string]string{}
+	if err := dynamodbattribute.UnmarshalMap(key, &d); err != nil {
+		return "", err
+	}
+	b, err := json.Marshal(d)
+	return base64.RawURLEncoding.EncodeToString(b), err
+}
+
+func decodeCursor(cursor string) (map[string]*dynamodb.AttributeValue, error) {
+	if cursor == "" {
+		return nil, nil
+	}
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+	d := map[string]string{}
+	if err = json.Unmarshal(b, &d); err != nil {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+	return dynamodbattribute.MarshalMap(d)
+}
+
+//isConditionFailed reports whether err is a failed dynamodb ConditionExpression
+func isConditionFailed(err error) bool {
+	if aerr, ok := err.(awserr.Error); ok {
+		return aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException
+	}
+	return false
+}
+
+func assetMetaToDynamoAttrMap(meta AssetMeta) map[string]*dynamodb.AttributeValue {
+	item := map[string]*dynamodb.AttributeValue{
+		"ObjID": {
+			S:  aws.String(ASSET_KEY_PREFIX + meta.Key()),
 		},
 		"ObjSort": {
 			S: aws.String(strconv.Itoa(meta.Version)),
@@ -127,13 +1028,103 @@ func assetMetaToDynamoAttrMap(meta AssetMeta) map[string]*dynamodb.AttributeValu
 			S: aws.String(strconv.Itoa(meta.Size)),
 		},
 	}
+	//dynamodb doesn't allow empty strings, so optional attributes are left out when unset
+	if meta.Owner != "" {
+		item["Owner"] = &dynamodb.AttributeValue{S: aws.String(meta.Owner)}
+	}
+	if meta.ContentType != "" {
+		item["ContentType"] = &dynamodb.AttributeValue{S: aws.String(meta.ContentType)}
+	}
+	if meta.ScanStatus != "" {
+		item["ScanStatus"] = &dynamodb.AttributeValue{S: aws.String(string(meta.ScanStatus))}
+	}
+	if meta.Checksum != "" {
+		item["Checksum"] = &dynamodb.AttributeValue{S: aws.String(meta.Checksum)}
+	}
+	if meta.Blob != "" {
+		item["Blob"] = &dynamodb.AttributeValue{S: aws.String(meta.Blob)}
+	}
+	if meta.DataID != "" {
+		item["DataID"] = &dynamodb.AttributeValue{S: aws.String(meta.DataID)}
+	}
+	if meta.WrappedKey != "" {
+		item["KeyID"] = &dynamodb.AttributeValue{S: aws.String(meta.KeyID)}
+		item["WrappedKey"] = &dynamodb.AttributeValue{S: aws.String(meta.WrappedKey)}
+	}
+	if meta.Encoding != "" {
+		item["Encoding"] = &dynamodb.AttributeValue{S: aws.String(meta.Encoding)}
+		item["EncodedSize"] = &dynamodb.AttributeValue{S: aws.String(strconv.FormatInt(meta.EncodedSize, 10))}
+	}
+	if meta.State != "" {
+		item["State"] = &dynamodb.AttributeValue{S: aws.String(string(meta.State))}
+	}
+	if meta.ReservedUntil != 0 {
+		item["ReservedUntil"] = &dynamodb.AttributeValue{S: aws.String(strconv.FormatInt(meta.ReservedUntil, 10))}
+	}
+	if meta.UploadID != "" {
+		item["UploadID"] = &dynamodb.AttributeValue{S: aws.String(meta.UploadID)}
+	}
+	if meta.Resumable {
+		item["Resumable"] = &dynamodb.AttributeValue{S: aws.String("1")}
+		item["Offset"] = &dynamodb.AttributeValue{S: aws.String(strconv.FormatInt(meta.Offset, 10))}
+		item["TailSize"] = &dynamodb.AttributeValue{S: aws.String(strconv.FormatInt(meta.TailSize, 10))}
+		if len(meta.Chunks) > 0 {
+			//etags and the like have no commas
+			item["Chunks"] = &dynamodb.AttributeValue{S: aws.String(strings.Join(meta.Chunks, ","))}
+		}
+	}
+	if meta.Created != 0 {
+		item["Created"] = &dynamodb.AttributeValue{S: aws.String(strconv.FormatInt(meta.Created, 10))}
+	}
+	if len(meta.Metadata) > 0 {
+		item["Metadata"] = &dynamodb.AttributeValue{S: aws.String(encodeMetadata(meta.Metadata))}
+	}
+	if meta.Revision != 0 {
+		item["Revision"] = &dynamodb.AttributeValue{S: aws.String(strconv.FormatInt(meta.Revision, 10))}
+	}
+	if meta.Expires != 0 {
+		item["Expires"] = &dynamodb.AttributeValue{S: aws.String(strconv.FormatInt(meta.Expires, 10))}
+	}
+	if meta.Accessed != 0 {
+		item["Accessed"] = &dynamodb.AttributeValue{S: aws.String(strconv.FormatInt(meta.Accessed, 10))}
+	}
+	return item
+}
+
+//encodeMetadata encodes user metadata as json, to be stored as a string
+func encodeMetadata(metadata map[string]string) string {
+	b, _ := json.Marshal(metadata)
+	return string(b)
 }
 
 func dynamoAssetAttrMapToMeta(m map[string]*dynamodb.AttributeValue) (meta AssetMeta) {
 	d := map[string]string{
-		"ObjID": "",  //ASSET_{ID}
+		"ObjID": "",  //ASSET_{tenant/ID}, or VERSION_{tenant/ID} for previous versions
+		"ObjSort": "0", //Version
 		"AssetName": "",
 		"Size": "0",
+		"Owner": "",
+		"ContentType": "",
+		"ScanStatus": "",
+		"State": "",
+		"Created": "0",
+		"Checksum": "",
+		"Blob": "",
+		"DataID": "",
+		"Encoding": "",
+		"EncodedSize": "0",
+		"KeyID": "",
+		"WrappedKey": "",
+		"ReservedUntil": "0",
+		"UploadID": "",
+		"Resumable": "",
+		"Offset": "0",
+		"TailSize": "0",
+		"Chunks": "",
+		"Metadata": "",
+		"Revision": "0",
+		"Expires": "0",
+		"Accessed": "0",
 	}
 	if err := dynamodbattribute.UnmarshalMap(m, &d); err != nil {
 		log.WithFields(log.Fields{
@@ -142,18 +1133,49 @@ func dynamoAssetAttrMapToMeta(m map[string]*dynamodb.AttributeValue) (meta Asset
 		}).Error(err)
 		return
 	}
-	meta.ID = strings.Replace(d["ObjID"], ASSET_KEY_PREFIX, "", 1)
+	key := strings.Replace(d["ObjID"], ASSET_KEY_PREFIX, "", 1)
+	if strings.HasPrefix(d["ObjID"], VERSION_KEY_PREFIX) {
+		key = strings.TrimPrefix(d["ObjID"], VERSION_KEY_PREFIX)
+	}
+	meta.Tenant, meta.ID = SplitScopedKey(key)
+	meta.Version, _ = strconv.Atoi(d["ObjSort"])
 	meta.Name = d["AssetName"]
 	meta.Size, _ = strconv.Atoi(d["Size"])
+	meta.Owner = d["Owner"]
+	meta.ContentType = d["ContentType"]
+	meta.ScanStatus = ScanStatus(d["ScanStatus"])
+	meta.State = AssetState(d["State"])
+	meta.Checksum = d["Checksum"]
+	meta.Blob = d["Blob"]
+	meta.DataID = d["DataID"]
+	meta.Encoding = d["Encoding"]
+	meta.EncodedSize, _ = strconv.ParseInt(d["EncodedSize"], 10, 64)
+	meta.KeyID = d["KeyID"]
+	meta.WrappedKey = d["WrappedKey"]
+	meta.ReservedUntil, _ = strconv.ParseInt(d["ReservedUntil"], 10, 64)
+	meta.UploadID = d["UploadID"]
+	meta.Resumable = d["Resumable"] == "1"
+	meta.Offset, _ = strconv.ParseInt(d["Offset"], 10, 64)
+	meta.TailSize, _ = strconv.ParseInt(d["TailSize"], 10, 64)
+	if d["Chunks"] != "" {
+		meta.Chunks = strings.Split(d["Chunks"], ",")
+	}
+	meta.Created, _ = strconv.ParseInt(d["Created"], 10, 64)
+	if d["Metadata"] != "" {
+		json.Unmarshal([]byte(d["Metadata"]), &meta.Metadata)
+	}
+	meta.Revision, _ = strconv.ParseInt(d["Revision"], 10, 64)
+	meta.Expires, _ = strconv.ParseInt(d["Expires"], 10, 64)
+	meta.Accessed, _ = strconv.ParseInt(d["Accessed"], 10, 64)
 	return meta
 }
 
-//metaTokenToDynamoAttrMap takes row with pk of TOKEN-{id} and returns the expiry and
+//metaTokenToDynamoAttrMap takes row with pk of TOKEN-{tenant/id} and returns the expiry and
 //Asset Id associated
 func dynamoTokenAttrMapToAssetToken(m map[string]*dynamodb.AttributeValue) (token AssetToken) {
 	d := map[string]string{
 		"AssetID": "", //Asset token refers to
-		"ObjID": "",   //TOKEN_{id}
+		"ObjID": "",   //TOKEN_{tenant/id}
 		"ObjSort": "0", //Token Expiry
 	}
 	if err := dynamodbattribute.UnmarshalMap(m, &d); err != nil {
@@ -164,7 +1186,7 @@ func dynamoTokenAttrMapToAssetToken(m map[string]*dynamodb.AttributeValue) (toke
 		return
 	}
 	token.AssetID = d["AssetID"]
-	token.Token = strings.Replace(d["ObjID"], TOKEN_KEY_PREFIX, "", 1)
+	token.Tenant, token.Token = SplitScopedKey(strings.Replace(d["ObjID"], TOKEN_KEY_PREFIX, "", 1))
 	if expiry, err := strconv.Atoi(d["ObjSort"], ); err == nil {
 		token.Expiry = int64(expiry)
 	}
@@ -174,7 +1196,7 @@ func dynamoTokenAttrMapToAssetToken(m map[string]*dynamodb.AttributeValue) (toke
 func assetTokenToDynamoAttrMap(token AssetToken) map[string]*dynamodb.AttributeValue {
 	return map[string]*dynamodb.AttributeValue{
 		"ObjID": {
-			S:  aws.String(TOKEN_KEY_PREFIX + token.Token),
+			S:  aws.String(TOKEN_KEY_PREFIX + token.Key()),
 		},
 		"ObjSort": {
 			S: aws.String(strconv.Itoa(int(token.Expiry))),
@@ -183,4 +1205,175 @@ func assetTokenToDynamoAttrMap(token AssetToken) map[string]*dynamodb.AttributeV
 			S: aws.String(token.AssetID),
 		},
 	}
-}
\ No newline at end of file
+}
+
+func dynamoArchiveAttrMapToArchiveToken(m map[string]*dynamodb.AttributeValue) (token ArchiveToken) {
+	d := map[string]string{
+		"AssetIDs": "", //comma separated ids of the assets in the archive
+		"Format": "",
+		"ObjID": "",   //ARCHIVE_{tenant/token}
+		"ObjSort": "0", //Token Expiry
+	}
+	if err := dynamodbattribute.UnmarshalMap(m, &d); err != nil {
+		log.WithFields(log.Fields{
+			"context": "dynamoArchiveAttrMapToArchiveToken",
+			"map": m,
+		}).Error(err)
+		return
+	}
+	token.Tenant, token.Token = SplitScopedKey(strings.Replace(d["ObjID"], ARCHIVE_KEY_PREFIX, "", 1))
+	if d["AssetIDs"] != "" {
+		token.AssetIDs = strings.Split(d["AssetIDs"], ",")
+	}
+	token.Format = d["Format"]
+	if expiry, err := strconv.Atoi(d["ObjSort"]); err == nil {
+		token.Expiry = int64(expiry)
+	}
+	return token
+}
+
+func archiveTokenToDynamoAttrMap(token ArchiveToken) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		"ObjID": {
+			S: aws.String(ARCHIVE_KEY_PREFIX + token.Key()),
+		},
+		"ObjSort": {
+			S: aws.String(strconv.Itoa(int(token.Expiry))),
+		},
+		"AssetIDs": {
+			S: aws.String(strings.Join(token.AssetIDs, ",")),
+		},
+		"Format": {
+			S: aws.String(token.Format),
+		},
+	}
+}
+
+func dynamoCollectionAttrMapToCollection(m map[string]*dynamodb.AttributeValue) (coll Collection) {
+	d := map[string]string{
+		"ObjID": "", //COLL_{tenant/id}
+		"CollectionName": "",
+		"Owner": "",
+		"AssetIDs": "", //comma separated ids of the assets in the collection, in order
+		"Created": "0",
+	}
+	if err := dynamodbattribute.UnmarshalMap(m, &d); err != nil {
+		log.WithFields(log.Fields{
+			"context": "dynamoCollectionAttrMapToCollection",
+			"map": m,
+		}).Error(err)
+		return
+	}
+	coll.Tenant, coll.ID = SplitScopedKey(strings.Replace(d["ObjID"], COLLECTION_KEY_PREFIX, "", 1))
+	coll.Name = d["CollectionName"]
+	coll.Owner = d["Owner"]
+	coll.AssetIDs = []string{}
+	if d["AssetIDs"] != "" {
+		coll.AssetIDs = strings.Split(d["AssetIDs"], ",")
+	}
+	coll.Created, _ = strconv.ParseInt(d["Created"], 10, 64)
+	return coll
+}
+
+func collectionToDynamoAttrMap(coll Collection) map[string]*dynamodb.AttributeValue {
+	item := collectionKey(coll.Key())
+	item["CollectionName"] = &dynamodb.AttributeValue{S: aws.String(coll.Name)}
+	item["Created"] = &dynamodb.AttributeValue{S: aws.String(strconv.FormatInt(coll.Created, 10))}
+	//dynamodb doesn't allow empty strings, so optional attributes are left out when unset
+	if coll.Owner != "" {
+		item["Owner"] = &dynamodb.AttributeValue{S: aws.String(coll.Owner)}
+	}
+	if len(coll.AssetIDs) > 0 {
+		item["AssetIDs"] = &dynamodb.AttributeValue{S: aws.String(strings.Join(coll.AssetIDs, ","))}
+	}
+	return item
+}
+
+func dynamoCollectionTokenAttrMapToCollectionToken(m map[string]*dynamodb.AttributeValue) (token CollectionToken) {
+	d := map[string]string{
+		"CollectionID": "", //Collection token refers to
+		"ObjID": "",   //COLLTOKEN_{tenant/token}
+		"ObjSort": "0", //Token Expiry
+	}
+	if err := dynamodbattribute.UnmarshalMap(m, &d); err != nil {
+		log.WithFields(log.Fields{
+			"context": "dynamoCollectionTokenAttrMapToCollectionToken",
+			"map": m,
+		}).Error(err)
+		return
+	}
+	token.CollectionID = d["CollectionID"]
+	token.Tenant, token.Token = SplitScopedKey(strings.Replace(d["ObjID"], COLLECTION_TOKEN_KEY_PREFIX, "", 1))
+	if expiry, err := strconv.Atoi(d["ObjSort"]); err == nil {
+		token.Expiry = int64(expiry)
+	}
+	return token
+}
+
+func collectionTokenToDynamoAttrMap(token CollectionToken) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		"ObjID": {
+			S: aws.String(COLLECTION_TOKEN_KEY_PREFIX + token.Key()),
+		},
+		"ObjSort": {
+			S: aws.String(strconv.Itoa(int(token.Expiry))),
+		},
+		"CollectionID": {
+			S: aws.String(token.CollectionID),
+		},
+	}
+}
+
+func dynamoAliasAttrMapToAlias(m map[string]*dynamodb.AttributeValue) (alias Alias) {
+	d := map[string]string{
+		"ObjID": "", //ALIAS_{tenant/slug}
+		"AssetID": "",
+		"Version": "",
+		"Owner": "",
+		"Revision": "0",
+		"Updated": "0",
+		"UpdatedBy": "",
+		"Deleted": "",
+	}
+	if err := dynamodbattribute.UnmarshalMap(m, &d); err != nil {
+		log.WithFields(log.Fields{
+			"context": "dynamoAliasAttrMapToAlias",
+			"map": m,
+		}).Error(err)
+		return
+	}
+	alias.Tenant, alias.Slug = SplitScopedKey(strings.Replace(d["ObjID"], ALIAS_KEY_PREFIX, "", 1))
+	alias.AssetID = d["AssetID"]
+	if version, err := strconv.Atoi(d["Version"]); err == nil {
+		alias.Version = &version
+	}
+	alias.Owner = d["Owner"]
+	alias.Revision, _ = strconv.ParseInt(d["Revision"], 10, 64)
+	alias.Updated, _ = strconv.ParseInt(d["Updated"], 10, 64)
+	alias.UpdatedBy = d["UpdatedBy"]
+	alias.Deleted = d["Deleted"] == "1"
+	return alias
+}
+
+func aliasToDynamoAttrMap(alias Alias, sort string) map[string]*dynamodb.AttributeValue {
+	item := aliasKey(alias.Key(), sort)
+	item["Revision"] = &dynamodb.AttributeValue{S: aws.String(strconv.FormatInt(alias.Revision, 10))}
+	item["Updated"] = &dynamodb.AttributeValue{S: aws.String(strconv.FormatInt(alias.Updated, 10))}
+	//dynamodb doesn't allow empty strings, so optional attributes are left out when unset
+	if alias.AssetID != "" {
+		item["AssetID"] = &dynamodb.AttributeValue{S: aws.String(alias.AssetID)}
+	}
+	if alias.Version != nil {
+		item["Version"] = &dynamodb.AttributeValue{S: aws.String(strconv.Itoa(*alias.Version))}
+	}
+	if alias.Owner != "" {
+		item["Owner"] = &dynamodb.AttributeValue{S: aws.String(alias.Owner)}
+	}
+	if alias.UpdatedBy != "" {
+		item["UpdatedBy"] = &dynamodb.AttributeValue{S: aws.String(alias.UpdatedBy)}
+	}
+	if alias.Deleted {
+		item["Deleted"] = &dynamodb.AttributeValue{S: aws.String("1")}
+	}
+	return item
+}
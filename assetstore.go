@@ -1,7 +1,11 @@
 package assetstore
 
 import (
+	"errors"
+	"fmt"
 	"io"
+	"regexp"
+	"strings"
 	"time"
 
 	log "github.com/sirupsen/logrus"
@@ -9,23 +13,145 @@ import (
 
 //High level types and interfaces for asset storage
 
+//Separates a tenant from the id it scopes in storage keys
+const tenantSeparator = "/"
+
+//Tenant names are restricted so they can safely be used as key prefixes
+var tenantPattern = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,64}$`)
+
+//ValidTenant reports whether tenant is a usable tenant/namespace name.  The default tenant is ""
+func ValidTenant(tenant string) bool {
+	return tenant == "" || tenantPattern.MatchString(tenant)
+}
+
+//ScopedKey scopes an asset id or token to a tenant, for use as a storage key.  Keys in the default tenant
+//are just the id, which keeps assets stored before tenants existed readable
+func ScopedKey(tenant, id string) string {
+	if tenant == "" {
+		return id
+	}
+	return tenant + tenantSeparator + id
+}
+
+//SplitScopedKey is the inverse of ScopedKey
+func SplitScopedKey(key string) (tenant, id string) {
+	if i := strings.Index(key, tenantSeparator); i >= 0 {
+		return key[:i], key[i+1:]
+	}
+	return "", key
+}
+
 //Properties our assets might have
 type AssetMeta struct {
 	ID string `json:"id"`
+	//Tenant/namespace the asset belongs to
+	Tenant string `json:"tenant,omitempty"`
+	//User who uploaded the asset, if known
+	Owner string `json:"owner,omitempty"`
 	//File or asset name
 	Name string `json:"name"`
 	//Size in bytes
 	Size int    `json:"size"`
+	//MIME type, sniffed from the data if not given
+	ContentType string `json:"content_type,omitempty"`
+	//Hex sha256 of the data
+	Checksum string `json:"checksum,omitempty"`
+	//Hash of the content addressed blob holding the data, in dedup mode
+	Blob string `json:"-"`
+	//Id of the data written by the asset's latest replacement (see AssetReplacer), "" if it was never replaced
+	DataID string `json:"-"`
+	//Content encoding the data is stored in (e.g. gzip), "" if stored as is
+	Encoding string `json:"-"`
+	//Size of the data in its Encoding
+	EncodedSize int64 `json:"-"`
+	//Id of the master key WrappedKey is wrapped with
+	KeyID string `json:"-"`
+	//Base64 data key the data is encrypted with, wrapped with a master key, "" if not encrypted
+	WrappedKey string `json:"-"`
+	//Malware scan status, if scanning is enabled
+	ScanStatus ScanStatus `json:"scan_status,omitempty"`
+	//Whether the asset is still being stored
+	State AssetState `json:"-"`
+	//Unix timestamp a reserved direct upload must be completed by, 0 if the asset wasn't reserved
+	ReservedUntil int64 `json:"-"`
+	//Id of the multipart upload a reserved asset's data is being uploaded with, if any
+	UploadID string `json:"-"`
+	//Whether the asset is a resumable upload, whose data is appended a chunk at a time
+	Resumable bool `json:"-"`
+	//Bytes of a resumable upload received so far
+	Offset int64 `json:"-"`
+	//Bytes received at the end of a resumable upload that are too few to append yet
+	TailSize int64 `json:"-"`
+	//References to the chunks appended to a resumable upload
+	Chunks []string `json:"-"`
+	//Unix timestamp the asset was created at
+	Created int64 `json:"created,omitempty"`
+	//Unix timestamp the asset expires at, after which it can't be retrieved and is deleted, 0 if it never expires
+	Expires int64 `json:"expires,omitempty"`
+	//Unix timestamp the asset was last retrieved at, to within a day, if lifecycle policies need to know (see
+	//LifecyclePolicy)
+	Accessed int64 `json:"accessed,omitempty"`
+	//User metadata
+	Metadata map[string]string `json:"metadata,omitempty"`
+	//Revision counts changes to the asset since it was uploaded (see MetaUpdater and AssetReplacer)
+	Revision int64 `json:"revision"`
 	//Version of asset
 	Version int `json:"version"`
 }
 
+type AssetState string
+
+const (
+	//StateUploading marks an asset whose data is being stored.  Its meta is only a placeholder so failed
+	//uploads can be found and cleaned up, and it can't be retrieved.
+	StateUploading AssetState = "uploading"
+	//StateReady assets are fully stored.  Assets stored before states existed have no state, and are ready.
+	StateReady AssetState = "ready"
+	//StateCorrupt assets' data no longer matches their meta (see Scrubber)
+	StateCorrupt AssetState = "corrupt"
+)
+
+var (
+	//ErrNotFound is returned (wrapped) when an asset, token or data doesn't exist
+	ErrNotFound = errors.New("not found")
+	//ErrTokenNotStored is returned by Store when the asset was stored, but its token couldn't be
+	ErrTokenNotStored = errors.New("asset stored, but its token could not be")
+)
+
+//Retrievable reports whether the asset is fully stored
+func (m AssetMeta) Retrievable() bool {
+	return m.State != StateUploading
+}
+
+//Expired reports whether the asset has expired as of now
+func (m AssetMeta) Expired(now time.Time) bool {
+	return m.Expires != 0 && now.Unix() >= m.Expires
+}
+
 func (m AssetMeta) Valid() bool {
-	return m.ID != "" && m.Name != ""
+	return m.ID != "" && m.Name != "" && ValidTenant(m.Tenant) && !strings.Contains(m.ID, tenantSeparator)
+}
+
+//Key is the tenant scoped key the asset is stored under
+func (m AssetMeta) Key() string {
+	return ScopedKey(m.Tenant, m.ID)
+}
+
+//DataKey is the key the asset's data is stored under, its blob's key when deduplicated
+func (m AssetMeta) DataKey() string {
+	if m.Blob != "" {
+		return BlobKey(m.Tenant, m.Blob)
+	}
+	if m.DataID != "" {
+		return replacementKey(m)
+	}
+	return m.Key()
 }
 
 type AssetToken struct {
 	Token string `json:"token,omitempty"`
+	//Tenant/namespace of the token and the asset it refers to
+	Tenant string `json:"tenant,omitempty"`
 	//Expiry unix timestamp
 	Expiry int64 `json:"expiry,omitempty"`
 	//AssetID
@@ -33,22 +159,52 @@ type AssetToken struct {
 }
 
 func (t AssetToken) Valid() bool {
-	return t.AssetID != "" && t.Token != "" && time.Now().Before(time.Unix(t.Expiry, 0))
+	return t.AssetID != "" && t.Token != "" && time.Now().Before(time.Unix(t.Expiry, 0)) &&
+		ValidTenant(t.Tenant) && !strings.Contains(t.Token, tenantSeparator)
+}
+
+//Key is the tenant scoped key the token is stored under
+func (t AssetToken) Key() string {
+	return ScopedKey(t.Tenant, t.Token)
+}
+
+//AssetKey is the tenant scoped key of the asset the token refers to
+func (t AssetToken) AssetKey() string {
+	return ScopedKey(t.Tenant, t.AssetID)
 }
 
-//AssetIDRetriever retrieves an assets' io.ReadCloser and meta by its id
+//AssetIDRetriever retrieves an assets' io.ReadCloser and meta by its tenant scoped id (see ScopedKey)
 type AssetIDRetriever interface {
 	GetByID(id string) (meta AssetMeta, asset io.ReadCloser, err error)
 }
 
-//AssetTokenRetriever retrieves an assets' io.ReadCloser and meta by via a token
+//SignedURLRetriever checks an asset can be retrieved, by id or token, and returns a short lived url its data can be
+//downloaded from directly, or "" if there isn't one
+type SignedURLRetriever interface {
+	SignedURLByID(id string, ttl time.Duration) (meta AssetMeta, url string, err error)
+	SignedURLByToken(token string, ttl time.Duration) (meta AssetMeta, url string, err error)
+}
+
+//EncodedAssetRetriever retrieves assets like AssetIDRetriever and AssetTokenRetriever, but returns data still
+//encoded when it's stored in one of the accepted encodings, so it can be sent with a Content-Encoding
+type EncodedAssetRetriever interface {
+	GetEncodedByID(id string, accept ...string) (meta AssetMeta, asset io.ReadCloser, encoding string, err error)
+	GetEncodedByToken(token string, accept ...string) (meta AssetMeta, asset io.ReadCloser, encoding string, err error)
+}
+
+//AssetTokenRetriever retrieves an assets' io.ReadCloser and meta by via a tenant scoped token (see ScopedKey)
 type AssetTokenRetriever interface {
 	GetByToken(token string) (meta AssetMeta, asset io.ReadCloser, err error)
 }
 
-//Stores an asset given its meta, token, and a io.ReadCloser
+//Stores an asset given its meta, token, and a io.ReadCloser, returning the meta as stored
 type AssetStorer interface {
-	Store(meta AssetMeta, token AssetToken, asset io.ReadCloser) (err error)
+	Store(meta AssetMeta, token AssetToken, asset io.ReadCloser) (stored AssetMeta, err error)
+}
+
+//AssetDeleter deletes an asset's meta and data by its tenant scoped id
+type AssetDeleter interface {
+	Delete(id string) (err error)
 }
 
 type MetaRetriever interface {
@@ -59,6 +215,10 @@ type MetaStorer interface {
 	StoreMeta(meta AssetMeta) (err error)
 }
 
+type MetaDeleter interface {
+	DeleteMeta(id string) (err error)
+}
+
 type TokenRetriever interface {
 	GetToken(token string) (t AssetToken, err error)
 }
@@ -75,14 +235,26 @@ type AssetDataWriter interface {
 	Writer(id string, reader io.ReadCloser) (n int64, err error)
 }
 
+type AssetDataDeleter interface {
+	Delete(id string) (err error)
+}
+
 type AssetDataHandler interface{
 	AssetDataReader
 	AssetDataWriter
+	AssetDataDeleter
+}
+
+//AssetTokenRevoker looks up and revokes tokens
+type AssetTokenRevoker interface {
+	TokenRetriever
+	TokenRevoker
 }
 
 type AssetMetaHandler interface {
 	MetaRetriever
 	MetaStorer
+	MetaDeleter
 }
 
 type AssetTokenHandler interface {
@@ -94,24 +266,69 @@ type AssetHandler interface {
 	AssetIDRetriever
 	AssetTokenRetriever
 	AssetStorer
+	AssetDeleter
 }
 
 type AssetStorage struct {
 	metaHandler AssetMetaHandler
 	tokenHandler AssetTokenHandler
 	dataHandler AssetDataHandler
+	//optional usage tracking and quotas
+	usageTracker UsageTracker
+	quotaLimits QuotaLimits
+	//optional checks of uploads before they're committed
+	uploadValidator UploadValidator
+	//optional malware scanning
+	scanner Scanner
+	scanPolicy ScanPolicy
+	//optional deduplication of data
+	blobs BlobRefCounter
+	//optional resumable uploads
+	resumable *resumableUploads
+	//optional sharing of archives
+	archiveTokens ArchiveTokenHandler
+	//optional collections of assets
+	collections CollectionHandler
+	//optional aliases of assets
+	aliases AliasHandler
+	//optional lifecycle policies
+	lifecycle LifecyclePolicies
 }
 
-func NewAssetStorage(metaHandler AssetMetaHandler, tokenHandler AssetTokenHandler, dataHandler AssetDataHandler) *AssetStorage {
-	return &AssetStorage{
+//AssetStorageOption enables optional AssetStorage features
+type AssetStorageOption func(s *AssetStorage)
+
+func NewAssetStorage(metaHandler AssetMetaHandler, tokenHandler AssetTokenHandler, dataHandler AssetDataHandler, opts ...AssetStorageOption) *AssetStorage {
+	s := &AssetStorage{
 		metaHandler: metaHandler,
 		tokenHandler: tokenHandler,
 		dataHandler: dataHandler,
 	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+//GetMeta gets an asset's meta, without its data, by its tenant scoped id
+func (s *AssetStorage) GetMeta(id string) (meta AssetMeta, err error) {
+	return s.metaHandler.GetMeta(id)
 }
 
 func (s *AssetStorage) GetByID(id string) (meta AssetMeta, asset io.ReadCloser, err error) {
-	meta, err = s.metaHandler.GetMeta(id)
+	meta, asset, _, err = s.GetEncodedByID(id)
+	return
+}
+
+//GetEncodedByID is GetByID, but if the asset's data is stored in one of the accepted encodings (e.g. "gzip") it's
+//returned still encoded, along with its encoding ("" when decoded)
+func (s *AssetStorage) GetEncodedByID(id string, accept ...string) (meta AssetMeta, asset io.ReadCloser, encoding string, err error) {
+	meta, err = s.retrievableMeta(id)
+	if err != nil {
+		return
+	}
+	s.recordAccess(meta)
+	asset, encoding, err = readDecoded(s.dataHandler, meta, meta.DataKey(), accept...)
 	if err != nil {
 		log.WithFields(log.Fields{
 			"context": "AssetStorage.GetByID()",
@@ -121,7 +338,38 @@ func (s *AssetStorage) GetByID(id string) (meta AssetMeta, asset io.ReadCloser,
 		}).Error(err)
 		return
 	}
-	asset, err = s.dataHandler.Reader(id)
+	return
+}
+
+func (s *AssetStorage) GetByToken(token string) (meta AssetMeta, asset io.ReadCloser, err error) {
+	meta, asset, _, err = s.GetEncodedByToken(token)
+	return
+}
+
+//GetEncodedByToken is GetByToken, returning data still encoded if it's in an accepted encoding, like GetEncodedByID
+func (s *AssetStorage) GetEncodedByToken(token string, accept ...string) (meta AssetMeta, asset io.ReadCloser, encoding string, err error) {
+	meta, err = s.retrievableMetaByToken(token)
+	if err != nil {
+		return
+	}
+	s.recordAccess(meta)
+	asset, encoding, err = readDecoded(s.dataHandler, meta, meta.DataKey(), accept...)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"context": "AssetStorage.GetByToken()",
+			"tokenHandler": s.tokenHandler,
+			"dataHandler": s.dataHandler,
+			"token": token,
+			"meta": meta,
+		}).Error(err)
+		return
+	}
+	return
+}
+
+//retrievableMeta gets the meta of an asset that can be retrieved
+func (s *AssetStorage) retrievableMeta(id string) (meta AssetMeta, err error) {
+	meta, err = s.metaHandler.GetMeta(id)
 	if err != nil {
 		log.WithFields(log.Fields{
 			"context": "AssetStorage.GetByID()",
@@ -131,10 +379,11 @@ func (s *AssetStorage) GetByID(id string) (meta AssetMeta, asset io.ReadCloser,
 		}).Error(err)
 		return
 	}
-	return
+	return meta, s.checkRetrievable(meta)
 }
 
-func (s *AssetStorage) GetByToken(token string) (meta AssetMeta, asset io.ReadCloser, err error) {
+//retrievableMetaByToken gets the meta of an asset that can be retrieved, by token
+func (s *AssetStorage) retrievableMetaByToken(token string) (meta AssetMeta, err error) {
 	aToken, err := s.tokenHandler.GetToken(token)
 	if err != nil {
 		log.WithFields(log.Fields{
@@ -144,7 +393,7 @@ func (s *AssetStorage) GetByToken(token string) (meta AssetMeta, asset io.ReadCl
 		}).Error(err)
 		return
 	}
-	meta, err = s.metaHandler.GetMeta(aToken.AssetID)
+	meta, err = s.metaHandler.GetMeta(aToken.AssetKey())
 	if err != nil {
 		log.WithFields(log.Fields{
 			"context": "AssetStorage.GetByToken()",
@@ -154,22 +403,76 @@ func (s *AssetStorage) GetByToken(token string) (meta AssetMeta, asset io.ReadCl
 		}).Error(err)
 		return
 	}
-	asset, err = s.dataHandler.Reader(meta.ID)
+	return meta, s.checkRetrievable(meta)
+}
+
+//checkRetrievable checks an asset is stored, intact, unexpired, and allowed by the scan policy
+func (s *AssetStorage) checkRetrievable(meta AssetMeta) error {
+	if !meta.Retrievable() {
+		return fmt.Errorf("%w: asset %s is still being stored", ErrNotFound, meta.ID)
+	}
+	if meta.State == StateCorrupt {
+		return ErrAssetCorrupt
+	}
+	if meta.Expired(time.Now()) {
+		return fmt.Errorf("%w: asset %s has expired", ErrNotFound, meta.ID)
+	}
+	return s.scanPolicy.check(meta)
+}
+
+//Store stores an asset's data, then its meta and token.  A pending marker is stored as the asset's meta before
+//any data, so data never exists without meta, and failures are rolled back: the data, marker and quota used are
+//all removed.  If the asset is stored but its token isn't, the stored meta is returned along with an error
+//wrapping ErrTokenNotStored.
+func (s *AssetStorage) Store(meta AssetMeta, token AssetToken, asset io.ReadCloser) (stored AssetMeta, err error) {
+	if !meta.Valid() {
+		asset.Close()
+		return meta, fmt.Errorf("meta invalid")
+	}
+	//a token can only ever refer to an asset in its own tenant
+	token.Tenant = meta.Tenant
+	//reserve quota for the declared size up front, then settle up once the real size is known
+	usage := Usage{Bytes: int64(meta.Size), Objects: 1}
+	if usage.Bytes < 0 {
+		usage.Bytes = 0
+	}
+	err = s.addUsage(meta, usage)
 	if err != nil {
+		asset.Close()
 		log.WithFields(log.Fields{
-			"context": "AssetStorage.GetByToken()",
-			"tokenHandler": s.tokenHandler,
-			"dataHandler": s.dataHandler,
-			"token": token,
+			"context": "AssetStorage.Store()",
+			"usageTracker": s.usageTracker,
 			"meta": meta,
 		}).Error(err)
-		return
+		return meta, err
 	}
-	return
-}
+	meta.State = StateUploading
+	meta.Created = time.Now().Unix()
+	err = s.metaHandler.StoreMeta(meta)
+	if err != nil {
+		asset.Close()
+		s.removeUsage(meta, usage)
+		log.WithFields(log.Fields{
+			"context": "AssetStorage.Store()",
+			"metaHandler": s.metaHandler,
+			"meta": meta,
+		}).Error(err)
+		return meta, err
+	}
+	committed := false
+	defer func() {
+		if !committed {
+			s.rollbackStore(meta, usage)
+		}
+	}()
 
-func (s *AssetStorage) Store(meta AssetMeta, token AssetToken, asset io.ReadCloser) (err error) {
-	n, err := s.dataHandler.Writer(meta.ID, asset)
+	hasher := newHashReadCloser(asset)
+	sniffer := newSniffReader(hasher)
+	writeKey := meta.Key()
+	if s.blobs != nil {
+		writeKey = stagingKey(meta)
+	}
+	n, err := writeEncoded(s.dataHandler, &meta, writeKey, sniffer)
 	if err != nil {
 		log.WithFields(log.Fields{
 			"context": "AssetStorage.Store()",
@@ -177,32 +480,187 @@ func (s *AssetStorage) Store(meta AssetMeta, token AssetToken, asset io.ReadClos
 			"token": token,
 			"meta": meta,
 		}).Error(err)
-		return
+		return meta, err
 	}
 	meta.Size = int(n)
+	meta.Checksum = hasher.Checksum()
+	//meta is updated before any rollback, so it releases a blob the data was promoted to
+	meta, err = s.commitStore(meta, token, &usage, sniffer.ContentType(), s.blobs != nil, &committed)
+	return meta, err
+}
+
+//commitStore checks written data, settling its usage up, then marks its meta ready and stores its token.  staged data
+//is promoted to its blob.  committed is set once the meta is stored, after which the store mustn't be rolled back.
+func (s *AssetStorage) commitStore(meta AssetMeta, token AssetToken, usage *Usage, sniffedType string, staged bool, committed *bool) (AssetMeta, error) {
+	n := int64(meta.Size)
+	err := s.addUsage(meta, Usage{Bytes: n - usage.Bytes})
+	if err != nil {
+		//the asset turned out bigger than declared, and doesn't fit
+		log.WithFields(log.Fields{
+			"context": "AssetStorage.commitStore()",
+			"usageTracker": s.usageTracker,
+			"meta": meta,
+		}).Error(err)
+		return meta, err
+	}
+	usage.Bytes = n
+	if meta.ContentType == "" {
+		meta.ContentType = sniffedType
+	}
+	if s.uploadValidator != nil {
+		err = s.uploadValidator.ValidateUpload(meta, sniffedType)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"context": "AssetStorage.commitStore()",
+				"uploadValidator": s.uploadValidator,
+				"meta": meta,
+			}).Warn(err)
+			return meta, err
+		}
+	}
+	if staged {
+		meta, err = s.promoteBlob(meta, stagingKey(meta))
+		if err != nil {
+			log.WithFields(log.Fields{
+				"context": "AssetStorage.commitStore()",
+				"blobs": s.blobs,
+				"meta": meta,
+			}).Error(err)
+			return meta, err
+		}
+	}
+	if s.scanner != nil {
+		meta.ScanStatus = ScanPending
+	}
+	meta.State = StateReady
 	err = s.metaHandler.StoreMeta(meta)
 	if err != nil {
 		log.WithFields(log.Fields{
-			"context": "AssetStorage.Store()",
+			"context": "AssetStorage.commitStore()",
 			"dataHandler": s.dataHandler,
 			"metaHandler": s.metaHandler,
 			"token": token,
 			"meta": meta,
 		}).Error(err)
-		return
+		return meta, err
 	}
+	*committed = true
+
 	if token.Valid() {
 		err = s.tokenHandler.StoreToken(token)
 		if err != nil {
 			log.WithFields(log.Fields{
-				"context":     "AssetStorage.Store()",
+				"context":     "AssetStorage.commitStore()",
 				"dataHandler": s.dataHandler,
 				"metaHandler": s.metaHandler,
 				"tokenHandler": s.tokenHandler,
 				"token":       token,
 				"meta":        meta,
 			}).Error(err)
+			return meta, fmt.Errorf("%w: %v", ErrTokenNotStored, err)
+		}
+	}
+	if s.scanner != nil {
+		if s.scanPolicy.Async {
+			go s.scan(meta)
+		} else if scanned, scanErr := s.scan(meta); scanErr == nil || errors.Is(scanErr, ErrAssetInfected) {
+			//scan failures other than infection leave the asset pending, it's stored either way
+			meta, err = scanned, scanErr
+		}
+	}
+	return meta, err
+}
+
+//rollbackStore removes everything a failed Store left behind.  Anything that can't be removed now is left
+//for the Reconciler.
+func (s *AssetStorage) rollbackStore(meta AssetMeta, usage Usage) {
+	s.deleteData(meta)
+	if s.blobs != nil || meta.ReservedUntil != 0 {
+		s.deleteKey(stagingKey(meta))
+	}
+	if meta.Resumable {
+		s.discardResumable(meta)
+	} else if meta.UploadID != "" {
+		s.abortUpload(meta)
+	}
+	if err := s.metaHandler.DeleteMeta(meta.Key()); err != nil {
+		log.WithFields(log.Fields{
+			"context": "AssetStorage.rollbackStore()",
+			"metaHandler": s.metaHandler,
+			"meta": meta,
+		}).Error(err)
+	}
+	s.removeUsage(meta, usage)
+}
+
+func (s *AssetStorage) GetToken(token string) (t AssetToken, err error) {
+	return s.tokenHandler.GetToken(token)
+}
+
+//RevokeToken revokes a token by its tenant scoped key, if the token handler supports revocation
+func (s *AssetStorage) RevokeToken(token string) (err error) {
+	revoker, ok := s.tokenHandler.(TokenRevoker)
+	if !ok {
+		return fmt.Errorf("tokens can't be revoked")
+	}
+	err = revoker.RevokeToken(token)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"context": "AssetStorage.RevokeToken()",
+			"tokenHandler": s.tokenHandler,
+			"token": token,
+		}).Error(err)
+	}
+	return
+}
+
+//Delete removes an asset's meta, then its data (or its reference to a shared blob), and releases the quota it used.
+//Its previous versions are deleted along with it.
+func (s *AssetStorage) Delete(id string) (err error) {
+	meta, err := s.metaHandler.GetMeta(id)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"context": "AssetStorage.Delete()",
+			"id": id,
+			"metaHandler": s.metaHandler,
+		}).Error(err)
+		return
+	}
+	err = s.metaHandler.DeleteMeta(meta.Key())
+	if err != nil {
+		log.WithFields(log.Fields{
+			"context": "AssetStorage.Delete()",
+			"metaHandler": s.metaHandler,
+			"meta": meta,
+		}).Error(err)
+		return
+	}
+	s.removeUsage(meta, Usage{Bytes: int64(meta.Size), Objects: 1})
+	s.deleteData(meta)
+	if meta.Version > 0 {
+		versions, _ := s.Versions(meta.Key())
+		for _, version := range versions {
+			s.DeleteVersion(version)
 		}
 	}
 	return
-}
\ No newline at end of file
+}
+
+//deleteData removes an asset's data, or its reference to the blob holding it
+func (s *AssetStorage) deleteData(meta AssetMeta) {
+	if meta.Blob != "" && s.blobs != nil {
+		s.releaseBlob(meta)
+		return
+	}
+	s.deleteKey(meta.DataKey())
+}
+
+func (s *AssetStorage) deleteKey(key string) {
+	if err := s.dataHandler.Delete(key); err != nil {
+		log.WithFields(log.Fields{
+			"context": "AssetStorage.deleteKey()",
+			"dataHandler": s.dataHandler,
+			"key": key,
+		}).Error(err)
+	}
+}
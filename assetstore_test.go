@@ -0,0 +1,485 @@
+package assetstore
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+//in memory stand ins for the dynamodb and s3 backends, so AssetStorage can be tested without aws
+
+type memMetaTokenStore struct {
+	mu       sync.Mutex
+	metas    map[string]AssetMeta
+	tokens   map[string]AssetToken
+	versions map[string][]AssetMeta
+}
+
+func newMemMetaTokenStore() *memMetaTokenStore {
+	return &memMetaTokenStore{
+		metas:    map[string]AssetMeta{},
+		tokens:   map[string]AssetToken{},
+		versions: map[string][]AssetMeta{},
+	}
+}
+
+func (s *memMetaTokenStore) GetMeta(id string) (meta AssetMeta, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	meta, ok := s.metas[id]
+	if !ok {
+		return meta, fmt.Errorf("%w: could not find result for asset with id %s", ErrNotFound, id)
+	}
+	return meta, nil
+}
+
+func (s *memMetaTokenStore) ListMeta(cursor string, limit int) (metas []AssetMeta, next string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, meta := range s.metas {
+		metas = append(metas, meta)
+	}
+	sort.Slice(metas, func(i, j int) bool { return metas[i].Key() < metas[j].Key() })
+	return pageMetas(metas, cursor, limit)
+}
+
+func (s *memMetaTokenStore) StoreMeta(meta AssetMeta) (err error) {
+	if !meta.Valid() {
+		return fmt.Errorf("meta invalid")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.metas[meta.Key()] = meta
+	return nil
+}
+
+func (s *memMetaTokenStore) DeleteMeta(id string) (err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.metas[id]; !ok {
+		return fmt.Errorf("could not find result for asset with id %s", id)
+	}
+	delete(s.metas, id)
+	return nil
+}
+
+func (s *memMetaTokenStore) UpdateMeta(id string, update MetaUpdate, revision int64) (meta AssetMeta, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	meta, ok := s.metas[id]
+	if !ok {
+		return meta, fmt.Errorf("%w: could not find result for asset with id %s", ErrNotFound, id)
+	}
+	if meta.Revision != revision {
+		return meta, fmt.Errorf("%w: %s", ErrRevisionMismatch, id)
+	}
+	meta = update.apply(meta)
+	meta.Revision++
+	s.metas[id] = meta
+	return meta, nil
+}
+
+func (s *memMetaTokenStore) SwapMeta(meta AssetMeta, revision int64) (err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	existing, ok := s.metas[meta.Key()]
+	if !ok {
+		return fmt.Errorf("%w: could not find result for asset with id %s", ErrNotFound, meta.Key())
+	}
+	if existing.Revision != revision {
+		return fmt.Errorf("%w: %s", ErrRevisionMismatch, meta.Key())
+	}
+	if existing.Version != meta.Version {
+		s.versions[meta.Key()] = append(s.versions[meta.Key()], existing)
+	}
+	s.metas[meta.Key()] = meta
+	return nil
+}
+
+func (s *memMetaTokenStore) GetVersion(id string, version int) (meta AssetMeta, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, meta := range s.versions[id] {
+		if meta.Version == version {
+			return meta, nil
+		}
+	}
+	return meta, fmt.Errorf("%w: could not find version %d of asset with id %s", ErrNotFound, version, id)
+}
+
+func (s *memMetaTokenStore) ListVersions(id string) (metas []AssetMeta, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append(metas, s.versions[id]...), nil
+}
+
+func (s *memMetaTokenStore) DeleteVersion(meta AssetMeta) (err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	kept := []AssetMeta{}
+	for _, version := range s.versions[meta.Key()] {
+		if version.Version != meta.Version {
+			kept = append(kept, version)
+		}
+	}
+	if len(kept) == len(s.versions[meta.Key()]) {
+		return fmt.Errorf("%w: could not find version %d of asset with id %s", ErrNotFound, meta.Version, meta.Key())
+	}
+	s.versions[meta.Key()] = kept
+	return nil
+}
+
+func (s *memMetaTokenStore) UpdateVersionKey(meta AssetMeta) (err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, version := range s.versions[meta.Key()] {
+		if version.Version == meta.Version {
+			s.versions[meta.Key()][i].KeyID, s.versions[meta.Key()][i].WrappedKey = meta.KeyID, meta.WrappedKey
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: could not find version %d of asset with id %s", ErrNotFound, meta.Version, meta.Key())
+}
+
+func (s *memMetaTokenStore) UpdateScanStatus(meta AssetMeta) (err error) {
+	return s.updateAtRevision(meta, func(existing *AssetMeta) { existing.ScanStatus = meta.ScanStatus })
+}
+
+func (s *memMetaTokenStore) UpdateState(meta AssetMeta) (err error) {
+	return s.updateAtRevision(meta, func(existing *AssetMeta) { existing.State = meta.State })
+}
+
+func (s *memMetaTokenStore) UpdateMetaKey(meta AssetMeta) (err error) {
+	return s.updateAtRevision(meta, func(existing *AssetMeta) {
+		existing.KeyID = meta.KeyID
+		existing.WrappedKey = meta.WrappedKey
+	})
+}
+
+//updateAtRevision updates stored meta, only if it's still at meta's revision
+func (s *memMetaTokenStore) updateAtRevision(meta AssetMeta, update func(existing *AssetMeta)) (err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	existing, ok := s.metas[meta.Key()]
+	if !ok {
+		return fmt.Errorf("%w: could not find result for asset with id %s", ErrNotFound, meta.Key())
+	}
+	if existing.Revision != meta.Revision {
+		return fmt.Errorf("%w: %s", ErrRevisionMismatch, meta.Key())
+	}
+	update(&existing)
+	s.metas[meta.Key()] = existing
+	return nil
+}
+
+func (s *memMetaTokenStore) RecordAccess(meta AssetMeta, at int64) (err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	existing, ok := s.metas[meta.Key()]
+	if !ok {
+		return fmt.Errorf("%w: could not find result for asset with id %s", ErrNotFound, meta.Key())
+	}
+	existing.Accessed = at
+	s.metas[meta.Key()] = existing
+	return nil
+}
+
+func (s *memMetaTokenStore) GetToken(token string) (t AssetToken, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.tokens[token]
+	if !ok {
+		return t, fmt.Errorf("%w: could not find result for token %s", ErrNotFound, token)
+	}
+	return t, nil
+}
+
+func (s *memMetaTokenStore) StoreToken(token AssetToken) (err error) {
+	if !token.Valid() {
+		return fmt.Errorf("token invalid")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tokens[token.Key()] = token
+	return nil
+}
+
+func (s *memMetaTokenStore) RevokeToken(token string) (err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.tokens[token]; !ok {
+		return fmt.Errorf("%w: could not find token %s", ErrNotFound, token)
+	}
+	delete(s.tokens, token)
+	return nil
+}
+
+type memDataStore struct {
+	mu       sync.Mutex
+	data     map[string][]byte
+	modified map[string]time.Time
+}
+
+func newMemDataStore() *memDataStore {
+	return &memDataStore{data: map[string][]byte{}, modified: map[string]time.Time{}}
+}
+
+func (s *memDataStore) Reader(id string) (reader io.ReadCloser, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, ok := s.data[id]
+	if !ok {
+		return ioutil.NopCloser(bytes.NewReader([]byte{})), fmt.Errorf("no such key %s", id)
+	}
+	return ioutil.NopCloser(bytes.NewReader(b)), nil
+}
+
+func (s *memDataStore) Writer(id string, reader io.ReadCloser) (n int64, err error) {
+	defer reader.Close()
+	if id == "" {
+		return 0, fmt.Errorf("zero-length id")
+	}
+	b, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return 0, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data[id] = b
+	s.modified[id] = time.Now()
+	return int64(len(b)), nil
+}
+
+func (s *memDataStore) Delete(id string) (err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.data, id)
+	delete(s.modified, id)
+	return nil
+}
+
+func (s *memDataStore) List(cursor string, limit int) (objects []DataObject, next string, err error) {
+	s.mu.Lock()
+	var keys []string
+	for key := range s.data {
+		keys = append(keys, key)
+	}
+	s.mu.Unlock()
+	sort.Strings(keys)
+	for _, key := range keys {
+		obj, _ := s.Stat(key)
+		objects = append(objects, obj)
+	}
+	start, end, next := pageBounds(keys, cursor, limit)
+	return objects[start:end], next, nil
+}
+
+func (s *memDataStore) Stat(id string) (obj DataObject, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, ok := s.data[id]
+	if !ok {
+		return obj, fmt.Errorf("%w: no object %s", ErrNotFound, id)
+	}
+	return DataObject{Key: id, Size: int64(len(b)), Modified: s.modified[id]}, nil
+}
+
+//pageBounds pages through sorted keys, with cursors that are the last key of the previous page, like dynamodb's
+//and s3's, so items removed while paging don't cause others to be skipped
+func pageBounds(keys []string, cursor string, limit int) (start, end int, next string) {
+	if cursor != "" {
+		start = sort.Search(len(keys), func(i int) bool { return keys[i] > cursor })
+	}
+	end = start + limit
+	if end > len(keys) {
+		end = len(keys)
+	}
+	if end < len(keys) {
+		next = keys[end-1]
+	}
+	return
+}
+
+func pageMetas(metas []AssetMeta, cursor string, limit int) (page []AssetMeta, next string, err error) {
+	var keys []string
+	for _, meta := range metas {
+		keys = append(keys, meta.Key())
+	}
+	start, end, next := pageBounds(keys, cursor, limit)
+	return metas[start:end], next, nil
+}
+
+func setupMemAssetStorage() (*AssetStorage, *memMetaTokenStore, *memDataStore) {
+	db := newMemMetaTokenStore()
+	data := newMemDataStore()
+	return NewAssetStorage(db, db, data), db, data
+}
+
+func readAll(t *testing.T, r io.ReadCloser) string {
+	defer r.Close()
+	b, err := ioutil.ReadAll(r)
+	assert.NoError(t, err)
+	return string(b)
+}
+
+func TestScopedKey(t *testing.T) {
+	tests := []struct {
+		name   string
+		tenant string
+		id     string
+		want   string
+	}{
+		{name: "default tenant", tenant: "", id: "abc", want: "abc"},
+		{name: "tenant", tenant: "team-a", id: "abc", want: "team-a/abc"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key := ScopedKey(tt.tenant, tt.id)
+			assert.Equal(t, tt.want, key)
+			tenant, id := SplitScopedKey(key)
+			assert.Equal(t, tt.tenant, tenant)
+			assert.Equal(t, tt.id, id)
+		})
+	}
+	assert.False(t, ValidTenant("a/b"))
+	assert.False(t, AssetMeta{ID: "x/y", Name: "n"}.Valid())
+}
+
+func TestAssetStorage_TenantIsolation(t *testing.T) {
+	s, _, data := setupMemAssetStorage()
+
+	meta := AssetMeta{ID: uuid.New().String(), Tenant: "team-a", Name: "a.txt"}
+	token := AssetToken{Token: uuid.New().String(), AssetID: meta.ID, Expiry: time.Now().Add(time.Minute).Unix()}
+	_, err := s.Store(meta, token, ioutil.NopCloser(bytes.NewReader([]byte("tenant a data"))))
+	assert.NoError(t, err)
+	assert.Contains(t, data.data, "team-a/"+meta.ID)
+
+	got, asset, err := s.GetByID(ScopedKey("team-a", meta.ID))
+	assert.NoError(t, err)
+	assert.Equal(t, "team-a", got.Tenant)
+	assert.Equal(t, "tenant a data", readAll(t, asset))
+
+	_, asset, err = s.GetByToken(ScopedKey("team-a", token.Token))
+	assert.NoError(t, err)
+	assert.Equal(t, "tenant a data", readAll(t, asset))
+
+	//neither the id nor the token resolve from another tenant, or the default tenant
+	for _, tenant := range []string{"team-b", ""} {
+		_, _, err = s.GetByID(ScopedKey(tenant, meta.ID))
+		assert.Error(t, err)
+		_, _, err = s.GetByToken(ScopedKey(tenant, token.Token))
+		assert.Error(t, err)
+	}
+}
+
+//flakyMetaTokenStore fails storing ready meta or tokens on demand
+type flakyMetaTokenStore struct {
+	*memMetaTokenStore
+	failMeta  bool
+	failToken bool
+}
+
+func (s *flakyMetaTokenStore) StoreMeta(meta AssetMeta) (err error) {
+	if s.failMeta && meta.State == StateReady {
+		return fmt.Errorf("meta store unavailable")
+	}
+	return s.memMetaTokenStore.StoreMeta(meta)
+}
+
+func (s *flakyMetaTokenStore) StoreToken(token AssetToken) (err error) {
+	if s.failToken {
+		return fmt.Errorf("token store unavailable")
+	}
+	return s.memMetaTokenStore.StoreToken(token)
+}
+
+func TestAssetStorage_StoreTransactional(t *testing.T) {
+	db := &flakyMetaTokenStore{memMetaTokenStore: newMemMetaTokenStore()}
+	data := newMemDataStore()
+	s := NewAssetStorage(db, db, data)
+	token := func(meta AssetMeta) AssetToken {
+		return AssetToken{Token: uuid.New().String(), AssetID: meta.ID, Expiry: time.Now().Add(time.Minute).Unix()}
+	}
+
+	//failing to commit the meta removes the data and pending marker
+	db.failMeta = true
+	meta := AssetMeta{ID: uuid.New().String(), Name: "a.txt"}
+	_, err := s.Store(meta, token(meta), ioutil.NopCloser(bytes.NewReader([]byte("data"))))
+	assert.Error(t, err)
+	assert.Empty(t, data.data)
+	assert.Empty(t, db.metas)
+
+	//failing to store the token still returns the asset, which exists
+	db.failMeta, db.failToken = false, true
+	meta = AssetMeta{ID: uuid.New().String(), Name: "b.txt"}
+	stored, err := s.Store(meta, token(meta), ioutil.NopCloser(bytes.NewReader([]byte("data"))))
+	assert.True(t, errors.Is(err, ErrTokenNotStored))
+	assert.Equal(t, 4, stored.Size)
+	_, asset, err := s.GetByID(meta.Key())
+	assert.NoError(t, err)
+	assert.Equal(t, "data", readAll(t, asset))
+}
+
+func TestReconciler_Reconcile(t *testing.T) {
+	s, db, data := setupMemAssetStorage()
+	old := time.Now().Add(-48 * time.Hour)
+
+	ok := AssetMeta{ID: uuid.New().String(), Name: "ok.txt"}
+	_, err := s.Store(ok, AssetToken{}, ioutil.NopCloser(bytes.NewReader([]byte("ok"))))
+	assert.NoError(t, err)
+
+	//an upload that died part way, long ago, and one still in progress
+	stale := AssetMeta{ID: uuid.New().String(), Name: "stale.txt", State: StateUploading, Created: old.Unix()}
+	db.StoreMeta(stale)
+	data.Writer(stale.Key(), ioutil.NopCloser(bytes.NewReader([]byte("part"))))
+	inProgress := AssetMeta{ID: uuid.New().String(), Name: "new.txt", State: StateUploading, Created: time.Now().Unix()}
+	db.StoreMeta(inProgress)
+
+	//meta whose data was deleted outside the api
+	noData := AssetMeta{ID: uuid.New().String(), Name: "gone.txt", State: StateReady}
+	db.StoreMeta(noData)
+
+	//data with no meta, plus internal data that isn't an asset's
+	data.Writer("orphan", ioutil.NopCloser(bytes.NewReader([]byte("orphan"))))
+	data.Writer(".tmp/upload", ioutil.NopCloser(bytes.NewReader([]byte("temp"))))
+	data.modified["orphan"] = old
+	data.modified[".tmp/upload"] = old
+
+	//a replaced asset's data, its previous version's, and replacement data that was never swapped in
+	kept, err := s.Replace(ok.Key(), 0, ioutil.NopCloser(bytes.NewReader([]byte("ok again"))))
+	assert.NoError(t, err)
+	replaced, err := s.Replace(ok.Key(), 1, ioutil.NopCloser(bytes.NewReader([]byte("ok once more"))))
+	assert.NoError(t, err)
+	abandoned := replacementKey(AssetMeta{ID: ok.ID, DataID: uuid.New().String()})
+	data.Writer(abandoned, ioutil.NopCloser(bytes.NewReader([]byte("abandoned"))))
+	data.modified[kept.DataKey()] = old
+	data.modified[replaced.DataKey()] = old
+	data.modified[abandoned] = old
+
+	r := NewReconciler(s, db, data)
+	r.PageSize = 2
+	report, err := r.Reconcile()
+	assert.NoError(t, err)
+	assert.Equal(t, ReconcileReport{StaleUploads: 1, OrphanedMeta: 1, OrphanedData: 2}, report)
+
+	assert.Contains(t, db.metas, ok.Key())
+	assert.Contains(t, db.metas, inProgress.Key())
+	assert.NotContains(t, db.metas, stale.Key())
+	assert.NotContains(t, db.metas, noData.Key())
+	assert.Contains(t, data.data, replaced.DataKey())
+	assert.Contains(t, data.data, kept.DataKey())
+	assert.Contains(t, data.data, ok.Key())
+	assert.NotContains(t, data.data, abandoned)
+	assert.Contains(t, data.data, ".tmp/upload")
+	assert.NotContains(t, data.data, stale.Key())
+	assert.NotContains(t, data.data, "orphan")
+}
@@ -0,0 +1,121 @@
+package assetstore
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+//Api callers are identified by an api key, which maps to a principal.  Callers without a key are anonymous,
+//and may only pick a tenant via the path.
+
+const (
+	principalContextKey = "principal"
+	tenantContextKey    = "tenant"
+)
+
+//Principal is an authenticated api caller
+type Principal struct {
+	//Tenant the caller is bound to
+	Tenant string `json:"tenant"`
+	//User (or service) the caller acts as
+	User string `json:"user"`
+	//Largest upload the caller may make, 0 for the global limit only
+	MaxUploadBytes int64 `json:"max_upload_bytes,omitempty"`
+}
+
+//apiKeys maps api keys to the principals they authenticate
+var apiKeys map[string]Principal
+
+//WithAPIKeys enables api key authentication via the x-api-key or "authorization: Bearer" headers
+func WithAPIKeys(keys map[string]Principal) APIOption {
+	return func() {
+		apiKeys = keys
+	}
+}
+
+//ParseAPIKeys parses keys in the form "key:tenant:user[:max_upload_bytes],key2:tenant2:user2"
+func ParseAPIKeys(s string) (map[string]Principal, error) {
+	keys := map[string]Principal{}
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.Split(entry, ":")
+		if len(parts) < 3 || len(parts) > 4 || parts[0] == "" {
+			return nil, fmt.Errorf("api key entry %q is not in the form key:tenant:user[:max_upload_bytes]", entry)
+		}
+		if !ValidTenant(parts[1]) {
+			return nil, fmt.Errorf("api key entry %q has an invalid tenant", entry)
+		}
+		p := Principal{Tenant: parts[1], User: parts[2]}
+		if len(parts) == 4 {
+			max, err := strconv.ParseInt(parts[3], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("api key entry %q has an invalid max upload size", entry)
+			}
+			p.MaxUploadBytes = max
+		}
+		keys[parts[0]] = p
+	}
+	return keys, nil
+}
+
+//authenticate sets the principal for requests carrying a known api key, and rejects unknown keys
+func authenticate(c *gin.Context) {
+	key := c.GetHeader("x-api-key")
+	if auth := c.GetHeader("authorization"); key == "" && strings.HasPrefix(auth, "Bearer ") {
+		key = strings.TrimPrefix(auth, "Bearer ")
+	}
+	if key == "" {
+		return
+	}
+	p, ok := apiKeys[key]
+	if !ok {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, "unknown api key")
+		return
+	}
+	c.Set(principalContextKey, p)
+}
+
+//resolveTenant works out which tenant a request is scoped to.  A principal's tenant always wins, and a
+//path tenant that disagrees with it is refused, so callers can never reach into another tenant.
+func resolveTenant(c *gin.Context) {
+	tenant := c.Param("tenant")
+	if !ValidTenant(tenant) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, "invalid tenant")
+		return
+	}
+	if p, ok := requestPrincipal(c); ok && p.Tenant != "" {
+		if tenant != "" && tenant != p.Tenant {
+			c.AbortWithStatusJSON(http.StatusForbidden, "api key is not valid for tenant "+tenant)
+			return
+		}
+		tenant = p.Tenant
+	}
+	c.Set(tenantContextKey, tenant)
+}
+
+//requestPrincipal is the authenticated caller, if any
+func requestPrincipal(c *gin.Context) (p Principal, ok bool) {
+	v, exists := c.Get(principalContextKey)
+	if !exists {
+		return p, false
+	}
+	p, ok = v.(Principal)
+	return
+}
+
+//requestTenant is the tenant the request was resolved to
+func requestTenant(c *gin.Context) string {
+	return c.GetString(tenantContextKey)
+}
+
+//scopedParam is the named path param scoped to the request's tenant
+func scopedParam(c *gin.Context, name string) string {
+	return ScopedKey(requestTenant(c), c.Param(name))
+}
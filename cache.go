@@ -0,0 +1,326 @@
+package assetstore
+
+import (
+	"container/list"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+//DiskCache is a read-through cache of data in a directory on local disk, bounded in size by evicting the least
+//recently read data.  A miss is fetched from the wrapped handler once, however many readers want it at the same
+//time: they all stream it from the cache file as it fills.  Data is invalidated when it's written, copied over, or
+//deleted through the cache.  Wrap it in any encrypting handler, so cached data is encrypted too.
+type DiskCache struct {
+	dataHandlerDecorator
+	dir string
+	//MaxBytes bounds the total size of cached data
+	MaxBytes int64
+
+	mu sync.Mutex
+	entries map[string]*list.Element
+	//least recently read at the back
+	lru *list.List
+	size int64
+	fills map[string]*cacheFill
+}
+
+type cacheEntry struct {
+	key string
+	size int64
+}
+
+//fillPrefix starts the names of files still being filled
+const fillPrefix = ".fill-"
+
+//NewDiskCache caches data in dir, keeping any data already cached there
+func NewDiskCache(dataHandler AssetDataHandler, dir string, maxBytes int64) (*DiskCache, error) {
+	c := &DiskCache{
+		dataHandlerDecorator: dataHandlerDecorator{dataHandler},
+		dir: dir,
+		MaxBytes: maxBytes,
+		entries: map[string]*list.Element{},
+		lru: list.New(),
+		fills: map[string]*cacheFill{},
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	//the most recently modified are treated as the most recently read
+	sort.Slice(files, func(i, j int) bool { return files[i].ModTime().After(files[j].ModTime()) })
+	for _, f := range files {
+		key, err := url.PathUnescape(f.Name())
+		if f.IsDir() || strings.HasPrefix(f.Name(), fillPrefix) || err != nil {
+			os.RemoveAll(filepath.Join(dir, f.Name()))
+			continue
+		}
+		c.entries[key] = c.lru.PushBack(&cacheEntry{key: key, size: f.Size()})
+		c.size += f.Size()
+	}
+	c.mu.Lock()
+	c.evict()
+	c.mu.Unlock()
+	return c, nil
+}
+
+func (c *DiskCache) path(key string) string {
+	return filepath.Join(c.dir, url.PathEscape(key))
+}
+
+func (c *DiskCache) Reader(key string) (reader io.ReadCloser, err error) {
+	c.mu.Lock()
+	if el, ok := c.entries[key]; ok {
+		c.lru.MoveToFront(el)
+		c.mu.Unlock()
+		if f, err := os.Open(c.path(key)); err == nil {
+			return f, nil
+		}
+		//the file's gone from under us, so forget it and fetch it again
+		c.Invalidate(key)
+		c.mu.Lock()
+	}
+	fill, ok := c.fills[key]
+	if !ok {
+		fill = c.startFill(key)
+	}
+	fill.acquire()
+	c.mu.Unlock()
+	<-fill.ready
+	if fill.openErr != nil {
+		fill.release()
+		return nil, fill.openErr
+	}
+	return &cacheFillReader{fill: fill}, nil
+}
+
+func (c *DiskCache) Writer(key string, reader io.ReadCloser) (n int64, err error) {
+	c.Invalidate(key)
+	n, err = c.AssetDataHandler.Writer(key, reader)
+	//in case it was read while it was being written
+	c.Invalidate(key)
+	return
+}
+
+func (c *DiskCache) Delete(key string) (err error) {
+	c.Invalidate(key)
+	return c.AssetDataHandler.Delete(key)
+}
+
+func (c *DiskCache) Copy(from, to string) (err error) {
+	c.Invalidate(to)
+	err = c.dataHandlerDecorator.Copy(from, to)
+	c.Invalidate(to)
+	return
+}
+
+//Invalidate drops any cached data for a key, e.g. after it's changed somewhere other than through the cache
+func (c *DiskCache) Invalidate(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[key]; ok {
+		c.remove(el)
+	}
+	if fill, ok := c.fills[key]; ok {
+		//readers already streaming it carry on, but it won't be cached
+		fill.stale = true
+		delete(c.fills, key)
+	}
+}
+
+//remove drops a cache entry, with mu held
+func (c *DiskCache) remove(el *list.Element) {
+	entry := c.lru.Remove(el).(*cacheEntry)
+	delete(c.entries, entry.key)
+	c.size -= entry.size
+	if err := os.Remove(c.path(entry.key)); err != nil && !os.IsNotExist(err) {
+		log.WithFields(log.Fields{
+			"context": "DiskCache.remove()",
+			"key": entry.key,
+		}).Error(err)
+	}
+}
+
+//evict removes the least recently read data until the cache fits, with mu held
+func (c *DiskCache) evict() {
+	for c.size > c.MaxBytes && c.lru.Len() > 0 {
+		c.remove(c.lru.Back())
+	}
+}
+
+//cacheFill is data being fetched into the cache, which readers can stream as it arrives
+type cacheFill struct {
+	//the file being filled, shared by its readers, which read it at their own offsets
+	file *os.File
+	//closed once the fetch has started, or failed to
+	ready chan struct{}
+	openErr error
+
+	mu sync.Mutex
+	cond *sync.Cond
+	written int64
+	done bool
+	err error
+	//the filler and readers using file, which is closed once they're all done
+	refs int
+	//set, with the cache's mu held, when the key's invalidated during the fill
+	stale bool
+}
+
+func (f *cacheFill) acquire() {
+	f.mu.Lock()
+	f.refs++
+	f.mu.Unlock()
+}
+
+func (f *cacheFill) release() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.refs--
+	if f.refs == 0 && f.file != nil {
+		f.file.Close()
+	}
+}
+
+//startFill starts fetching a key into the cache, with mu held
+func (c *DiskCache) startFill(key string) *cacheFill {
+	fill := &cacheFill{ready: make(chan struct{}), refs: 1}
+	fill.cond = sync.NewCond(&fill.mu)
+	c.fills[key] = fill
+	go c.runFill(key, fill)
+	return fill
+}
+
+func (c *DiskCache) runFill(key string, fill *cacheFill) {
+	defer fill.release()
+	file, err := ioutil.TempFile(c.dir, fillPrefix)
+	var source io.ReadCloser
+	if err == nil {
+		source, err = c.AssetDataHandler.Reader(key)
+		if err != nil {
+			file.Close()
+			os.Remove(file.Name())
+		}
+	}
+	if err != nil {
+		fill.openErr = err
+		c.mu.Lock()
+		if c.fills[key] == fill {
+			delete(c.fills, key)
+		}
+		c.mu.Unlock()
+		close(fill.ready)
+		return
+	}
+	fill.file = file
+	close(fill.ready)
+	defer source.Close()
+
+	buf := make([]byte, 64*1024)
+	for {
+		n, readErr := source.Read(buf)
+		if n > 0 {
+			if _, err = file.Write(buf[:n]); err != nil {
+				break
+			}
+			fill.mu.Lock()
+			fill.written += int64(n)
+			fill.cond.Broadcast()
+			fill.mu.Unlock()
+		}
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			err = readErr
+			break
+		}
+	}
+	c.finishFill(key, fill, err)
+}
+
+//finishFill caches a completed fill, unless it failed or was invalidated, and wakes its readers
+func (c *DiskCache) finishFill(key string, fill *cacheFill, err error) {
+	c.mu.Lock()
+	if c.fills[key] == fill {
+		delete(c.fills, key)
+	}
+	cached := false
+	var cacheErr error
+	if err == nil && !fill.stale && fill.written <= c.MaxBytes {
+		if cacheErr = os.Rename(fill.file.Name(), c.path(key)); cacheErr == nil {
+			c.entries[key] = c.lru.PushFront(&cacheEntry{key: key, size: fill.written})
+			c.size += fill.written
+			c.evict()
+			cached = true
+		}
+	}
+	c.mu.Unlock()
+	if !cached {
+		//readers already have it open, so can still finish reading it
+		os.Remove(fill.file.Name())
+	}
+	if err != nil || cacheErr != nil {
+		log.WithFields(log.Fields{
+			"context": "DiskCache.finishFill()",
+			"key": key,
+			"cacheErr": cacheErr,
+		}).Error(err)
+	}
+	fill.mu.Lock()
+	fill.done = true
+	fill.err = err
+	fill.cond.Broadcast()
+	fill.mu.Unlock()
+}
+
+//cacheFillReader reads a fill's file as it's written
+type cacheFillReader struct {
+	fill *cacheFill
+	offset int64
+	closed bool
+}
+
+func (r *cacheFillReader) Read(p []byte) (n int, err error) {
+	f := r.fill
+	f.mu.Lock()
+	for r.offset >= f.written && !f.done {
+		f.cond.Wait()
+	}
+	available := f.written - r.offset
+	done, fillErr := f.done, f.err
+	f.mu.Unlock()
+	if available <= 0 {
+		if fillErr != nil && done {
+			return 0, fillErr
+		}
+		return 0, io.EOF
+	}
+	if int64(len(p)) > available {
+		p = p[:available]
+	}
+	n, err = f.file.ReadAt(p, r.offset)
+	r.offset += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return
+}
+
+func (r *cacheFillReader) Close() error {
+	if !r.closed {
+		r.closed = true
+		r.fill.release()
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+package assetstore
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+//countingDataStore counts backend reads, and can hold them up until released
+type countingDataStore struct {
+	*memDataStore
+	mu    sync.Mutex
+	reads int
+	gate  chan struct{}
+}
+
+func (s *countingDataStore) Reader(id string) (reader io.ReadCloser, err error) {
+	s.mu.Lock()
+	s.reads++
+	gate := s.gate
+	s.mu.Unlock()
+	reader, err = s.memDataStore.Reader(id)
+	if err != nil || gate == nil {
+		return
+	}
+	return &gatedReader{ReadCloser: reader, gate: gate}, nil
+}
+
+func (s *countingDataStore) readCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.reads
+}
+
+type gatedReader struct {
+	io.ReadCloser
+	gate chan struct{}
+}
+
+func (r *gatedReader) Read(p []byte) (n int, err error) {
+	<-r.gate
+	return r.ReadCloser.Read(p)
+}
+
+func TestDiskCache(t *testing.T) {
+	dir := t.TempDir()
+	data := &countingDataStore{memDataStore: newMemDataStore()}
+	cache, err := NewDiskCache(data, dir, 10)
+	assert.NoError(t, err)
+	write := func(key, content string) {
+		_, err := cache.Writer(key, ioutil.NopCloser(bytes.NewReader([]byte(content))))
+		assert.NoError(t, err)
+	}
+	read := func(key string) string {
+		reader, err := cache.Reader(key)
+		if !assert.NoError(t, err) {
+			return ""
+		}
+		return readAll(t, reader)
+	}
+
+	//misses are fetched once, then served from disk
+	write("a", "aaaaaa")
+	assert.Equal(t, "aaaaaa", read("a"))
+	assert.Equal(t, "aaaaaa", read("a"))
+	assert.Equal(t, 1, data.readCount())
+
+	//concurrent misses share one fetch, streamed to all of them as it arrives
+	write("b", "bbbbbb")
+	data.gate = make(chan struct{})
+	var wg sync.WaitGroup
+	results := make([]string, 5)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i] = read("b")
+		}(i)
+	}
+	close(data.gate)
+	wg.Wait()
+	data.gate = nil
+	assert.Equal(t, []string{"bbbbbb", "bbbbbb", "bbbbbb", "bbbbbb", "bbbbbb"}, results)
+	assert.Equal(t, 2, data.readCount())
+
+	//caching b pushed the least recently read, a, out
+	assert.Equal(t, "aaaaaa", read("a"))
+	assert.Equal(t, 3, data.readCount())
+
+	//writes and deletes invalidate
+	write("a", "new")
+	assert.Equal(t, "new", read("a"))
+	assert.Equal(t, 4, data.readCount())
+	assert.NoError(t, cache.Delete("a"))
+	_, err = cache.Reader("a")
+	assert.Error(t, err)
+
+	//data too big to cache is still read
+	write("big", "0123456789abcdef")
+	assert.Equal(t, "0123456789abcdef", read("big"))
+	assert.Equal(t, "0123456789abcdef", read("big"))
+
+	//cached data survives restarts
+	assert.Equal(t, "bbbbbb", read("b"))
+	reads := data.readCount()
+	cache, err = NewDiskCache(data, dir, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, "bbbbbb", read("b"))
+	assert.Equal(t, reads, data.readCount())
+}
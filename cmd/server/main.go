@@ -1,8 +1,11 @@
 package main
 
 import (
+	"encoding/json"
+	"fmt"
 	"os"
 	"strconv"
+	"time"
 
 	"assetstore"
 	"github.com/aws/aws-sdk-go/aws/session"
@@ -21,19 +24,288 @@ func main() {
 	}))
 
 	dnm := assetstore.NewDynamoDBMetaTokenStore(os.Getenv("DYNAMODB_TABLE"), sess)
+	s3Storage := assetstore.NewS3Storage(os.Getenv("S3_BUCKET"), sess)
+
+	//usage is always tracked, quotas are unlimited unless configured
+	quotas := assetstore.QuotaLimits{
+		Tenant: assetstore.Quota{
+			MaxBytes:   envInt64("TENANT_QUOTA_BYTES"),
+			MaxObjects: envInt64("TENANT_QUOTA_OBJECTS"),
+		},
+		Owner: assetstore.Quota{
+			MaxBytes:   envInt64("USER_QUOTA_BYTES"),
+			MaxObjects: envInt64("USER_QUOTA_OBJECTS"),
+		},
+	}
+
+	storageOpts := []assetstore.AssetStorageOption{
+		assetstore.WithQuotas(dnm, quotas),
+		assetstore.WithArchiveTokens(dnm),
+		assetstore.WithCollectionStore(dnm),
+		assetstore.WithAliasStore(dnm),
+	}
+
+	//optional content type allow/deny policies, by tenant or api key user
+	if file := os.Getenv("CONTENT_POLICY_FILE"); file != "" {
+		policies, err := assetstore.LoadContentPolicies(file)
+		if err != nil {
+			panic("CONTENT_POLICY_FILE could not be loaded: " + err.Error())
+		}
+		storageOpts = append(storageOpts, assetstore.WithUploadValidator(policies))
+	}
+
+	//optional lifecycle policies, deleting assets by age or idleness, and old versions, by tenant
+	if file := os.Getenv("LIFECYCLE_POLICY_FILE"); file != "" {
+		policies, err := assetstore.LoadLifecyclePolicies(file)
+		if err != nil {
+			panic("LIFECYCLE_POLICY_FILE could not be loaded: " + err.Error())
+		}
+		storageOpts = append(storageOpts, assetstore.WithLifecyclePolicies(policies))
+	}
+
+	//optional malware scanning via clamd, e.g. CLAMD_ADDRESS=unix:///var/run/clamd.ctl
+	if addr := os.Getenv("CLAMD_ADDRESS"); addr != "" {
+		scanner, err := assetstore.NewClamdScanner(addr)
+		if err != nil {
+			panic("CLAMD_ADDRESS env var was not correctly defined: " + err.Error())
+		}
+		storageOpts = append(storageOpts, assetstore.WithScanner(scanner, assetstore.ScanPolicy{
+			Async:        os.Getenv("SCAN_ASYNC") == "1",
+			AllowPending: os.Getenv("SCAN_ALLOW_PENDING") == "1",
+		}))
+	}
+
+	//optionally store identical uploads once, as reference counted blobs
+	if os.Getenv("DEDUP") == "1" {
+		storageOpts = append(storageOpts, assetstore.WithDedup(dnm))
+	}
+
+	//optionally accept resumable tus uploads under /files, e.g. TUS_UPLOAD_TTL=24h, appended to s3 multipart uploads,
+	//or to files in TUS_DIR, which needs each upload routed to the same server
+	if ttl := envDuration("TUS_UPLOAD_TTL"); ttl > 0 {
+		var appender assetstore.ChunkAppender = s3Storage
+		if dir := os.Getenv("TUS_DIR"); dir != "" {
+			var err error
+			appender, err = assetstore.NewFileChunkAppender(dir)
+			if err != nil {
+				panic("TUS_DIR could not be used: " + err.Error())
+			}
+		}
+		storageOpts = append(storageOpts, assetstore.WithChunkAppender(appender, ttl))
+	}
+
+	//optionally cache hot data on local disk, e.g. CACHE_DIR=/var/cache/assetstore CACHE_MAX_BYTES=10737418240
+	var dataHandler assetstore.AssetDataHandler = s3Storage
+	if dir := os.Getenv("CACHE_DIR"); dir != "" {
+		maxBytes := envInt64("CACHE_MAX_BYTES")
+		if maxBytes == 0 {
+			maxBytes = 1 << 30
+		}
+		cache, err := assetstore.NewDiskCache(s3Storage, dir, maxBytes)
+		if err != nil {
+			panic("CACHE_DIR could not be used: " + err.Error())
+		}
+		dataHandler = cache
+	}
+
+	//optionally encrypt data with per asset keys, wrapped with master keys from ENCRYPTION_KEY_FILE
+	var keys assetstore.KeyProvider
+	if file := os.Getenv("ENCRYPTION_KEY_FILE"); file != "" {
+		var err error
+		keys, err = assetstore.LoadLocalKeyProvider(file)
+		if err != nil {
+			panic("ENCRYPTION_KEY_FILE could not be loaded: " + err.Error())
+		}
+	}
+
+	//optionally gzip data (before it's encrypted), except for already compressed content types
+	compress := os.Getenv("COMPRESS") == "1"
+
+	//encode wraps a data handler in the encryption and compression data's stored with
+	encode := func(h assetstore.AssetDataHandler) assetstore.AssetDataHandler {
+		if keys != nil {
+			h = assetstore.NewEncryptingDataHandler(h, keys)
+		}
+		if compress {
+			h = assetstore.NewCompressingDataHandler(h)
+		}
+		return h
+	}
+	dataHandler = encode(dataHandler)
 
 	//AssetStorage implements all the required interfaces required in one abstraction
+	//optionally cache meta and token lookups in process, for up to META_CACHE_TTL (default 1m), which bounds how
+	//long changes made by other servers (e.g. token revocations) take to be seen
+	var metaHandler assetstore.AssetMetaHandler = dnm
+	var tokenHandler assetstore.AssetTokenHandler = dnm
+	if entries := envInt64("META_CACHE_ENTRIES"); entries > 0 {
+		cache := assetstore.NewMetaTokenCache(dnm, dnm, int(entries))
+		if ttl := envDuration("META_CACHE_TTL"); ttl > 0 {
+			cache.TTL = ttl
+			if ttl < cache.NegativeTTL {
+				cache.NegativeTTL = ttl
+			}
+		}
+		metaHandler, tokenHandler = cache, cache
+	}
+
 	assetStorage := assetstore.NewAssetStorage(
-		dnm,
-		dnm,
-		assetstore.NewS3Storage(os.Getenv("S3_BUCKET"), sess),
+		metaHandler,
+		tokenHandler,
+		dataHandler,
+		storageOpts...,
 	)
 
+	//the scrubber reads data straight from s3, not through the disk cache
+	scrubber := assetstore.NewScrubber(assetStorage, dnm, dnm, encode(s3Storage))
+	scrubber.BytesPerSecond = envInt64("SCRUB_BYTES_PER_SECOND")
+
+	//"main scrub" makes one integrity scrubbing pass (resuming any unfinished one) and exits
+	if len(os.Args) > 1 && os.Args[1] == "scrub" {
+		report, err := scrubber.Scrub(nil)
+		out, _ := json.MarshalIndent(report, "", "  ")
+		fmt.Println(string(out))
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	//"main rotate-keys" re-wraps every asset's data key with the current master key and exits
+	if len(os.Args) > 1 && os.Args[1] == "rotate-keys" {
+		if keys == nil {
+			log.Fatal("ENCRYPTION_KEY_FILE env var is not defined")
+		}
+		report, err := assetstore.NewKeyRotator(assetStorage, dnm, keys).Rotate()
+		out, _ := json.MarshalIndent(report, "", "  ")
+		fmt.Println(string(out))
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	//optionally clean up after failed or abandoned uploads in the background, e.g. RECONCILE_INTERVAL=1h
+	if d := envDuration("RECONCILE_INTERVAL"); d > 0 {
+		reconciler := assetstore.NewReconciler(assetStorage, dnm, s3Storage)
+		go reconciler.Run(d, make(chan struct{}))
+	}
+
+	//optionally delete expired assets, and apply lifecycle policies, in the background, e.g. LIFECYCLE_INTERVAL=1h
+	lifecycleWorker := assetstore.NewLifecycleWorker(assetStorage, dnm)
+	if d := envDuration("LIFECYCLE_INTERVAL"); d > 0 {
+		go lifecycleWorker.Run(d, make(chan struct{}))
+	}
+
+	//optionally scrub continuously in the background, pausing SCRUB_INTERVAL between passes
+	if d := envDuration("SCRUB_INTERVAL"); d > 0 {
+		go scrubber.Run(d, make(chan struct{}))
+	}
+
 	port, err := strconv.Atoi(os.Getenv("PORT"))
 	if err != nil {
 		panic("PORT env var was not correctly defined")
 	}
 
+	//optional api keys, each bound to a tenant and user
+	apiKeys, err := assetstore.ParseAPIKeys(os.Getenv("API_KEYS"))
+	if err != nil {
+		panic("API_KEYS env var was not correctly defined: " + err.Error())
+	}
+
+	//optionally redirect downloads to presigned s3 urls, e.g. PRESIGNED_URL_TTL=5m, instead of streaming them
+	var presigner assetstore.SignedURLRetriever
+	if envDuration("PRESIGNED_URL_TTL") > 0 {
+		presigner = assetStorage
+	}
+
+	//optionally let clients upload straight to s3, e.g. DIRECT_UPLOAD_TTL=1h, with reservations that expire after it
+	var directUploader assetstore.DirectUploader
+	if envDuration("DIRECT_UPLOAD_TTL") > 0 {
+		directUploader = assetStorage
+	}
+
+	//optionally accept multipart uploads, with parts uploaded in parallel, e.g. MULTIPART_UPLOAD_TTL=24h, which are
+	//written straight to s3 multipart uploads
+	var multipartUploader assetstore.MultipartUploader
+	if envDuration("MULTIPART_UPLOAD_TTL") > 0 {
+		multipartUploader = assetStorage
+	}
+
+	//serve tus uploads, if TUS_UPLOAD_TTL enabled them above
+	var resumableUploader assetstore.ResumableUploader
+	if envDuration("TUS_UPLOAD_TTL") > 0 {
+		resumableUploader = assetStorage
+	}
+
+	//optionally make shorter asset and collection ids, and tokens, than uuids, e.g. ID_FORMAT=base58 ID_LENGTH=10, or
+	//TOKEN_FORMAT=words TOKEN_LENGTH=2 for share codes like brave-otter-42, claimed in dynamodb so they're unique
+	ids, err := assetstore.NewIDGenerator(os.Getenv("ID_FORMAT"), int(envInt64("ID_LENGTH")), dnm)
+	if err != nil {
+		panic("ID_FORMAT env var was not correctly defined: " + err.Error())
+	}
+	tokens, err := assetstore.NewIDGenerator(os.Getenv("TOKEN_FORMAT"), int(envInt64("TOKEN_LENGTH")), dnm)
+	if err != nil {
+		panic("TOKEN_FORMAT env var was not correctly defined: " + err.Error())
+	}
+
+	apiOpts := []assetstore.APIOption{
+		assetstore.WithAPIKeys(apiKeys),
+		assetstore.WithUploadLimit(envInt64("MAX_UPLOAD_BYTES")),
+		assetstore.WithUsageReporter(assetStorage),
+		assetstore.WithTokenRevoker(assetStorage, assetStorage),
+		assetstore.WithPresignedRedirects(presigner, envDuration("PRESIGNED_URL_TTL")),
+		assetstore.WithDirectUploads(directUploader, envDuration("DIRECT_UPLOAD_TTL")),
+		assetstore.WithMultipartUploads(multipartUploader, envDuration("MULTIPART_UPLOAD_TTL")),
+		assetstore.WithTusUploads(resumableUploader),
+		assetstore.WithArchives(assetStorage),
+		assetstore.WithCollections(assetStorage),
+		assetstore.WithAliases(assetStorage),
+		assetstore.WithLifecycleReports(lifecycleWorker),
+		assetstore.WithIDGenerators(ids, tokens),
+	}
+
+	//optionally let api key holders delete assets, with DELETE /asset/:id
+	if os.Getenv("ALLOW_DELETE") == "1" {
+		apiOpts = append(apiOpts, assetstore.WithAssetDeleter(assetStorage, assetStorage))
+	}
+
+	//optionally let api key holders change assets' names, content types and metadata, with PATCH /asset/:id
+	if os.Getenv("ALLOW_META_UPDATES") == "1" {
+		apiOpts = append(apiOpts, assetstore.WithMetaUpdater(assetStorage, assetStorage))
+	}
+
+	//optionally let api key holders replace assets' data, with PUT /asset/:id
+	if os.Getenv("ALLOW_REPLACE") == "1" {
+		apiOpts = append(apiOpts, assetstore.WithAssetReplacer(assetStorage, assetStorage))
+	}
+
 	//run an http/api server to store/get assets
-	assetstore.RunAPI(assetStorage, assetStorage, assetStorage, os.Getenv("BASE_PATH"), port)
-}
\ No newline at end of file
+	assetstore.RunAPI(assetStorage, assetStorage, assetStorage, os.Getenv("BASE_PATH"), port, apiOpts...)
+}
+
+//envInt64 reads an optional integer env var, 0 if unset
+func envInt64(name string) int64 {
+	v := os.Getenv(name)
+	if v == "" {
+		return 0
+	}
+	i, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		panic(name + " env var was not correctly defined")
+	}
+	return i
+}
+
+//envDuration reads an optional duration env var like "1h", 0 if unset
+func envDuration(name string) time.Duration {
+	v := os.Getenv(name)
+	if v == "" {
+		return 0
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		panic(name + " env var was not correctly defined")
+	}
+	return d
+}
@@ -0,0 +1,266 @@
+package assetstore
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+//Collections group assets, like the files of a release, under an id and name of their own, in order.  A collection
+//token gives access to every asset in a collection, by name, for as long as it lasts.  Deleting a collection doesn't
+//delete its assets.
+
+//maxCollectionAssets is the most assets a collection can have
+const maxCollectionAssets = 1000
+
+//collectionFetchBatch is how many of a collection's assets' meta are fetched at once, looking one up by name
+const collectionFetchBatch = 25
+
+//Collection is an ordered group of assets in a tenant
+type Collection struct {
+	ID string `json:"id"`
+	//Tenant/namespace of the collection and its assets
+	Tenant string `json:"tenant,omitempty"`
+	//User who created the collection, if known
+	Owner string `json:"owner,omitempty"`
+	Name string `json:"name"`
+	//ids of the assets in the collection, in order
+	AssetIDs []string `json:"asset_ids"`
+	//Unix timestamp the collection was created at
+	Created int64 `json:"created,omitempty"`
+}
+
+func (c Collection) Valid() bool {
+	return c.ID != "" && c.Name != "" && ValidTenant(c.Tenant) && !strings.Contains(c.ID, tenantSeparator)
+}
+
+//Key is the tenant scoped key the collection is stored under
+func (c Collection) Key() string {
+	return ScopedKey(c.Tenant, c.ID)
+}
+
+//CollectionToken grants access to every asset in a collection, until it expires
+type CollectionToken struct {
+	Token string `json:"token,omitempty"`
+	//Tenant/namespace of the token and the collection it refers to
+	Tenant string `json:"tenant,omitempty"`
+	//Expiry unix timestamp
+	Expiry int64 `json:"expiry,omitempty"`
+	CollectionID string `json:"collection_id,omitempty"`
+}
+
+func (t CollectionToken) Valid() bool {
+	return t.CollectionID != "" && t.Token != "" && time.Now().Before(time.Unix(t.Expiry, 0)) &&
+		ValidTenant(t.Tenant) && !strings.Contains(t.Token, tenantSeparator)
+}
+
+//Key is the tenant scoped key the token is stored under
+func (t CollectionToken) Key() string {
+	return ScopedKey(t.Tenant, t.Token)
+}
+
+//CollectionKey is the tenant scoped key of the collection the token refers to
+func (t CollectionToken) CollectionKey() string {
+	return ScopedKey(t.Tenant, t.CollectionID)
+}
+
+//CollectionHandler stores, gets and deletes collections, and their tokens, by their tenant scoped keys
+type CollectionHandler interface {
+	GetCollection(id string) (coll Collection, err error)
+	StoreCollection(coll Collection) (err error)
+	DeleteCollection(id string) (err error)
+	GetCollectionToken(token string) (t CollectionToken, err error)
+	StoreCollectionToken(token CollectionToken) (err error)
+}
+
+//AssetCollector manages collections of assets, and retrieves their assets with collection tokens
+type AssetCollector interface {
+	GetCollection(id string) (coll Collection, err error)
+	SaveCollection(coll Collection) (saved Collection, err error)
+	DeleteCollection(id string) (err error)
+	ShareCollection(id string, token CollectionToken) (shared CollectionToken, err error)
+	GetEncodedByCollectionToken(token, name string, accept ...string) (meta AssetMeta, asset io.ReadCloser, encoding string, err error)
+}
+
+//WithCollectionStore enables collections of assets, stored by collections
+func WithCollectionStore(collections CollectionHandler) AssetStorageOption {
+	return func(s *AssetStorage) {
+		s.collections = collections
+	}
+}
+
+//GetCollection gets a collection by its tenant scoped id
+func (s *AssetStorage) GetCollection(id string) (coll Collection, err error) {
+	if s.collections == nil {
+		return coll, fmt.Errorf("%w: collections aren't enabled", ErrNotFound)
+	}
+	return s.collections.GetCollection(id)
+}
+
+//SaveCollection creates a collection, or replaces the name and assets of an existing one.  Its assets must all exist
+//in its tenant, and be listed once each.
+func (s *AssetStorage) SaveCollection(coll Collection) (saved Collection, err error) {
+	if s.collections == nil {
+		return coll, fmt.Errorf("collections aren't enabled")
+	}
+	if !coll.Valid() {
+		return coll, fmt.Errorf("collection invalid")
+	}
+	if len(coll.AssetIDs) > maxCollectionAssets {
+		return coll, fmt.Errorf("collections can have at most %d assets", maxCollectionAssets)
+	}
+	if coll.AssetIDs == nil {
+		coll.AssetIDs = []string{}
+	}
+	listed := map[string]bool{}
+	for _, id := range coll.AssetIDs {
+		if id == "" || strings.Contains(id, tenantSeparator) || listed[id] {
+			return coll, fmt.Errorf("invalid or repeated asset id %q", id)
+		}
+		listed[id] = true
+		if _, err = s.metaHandler.GetMeta(ScopedKey(coll.Tenant, id)); err != nil {
+			return coll, err
+		}
+	}
+	if existing, err := s.collections.GetCollection(coll.Key()); err == nil {
+		coll.Created, coll.Owner = existing.Created, existing.Owner
+	}
+	if coll.Created == 0 {
+		coll.Created = time.Now().Unix()
+	}
+	err = s.collections.StoreCollection(coll)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"context": "AssetStorage.SaveCollection()",
+			"collections": s.collections,
+			"collection": coll,
+		}).Error(err)
+	}
+	return coll, err
+}
+
+//DeleteCollection deletes a collection by its tenant scoped id, but not its assets.  Its tokens stop working.
+func (s *AssetStorage) DeleteCollection(id string) (err error) {
+	if s.collections == nil {
+		return fmt.Errorf("%w: collections aren't enabled", ErrNotFound)
+	}
+	err = s.collections.DeleteCollection(id)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"context": "AssetStorage.DeleteCollection()",
+			"collections": s.collections,
+			"id": id,
+		}).Error(err)
+	}
+	return
+}
+
+//ShareCollection stores token, which needs its Token and Expiry set, for the collection with tenant scoped id
+func (s *AssetStorage) ShareCollection(id string, token CollectionToken) (shared CollectionToken, err error) {
+	coll, err := s.GetCollection(id)
+	if err != nil {
+		return token, err
+	}
+	token.Tenant, token.CollectionID = coll.Tenant, coll.ID
+	if !token.Valid() {
+		return token, fmt.Errorf("collection token invalid")
+	}
+	err = s.collections.StoreCollectionToken(token)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"context": "AssetStorage.ShareCollection()",
+			"collections": s.collections,
+			"token": token,
+		}).Error(err)
+	}
+	return token, err
+}
+
+//GetByCollectionToken gets the asset named name (or with id name) in the collection a collection token, by its
+//tenant scoped key, refers to.  If several assets in it have the name, it's the first of them.
+func (s *AssetStorage) GetByCollectionToken(token, name string) (meta AssetMeta, asset io.ReadCloser, err error) {
+	meta, asset, _, err = s.GetEncodedByCollectionToken(token, name)
+	return
+}
+
+//GetEncodedByCollectionToken is GetByCollectionToken, returning data still encoded if it's in an accepted encoding,
+//like GetEncodedByID
+func (s *AssetStorage) GetEncodedByCollectionToken(token, name string, accept ...string) (meta AssetMeta, asset io.ReadCloser, encoding string, err error) {
+	meta, err = s.collectionMember(token, name)
+	if err != nil {
+		return
+	}
+	s.recordAccess(meta)
+	asset, encoding, err = readDecoded(s.dataHandler, meta, meta.DataKey(), accept...)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"context": "AssetStorage.GetByCollectionToken()",
+			"dataHandler": s.dataHandler,
+			"token": token,
+			"meta": meta,
+		}).Error(err)
+	}
+	return
+}
+
+//collectionMember gets the meta of the retrievable asset named name, or with id name, in a token's collection
+func (s *AssetStorage) collectionMember(token, name string) (meta AssetMeta, err error) {
+	if s.collections == nil {
+		return meta, fmt.Errorf("%w: collections aren't enabled", ErrNotFound)
+	}
+	t, err := s.collections.GetCollectionToken(token)
+	if err == nil && !t.Valid() {
+		err = fmt.Errorf("%w: collection token %s expired", ErrNotFound, token)
+	}
+	if err != nil {
+		log.WithFields(log.Fields{
+			"context": "AssetStorage.GetByCollectionToken()",
+			"collections": s.collections,
+			"token": token,
+		}).Error(err)
+		return
+	}
+	coll, err := s.collections.GetCollection(t.CollectionKey())
+	if err != nil {
+		return
+	}
+	//an asset's id needs just its own meta fetched
+	for _, id := range coll.AssetIDs {
+		if id != name {
+			continue
+		}
+		if meta, err = s.metaHandler.GetMeta(ScopedKey(coll.Tenant, id)); err == nil {
+			return meta, s.checkRetrievable(meta)
+		}
+		break
+	}
+	//names need the assets' meta fetched, a batch at a time, until one has it
+	for start := 0; start < len(coll.AssetIDs); start += collectionFetchBatch {
+		ids := coll.AssetIDs[start:]
+		if len(ids) > collectionFetchBatch {
+			ids = ids[:collectionFetchBatch]
+		}
+		metas := make([]AssetMeta, len(ids))
+		errs := make([]error, len(ids))
+		var wg sync.WaitGroup
+		for i, id := range ids {
+			wg.Add(1)
+			go func(i int, id string) {
+				defer wg.Done()
+				metas[i], errs[i] = s.metaHandler.GetMeta(ScopedKey(coll.Tenant, id))
+			}(i, id)
+		}
+		wg.Wait()
+		for i, meta := range metas {
+			//assets deleted since they were collected are skipped
+			if errs[i] == nil && meta.Name == name {
+				return meta, s.checkRetrievable(meta)
+			}
+		}
+	}
+	return AssetMeta{}, fmt.Errorf("%w: no asset %s in collection %s", ErrNotFound, name, coll.ID)
+}
@@ -0,0 +1,207 @@
+package assetstore
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+type memCollections struct {
+	collections map[string]Collection
+	tokens map[string]CollectionToken
+}
+
+func newMemCollections() *memCollections {
+	return &memCollections{collections: map[string]Collection{}, tokens: map[string]CollectionToken{}}
+}
+
+func (m *memCollections) GetCollection(id string) (Collection, error) {
+	coll, ok := m.collections[id]
+	if !ok {
+		return coll, fmt.Errorf("%w: collection %s", ErrNotFound, id)
+	}
+	return coll, nil
+}
+
+func (m *memCollections) StoreCollection(coll Collection) error {
+	m.collections[coll.Key()] = coll
+	return nil
+}
+
+func (m *memCollections) DeleteCollection(id string) error {
+	if _, ok := m.collections[id]; !ok {
+		return fmt.Errorf("%w: collection %s", ErrNotFound, id)
+	}
+	delete(m.collections, id)
+	return nil
+}
+
+func (m *memCollections) GetCollectionToken(token string) (CollectionToken, error) {
+	t, ok := m.tokens[token]
+	if !ok {
+		return t, fmt.Errorf("%w: collection token %s", ErrNotFound, token)
+	}
+	return t, nil
+}
+
+func (m *memCollections) StoreCollectionToken(token CollectionToken) error {
+	m.tokens[token.Key()] = token
+	return nil
+}
+
+func TestAssetStorage_Collections(t *testing.T) {
+	db := newMemMetaTokenStore()
+	s := NewAssetStorage(db, db, newMemDataStore(), WithCollectionStore(newMemCollections()))
+	store := func(tenant, name, content string) AssetMeta {
+		meta, err := s.Store(AssetMeta{ID: uuid.New().String(), Tenant: tenant, Name: name}, AssetToken{}, ioutil.NopCloser(strings.NewReader(content)))
+		assert.NoError(t, err)
+		return meta
+	}
+	a := store("", "dist/app.js", "first")
+	b := store("", "app.js", "second")
+	other := store("acme", "app.js", "other tenant")
+
+	coll, err := s.SaveCollection(Collection{ID: uuid.New().String(), Name: "v1.0", Owner: "alice", AssetIDs: []string{a.ID, b.ID}})
+	assert.NoError(t, err)
+	assert.NotZero(t, coll.Created)
+
+	tests := []struct {
+		name string
+		ids  []string
+	}{
+		{"missing asset", []string{a.ID, uuid.New().String()}},
+		{"asset in another tenant", []string{other.ID}},
+		{"repeated asset", []string{a.ID, a.ID}},
+		{"scoped asset id", []string{other.Key()}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := s.SaveCollection(Collection{ID: uuid.New().String(), Name: "bad", AssetIDs: tt.ids})
+			assert.Error(t, err)
+		})
+	}
+
+	token, err := s.ShareCollection(coll.Key(), CollectionToken{Token: uuid.New().String(), Expiry: time.Now().Add(time.Hour).Unix()})
+	assert.NoError(t, err)
+	assert.Equal(t, coll.ID, token.CollectionID)
+	for name, want := range map[string]string{"dist/app.js": "first", "app.js": "second", a.ID: "first"} {
+		_, asset, err := s.GetByCollectionToken(token.Key(), name)
+		assert.NoError(t, err)
+		assert.Equal(t, want, readAll(t, asset))
+	}
+	_, _, err = s.GetByCollectionToken(token.Key(), "missing.js")
+	assert.True(t, errors.Is(err, ErrNotFound))
+
+	//updates keep the collection's owner and creation time, and change what its tokens give access to
+	updated, err := s.SaveCollection(Collection{ID: coll.ID, Name: "v1.1", AssetIDs: []string{b.ID}})
+	assert.NoError(t, err)
+	assert.Equal(t, "alice", updated.Owner)
+	assert.Equal(t, coll.Created, updated.Created)
+	_, _, err = s.GetByCollectionToken(token.Key(), "dist/app.js")
+	assert.True(t, errors.Is(err, ErrNotFound))
+
+	//deleting a collection leaves its assets, but its tokens stop working
+	assert.NoError(t, s.DeleteCollection(coll.Key()))
+	_, _, err = s.GetByCollectionToken(token.Key(), "app.js")
+	assert.True(t, errors.Is(err, ErrNotFound))
+	_, _, err = s.GetByID(b.Key())
+	assert.NoError(t, err)
+	_, err = s.ShareCollection(coll.Key(), CollectionToken{Token: uuid.New().String(), Expiry: time.Now().Add(time.Hour).Unix()})
+	assert.True(t, errors.Is(err, ErrNotFound))
+
+	expired, err := s.SaveCollection(Collection{ID: uuid.New().String(), Name: "old", AssetIDs: []string{a.ID}})
+	assert.NoError(t, err)
+	_, err = s.ShareCollection(expired.Key(), CollectionToken{Token: uuid.New().String(), Expiry: time.Now().Add(-time.Hour).Unix()})
+	assert.Error(t, err)
+}
+
+func TestAssetStorage_CollectionMemberLookups(t *testing.T) {
+	db := &countingMetaTokenStore{memMetaTokenStore: newMemMetaTokenStore()}
+	s := NewAssetStorage(db, db, newMemDataStore(), WithCollectionStore(newMemCollections()))
+	ids := []string{}
+	for i := 0; i < collectionFetchBatch+5; i++ {
+		meta, err := s.Store(AssetMeta{ID: uuid.New().String(), Name: fmt.Sprintf("%d.txt", i)}, AssetToken{}, ioutil.NopCloser(strings.NewReader("data")))
+		assert.NoError(t, err)
+		ids = append(ids, meta.ID)
+	}
+	coll, err := s.SaveCollection(Collection{ID: uuid.New().String(), Name: "many", AssetIDs: ids})
+	assert.NoError(t, err)
+	token, err := s.ShareCollection(coll.Key(), CollectionToken{Token: uuid.New().String(), Expiry: time.Now().Add(time.Hour).Unix()})
+	assert.NoError(t, err)
+
+	//assets are looked up by id directly, and by name a batch at a time, stopping at the batch with the name
+	tests := []struct {
+		name    string
+		lookups int
+	}{
+		{ids[len(ids)-1], 1},
+		{"0.txt", collectionFetchBatch},
+		{fmt.Sprintf("%d.txt", collectionFetchBatch), len(ids)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db.lookups = 0
+			_, err := s.collectionMember(token.Key(), tt.name)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.lookups, db.lookups)
+		})
+	}
+}
+
+func TestAPI_ShareCollection(t *testing.T) {
+	db := newMemMetaTokenStore()
+	s := NewAssetStorage(db, db, newMemDataStore(), WithCollectionStore(newMemCollections()))
+	api := testAPI(s, WithCollections(s), WithAPIKeys(map[string]Principal{
+		"alice-key": {Tenant: "acme", User: "alice"},
+		"bob-key":   {Tenant: "acme", User: "bob"},
+	}))
+	meta, err := s.Store(AssetMeta{ID: uuid.New().String(), Tenant: "acme", Owner: "alice", Name: "app.js"}, AssetToken{}, ioutil.NopCloser(strings.NewReader("data")))
+	assert.NoError(t, err)
+	coll, err := s.SaveCollection(Collection{ID: uuid.New().String(), Tenant: "acme", Owner: "alice", Name: "v1.0", AssetIDs: []string{meta.ID}})
+	assert.NoError(t, err)
+	unowned, err := s.SaveCollection(Collection{ID: uuid.New().String(), Tenant: "acme", Name: "v0.9", AssetIDs: []string{meta.ID}})
+	assert.NoError(t, err)
+
+	//sharing needs an api key, and only a collection's owner can share it if it has one
+	tests := []struct {
+		name   string
+		path   string
+		apiKey string
+		want   int
+	}{
+		{"anonymous", "/t/acme/collections/" + coll.ID + "/token", "", http.StatusUnauthorized},
+		{"anonymous, unowned", "/t/acme/collections/" + unowned.ID + "/token", "", http.StatusUnauthorized},
+		{"anyone with a key, unowned", "/collections/" + unowned.ID + "/token", "bob-key", http.StatusOK},
+		{"someone else", "/collections/" + coll.ID + "/token", "bob-key", http.StatusForbidden},
+		{"missing", "/collections/" + uuid.New().String() + "/token", "alice-key", http.StatusNotFound},
+		{"owner", "/collections/" + coll.ID + "/token", "alice-key", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := serve(api, http.MethodPost, tt.path, tt.apiKey, strings.NewReader(`{"expiry": 60}`))
+			assert.Equal(t, tt.want, w.Code, w.Body.String())
+		})
+	}
+}
+
+func TestAPI_CreateCollection(t *testing.T) {
+	db := newMemMetaTokenStore()
+	s := NewAssetStorage(db, db, newMemDataStore(), WithCollectionStore(newMemCollections()))
+	api := testAPI(s, WithCollections(s), WithAPIKeys(map[string]Principal{
+		"alice-key": {Tenant: "acme", User: "alice"},
+	}))
+
+	//creating a collection needs an api key, and it's owned by the key's user
+	w := serve(api, http.MethodPost, "/t/acme/collections", "", strings.NewReader(`{"name": "v1.0"}`))
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	w = serve(api, http.MethodPost, "/collections", "alice-key", strings.NewReader(`{"name": "v1.0"}`))
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Contains(t, w.Body.String(), `"owner":"alice"`)
+}
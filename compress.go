@@ -0,0 +1,106 @@
+package assetstore
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+//GzipEncoding is the Encoding of gzipped data
+const GzipEncoding = "gzip"
+
+//CompressedContentTypes are already compressed, so aren't worth compressing again
+var CompressedContentTypes = []string{
+	"image/jpeg", "image/png", "image/gif", "image/webp",
+	"video/*", "audio/*", "font/woff", "font/woff2", "application/pdf",
+	"application/zip", "application/x-gzip", "application/gzip", "application/x-bzip2", "application/x-xz",
+	"application/zstd", "application/x-7z-compressed", "application/x-rar-compressed",
+}
+
+//CompressingDataHandler gzips asset data as it's written, and gunzips it as it's read.  Assets whose content type
+//(as given, or sniffed) is in SkipTypes are stored as is.
+type CompressingDataHandler struct {
+	dataHandlerDecorator
+	//Level is the gzip compression level
+	Level int
+	SkipTypes []string
+}
+
+func NewCompressingDataHandler(dataHandler AssetDataHandler) *CompressingDataHandler {
+	return &CompressingDataHandler{
+		dataHandlerDecorator: dataHandlerDecorator{dataHandler},
+		Level: gzip.DefaultCompression,
+		SkipTypes: CompressedContentTypes,
+	}
+}
+
+func (h *CompressingDataHandler) WriteEncoded(meta *AssetMeta, key string, reader io.ReadCloser) (n int64, err error) {
+	defer reader.Close()
+	buffered := bufio.NewReaderSize(reader, sniffLen)
+	contentType := meta.ContentType
+	if contentType == "" {
+		head, _ := buffered.Peek(sniffLen)
+		contentType = SniffContentType(head)
+	}
+	if matchesType(h.SkipTypes, contentType) {
+		return writeEncoded(h.AssetDataHandler, meta, key, ioutil.NopCloser(buffered))
+	}
+	zw, err := gzip.NewWriterLevel(ioutil.Discard, h.Level)
+	if err != nil {
+		return
+	}
+	//compress into a pipe the wrapped handler reads from
+	pr, pw := io.Pipe()
+	zw.Reset(pw)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		var copyErr error
+		n, copyErr = io.Copy(zw, buffered)
+		if closeErr := zw.Close(); copyErr == nil {
+			copyErr = closeErr
+		}
+		pw.CloseWithError(copyErr)
+	}()
+	meta.Encoding = GzipEncoding
+	meta.EncodedSize, err = writeEncoded(h.AssetDataHandler, meta, key, pr)
+	//unblock the compressor if the write gave up early
+	pr.Close()
+	<-done
+	return n, err
+}
+
+func (h *CompressingDataHandler) ReadDecoded(meta AssetMeta, key string, accept ...string) (reader io.ReadCloser, encoding string, err error) {
+	reader, _, err = readDecoded(h.AssetDataHandler, meta, key)
+	if err != nil || meta.Encoding == "" {
+		return
+	}
+	if meta.Encoding != GzipEncoding {
+		reader.Close()
+		return nil, "", fmt.Errorf("unsupported encoding %s", meta.Encoding)
+	}
+	for _, a := range accept {
+		if a == meta.Encoding {
+			return reader, meta.Encoding, nil
+		}
+	}
+	zr, err := gzip.NewReader(reader)
+	if err != nil {
+		reader.Close()
+		return nil, "", err
+	}
+	return &gzipReadCloser{Reader: zr, source: reader}, "", nil
+}
+
+//gzipReadCloser closes both the gzip reader and what it reads from
+type gzipReadCloser struct {
+	*gzip.Reader
+	source io.ReadCloser
+}
+
+func (r *gzipReadCloser) Close() error {
+	r.Reader.Close()
+	return r.source.Close()
+}
@@ -0,0 +1,76 @@
+package assetstore
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompressingDataHandler(t *testing.T) {
+	db := newMemMetaTokenStore()
+	data := newMemDataStore()
+	s := NewAssetStorage(db, db, NewCompressingDataHandler(data))
+
+	logs := strings.Repeat(`{"level":"info","msg":"request handled","status":200}`+"\n", 200)
+	png := append([]byte("\x89PNG\x0D\x0A\x1A\x0A"), bytes.Repeat([]byte{0}, 1000)...)
+
+	tests := []struct {
+		name     string
+		content  []byte
+		encoding string
+	}{
+		{"logs.json", []byte(logs), GzipEncoding},
+		{"image.png", png, ""},
+		{"empty.txt", []byte{}, GzipEncoding},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			meta := AssetMeta{ID: uuid.New().String(), Name: tt.name}
+			token := AssetToken{Token: uuid.New().String(), AssetID: meta.ID, Expiry: time.Now().Add(time.Minute).Unix()}
+			stored, err := s.Store(meta, token, ioutil.NopCloser(bytes.NewReader(tt.content)))
+			assert.NoError(t, err)
+			assert.Equal(t, tt.encoding, stored.Encoding)
+			assert.Equal(t, len(tt.content), stored.Size)
+			if tt.encoding != "" {
+				assert.Equal(t, int64(len(data.data[stored.Key()])), stored.EncodedSize)
+			} else {
+				assert.Equal(t, tt.content, data.data[stored.Key()])
+			}
+
+			//reads are decoded, unless the encoding is accepted
+			_, asset, err := s.GetByID(stored.Key())
+			assert.NoError(t, err)
+			assert.Equal(t, string(tt.content), readAll(t, asset))
+			_, asset, encoding, err := s.GetEncodedByToken(token.Key(), GzipEncoding)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.encoding, encoding)
+			if encoding == GzipEncoding {
+				zr, err := gzip.NewReader(asset)
+				assert.NoError(t, err)
+				asset = zr
+			}
+			assert.Equal(t, string(tt.content), readAll(t, asset))
+		})
+	}
+
+	//json compresses well
+	for _, meta := range db.metas {
+		if meta.Name == "logs.json" {
+			assert.True(t, meta.EncodedSize < int64(meta.Size)/10)
+		}
+	}
+
+	//data stored before compression was enabled is still readable
+	meta := AssetMeta{ID: uuid.New().String(), Name: "old.txt", Size: 3}
+	assert.NoError(t, db.StoreMeta(meta))
+	data.data[meta.Key()] = []byte("old")
+	_, asset, err := s.GetByID(meta.Key())
+	assert.NoError(t, err)
+	assert.Equal(t, "old", readAll(t, asset))
+}
@@ -0,0 +1,176 @@
+package assetstore
+
+import (
+	"errors"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+//In dedup mode data is streamed to a temp key while it's hashed, then promoted to a content addressed blob key,
+//so identical uploads share one copy of their data.  Blobs are reference counted, and only removed once no asset
+//refers to them.  Blobs are per tenant, so dedup never reveals what another tenant has stored.  A blob's marked as
+//being deleted before its data is removed, and uploads of the same data meanwhile keep their own copy of it instead.
+
+//ErrBlobInUse is returned marking a blob as being deleted while it's still referenced
+var ErrBlobInUse = errors.New("blob is still referenced")
+
+//BlobRefCounter counts references to blobs, by blob key
+type BlobRefCounter interface {
+	//AddBlobRef atomically adds delta to a blob's reference count, returning the new count, and whether the blob's
+	//being deleted
+	AddBlobRef(key string, delta int64) (refs int64, deleting bool, err error)
+	//MarkBlobDeleting marks a blob as being deleted, failing with ErrBlobInUse unless its count is 0
+	MarkBlobDeleting(key string) (err error)
+	//RemoveBlobRef removes a deleted blob's reference count, or only unmarks it if it's been referenced since it was
+	//marked
+	RemoveBlobRef(key string) (err error)
+}
+
+//AssetDataCopier copies data between keys, ideally without streaming it through us
+type AssetDataCopier interface {
+	Copy(from, to string) (err error)
+}
+
+//BlobKey is the data key of a tenant's blob with the given content hash
+func BlobKey(tenant, hash string) string {
+	return ScopedKey(tenant, internalKeyPrefix+"blob/"+hash)
+}
+
+//stagingKey is where an asset's data is written before it's promoted to a blob
+func stagingKey(meta AssetMeta) string {
+	return ScopedKey(meta.Tenant, internalKeyPrefix+"tmp/"+meta.ID)
+}
+
+//stagedAssetKey is the key of the asset whose data is staged under key, if key is a staging key
+func stagedAssetKey(key string) (assetKey string, ok bool) {
+	prefix := internalKeyPrefix + "tmp/"
+	tenant := ""
+	if !strings.HasPrefix(key, prefix) {
+		tenant, key = SplitScopedKey(key)
+	}
+	if !strings.HasPrefix(key, prefix) {
+		return "", false
+	}
+	return ScopedKey(tenant, strings.TrimPrefix(key, prefix)), true
+}
+
+//WithDedup stores data in reference counted, content addressed blobs
+func WithDedup(blobs BlobRefCounter) AssetStorageOption {
+	return func(s *AssetStorage) {
+		s.blobs = blobs
+	}
+}
+
+//promoteBlob moves data staged under staged to its blob, unless an identical blob already exists, and references it.
+//The meta passed must have its Checksum (and Encoding), and gets its Blob set, unless it's encrypted.
+func (s *AssetStorage) promoteBlob(meta AssetMeta, staged string) (AssetMeta, error) {
+	if meta.WrappedKey != "" {
+		//data encrypted with its own data key can't be shared, so it's just moved to the asset's own key
+		return s.keepUnshared(meta, staged)
+	}
+	//data is shared as stored, so only with assets stored in the same encoding
+	meta.Blob = meta.Checksum
+	if meta.Encoding != "" {
+		meta.Blob += "." + meta.Encoding
+	}
+	refs, deleting, err := s.blobs.AddBlobRef(meta.DataKey(), 1)
+	if err != nil {
+		meta.Blob = ""
+		return meta, err
+	}
+	if deleting {
+		//the blob's data may be gone any moment, so the asset keeps its data to itself
+		if _, _, err = s.blobs.AddBlobRef(meta.DataKey(), -1); err != nil {
+			log.WithFields(log.Fields{
+				"context": "AssetStorage.promoteBlob()",
+				"meta": meta,
+			}).Error(err)
+		}
+		meta.Blob = ""
+		return s.keepUnshared(meta, staged)
+	}
+	//the first reference copies the data, later ones only do if it's somehow missing
+	copyData := refs == 1
+	if statter, ok := s.dataHandler.(AssetDataStatter); ok && !copyData {
+		_, statErr := statter.Stat(meta.DataKey())
+		copyData = errors.Is(statErr, ErrNotFound)
+	}
+	if copyData {
+		if err = s.copyData(staged, meta.DataKey()); err != nil {
+			s.releaseBlob(meta)
+			meta.Blob = ""
+			return meta, err
+		}
+	}
+	if err = s.dataHandler.Delete(staged); err != nil {
+		log.WithFields(log.Fields{
+			"context": "AssetStorage.promoteBlob()",
+			"meta": meta,
+		}).Error(err)
+	}
+	return meta, nil
+}
+
+//keepUnshared moves data staged under staged to the asset's own data key, if that's not where it's staged
+func (s *AssetStorage) keepUnshared(meta AssetMeta, staged string) (AssetMeta, error) {
+	if staged == meta.DataKey() {
+		return meta, nil
+	}
+	if err := s.copyData(staged, meta.DataKey()); err != nil {
+		return meta, err
+	}
+	s.deleteKey(staged)
+	return meta, nil
+}
+
+//copyData copies data between keys, server side if the data handler can
+func (s *AssetStorage) copyData(from, to string) (err error) {
+	if copier, ok := s.dataHandler.(AssetDataCopier); ok {
+		return copier.Copy(from, to)
+	}
+	reader, err := s.dataHandler.Reader(from)
+	if err != nil {
+		return
+	}
+	_, err = s.dataHandler.Writer(to, reader)
+	return
+}
+
+//releaseBlob drops an asset's reference to its blob, removing the blob once nothing refers to it
+func (s *AssetStorage) releaseBlob(meta AssetMeta) {
+	refs, _, err := s.blobs.AddBlobRef(meta.DataKey(), -1)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"context": "AssetStorage.releaseBlob()",
+			"meta": meta,
+		}).Error(err)
+		return
+	}
+	if refs > 0 {
+		return
+	}
+	//the blob's marked first, only if its count is still 0, so uploads referencing it again while its data is
+	//removed keep their own copy rather than sharing data that's about to be gone
+	if err = s.blobs.MarkBlobDeleting(meta.DataKey()); err != nil {
+		if !errors.Is(err, ErrBlobInUse) {
+			log.WithFields(log.Fields{
+				"context": "AssetStorage.releaseBlob()",
+				"meta": meta,
+			}).Error(err)
+		}
+		return
+	}
+	if err = s.dataHandler.Delete(meta.DataKey()); err != nil {
+		log.WithFields(log.Fields{
+			"context": "AssetStorage.releaseBlob()",
+			"meta": meta,
+		}).Error(err)
+	}
+	if err = s.blobs.RemoveBlobRef(meta.DataKey()); err != nil {
+		log.WithFields(log.Fields{
+			"context": "AssetStorage.releaseBlob()",
+			"meta": meta,
+		}).Error(err)
+	}
+}
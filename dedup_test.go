@@ -0,0 +1,176 @@
+package assetstore
+
+import (
+	"bytes"
+	"io/ioutil"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+type memBlobRefs struct {
+	mu       sync.Mutex
+	refs     map[string]int64
+	deleting map[string]bool
+}
+
+func newMemBlobRefs() *memBlobRefs {
+	return &memBlobRefs{refs: map[string]int64{}, deleting: map[string]bool{}}
+}
+
+func (m *memBlobRefs) AddBlobRef(key string, delta int64) (refs int64, deleting bool, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.refs[key] += delta
+	return m.refs[key], m.deleting[key], nil
+}
+
+func (m *memBlobRefs) MarkBlobDeleting(key string) (err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.refs[key] > 0 {
+		return ErrBlobInUse
+	}
+	m.deleting[key] = true
+	return nil
+}
+
+func (m *memBlobRefs) RemoveBlobRef(key string) (err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.deleting, key)
+	if m.refs[key] <= 0 {
+		delete(m.refs, key)
+	}
+	return nil
+}
+
+//hookedDataStore runs beforeDelete, once, before a key's data is deleted
+type hookedDataStore struct {
+	*memDataStore
+	beforeDelete func(key string)
+}
+
+func (h *hookedDataStore) Delete(id string) (err error) {
+	if hook := h.beforeDelete; hook != nil {
+		h.beforeDelete = nil
+		hook(id)
+	}
+	return h.memDataStore.Delete(id)
+}
+
+func TestAssetStorage_Dedup(t *testing.T) {
+	db := newMemMetaTokenStore()
+	data := newMemDataStore()
+	blobs := newMemBlobRefs()
+	s := NewAssetStorage(db, db, data, WithDedup(blobs))
+
+	store := func(tenant, content string) AssetMeta {
+		meta := AssetMeta{ID: uuid.New().String(), Tenant: tenant, Name: "a.txt"}
+		token := AssetToken{Token: uuid.New().String(), AssetID: meta.ID, Tenant: tenant, Expiry: time.Now().Add(time.Minute).Unix()}
+		stored, err := s.Store(meta, token, ioutil.NopCloser(bytes.NewReader([]byte(content))))
+		assert.NoError(t, err)
+		return stored
+	}
+
+	//identical uploads share one blob, and nothing is left staged
+	a := store("acme", "same data")
+	b := store("acme", "same data")
+	assert.Equal(t, a.Blob, b.Blob)
+	assert.Equal(t, a.DataKey(), b.DataKey())
+	assert.Len(t, data.data, 1)
+	assert.Equal(t, int64(2), blobs.refs[a.DataKey()])
+
+	//blobs are per tenant
+	c := store("other", "same data")
+	assert.NotEqual(t, a.DataKey(), c.DataKey())
+	assert.Len(t, data.data, 2)
+
+	//downloads are unchanged
+	for _, meta := range []AssetMeta{a, b, c} {
+		_, asset, err := s.GetByID(meta.Key())
+		assert.NoError(t, err)
+		assert.Equal(t, "same data", readAll(t, asset))
+	}
+
+	//the blob stays until its last reference is deleted
+	assert.NoError(t, s.Delete(a.Key()))
+	_, asset, err := s.GetByID(b.Key())
+	assert.NoError(t, err)
+	assert.Equal(t, "same data", readAll(t, asset))
+	_, ok := data.data[b.DataKey()]
+	assert.True(t, ok)
+
+	assert.NoError(t, s.Delete(b.Key()))
+	_, ok = data.data[b.DataKey()]
+	assert.False(t, ok)
+	_, ok = blobs.refs[b.DataKey()]
+	assert.False(t, ok)
+	assert.Len(t, data.data, 1)
+}
+
+func TestAssetStorage_DedupDeleteRace(t *testing.T) {
+	db := newMemMetaTokenStore()
+	data := &hookedDataStore{memDataStore: newMemDataStore()}
+	blobs := newMemBlobRefs()
+	s := NewAssetStorage(db, db, data, WithDedup(blobs))
+	store := func() AssetMeta {
+		stored, err := s.Store(AssetMeta{ID: uuid.New().String(), Name: "a.txt"}, AssetToken{}, ioutil.NopCloser(bytes.NewReader([]byte("same data"))))
+		assert.NoError(t, err)
+		return stored
+	}
+	a := store()
+
+	//an identical upload made while the last reference's blob is being deleted keeps its own copy of the data
+	var b AssetMeta
+	data.beforeDelete = func(key string) {
+		if assert.Equal(t, a.DataKey(), key) {
+			b = store()
+		}
+	}
+	assert.NoError(t, s.Delete(a.Key()))
+	assert.Empty(t, b.Blob)
+	assert.Equal(t, b.Key(), b.DataKey())
+	_, asset, err := s.GetByID(b.Key())
+	if assert.NoError(t, err) {
+		assert.Equal(t, "same data", readAll(t, asset))
+	}
+	assert.Empty(t, blobs.refs)
+	assert.Empty(t, blobs.deleting)
+
+	//and later uploads share a blob again
+	c := store()
+	assert.Equal(t, a.DataKey(), c.DataKey())
+	_, asset, err = s.GetByID(c.Key())
+	if assert.NoError(t, err) {
+		assert.Equal(t, "same data", readAll(t, asset))
+	}
+}
+
+func TestReconciler_DedupMissingBlob(t *testing.T) {
+	db := newMemMetaTokenStore()
+	data := newMemDataStore()
+	blobs := newMemBlobRefs()
+	tracker := newMemUsageTracker()
+	s := NewAssetStorage(db, db, data, WithDedup(blobs), WithQuotas(tracker, QuotaLimits{}))
+	var metas []AssetMeta
+	for i := 0; i < 2; i++ {
+		meta, err := s.Store(AssetMeta{ID: uuid.New().String(), Tenant: "acme", Name: "a.txt"}, AssetToken{}, ioutil.NopCloser(bytes.NewReader([]byte("shared"))))
+		assert.NoError(t, err)
+		metas = append(metas, meta)
+	}
+	assert.Equal(t, int64(2), blobs.refs[metas[0].DataKey()])
+
+	//the blob's data is deleted outside the api, so its assets' meta is removed, releasing the blob and their usage
+	assert.NoError(t, data.Delete(metas[0].DataKey()))
+	report, err := NewReconciler(s, db, data).Reconcile()
+	assert.NoError(t, err)
+	assert.Equal(t, 2, report.OrphanedMeta)
+	assert.Empty(t, db.metas)
+	assert.NotContains(t, blobs.refs, metas[0].DataKey())
+	assert.Empty(t, blobs.deleting)
+	assert.Equal(t, Usage{}, tracker.usage[TenantUsageScope("acme")])
+}
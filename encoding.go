@@ -0,0 +1,125 @@
+package assetstore
+
+import (
+	"fmt"
+	"io"
+	"time"
+)
+
+//Data handlers can be decorated to transform data as it's stored (see CompressingDataHandler).  Decorators record
+//how they encoded each asset's data in its meta, so data stored different ways can always be read back.
+
+//AssetDataEncoder is an AssetDataHandler that encodes data as it's written, recording how in the asset's meta, so
+//it can be decoded when read.  Its plain Reader and Writer pass data through as stored, e.g. to copy it.
+type AssetDataEncoder interface {
+	AssetDataHandler
+	WriteEncoded(meta *AssetMeta, key string, reader io.ReadCloser) (n int64, err error)
+	//ReadDecoded decodes data, except for encodings in accept, which it's returned in
+	ReadDecoded(meta AssetMeta, key string, accept ...string) (reader io.ReadCloser, encoding string, err error)
+}
+
+//writeEncoded writes an asset's data, encoded if the handler encodes, returning the size of the data before encoding
+func writeEncoded(h AssetDataHandler, meta *AssetMeta, key string, reader io.ReadCloser) (n int64, err error) {
+	if e, ok := h.(AssetDataEncoder); ok {
+		return e.WriteEncoded(meta, key, reader)
+	}
+	return h.Writer(key, reader)
+}
+
+//readDecoded reads an asset's data, decoded if the handler encodes
+func readDecoded(h AssetDataHandler, meta AssetMeta, key string, accept ...string) (reader io.ReadCloser, encoding string, err error) {
+	if e, ok := h.(AssetDataEncoder); ok {
+		return e.ReadDecoded(meta, key, accept...)
+	}
+	reader, err = h.Reader(key)
+	return reader, "", err
+}
+
+//dataHandlerDecorator forwards the optional data handler interfaces to the handler a decorator wraps, falling
+//back to streaming through it
+type dataHandlerDecorator struct {
+	AssetDataHandler
+}
+
+func (d dataHandlerDecorator) Stat(key string) (obj DataObject, err error) {
+	if statter, ok := d.AssetDataHandler.(AssetDataStatter); ok {
+		return statter.Stat(key)
+	}
+	reader, err := d.AssetDataHandler.Reader(key)
+	if err != nil {
+		return
+	}
+	return DataObject{Key: key}, reader.Close()
+}
+
+func (d dataHandlerDecorator) List(cursor string, limit int) (objects []DataObject, next string, err error) {
+	if lister, ok := d.AssetDataHandler.(AssetDataLister); ok {
+		return lister.List(cursor, limit)
+	}
+	return nil, "", fmt.Errorf("%T can't list data", d.AssetDataHandler)
+}
+
+//SignURL signs urls for the data as stored, so is only any use for data stored as is
+func (d dataHandlerDecorator) SignURL(key, filename string, ttl time.Duration) (url string, err error) {
+	if signer, ok := d.AssetDataHandler.(URLSigner); ok {
+		return signer.SignURL(key, filename, ttl)
+	}
+	return "", ErrSigningUnsupported
+}
+
+//SignUpload and StartMultipartUpload sign uploads of data as stored, so are only any use for decorators that can
+//read data stored as is
+func (d dataHandlerDecorator) SignUpload(key string, ttl time.Duration) (url string, err error) {
+	if signer, ok := d.AssetDataHandler.(UploadSigner); ok {
+		return signer.SignUpload(key, ttl)
+	}
+	return "", ErrSigningUnsupported
+}
+
+func (d dataHandlerDecorator) StartMultipartUpload(key string, parts int, ttl time.Duration) (uploadID string, urls []string, err error) {
+	if signer, ok := d.AssetDataHandler.(UploadSigner); ok {
+		return signer.StartMultipartUpload(key, parts, ttl)
+	}
+	return "", nil, ErrSigningUnsupported
+}
+
+//StartMultipartWrite and WritePart write parts of data as stored, like signed uploads
+func (d dataHandlerDecorator) StartMultipartWrite(key string) (uploadID string, err error) {
+	if writer, ok := d.AssetDataHandler.(MultipartWriter); ok {
+		return writer.StartMultipartWrite(key)
+	}
+	return "", ErrMultipartUnsupported
+}
+
+func (d dataHandlerDecorator) WritePart(key, uploadID string, number int64, part io.ReadSeeker) (uploaded UploadPart, err error) {
+	if writer, ok := d.AssetDataHandler.(MultipartWriter); ok {
+		return writer.WritePart(key, uploadID, number, part)
+	}
+	return uploaded, ErrMultipartUnsupported
+}
+
+func (d dataHandlerDecorator) CompleteMultipartUpload(key, uploadID string, parts []UploadPart) (err error) {
+	if completer, ok := d.AssetDataHandler.(multipartCompleter); ok {
+		return completer.CompleteMultipartUpload(key, uploadID, parts)
+	}
+	return ErrMultipartUnsupported
+}
+
+func (d dataHandlerDecorator) AbortMultipartUpload(key, uploadID string) (err error) {
+	if completer, ok := d.AssetDataHandler.(multipartCompleter); ok {
+		return completer.AbortMultipartUpload(key, uploadID)
+	}
+	return ErrMultipartUnsupported
+}
+
+func (d dataHandlerDecorator) Copy(from, to string) (err error) {
+	if copier, ok := d.AssetDataHandler.(AssetDataCopier); ok {
+		return copier.Copy(from, to)
+	}
+	reader, err := d.AssetDataHandler.Reader(from)
+	if err != nil {
+		return
+	}
+	_, err = d.AssetDataHandler.Writer(to, reader)
+	return
+}
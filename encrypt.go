@@ -0,0 +1,470 @@
+package assetstore
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+//Envelope encryption: every asset's data is encrypted with its own random data key, in AES-GCM chunks so it can be
+//streamed.  The data key is stored in the asset's meta, wrapped (encrypted) with a master key from a KeyProvider.
+//Rotating master keys only re-wraps data keys, the data itself is never rewritten.
+
+//KeyProvider wraps and unwraps data keys with master keys it holds
+type KeyProvider interface {
+	//WrapKey wraps a data key with the current master key, returning that key's id
+	WrapKey(dataKey []byte) (wrapped []byte, keyID string, err error)
+	UnwrapKey(wrapped []byte, keyID string) (dataKey []byte, err error)
+	//CurrentKeyID is the id of the master key new data keys are wrapped with
+	CurrentKeyID() string
+}
+
+//LocalKeyProvider holds 256 bit AES master keys by id, e.g. loaded from a file (see LoadLocalKeyProvider)
+type LocalKeyProvider struct {
+	current string
+	keys map[string][]byte
+}
+
+func NewLocalKeyProvider(current string, keys map[string][]byte) (*LocalKeyProvider, error) {
+	for id, key := range keys {
+		if len(key) != 32 {
+			return nil, fmt.Errorf("master key %s must be 32 bytes, not %d", id, len(key))
+		}
+	}
+	if _, ok := keys[current]; !ok {
+		return nil, fmt.Errorf("no current master key %s", current)
+	}
+	return &LocalKeyProvider{current: current, keys: keys}, nil
+}
+
+//LoadLocalKeyProvider reads master keys from a json file like:
+//  {"current": "2024-01", "keys": {"2023-06": "<base64 key>", "2024-01": "<base64 key>"}}
+//To rotate, add a new key, make it current, and run a KeyRotator.  Old keys can be removed once it's done.
+func LoadLocalKeyProvider(file string) (*LocalKeyProvider, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	f := struct {
+		Current string `json:"current"`
+		Keys map[string]string `json:"keys"`
+	}{}
+	if err = json.Unmarshal(b, &f); err != nil {
+		return nil, err
+	}
+	keys := map[string][]byte{}
+	for id, encoded := range f.Keys {
+		if keys[id], err = base64.StdEncoding.DecodeString(encoded); err != nil {
+			return nil, fmt.Errorf("master key %s: %w", id, err)
+		}
+	}
+	return NewLocalKeyProvider(f.Current, keys)
+}
+
+func (p *LocalKeyProvider) CurrentKeyID() string {
+	return p.current
+}
+
+func (p *LocalKeyProvider) WrapKey(dataKey []byte) (wrapped []byte, keyID string, err error) {
+	aead, err := newGCM(p.keys[p.current])
+	if err != nil {
+		return
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return
+	}
+	return aead.Seal(nonce, nonce, dataKey, []byte(p.current)), p.current, nil
+}
+
+func (p *LocalKeyProvider) UnwrapKey(wrapped []byte, keyID string) (dataKey []byte, err error) {
+	master, ok := p.keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("unknown master key %s", keyID)
+	}
+	aead, err := newGCM(master)
+	if err != nil {
+		return
+	}
+	if len(wrapped) < aead.NonceSize() {
+		return nil, fmt.Errorf("wrapped key is too short")
+	}
+	return aead.Open(nil, wrapped[:aead.NonceSize()], wrapped[aead.NonceSize():], []byte(keyID))
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+const (
+	//encryptionVersion is the first byte of encrypted data, in case the format ever changes
+	encryptionVersion = 1
+	//encryptionHeaderLen is the version and chunk size
+	encryptionHeaderLen = 5
+	//maxEncryptedChunkSize guards against allocating huge buffers for corrupt headers
+	maxEncryptedChunkSize = 16 * 1024 * 1024
+)
+
+//EncryptingDataHandler encrypts asset data as it's written, and decrypts it as it's read.  Data stored before
+//encryption was enabled is read as is.  Wrap it in a CompressingDataHandler, not the other way round, as encrypted
+//data doesn't compress.
+type EncryptingDataHandler struct {
+	dataHandlerDecorator
+	keys KeyProvider
+	//ChunkSize is how much data is encrypted (and authenticated) at a time
+	ChunkSize int
+}
+
+func NewEncryptingDataHandler(dataHandler AssetDataHandler, keys KeyProvider) *EncryptingDataHandler {
+	return &EncryptingDataHandler{
+		dataHandlerDecorator: dataHandlerDecorator{dataHandler},
+		keys: keys,
+		ChunkSize: 64 * 1024,
+	}
+}
+
+//SignUpload refuses to sign uploads, which would be stored unencrypted
+func (h *EncryptingDataHandler) SignUpload(key string, ttl time.Duration) (url string, err error) {
+	return "", ErrSigningUnsupported
+}
+
+func (h *EncryptingDataHandler) StartMultipartUpload(key string, parts int, ttl time.Duration) (uploadID string, urls []string, err error) {
+	return "", nil, ErrSigningUnsupported
+}
+
+//StartMultipartWrite refuses multipart writes, whose parts would be stored unencrypted
+func (h *EncryptingDataHandler) StartMultipartWrite(key string) (uploadID string, err error) {
+	return "", ErrMultipartUnsupported
+}
+
+func (h *EncryptingDataHandler) WriteEncoded(meta *AssetMeta, key string, reader io.ReadCloser) (n int64, err error) {
+	defer reader.Close()
+	if h.ChunkSize <= 0 || h.ChunkSize > maxEncryptedChunkSize {
+		return 0, fmt.Errorf("invalid chunk size %d", h.ChunkSize)
+	}
+	dataKey := make([]byte, 32)
+	if _, err = rand.Read(dataKey); err != nil {
+		return
+	}
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return
+	}
+	wrapped, keyID, err := h.keys.WrapKey(dataKey)
+	if err != nil {
+		return
+	}
+	meta.KeyID, meta.WrappedKey = keyID, base64.StdEncoding.EncodeToString(wrapped)
+	//encrypt into a pipe the wrapped handler reads from
+	pr, pw := io.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		var encryptErr error
+		n, encryptErr = encryptStream(pw, reader, aead, h.ChunkSize)
+		pw.CloseWithError(encryptErr)
+	}()
+	_, err = writeEncoded(h.AssetDataHandler, meta, key, pr)
+	//unblock the encrypter if the write gave up early
+	pr.Close()
+	<-done
+	return n, err
+}
+
+func (h *EncryptingDataHandler) ReadDecoded(meta AssetMeta, key string, accept ...string) (reader io.ReadCloser, encoding string, err error) {
+	if meta.WrappedKey == "" {
+		return readDecoded(h.AssetDataHandler, meta, key, accept...)
+	}
+	aead, err := dataKeyAEAD(h.keys, meta)
+	if err != nil {
+		return
+	}
+	reader, encoding, err = readDecoded(h.AssetDataHandler, meta, key, accept...)
+	if err != nil {
+		return
+	}
+	return &decryptReader{source: reader, aead: aead}, encoding, nil
+}
+
+//dataKeyAEAD unwraps an asset's data key, ready to decrypt with
+func dataKeyAEAD(keys KeyProvider, meta AssetMeta) (cipher.AEAD, error) {
+	wrapped, err := base64.StdEncoding.DecodeString(meta.WrappedKey)
+	if err != nil {
+		return nil, err
+	}
+	dataKey, err := keys.UnwrapKey(wrapped, meta.KeyID)
+	if err != nil {
+		return nil, err
+	}
+	return newGCM(dataKey)
+}
+
+//chunkNonce is the nonce of the counter'th chunk.  Every asset has its own key, so counters never repeat under
+//one.  The last chunk is flagged, so truncation at a chunk boundary is detected.
+func chunkNonce(counter uint64, last bool) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[3:11], counter)
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+//encryptStream encrypts r to w in chunks of chunkSize, returning how much it read.  Every chunk but the last is
+//full, and the last is always short (if need be, empty), so readers know where the data ends.
+func encryptStream(w io.Writer, r io.Reader, aead cipher.AEAD, chunkSize int) (n int64, err error) {
+	header := make([]byte, encryptionHeaderLen)
+	header[0] = encryptionVersion
+	binary.BigEndian.PutUint32(header[1:], uint32(chunkSize))
+	if _, err = w.Write(header); err != nil {
+		return
+	}
+	buf := make([]byte, chunkSize)
+	for counter := uint64(0); ; counter++ {
+		m, readErr := io.ReadFull(r, buf)
+		n += int64(m)
+		if readErr != nil && readErr != io.EOF && readErr != io.ErrUnexpectedEOF {
+			return n, readErr
+		}
+		last := m < chunkSize
+		if _, err = w.Write(aead.Seal(nil, chunkNonce(counter, last), buf[:m], header)); err != nil {
+			return
+		}
+		if last {
+			return n, nil
+		}
+	}
+}
+
+//decryptReader decrypts data written by encryptStream, failing with ErrAssetCorrupt if it's been tampered with
+type decryptReader struct {
+	source io.ReadCloser
+	aead cipher.AEAD
+	header []byte
+	chunk []byte
+	counter uint64
+	plain []byte
+	done bool
+}
+
+func (r *decryptReader) Read(p []byte) (n int, err error) {
+	for len(r.plain) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		if err = r.next(); err != nil {
+			return 0, err
+		}
+	}
+	n = copy(p, r.plain)
+	r.plain = r.plain[n:]
+	return n, nil
+}
+
+//next decrypts the next chunk
+func (r *decryptReader) next() (err error) {
+	if r.header == nil {
+		header := make([]byte, encryptionHeaderLen)
+		if _, err = io.ReadFull(r.source, header); err != nil {
+			return fmt.Errorf("%w: encrypted data header: %v", ErrAssetCorrupt, err)
+		}
+		chunkSize := binary.BigEndian.Uint32(header[1:])
+		if header[0] != encryptionVersion || chunkSize == 0 || chunkSize > maxEncryptedChunkSize {
+			return fmt.Errorf("%w: unsupported encrypted data header", ErrAssetCorrupt)
+		}
+		r.header = header
+		r.chunk = make([]byte, int(chunkSize)+r.aead.Overhead())
+	}
+	m, err := io.ReadFull(r.source, r.chunk)
+	switch err {
+	case nil:
+	case io.ErrUnexpectedEOF:
+		r.done = true
+	case io.EOF:
+		return fmt.Errorf("%w: encrypted data is truncated", ErrAssetCorrupt)
+	default:
+		return err
+	}
+	r.plain, err = r.aead.Open(r.chunk[:0], chunkNonce(r.counter, r.done), r.chunk[:m], r.header)
+	if err != nil {
+		return fmt.Errorf("%w: decrypting chunk %d: %v", ErrAssetCorrupt, r.counter, err)
+	}
+	r.counter++
+	return nil
+}
+
+func (r *decryptReader) Close() error {
+	return r.source.Close()
+}
+
+type KeyRotationReport struct {
+	Checked int `json:"checked"`
+	Rewrapped int `json:"rewrapped"`
+	//Assets changed or deleted while their key was re-wrapped, left for the next pass
+	Skipped int `json:"skipped"`
+	Errors int `json:"errors"`
+}
+
+//MetaKeyUpdater sets the data key of an asset's meta, by its tenant scoped key, leaving its other fields as they are,
+//only if it's still at meta's revision, or returns ErrRevisionMismatch.  It doesn't bump the revision, as re-wrapping
+//a key isn't a change to the asset.
+type MetaKeyUpdater interface {
+	UpdateMetaKey(meta AssetMeta) (err error)
+}
+
+//KeyRotator re-wraps data keys wrapped with old master keys with the current one, so old master keys can be retired
+type KeyRotator struct {
+	storage *AssetStorage
+	metaLister MetaLister
+	keys KeyProvider
+	PageSize int
+}
+
+func NewKeyRotator(storage *AssetStorage, metaLister MetaLister, keys KeyProvider) *KeyRotator {
+	return &KeyRotator{
+		storage: storage,
+		metaLister: metaLister,
+		keys: keys,
+		PageSize: 500,
+	}
+}
+
+//Rotate makes one pass over all meta, and assets' previous versions, re-wrapping data keys that aren't wrapped with
+//the current master key
+func (k *KeyRotator) Rotate() (report KeyRotationReport, err error) {
+	start := time.Now()
+	cursor := ""
+	for {
+		metas, next, err := k.metaLister.ListMeta(cursor, k.PageSize)
+		if err != nil {
+			return report, err
+		}
+		for _, meta := range metas {
+			k.rotateAsset(meta, &report)
+			if meta.Version > 0 {
+				k.rotateVersions(meta, &report)
+			}
+		}
+		if next == "" {
+			log.WithFields(log.Fields{
+				"context": "KeyRotator.Rotate()",
+				"report": report,
+				"took": time.Since(start).String(),
+			}).Info("rotated keys")
+			return report, nil
+		}
+		cursor = next
+	}
+}
+
+func (k *KeyRotator) rotateAsset(meta AssetMeta, report *KeyRotationReport) {
+	if meta.WrappedKey == "" {
+		return
+	}
+	report.Checked++
+	if meta.KeyID == k.keys.CurrentKeyID() {
+		return
+	}
+	updater, ok := k.storage.metaHandler.(MetaKeyUpdater)
+	if !ok {
+		report.Errors++
+		log.WithFields(log.Fields{
+			"context": "KeyRotator.rotateAsset()",
+			"meta": meta,
+		}).Error("meta keys can't be updated")
+		return
+	}
+	//only the re-wrapped key is written, and only if the asset's still at the revision it was read at, so neither
+	//changes made meanwhile, nor statuses and access times recorded since the listing, are reverted, nor deleted
+	//assets brought back
+	err := k.rewrap(&meta)
+	if err == nil {
+		err = updater.UpdateMetaKey(meta)
+	}
+	if errors.Is(err, ErrRevisionMismatch) || errors.Is(err, ErrNotFound) {
+		report.Skipped++
+		return
+	}
+	if err != nil {
+		report.Errors++
+		log.WithFields(log.Fields{
+			"context": "KeyRotator.rotateAsset()",
+			"meta": meta,
+		}).Error(err)
+		return
+	}
+	report.Rewrapped++
+}
+
+//rotateVersions re-wraps the data keys of an asset's previous versions, which are never changed otherwise
+func (k *KeyRotator) rotateVersions(meta AssetMeta, report *KeyRotationReport) {
+	handler, ok := k.storage.metaHandler.(VersionHandler)
+	if !ok {
+		return
+	}
+	versions, err := handler.ListVersions(meta.Key())
+	if err != nil {
+		report.Errors++
+		log.WithFields(log.Fields{
+			"context": "KeyRotator.rotateVersions()",
+			"meta": meta,
+		}).Error(err)
+		return
+	}
+	for _, version := range versions {
+		if version.WrappedKey == "" {
+			continue
+		}
+		report.Checked++
+		if version.KeyID == k.keys.CurrentKeyID() {
+			continue
+		}
+		err := k.rewrap(&version)
+		if err == nil {
+			err = handler.UpdateVersionKey(version)
+		}
+		if errors.Is(err, ErrNotFound) {
+			report.Skipped++
+			continue
+		}
+		if err != nil {
+			report.Errors++
+			log.WithFields(log.Fields{
+				"context": "KeyRotator.rotateVersions()",
+				"version": version,
+			}).Error(err)
+			continue
+		}
+		report.Rewrapped++
+	}
+}
+
+func (k *KeyRotator) rewrap(meta *AssetMeta) error {
+	wrapped, err := base64.StdEncoding.DecodeString(meta.WrappedKey)
+	if err != nil {
+		return err
+	}
+	dataKey, err := k.keys.UnwrapKey(wrapped, meta.KeyID)
+	if err != nil {
+		return err
+	}
+	if wrapped, meta.KeyID, err = k.keys.WrapKey(dataKey); err != nil {
+		return err
+	}
+	meta.WrappedKey = base64.StdEncoding.EncodeToString(wrapped)
+	return nil
+}
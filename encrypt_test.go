@@ -0,0 +1,220 @@
+package assetstore
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func testKeyProvider(t *testing.T, current string, ids ...string) *LocalKeyProvider {
+	keys := map[string][]byte{}
+	for i, id := range ids {
+		keys[id] = bytes.Repeat([]byte{byte(i + 1)}, 32)
+	}
+	p, err := NewLocalKeyProvider(current, keys)
+	assert.NoError(t, err)
+	return p
+}
+
+func TestEncryptingDataHandler(t *testing.T) {
+	db := newMemMetaTokenStore()
+	data := newMemDataStore()
+	keys := testKeyProvider(t, "k1", "k1")
+	encrypter := NewEncryptingDataHandler(data, keys)
+	encrypter.ChunkSize = 16
+	s := NewAssetStorage(db, db, encrypter)
+
+	tests := []struct {
+		name    string
+		content string
+	}{
+		{"empty", ""},
+		{"short", "secret"},
+		{"exactly one chunk", strings.Repeat("a", 16)},
+		{"several chunks", strings.Repeat("customer data ", 10)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			meta := AssetMeta{ID: uuid.New().String(), Name: "f.txt"}
+			stored, err := s.Store(meta, AssetToken{}, ioutil.NopCloser(strings.NewReader(tt.content)))
+			assert.NoError(t, err)
+			assert.Equal(t, len(tt.content), stored.Size)
+			assert.Equal(t, "k1", stored.KeyID)
+			assert.NotEmpty(t, stored.WrappedKey)
+			if tt.content != "" {
+				assert.False(t, bytes.Contains(data.data[stored.Key()], []byte(tt.content)))
+			}
+			_, asset, err := s.GetByID(stored.Key())
+			assert.NoError(t, err)
+			assert.Equal(t, tt.content, readAll(t, asset))
+		})
+	}
+
+	//tampering or truncation is detected, and scrubbed assets marked corrupt
+	meta, err := s.Store(AssetMeta{ID: uuid.New().String(), Name: "f.txt"}, AssetToken{},
+		ioutil.NopCloser(strings.NewReader(strings.Repeat("x", 40))))
+	assert.NoError(t, err)
+	stored := data.data[meta.Key()]
+	for _, damaged := range [][]byte{
+		append(append([]byte{}, stored[:len(stored)-1]...), stored[len(stored)-1]^1),
+		stored[:encryptionHeaderLen+16+16],
+	} {
+		data.data[meta.Key()] = damaged
+		_, asset, err := s.GetByID(meta.Key())
+		assert.NoError(t, err)
+		_, err = ioutil.ReadAll(asset)
+		assert.True(t, errors.Is(err, ErrAssetCorrupt))
+	}
+	report, err := NewScrubber(s, db, NewFileCheckpointStore(t.TempDir()), s.dataHandler).Scrub(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{meta.Key()}, report.Corrupt)
+}
+
+func TestKeyRotator_Rotate(t *testing.T) {
+	db := newMemMetaTokenStore()
+	data := newMemDataStore()
+	old := testKeyProvider(t, "k1", "k1", "k2")
+	s := NewAssetStorage(db, db, NewEncryptingDataHandler(data, old))
+	meta, err := s.Store(AssetMeta{ID: uuid.New().String(), Name: "f.txt"}, AssetToken{},
+		ioutil.NopCloser(strings.NewReader("secret")))
+	assert.NoError(t, err)
+	stored := append([]byte{}, data.data[meta.Key()]...)
+	replaced, err := s.Replace(meta.Key(), 0, ioutil.NopCloser(strings.NewReader("new secret")))
+	assert.NoError(t, err)
+
+	//after rotating to k2, k1 can be retired, and the data is untouched, previous versions' included
+	rotated := testKeyProvider(t, "k2", "k1", "k2")
+	report, err := NewKeyRotator(s, db, rotated).Rotate()
+	assert.NoError(t, err)
+	assert.Equal(t, KeyRotationReport{Checked: 2, Rewrapped: 2}, report)
+	assert.Equal(t, stored, data.data[meta.Key()])
+
+	k2Only, err := NewLocalKeyProvider("k2", map[string][]byte{"k2": rotated.keys["k2"]})
+	assert.NoError(t, err)
+	s = NewAssetStorage(db, db, NewEncryptingDataHandler(data, k2Only))
+	rotatedMeta, asset, err := s.GetByID(meta.Key())
+	assert.NoError(t, err)
+	assert.Equal(t, "k2", rotatedMeta.KeyID)
+	assert.Equal(t, replaced.DataKey(), rotatedMeta.DataKey())
+	assert.Equal(t, "new secret", readAll(t, asset))
+	version, err := db.GetVersion(meta.Key(), meta.Version)
+	assert.NoError(t, err)
+	assert.Equal(t, "k2", version.KeyID)
+	asset, _, err = readDecoded(s.dataHandler, version, version.DataKey())
+	assert.NoError(t, err)
+	assert.Equal(t, "secret", readAll(t, asset))
+
+	//a second pass has nothing to do
+	report, err = NewKeyRotator(s, db, k2Only).Rotate()
+	assert.NoError(t, err)
+	assert.Equal(t, KeyRotationReport{Checked: 2}, report)
+}
+
+//hookedKeyProvider runs beforeWrap before wrapping a key
+type hookedKeyProvider struct {
+	KeyProvider
+	beforeWrap func()
+}
+
+func (h hookedKeyProvider) WrapKey(dataKey []byte) (wrapped []byte, keyID string, err error) {
+	h.beforeWrap()
+	return h.KeyProvider.WrapKey(dataKey)
+}
+
+func TestKeyRotator_ConcurrentChanges(t *testing.T) {
+	db := newMemMetaTokenStore()
+	data := newMemDataStore()
+	old := testKeyProvider(t, "k1", "k1", "k2")
+	s := NewAssetStorage(db, db, NewEncryptingDataHandler(data, old))
+	store := func(name string) AssetMeta {
+		meta, err := s.Store(AssetMeta{ID: uuid.New().String(), Name: name}, AssetToken{},
+			ioutil.NopCloser(strings.NewReader("secret")))
+		assert.NoError(t, err)
+		return meta
+	}
+	renamed := store("reprot.txt")
+	deleted := store("deleted.txt")
+	checked := store("checked.txt")
+
+	//assets changed or deleted while their keys are re-wrapped are left as they were changed, for the next pass,
+	//while scan results, corrupt marks and access times recorded meanwhile are kept alongside the re-wrapped key
+	name := "report.txt"
+	rotated := hookedKeyProvider{KeyProvider: testKeyProvider(t, "k2", "k1", "k2"), beforeWrap: func() {
+		if meta, ok := db.metas[checked.Key()]; ok && meta.Accessed == 0 {
+			meta.ScanStatus = ScanInfected
+			meta.State = StateCorrupt
+			assert.NoError(t, db.UpdateScanStatus(meta))
+			assert.NoError(t, db.UpdateState(meta))
+			assert.NoError(t, db.RecordAccess(meta, 1234))
+		}
+		if meta, ok := db.metas[renamed.Key()]; ok && meta.Revision == 0 {
+			_, err := s.UpdateMeta(renamed.Key(), MetaUpdate{Name: &name}, 0)
+			assert.NoError(t, err)
+		}
+		if _, ok := db.metas[deleted.Key()]; ok {
+			assert.NoError(t, s.Delete(deleted.Key()))
+		}
+	}}
+	report, err := NewKeyRotator(s, db, rotated).Rotate()
+	assert.NoError(t, err)
+	assert.Equal(t, KeyRotationReport{Checked: 3, Rewrapped: 1, Skipped: 2}, report)
+	assert.Equal(t, name, db.metas[renamed.Key()].Name)
+	assert.Equal(t, "k1", db.metas[renamed.Key()].KeyID)
+	assert.NotContains(t, db.metas, deleted.Key())
+	assert.Equal(t, "k2", db.metas[checked.Key()].KeyID)
+	assert.Equal(t, ScanInfected, db.metas[checked.Key()].ScanStatus)
+	assert.Equal(t, StateCorrupt, db.metas[checked.Key()].State)
+	assert.Equal(t, int64(1234), db.metas[checked.Key()].Accessed)
+
+	report, err = NewKeyRotator(s, db, rotated).Rotate()
+	assert.NoError(t, err)
+	assert.Equal(t, KeyRotationReport{Checked: 2, Rewrapped: 1}, report)
+	assert.Equal(t, name, db.metas[renamed.Key()].Name)
+	assert.Equal(t, "k2", db.metas[renamed.Key()].KeyID)
+}
+
+func TestLoadLocalKeyProvider(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "keys.json")
+	key := "AQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQE="
+	assert.NoError(t, ioutil.WriteFile(file, []byte(`{"current":"a","keys":{"a":"`+key+`"}}`), 0600))
+	p, err := LoadLocalKeyProvider(file)
+	assert.NoError(t, err)
+	wrapped, id, err := p.WrapKey([]byte("0123456789abcdef0123456789abcdef"))
+	assert.NoError(t, err)
+	assert.Equal(t, "a", id)
+	dataKey, err := p.UnwrapKey(wrapped, id)
+	assert.NoError(t, err)
+	assert.Equal(t, "0123456789abcdef0123456789abcdef", string(dataKey))
+	_, err = p.UnwrapKey(wrapped, "b")
+	assert.Error(t, err)
+
+	assert.NoError(t, ioutil.WriteFile(file, []byte(`{"current":"b","keys":{"a":"`+key+`"}}`), 0600))
+	_, err = LoadLocalKeyProvider(file)
+	assert.Error(t, err)
+}
+
+func TestCompressedEncryptedAssets(t *testing.T) {
+	db := newMemMetaTokenStore()
+	data := newMemDataStore()
+	s := NewAssetStorage(db, db,
+		NewCompressingDataHandler(NewEncryptingDataHandler(data, testKeyProvider(t, "k1", "k1"))),
+		WithDedup(newMemBlobRefs()))
+	content := strings.Repeat("compressible ", 100)
+	meta, err := s.Store(AssetMeta{ID: uuid.New().String(), Name: "f.txt"}, AssetToken{},
+		ioutil.NopCloser(strings.NewReader(content)))
+	assert.NoError(t, err)
+	assert.Equal(t, GzipEncoding, meta.Encoding)
+	assert.NotEmpty(t, meta.WrappedKey)
+	assert.Equal(t, "", meta.Blob)
+	assert.Len(t, data.data, 1)
+	assert.True(t, len(data.data[meta.Key()]) < len(content)/4)
+	_, asset, err := s.GetByID(meta.Key())
+	assert.NoError(t, err)
+	assert.Equal(t, content, readAll(t, asset))
+}
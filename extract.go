@@ -0,0 +1,234 @@
+package assetstore
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+)
+
+//Uploaded zip, tar and tar.gz archives can be extracted, storing each file in them as an asset of its own.  Tars are
+//extracted as they're streamed, but a zip's directory is at its end, so zips are spooled to a temporary file first.
+//Extraction stops if an archive expands too far (e.g. a zip bomb), and entries with paths outside the archive, or
+//which aren't regular files, aren't stored.
+
+//ErrExtractLimit is returned extracting an archive that expands beyond the extraction limits
+var ErrExtractLimit = errors.New("archive expands beyond extraction limits")
+
+//maxExtractEntries is the most files extracted from an archive
+var maxExtractEntries = 10000
+
+//maxExtractBytes is the most data extracted from an archive
+var maxExtractBytes int64 = 10 * 1024 * 1024 * 1024
+
+//maxExtractRatio is how many times bigger than the archive read so far the data extracted from it can be, plus
+//extractRatioSlack, so small archives of very compressible files still extract
+var maxExtractRatio int64 = 100
+
+const extractRatioSlack = 1024 * 1024
+
+//ExtractedAsset is the result of storing a file in an extracted archive
+type ExtractedAsset struct {
+	//Path of the file in the archive
+	Path string `json:"path"`
+	Meta AssetMeta `json:"asset"`
+	Token AssetToken `json:"token,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+//ExtractArchive stores each regular file in a zip, tar or tar.gz archive as an asset with storer, the meta and token
+//of which newAsset makes from its path, limiting each file to limit bytes (unlimited if 0).  It returns a manifest of
+//what was stored, in order, with any errors storing each file.  If the archive can't be read, or expands beyond the
+//extraction limits, it returns an error too, and the manifest of what was stored up to then.
+func ExtractArchive(storer AssetStorer, archive io.Reader, limit int64, newAsset func(path string) (AssetMeta, AssetToken, error)) (manifest []ExtractedAsset, err error) {
+	guard := &extractGuard{archive: &countingReader{Reader: archive}}
+	each := func(name string, entry io.Reader) bool {
+		result := ExtractedAsset{Path: name}
+		cleaned, pathErr := extractPath(name)
+		if pathErr != nil {
+			result.Error = pathErr.Error()
+			manifest = append(manifest, result)
+			return true
+		}
+		result.Path = cleaned
+		guard.entries++
+		if guard.entries > maxExtractEntries {
+			err = fmt.Errorf("%w: more than %d files", ErrExtractLimit, maxExtractEntries)
+			return false
+		}
+		meta, token, storeErr := newAsset(cleaned)
+		if storeErr == nil {
+			meta, storeErr = storer.Store(meta, token, NewLimitedReadCloser(ioutil.NopCloser(guard.reader(entry)), limit))
+		}
+		switch {
+		case guard.err != nil:
+			//stored data may have been cut short, and nothing more's going to be extracted
+			err = guard.err
+			return false
+		case errors.Is(storeErr, ErrTokenNotStored):
+			result.Meta, result.Error = meta, storeErr.Error()
+		case storeErr != nil:
+			result.Error = storeErr.Error()
+		default:
+			result.Meta, result.Token = meta, token
+		}
+		manifest = append(manifest, result)
+		return true
+	}
+
+	buffered := bufio.NewReader(guard.archive)
+	magic, _ := buffered.Peek(4)
+	switch {
+	case bytes.HasPrefix(magic, []byte("PK\x03\x04")):
+		readErr := extractZip(buffered, each)
+		if err == nil {
+			err = readErr
+		}
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		gz, gzErr := gzip.NewReader(buffered)
+		if gzErr != nil {
+			return nil, gzErr
+		}
+		readErr := extractTar(gz, each)
+		if err == nil {
+			err = readErr
+		}
+	default:
+		readErr := extractTar(buffered, each)
+		if err == nil {
+			err = readErr
+		}
+	}
+	return manifest, err
+}
+
+//extractTar calls each with every regular file in a tar, until it returns false
+func extractTar(archive io.Reader, each func(name string, entry io.Reader) bool) error {
+	tr := tar.NewReader(archive)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("archive could not be read: %w", err)
+		}
+		if h.Typeflag != tar.TypeReg && h.Typeflag != tar.TypeRegA {
+			continue
+		}
+		if !each(h.Name, tr) {
+			return nil
+		}
+	}
+}
+
+//extractZip spools a zip to a temporary file, then calls each with every regular file in it, until it returns false
+func extractZip(archive io.Reader, each func(name string, entry io.Reader) bool) error {
+	spool, err := ioutil.TempFile("", "extract-")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		spool.Close()
+		os.Remove(spool.Name())
+	}()
+	size, err := io.Copy(spool, archive)
+	if err != nil {
+		return err
+	}
+	zr, err := zip.NewReader(spool, size)
+	if err != nil {
+		return fmt.Errorf("archive could not be read: %w", err)
+	}
+	for _, f := range zr.File {
+		if !f.Mode().IsRegular() {
+			continue
+		}
+		entry, err := f.Open()
+		if err != nil {
+			//e.g. an unsupported compression method, which only affects this file
+			entry = ioutil.NopCloser(&failingEntry{err})
+		}
+		more := each(f.Name, entry)
+		entry.Close()
+		if !more {
+			return nil
+		}
+	}
+	return nil
+}
+
+//failingEntry fails to be read, for files in an archive that can't be opened
+type failingEntry struct {
+	err error
+}
+
+func (f *failingEntry) Read(p []byte) (int, error) {
+	return 0, f.err
+}
+
+//extractPath cleans the path of a file in an archive, refusing any that would be outside it if it were extracted
+func extractPath(name string) (string, error) {
+	cleaned := path.Clean(strings.ReplaceAll(name, "\\", "/"))
+	if strings.HasPrefix(cleaned, "/") || strings.HasPrefix(cleaned, "../") || cleaned == ".." || cleaned == "." ||
+		strings.Contains(cleaned, "\x00") || (len(cleaned) > 1 && cleaned[1] == ':') {
+		return "", fmt.Errorf("unsafe path in archive")
+	}
+	return cleaned, nil
+}
+
+//countingReader counts the bytes read through it
+type countingReader struct {
+	io.Reader
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (n int, err error) {
+	n, err = r.Reader.Read(p)
+	r.n += int64(n)
+	return
+}
+
+//extractGuard keeps track of how much an archive's expanded, failing reads of its files once it's expanded too far
+type extractGuard struct {
+	archive *countingReader
+	entries int
+	extracted int64
+	err error
+}
+
+func (g *extractGuard) reader(entry io.Reader) io.Reader {
+	return &guardedEntry{Reader: entry, guard: g}
+}
+
+type guardedEntry struct {
+	io.Reader
+	guard *extractGuard
+}
+
+func (e *guardedEntry) Read(p []byte) (n int, err error) {
+	g := e.guard
+	if g.err != nil {
+		return 0, g.err
+	}
+	n, err = e.Reader.Read(p)
+	g.extracted += int64(n)
+	switch {
+	case g.extracted > maxExtractBytes:
+		g.err = fmt.Errorf("%w: more than %d bytes", ErrExtractLimit, maxExtractBytes)
+	case g.extracted > maxExtractRatio*g.archive.n+extractRatioSlack:
+		g.err = fmt.Errorf("%w: more than %d times its size", ErrExtractLimit, maxExtractRatio)
+	}
+	if g.err != nil {
+		return n, g.err
+	}
+	return
+}
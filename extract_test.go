@@ -0,0 +1,171 @@
+package assetstore
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+type archiveEntry struct {
+	name, content string
+	link bool
+}
+
+//makeArchive makes a zip, tar or tar.gz archive of entries
+func makeArchive(t *testing.T, format string, entries []archiveEntry) []byte {
+	buf := &bytes.Buffer{}
+	if format == ArchiveZip {
+		zw := zip.NewWriter(buf)
+		for _, e := range entries {
+			h := &zip.FileHeader{Name: e.name, Method: zip.Deflate}
+			if e.link {
+				h.SetMode(0777 | os.ModeSymlink)
+			}
+			w, err := zw.CreateHeader(h)
+			assert.NoError(t, err)
+			w.Write([]byte(e.content))
+		}
+		assert.NoError(t, zw.Close())
+		return buf.Bytes()
+	}
+	var gz *gzip.Writer
+	tw := tar.NewWriter(buf)
+	if format == ArchiveTarGz {
+		gz = gzip.NewWriter(buf)
+		tw = tar.NewWriter(gz)
+	}
+	for _, e := range entries {
+		h := &tar.Header{Typeflag: tar.TypeReg, Name: e.name, Mode: 0644, Size: int64(len(e.content))}
+		if e.link {
+			h = &tar.Header{Typeflag: tar.TypeSymlink, Name: e.name, Linkname: e.content}
+		}
+		assert.NoError(t, tw.WriteHeader(h))
+		tw.Write([]byte(e.content))
+	}
+	assert.NoError(t, tw.Close())
+	if gz != nil {
+		assert.NoError(t, gz.Close())
+	}
+	return buf.Bytes()
+}
+
+func TestExtractArchive(t *testing.T) {
+	entries := []archiveEntry{
+		{name: "dist/app.js", content: "console.log(1)"},
+		{name: "dist/../index.html", content: "<html></html>"},
+		{name: "../../etc/passwd", content: "root"},
+		{name: "/abs.txt", content: "absolute"},
+		{name: "link", content: "/etc/passwd", link: true},
+		{name: "dist\\win.txt", content: "windows"},
+	}
+	for _, format := range []string{"tar", ArchiveTarGz, ArchiveZip} {
+		t.Run(format, func(t *testing.T) {
+			db := newMemMetaTokenStore()
+			s := NewAssetStorage(db, db, newMemDataStore())
+			manifest, err := ExtractArchive(s, bytes.NewReader(makeArchive(t, format, entries)), 0, func(path string) (AssetMeta, AssetToken, error) {
+				return AssetMeta{ID: uuid.New().String(), Name: path}, AssetToken{}, nil
+			})
+			assert.NoError(t, err)
+			want := []struct{ path, content, err string }{
+				{"dist/app.js", "console.log(1)", ""},
+				{"index.html", "<html></html>", ""},
+				{"../../etc/passwd", "", "unsafe path in archive"},
+				{"/abs.txt", "", "unsafe path in archive"},
+				{"dist/win.txt", "windows", ""},
+			}
+			if assert.Len(t, manifest, len(want)) {
+				for i, w := range want {
+					assert.Equal(t, w.path, manifest[i].Path)
+					assert.Equal(t, w.err, manifest[i].Error)
+					if w.err != "" {
+						assert.Empty(t, manifest[i].Meta.ID)
+						continue
+					}
+					meta, asset, err := s.GetByID(manifest[i].Meta.Key())
+					assert.NoError(t, err)
+					assert.Equal(t, w.path, meta.Name)
+					assert.Equal(t, w.content, readAll(t, asset))
+				}
+			}
+		})
+	}
+}
+
+func TestExtractArchive_Limits(t *testing.T) {
+	defer func(entries int, bytes, ratio int64) {
+		maxExtractEntries, maxExtractBytes, maxExtractRatio = entries, bytes, ratio
+	}(maxExtractEntries, maxExtractBytes, maxExtractRatio)
+
+	//a megabyte and a half of zeros compresses to almost nothing
+	bomb := []archiveEntry{{name: "a.txt", content: "a"}, {name: "zeros", content: strings.Repeat("\x00", 3*extractRatioSlack/2)}}
+	tests := []struct {
+		name    string
+		format  string
+		limit   int64
+		set     func()
+		entries []archiveEntry
+		stored  int
+		wantErr error
+	}{
+		{"too many files", ArchiveZip, 0, func() { maxExtractEntries = 1 }, bomb, 1, ErrExtractLimit},
+		{"too many bytes", ArchiveTarGz, 0, func() { maxExtractBytes = 1024 }, bomb, 1, ErrExtractLimit},
+		{"zip bomb", ArchiveZip, 0, func() { maxExtractRatio = 1 }, bomb, 1, ErrExtractLimit},
+		{"tar bomb", ArchiveTarGz, 0, func() { maxExtractRatio = 1 }, bomb, 1, ErrExtractLimit},
+		{"file too large", ArchiveTarGz, 1024, func() {}, bomb, 2, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			maxExtractEntries, maxExtractBytes, maxExtractRatio = 10000, 1024*1024*1024, 100
+			tt.set()
+			db := newMemMetaTokenStore()
+			s := NewAssetStorage(db, db, newMemDataStore())
+			manifest, err := ExtractArchive(s, bytes.NewReader(makeArchive(t, tt.format, tt.entries)), tt.limit, func(path string) (AssetMeta, AssetToken, error) {
+				return AssetMeta{ID: uuid.New().String(), Name: path}, AssetToken{}, nil
+			})
+			if tt.wantErr != nil {
+				assert.True(t, errors.Is(err, tt.wantErr))
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Len(t, manifest, tt.stored)
+			assert.Empty(t, manifest[0].Error)
+			if tt.stored > 1 {
+				assert.Contains(t, manifest[1].Error, ErrUploadTooLarge.Error())
+			}
+		})
+	}
+}
+
+func TestExtractPath(t *testing.T) {
+	tests := []struct {
+		name    string
+		want    string
+		wantErr bool
+	}{
+		{"a/b.txt", "a/b.txt", false},
+		{"./a//b/../c.txt", "a/c.txt", false},
+		{"a\\b.txt", "a/b.txt", false},
+		{"../a.txt", "", true},
+		{"a/../../b.txt", "", true},
+		{"/etc/passwd", "", true},
+		{"\\\\server\\share", "", true},
+		{"C:\\windows", "", true},
+		{".", "", true},
+		{"a\x00.txt", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := extractPath(tt.name)
+			assert.Equal(t, tt.wantErr, err != nil)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
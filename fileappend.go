@@ -0,0 +1,85 @@
+package assetstore
+
+import (
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/google/uuid"
+)
+
+//FileChunkAppender builds objects up by appending chunks to files in a local directory.  Uploads being appended to
+//have to be routed to the same server, unlike with S3Storage.
+type FileChunkAppender struct {
+	dir string
+}
+
+func NewFileChunkAppender(dir string) (*FileChunkAppender, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &FileChunkAppender{dir: dir}, nil
+}
+
+func (a *FileChunkAppender) path(key, appendID string) string {
+	return filepath.Join(a.dir, url.PathEscape(key)+"."+appendID)
+}
+
+func (a *FileChunkAppender) StartAppend(key string) (appendID string, err error) {
+	appendID = uuid.New().String()
+	f, err := os.OpenFile(a.path(key, appendID), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return "", err
+	}
+	return appendID, f.Close()
+}
+
+//AppendChunk writes a chunk at offset, dropping anything after it that a failed append left, and returns the size
+//of the file after it
+func (a *FileChunkAppender) AppendChunk(key, appendID string, number int, offset int64, chunk io.ReadSeeker) (ref string, err error) {
+	f, err := os.OpenFile(a.path(key, appendID), os.O_WRONLY, 0600)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	if err = f.Truncate(offset); err != nil {
+		return
+	}
+	if _, err = f.Seek(offset, io.SeekStart); err != nil {
+		return
+	}
+	n, err := io.Copy(f, chunk)
+	if err != nil {
+		return
+	}
+	return strconv.FormatInt(offset+n, 10), f.Sync()
+}
+
+func (a *FileChunkAppender) MinChunkBytes() int64 {
+	return 0
+}
+
+//CompleteAppend opens the file, truncated to the end of the last chunk
+func (a *FileChunkAppender) CompleteAppend(key, appendID string, refs []string) (data io.ReadCloser, err error) {
+	var size int64
+	if len(refs) > 0 {
+		if size, err = strconv.ParseInt(refs[len(refs)-1], 10, 64); err != nil {
+			return
+		}
+	}
+	path := a.path(key, appendID)
+	if err = os.Truncate(path, size); err != nil {
+		return
+	}
+	return os.Open(path)
+}
+
+func (a *FileChunkAppender) AbortAppend(key, appendID string) (err error) {
+	err = os.Remove(a.path(key, appendID))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return
+}
@@ -2,10 +2,16 @@ package assetstore
 
 import (
 	"bytes"
+	"fmt"
 	"io"
 	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
@@ -58,4 +64,266 @@ func (s *S3Storage) Writer(id string, reader io.ReadCloser) (n int64, err error)
 	return *head.ContentLength, err
 }
 
+func (s *S3Storage) Delete(id string) (err error) {
+	if id == "" {
+		return fmt.Errorf("zero-length id")
+	}
+	c := s3.New(s.sess)
+	_, err = c.DeleteObject(&s3.DeleteObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key: aws.String(id),
+	})
+	return
+}
+
+//List pages through the objects in the bucket
+func (s *S3Storage) List(cursor string, limit int) (objects []DataObject, next string, err error) {
+	c := s3.New(s.sess)
+	input := &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucket),
+		MaxKeys: aws.Int64(int64(limit)),
+	}
+	if cursor != "" {
+		input.ContinuationToken = aws.String(cursor)
+	}
+	result, err := c.ListObjectsV2(input)
+	if err != nil {
+		return
+	}
+	for _, obj := range result.Contents {
+		objects = append(objects, DataObject{
+			Key: aws.StringValue(obj.Key),
+			Size: aws.Int64Value(obj.Size),
+			Modified: aws.TimeValue(obj.LastModified),
+		})
+	}
+	if aws.BoolValue(result.IsTruncated) {
+		next = aws.StringValue(result.NextContinuationToken)
+	}
+	return
+}
+
+func (s *S3Storage) Stat(id string) (obj DataObject, err error) {
+	c := s3.New(s.sess)
+	head, err := c.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key: aws.String(id),
+	})
+	if aerr, ok := err.(awserr.RequestFailure); ok && aerr.StatusCode() == http.StatusNotFound {
+		return obj, fmt.Errorf("%w: no object %s", ErrNotFound, id)
+	}
+	if err != nil {
+		return
+	}
+	return DataObject{
+		Key: id,
+		Size: aws.Int64Value(head.ContentLength),
+		Modified: aws.TimeValue(head.LastModified),
+	}, nil
+}
 
+//maxCopyObjectBytes is the largest object CopyObject can copy, larger ones are copied in parts
+const maxCopyObjectBytes = 5 * 1024 * 1024 * 1024
+
+//copyPartBytes is the size of each part of a multipart copy
+const copyPartBytes = 512 * 1024 * 1024
+
+//Copy copies an object within the bucket, without downloading it
+func (s *S3Storage) Copy(from, to string) (err error) {
+	obj, err := s.Stat(from)
+	if err != nil {
+		return
+	}
+	c := s3.New(s.sess)
+	source := url.PathEscape(s.bucket + "/" + from)
+	if obj.Size <= maxCopyObjectBytes {
+		_, err = c.CopyObject(&s3.CopyObjectInput{
+			Bucket: aws.String(s.bucket),
+			Key: aws.String(to),
+			CopySource: aws.String(source),
+		})
+		return
+	}
+	upload, err := c.CreateMultipartUpload(&s3.CreateMultipartUploadInput{
+		Bucket: aws.String(s.bucket),
+		Key: aws.String(to),
+	})
+	if err != nil {
+		return
+	}
+	var parts []*s3.CompletedPart
+	for start, part := int64(0), int64(1); start < obj.Size; start, part = start+copyPartBytes, part+1 {
+		end := start + copyPartBytes - 1
+		if end >= obj.Size {
+			end = obj.Size - 1
+		}
+		result, err := c.UploadPartCopy(&s3.UploadPartCopyInput{
+			Bucket: aws.String(s.bucket),
+			Key: aws.String(to),
+			CopySource: aws.String(source),
+			CopySourceRange: aws.String(fmt.Sprintf("bytes=%d-%d", start, end)),
+			PartNumber: aws.Int64(part),
+			UploadId: upload.UploadId,
+		})
+		if err != nil {
+			c.AbortMultipartUpload(&s3.AbortMultipartUploadInput{
+				Bucket: aws.String(s.bucket),
+				Key: aws.String(to),
+				UploadId: upload.UploadId,
+			})
+			return err
+		}
+		parts = append(parts, &s3.CompletedPart{ETag: result.CopyPartResult.ETag, PartNumber: aws.Int64(part)})
+	}
+	_, err = c.CompleteMultipartUpload(&s3.CompleteMultipartUploadInput{
+		Bucket: aws.String(s.bucket),
+		Key: aws.String(to),
+		UploadId: upload.UploadId,
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: parts},
+	})
+	return
+}
+
+//SignURL presigns a GET of an object, downloading it as an attachment named filename
+func (s *S3Storage) SignURL(id, filename string, ttl time.Duration) (url string, err error) {
+	c := s3.New(s.sess)
+	req, _ := c.GetObjectRequest(&s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key: aws.String(id),
+		ResponseContentDisposition: aws.String(attachmentDisposition(filename)),
+	})
+	return req.Presign(ttl)
+}
+
+//SignUpload presigns a PUT of an object
+func (s *S3Storage) SignUpload(id string, ttl time.Duration) (url string, err error) {
+	c := s3.New(s.sess)
+	req, _ := c.PutObjectRequest(&s3.PutObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key: aws.String(id),
+	})
+	return req.Presign(ttl)
+}
+
+//StartMultipartUpload creates a multipart upload, and presigns a PUT of each of its parts
+func (s *S3Storage) StartMultipartUpload(id string, parts int, ttl time.Duration) (uploadID string, urls []string, err error) {
+	uploadID, err = s.StartMultipartWrite(id)
+	if err != nil {
+		return
+	}
+	c := s3.New(s.sess)
+	for part := int64(1); part <= int64(parts); part++ {
+		req, _ := c.UploadPartRequest(&s3.UploadPartInput{
+			Bucket: aws.String(s.bucket),
+			Key: aws.String(id),
+			PartNumber: aws.Int64(part),
+			UploadId: aws.String(uploadID),
+		})
+		url, err := req.Presign(ttl)
+		if err != nil {
+			s.AbortMultipartUpload(id, uploadID)
+			return "", nil, err
+		}
+		urls = append(urls, url)
+	}
+	return uploadID, urls, nil
+}
+
+//StartMultipartWrite creates a multipart upload
+func (s *S3Storage) StartMultipartWrite(id string) (uploadID string, err error) {
+	upload, err := s3.New(s.sess).CreateMultipartUpload(&s3.CreateMultipartUploadInput{
+		Bucket: aws.String(s.bucket),
+		Key: aws.String(id),
+	})
+	if err != nil {
+		return
+	}
+	return *upload.UploadId, nil
+}
+
+//WritePart uploads a part of a multipart upload.  s3 checks the part against the sha256 its upload is signed with.
+func (s *S3Storage) WritePart(id, uploadID string, number int64, part io.ReadSeeker) (uploaded UploadPart, err error) {
+	result, err := s3.New(s.sess).UploadPart(&s3.UploadPartInput{
+		Bucket: aws.String(s.bucket),
+		Key: aws.String(id),
+		UploadId: aws.String(uploadID),
+		PartNumber: aws.Int64(number),
+		Body: part,
+	})
+	if err != nil {
+		return
+	}
+	return UploadPart{Number: number, ETag: *result.ETag}, nil
+}
+
+func (s *S3Storage) CompleteMultipartUpload(id, uploadID string, parts []UploadPart) (err error) {
+	completed := make([]*s3.CompletedPart, len(parts))
+	for i, p := range parts {
+		completed[i] = &s3.CompletedPart{ETag: aws.String(p.ETag), PartNumber: aws.Int64(p.Number)}
+	}
+	//s3 wants them in order
+	sort.Slice(completed, func(i, j int) bool { return *completed[i].PartNumber < *completed[j].PartNumber })
+	_, err = s3.New(s.sess).CompleteMultipartUpload(&s3.CompleteMultipartUploadInput{
+		Bucket: aws.String(s.bucket),
+		Key: aws.String(id),
+		UploadId: aws.String(uploadID),
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: completed},
+	})
+	return
+}
+
+func (s *S3Storage) AbortMultipartUpload(id, uploadID string) (err error) {
+	_, err = s3.New(s.sess).AbortMultipartUpload(&s3.AbortMultipartUploadInput{
+		Bucket: aws.String(s.bucket),
+		Key: aws.String(id),
+		UploadId: aws.String(uploadID),
+	})
+	return
+}
+
+//minUploadPartBytes is the smallest part of a multipart upload s3 allows, bar the last
+const minUploadPartBytes = 5 * 1024 * 1024
+
+//StartAppend starts a multipart upload, which chunks are appended to as parts
+func (s *S3Storage) StartAppend(id string) (appendID string, err error) {
+	return s.StartMultipartWrite(id)
+}
+
+//AppendChunk uploads a chunk as the part number, returning its etag
+func (s *S3Storage) AppendChunk(id, appendID string, number int, offset int64, chunk io.ReadSeeker) (ref string, err error) {
+	part, err := s.WritePart(id, appendID, int64(number), chunk)
+	return part.ETag, err
+}
+
+func (s *S3Storage) MinChunkBytes() int64 {
+	return minUploadPartBytes
+}
+
+//CompleteAppend completes a multipart upload from its parts' etags, in order.  An upload that's already been completed
+//is read back as the object it was completed as.
+func (s *S3Storage) CompleteAppend(id, appendID string, refs []string) (data io.ReadCloser, err error) {
+	parts := make([]UploadPart, len(refs))
+	for i, ref := range refs {
+		parts[i] = UploadPart{Number: int64(i + 1), ETag: ref}
+	}
+	err = s.CompleteMultipartUpload(id, appendID, parts)
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == s3.ErrCodeNoSuchUpload {
+		err = nil
+	}
+	if err != nil {
+		return
+	}
+	return s.Reader(id)
+}
+
+//AbortAppend aborts a multipart upload, or deletes the object it was completed as
+func (s *S3Storage) AbortAppend(id, appendID string) (err error) {
+	err = s.AbortMultipartUpload(id, appendID)
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == s3.ErrCodeNoSuchUpload {
+		err = nil
+	}
+	if err != nil {
+		return
+	}
+	return s.Delete(id)
+}
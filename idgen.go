@@ -0,0 +1,206 @@
+package assetstore
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"strings"
+
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+//Ids and tokens are uuids unless another IDGenerator is used.  Short random ids in base58 or Crockford base32, and
+//word share codes like "brave-otter-42", are easier to share or type, but collide far more readily, so each is
+//claimed (with a conditional write) before it's used, and another's generated if it's already taken.
+
+const (
+	Base58Alphabet = "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz"
+	//CrockfordAlphabet leaves out I, L, O and U, which are easily misread
+	CrockfordAlphabet = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+)
+
+const (
+	defaultIDLength = 10
+	defaultShareCodeDigits = 2
+)
+
+//maxIDAttempts is how many ids are generated before giving up on finding one that isn't taken
+const maxIDAttempts = 5
+
+//ErrIDTaken is returned claiming an id that's already been claimed
+var ErrIDTaken = errors.New("id already taken")
+
+//IDGenerator makes new ids, unique within a scope, like the tenant scoped kind of thing they're ids of
+type IDGenerator interface {
+	NewID(scope string) (id string, err error)
+}
+
+//IDClaimer claims ids within a scope, so they're never generated twice
+type IDClaimer interface {
+	//ClaimID claims an id, or returns ErrIDTaken if it's already been claimed
+	ClaimID(scope, id string) (err error)
+}
+
+//NewIDGenerator makes a generator for a format: "uuid" (or ""), "base58" or "crockford", of ids length (10 if 0)
+//characters long, or "words", of share codes ending in a length (2 if 0) digit number.  All but uuids are claimed with
+//claimer.
+func NewIDGenerator(format string, length int, claimer IDClaimer) (IDGenerator, error) {
+	if format != "" && format != "uuid" && claimer == nil {
+		return nil, fmt.Errorf("%s ids need an id claimer", format)
+	}
+	if length <= 0 {
+		length = defaultIDLength
+		if format == "words" {
+			length = defaultShareCodeDigits
+		}
+	}
+	switch format {
+	case "", "uuid":
+		return UUIDGenerator{}, nil
+	case "base58":
+		return &RandomIDGenerator{Alphabet: Base58Alphabet, Length: length, Claimer: claimer}, nil
+	case "crockford":
+		return &RandomIDGenerator{Alphabet: CrockfordAlphabet, Length: length, Claimer: claimer}, nil
+	case "words":
+		return &ShareCodeGenerator{Digits: length, Claimer: claimer}, nil
+	default:
+		return nil, fmt.Errorf("unknown id format %s", format)
+	}
+}
+
+//UUIDGenerator generates random (v4) uuids, which never need collision checks
+type UUIDGenerator struct{}
+
+func (UUIDGenerator) NewID(scope string) (string, error) {
+	return uuid.New().String(), nil
+}
+
+//RandomIDGenerator generates ids of Length random characters from Alphabet, claimed with Claimer
+type RandomIDGenerator struct {
+	Alphabet string
+	Length int
+	Claimer IDClaimer
+	//Rand is the source of randomness, crypto/rand's if nil
+	Rand io.Reader
+}
+
+func (g *RandomIDGenerator) NewID(scope string) (string, error) {
+	if g.Length <= 0 || len(g.Alphabet) < 2 {
+		return "", fmt.Errorf("random ids need a length and an alphabet")
+	}
+	return claimNewID(g.Claimer, scope, func() (string, error) {
+		return randomString(randReader(g.Rand), g.Alphabet, g.Length)
+	})
+}
+
+//ShareCodeGenerator generates codes of an adjective, a noun and a Digits digit number, like "brave-otter-42", to be
+//read out or typed.  They're far easier to guess than other ids, so tokens that are share codes should be short lived.
+type ShareCodeGenerator struct {
+	//Adjectives and Nouns codes are made of, the defaults if empty
+	Adjectives []string
+	Nouns []string
+	Digits int
+	Claimer IDClaimer
+	//Rand is the source of randomness, crypto/rand's if nil
+	Rand io.Reader
+}
+
+func (g *ShareCodeGenerator) NewID(scope string) (string, error) {
+	adjectives, nouns := g.Adjectives, g.Nouns
+	if len(adjectives) == 0 {
+		adjectives = shareCodeAdjectives
+	}
+	if len(nouns) == 0 {
+		nouns = shareCodeNouns
+	}
+	r := randReader(g.Rand)
+	return claimNewID(g.Claimer, scope, func() (string, error) {
+		words := make([]string, 0, 3)
+		for _, list := range [][]string{adjectives, nouns} {
+			n, err := rand.Int(r, big.NewInt(int64(len(list))))
+			if err != nil {
+				return "", err
+			}
+			words = append(words, list[n.Int64()])
+		}
+		if g.Digits > 0 {
+			number, err := randomString(r, "0123456789", g.Digits)
+			if err != nil {
+				return "", err
+			}
+			words = append(words, number)
+		}
+		return strings.Join(words, "-"), nil
+	})
+}
+
+//claimNewID generates ids until one that isn't taken in scope is claimed
+func claimNewID(claimer IDClaimer, scope string, generate func() (string, error)) (id string, err error) {
+	for attempt := 0; attempt < maxIDAttempts; attempt++ {
+		id, err = generate()
+		if err != nil {
+			return
+		}
+		if claimer == nil {
+			return
+		}
+		err = claimer.ClaimID(scope, id)
+		if !errors.Is(err, ErrIDTaken) {
+			if err != nil {
+				log.WithFields(log.Fields{
+					"context": "claimNewID()",
+					"claimer": claimer,
+					"scope": scope,
+					"id": id,
+				}).Error(err)
+			}
+			return
+		}
+	}
+	return "", fmt.Errorf("no id that wasn't taken in %d attempts: %w", maxIDAttempts, err)
+}
+
+//randReader is r, or crypto/rand's reader if it's nil
+func randReader(r io.Reader) io.Reader {
+	if r == nil {
+		return rand.Reader
+	}
+	return r
+}
+
+//randomString is length characters picked at random, with randomness read from r, from alphabet
+func randomString(r io.Reader, alphabet string, length int) (string, error) {
+	max := big.NewInt(int64(len(alphabet)))
+	b := make([]byte, length)
+	for i := range b {
+		n, err := rand.Int(r, max)
+		if err != nil {
+			return "", err
+		}
+		b[i] = alphabet[n.Int64()]
+	}
+	return string(b), nil
+}
+
+var shareCodeAdjectives = []string{
+	"able", "amber", "ample", "azure", "bold", "brave", "brisk", "bright", "calm", "candid", "clever", "cosy",
+	"crisp", "curly", "daring", "dusty", "eager", "early", "fair", "fancy", "fast", "fierce", "fluffy", "fond",
+	"gentle", "giant", "glad", "golden", "grand", "happy", "hardy", "hazy", "honest", "humble", "icy", "jolly",
+	"keen", "kind", "lively", "lucky", "mellow", "merry", "mighty", "misty", "modest", "neat", "nimble", "noble",
+	"odd", "olive", "plucky", "polite", "proud", "quick", "quiet", "rapid", "rosy", "royal", "rustic", "sandy",
+	"shiny", "silent", "silver", "sleepy", "smart", "snowy", "sunny", "swift", "tidy", "tiny", "tender", "vivid",
+	"warm", "wild", "wise", "witty", "young", "zany", "zesty", "velvet",
+}
+
+var shareCodeNouns = []string{
+	"otter", "badger", "beaver", "bison", "camel", "cobra", "condor", "coyote", "crane", "dingo", "dolphin",
+	"eagle", "falcon", "ferret", "finch", "gecko", "gibbon", "goose", "heron", "hippo", "ibis", "iguana", "jackal",
+	"jaguar", "koala", "lemur", "leopard", "llama", "lynx", "magpie", "marmot", "moose", "newt", "ocelot", "orca",
+	"osprey", "owl", "panda", "parrot", "pelican", "penguin", "puffin", "python", "quail", "rabbit", "raven",
+	"robin", "salmon", "seal", "shark", "sloth", "sparrow", "squid", "stork", "swan", "tapir", "tiger", "toucan",
+	"turtle", "viper", "walrus", "weasel", "whale", "wombat", "yak", "zebra", "bear", "crow", "deer", "fox",
+	"hare", "lark", "mole", "mouse", "pike", "wolf", "wren", "yeti",
+}
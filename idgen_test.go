@@ -0,0 +1,111 @@
+package assetstore
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+//memIDClaimer claims ids in memory, with some already taken
+type memIDClaimer struct {
+	claimed map[string]bool
+	attempts int
+}
+
+func (m *memIDClaimer) ClaimID(scope, id string) error {
+	m.attempts++
+	if m.claimed[scope+"/"+id] {
+		return fmt.Errorf("%w: %s", ErrIDTaken, id)
+	}
+	m.claimed[scope+"/"+id] = true
+	return nil
+}
+
+func TestNewIDGenerator(t *testing.T) {
+	tests := []struct {
+		format  string
+		length  int
+		pattern string
+		wantErr bool
+	}{
+		{"", 0, `^[0-9a-f-]{36}$`, false},
+		{"uuid", 0, `^[0-9a-f-]{36}$`, false},
+		{"base58", 8, `^[1-9A-HJ-NP-Za-km-z]{8}$`, false},
+		{"base58", 0, `^[1-9A-HJ-NP-Za-km-z]{10}$`, false},
+		{"crockford", 12, `^[0-9A-HJKMNP-TV-Z]{12}$`, false},
+		{"words", 3, `^[a-z]+-[a-z]+-[0-9]{3}$`, false},
+		{"words", 0, `^[a-z]+-[a-z]+-[0-9]{2}$`, false},
+		{"snowflake", 0, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s %d", tt.format, tt.length), func(t *testing.T) {
+			g, err := NewIDGenerator(tt.format, tt.length, &memIDClaimer{claimed: map[string]bool{}})
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			id, err := g.NewID("asset")
+			assert.NoError(t, err)
+			assert.Regexp(t, regexp.MustCompile(tt.pattern), id)
+			assert.NotContains(t, id, tenantSeparator)
+		})
+	}
+
+	_, err := NewIDGenerator("base58", 10, nil)
+	assert.Error(t, err)
+}
+
+func TestRandomIDGenerator_Collisions(t *testing.T) {
+	//an alphabet of two, two long, has four ids, and each byte of randomness picks a character by its lowest bit
+	claimer := &memIDClaimer{claimed: map[string]bool{}}
+	random := []byte{0, 0, 0, 1, 0, 0, 1, 0, 1, 1}
+	//once they're all taken, generating gives up
+	random = append(random, bytes.Repeat([]byte{1, 0}, maxIDAttempts)...)
+	//ids are only unique within their scope
+	random = append(random, 0, 0)
+	g := &RandomIDGenerator{Alphabet: "ab", Length: 2, Claimer: claimer, Rand: bytes.NewReader(random)}
+
+	tests := []struct {
+		scope    string
+		want     string
+		attempts int
+		wantErr  error
+	}{
+		{"acme/asset", "aa", 1, nil},
+		{"acme/asset", "ab", 1, nil},
+		{"acme/asset", "ba", 2, nil},
+		{"acme/asset", "bb", 1, nil},
+		{"acme/asset", "", maxIDAttempts, ErrIDTaken},
+		{"other/asset", "aa", 1, nil},
+	}
+	for _, tt := range tests {
+		claimer.attempts = 0
+		id, err := g.NewID(tt.scope)
+		assert.Equal(t, tt.want, id)
+		assert.Equal(t, tt.attempts, claimer.attempts)
+		if tt.wantErr != nil {
+			assert.True(t, errors.Is(err, tt.wantErr))
+		} else {
+			assert.NoError(t, err)
+		}
+	}
+}
+
+func TestShareCodeGenerator(t *testing.T) {
+	g := &ShareCodeGenerator{Adjectives: []string{"brave"}, Nouns: []string{"otter"}, Digits: 2, Claimer: &memIDClaimer{claimed: map[string]bool{}}}
+	id, err := g.NewID("token")
+	assert.NoError(t, err)
+	assert.Regexp(t, `^brave-otter-[0-9]{2}$`, id)
+
+	noDigits := &ShareCodeGenerator{Adjectives: []string{"brave"}, Nouns: []string{"otter"}, Claimer: &memIDClaimer{claimed: map[string]bool{}}}
+	id, err = noDigits.NewID("token")
+	assert.NoError(t, err)
+	assert.Equal(t, "brave-otter", id)
+	_, err = noDigits.NewID("token")
+	assert.True(t, errors.Is(err, ErrIDTaken))
+}
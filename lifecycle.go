@@ -0,0 +1,310 @@
+package assetstore
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+//Assets can be uploaded with a TTL, after which they can't be retrieved, and lifecycle policies delete assets by rule:
+//some days after they were uploaded, or some days after they were last retrieved.  They also delete the previous
+//versions kept when an asset's replaced (see AssetStorage.Replace) once there are enough newer versions of it.  The
+//LifecycleWorker deletes expired assets and applies the policies in the background, and can report what it would
+//delete without deleting anything.
+
+//accessResolution is how often an asset's last access is recorded, so retrieving it doesn't always write its meta
+const accessResolution = 24 * time.Hour
+
+//Lifecycle rules assets are deleted by
+const (
+	RuleExpired = "expired"
+	RuleAge = "age"
+	RuleIdle = "idle"
+	RuleVersions = "versions"
+)
+
+//LifecyclePolicy deletes assets by rules.  Rules left 0 don't apply.
+type LifecyclePolicy struct {
+	//DeleteAfterDays deletes assets this many days after they were uploaded
+	DeleteAfterDays int `json:"delete_after_days,omitempty"`
+	//DeleteAfterIdleDays deletes assets that haven't been retrieved for this many days
+	DeleteAfterIdleDays int `json:"delete_after_idle_days,omitempty"`
+	//KeepVersions deletes all but the newest this many versions of an asset, counting its current version
+	KeepVersions int `json:"keep_versions,omitempty"`
+}
+
+//ruleFor is the rule an asset should be deleted by at now, other than versions, "" if none
+func (p LifecyclePolicy) ruleFor(meta AssetMeta, now time.Time) string {
+	created := time.Unix(meta.Created, 0)
+	accessed := created
+	if meta.Accessed > meta.Created {
+		accessed = time.Unix(meta.Accessed, 0)
+	}
+	switch {
+	case meta.Expired(now):
+		return RuleExpired
+	case p.DeleteAfterDays > 0 && now.Sub(created) >= days(p.DeleteAfterDays):
+		return RuleAge
+	case p.DeleteAfterIdleDays > 0 && now.Sub(accessed) >= days(p.DeleteAfterIdleDays):
+		return RuleIdle
+	}
+	return ""
+}
+
+func days(n int) time.Duration {
+	return time.Duration(n) * 24 * time.Hour
+}
+
+//LifecyclePolicies picks the policy for an asset.  The tenant's policy wins over the default.
+type LifecyclePolicies struct {
+	Default LifecyclePolicy `json:"default"`
+	//Policies by tenant
+	Tenants map[string]LifecyclePolicy `json:"tenants,omitempty"`
+}
+
+//LoadLifecyclePolicies reads LifecyclePolicies from a json file
+func LoadLifecyclePolicies(file string) (policies LifecyclePolicies, err error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(b, &policies)
+	return
+}
+
+func (p LifecyclePolicies) policyFor(meta AssetMeta) LifecyclePolicy {
+	if policy, ok := p.Tenants[meta.Tenant]; ok {
+		return policy
+	}
+	return p.Default
+}
+
+//tracksAccess reports whether any policy needs to know when assets were last retrieved
+func (p LifecyclePolicies) tracksAccess() bool {
+	if p.Default.DeleteAfterIdleDays > 0 {
+		return true
+	}
+	for _, policy := range p.Tenants {
+		if policy.DeleteAfterIdleDays > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+//WithLifecyclePolicies deletes assets by policies, when a LifecycleWorker runs, recording when assets are retrieved
+//if any policy needs to know
+func WithLifecyclePolicies(policies LifecyclePolicies) AssetStorageOption {
+	return func(s *AssetStorage) {
+		s.lifecycle = policies
+	}
+}
+
+//AccessRecorder records when an asset, by its tenant scoped key, was last retrieved, if it still exists
+type AccessRecorder interface {
+	RecordAccess(meta AssetMeta, at int64) (err error)
+}
+
+//recordAccess records that an asset was retrieved, if the policies need to know and it's not been recorded recently
+func (s *AssetStorage) recordAccess(meta AssetMeta) {
+	recorder, ok := s.metaHandler.(AccessRecorder)
+	now := time.Now()
+	if !ok || !s.lifecycle.tracksAccess() || now.Sub(time.Unix(meta.Accessed, 0)) < accessResolution {
+		return
+	}
+	if err := recorder.RecordAccess(meta, now.Unix()); err != nil {
+		log.WithFields(log.Fields{
+			"context": "AssetStorage.recordAccess()",
+			"metaHandler": s.metaHandler,
+			"meta": meta,
+		}).Error(err)
+	}
+}
+
+//LifecycleAction is an asset, or previous version of one, deleted, or that would be, and the rule it's deleted by
+type LifecycleAction struct {
+	Key string `json:"key"`
+	Name string `json:"name"`
+	Version int `json:"version"`
+	Rule string `json:"rule"`
+}
+
+type LifecycleReport struct {
+	Checked int `json:"checked"`
+	//Assets deleted, or that would be deleted in a dry run
+	Deleted []LifecycleAction `json:"deleted"`
+	Errors int `json:"errors"`
+	DryRun bool `json:"dry_run"`
+}
+
+//LifecycleReporter reports what a lifecycle pass would delete in a tenant, without deleting anything
+type LifecycleReporter interface {
+	DryRun(tenant string) (report LifecycleReport, err error)
+}
+
+type LifecycleWorker struct {
+	storage *AssetStorage
+	metaLister MetaLister
+	PageSize int
+	//ReportTTL is how long a tenant's dry run report is reused for, as each is a pass over every asset
+	ReportTTL time.Duration
+
+	//reportsMu is held while a dry run's made, so only one is ever made at a time
+	reportsMu sync.Mutex
+	reports map[string]cachedLifecycleReport
+}
+
+type cachedLifecycleReport struct {
+	report LifecycleReport
+	made time.Time
+}
+
+func NewLifecycleWorker(storage *AssetStorage, metaLister MetaLister) *LifecycleWorker {
+	return &LifecycleWorker{
+		storage: storage,
+		metaLister: metaLister,
+		PageSize: 500,
+		ReportTTL: 5 * time.Minute,
+		reports: map[string]cachedLifecycleReport{},
+	}
+}
+
+//Run applies lifecycle policies every interval until stop is closed
+func (w *LifecycleWorker) Run(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			report, err := w.Apply()
+			entry := log.WithFields(log.Fields{
+				"context": "LifecycleWorker.Run()",
+				"checked": report.Checked,
+				"deleted": len(report.Deleted),
+				"errors": report.Errors,
+			})
+			if err != nil {
+				entry.Error(err)
+			} else {
+				entry.Info("applied lifecycle policies")
+			}
+		}
+	}
+}
+
+//Apply makes one pass over every asset, deleting expired assets and those the policies say to
+func (w *LifecycleWorker) Apply() (report LifecycleReport, err error) {
+	return w.pass(false, func(AssetMeta) bool { return true })
+}
+
+//DryRun makes one pass over a tenant's assets, reporting what Apply would delete.  Reports are reused for ReportTTL,
+//and only one pass is made at a time.
+func (w *LifecycleWorker) DryRun(tenant string) (report LifecycleReport, err error) {
+	w.reportsMu.Lock()
+	defer w.reportsMu.Unlock()
+	if cached, ok := w.reports[tenant]; ok && time.Since(cached.made) < w.ReportTTL {
+		return cached.report, nil
+	}
+	report, err = w.pass(true, func(meta AssetMeta) bool { return meta.Tenant == tenant })
+	if err == nil {
+		w.reports[tenant] = cachedLifecycleReport{report: report, made: time.Now()}
+	}
+	return
+}
+
+//pass finds the assets to delete, out of those include includes, deleting them unless dryRun
+func (w *LifecycleWorker) pass(dryRun bool, include func(AssetMeta) bool) (report LifecycleReport, err error) {
+	report = LifecycleReport{Deleted: []LifecycleAction{}, DryRun: dryRun}
+	now := time.Now()
+	cursor := ""
+	for {
+		metas, next, err := w.metaLister.ListMeta(cursor, w.PageSize)
+		if err != nil {
+			return report, err
+		}
+		for _, meta := range metas {
+			if !meta.Retrievable() || !include(meta) {
+				continue
+			}
+			report.Checked++
+			policy := w.storage.lifecycle.policyFor(meta)
+			if rule := policy.ruleFor(meta, now); rule != "" {
+				w.delete(meta, rule, dryRun, &report)
+			} else if policy.KeepVersions > 0 && meta.Version > 0 {
+				w.deleteVersions(meta, policy.KeepVersions, dryRun, &report)
+			}
+		}
+		if next == "" {
+			return report, nil
+		}
+		cursor = next
+	}
+}
+
+//deleteVersions deletes all but the newest keep versions of an asset, counting its current version, unless dryRun
+func (w *LifecycleWorker) deleteVersions(meta AssetMeta, keep int, dryRun bool, report *LifecycleReport) {
+	//oldest first
+	versions, err := w.storage.Versions(meta.Key())
+	if err != nil {
+		report.Errors++
+		return
+	}
+	if len(versions) < keep {
+		return
+	}
+	for _, version := range versions[:len(versions)-keep+1] {
+		action := LifecycleAction{Key: version.Key(), Name: version.Name, Version: version.Version, Rule: RuleVersions}
+		if dryRun {
+			report.Deleted = append(report.Deleted, action)
+			continue
+		}
+		if err := w.storage.DeleteVersion(version); err != nil {
+			//deleted along with its asset since it was listed
+			if !errors.Is(err, ErrNotFound) {
+				report.Errors++
+			}
+			continue
+		}
+		report.Deleted = append(report.Deleted, action)
+		log.WithFields(log.Fields{
+			"context": "LifecycleWorker.deleteVersions()",
+			"version": version,
+		}).Info("deleted version")
+	}
+}
+
+//delete deletes an asset, and its previous versions, by a rule, unless dryRun.  Assets retrieved or changed since they
+//were listed are checked against the rule again first.
+func (w *LifecycleWorker) delete(meta AssetMeta, rule string, dryRun bool, report *LifecycleReport) {
+	action := LifecycleAction{Key: meta.Key(), Name: meta.Name, Version: meta.Version, Rule: rule}
+	if dryRun {
+		report.Deleted = append(report.Deleted, action)
+		return
+	}
+	current, err := w.storage.metaHandler.GetMeta(meta.Key())
+	if err != nil {
+		if !errors.Is(err, ErrNotFound) {
+			report.Errors++
+		}
+		return
+	}
+	if w.storage.lifecycle.policyFor(current).ruleFor(current, time.Now()) == "" {
+		return
+	}
+	if err := w.storage.Delete(meta.Key()); err != nil {
+		report.Errors++
+		return
+	}
+	report.Deleted = append(report.Deleted, action)
+	log.WithFields(log.Fields{
+		"context": "LifecycleWorker.delete()",
+		"meta": meta,
+		"rule": rule,
+	}).Info("deleted asset")
+}
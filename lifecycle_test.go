@@ -0,0 +1,153 @@
+package assetstore
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLifecyclePolicy_RuleFor(t *testing.T) {
+	now := time.Now()
+	daysAgo := func(n int) int64 { return now.Add(-days(n)).Unix() }
+	policy := LifecyclePolicy{DeleteAfterDays: 30, DeleteAfterIdleDays: 7}
+	tests := []struct {
+		name string
+		meta AssetMeta
+		want string
+	}{
+		{"new", AssetMeta{Created: daysAgo(1)}, ""},
+		{"expired", AssetMeta{Created: daysAgo(1), Expires: now.Unix() - 1}, RuleExpired},
+		{"not yet expired", AssetMeta{Created: daysAgo(1), Expires: now.Unix() + 60}, ""},
+		{"old", AssetMeta{Created: daysAgo(31), Accessed: daysAgo(1)}, RuleAge},
+		{"idle", AssetMeta{Created: daysAgo(10), Accessed: daysAgo(8)}, RuleIdle},
+		{"never accessed", AssetMeta{Created: daysAgo(8)}, RuleIdle},
+		{"recently accessed", AssetMeta{Created: daysAgo(10), Accessed: daysAgo(2)}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, policy.ruleFor(tt.meta, now))
+		})
+	}
+	assert.Equal(t, "", LifecyclePolicy{}.ruleFor(AssetMeta{Created: daysAgo(1000)}, now))
+}
+
+func TestLifecycleWorker(t *testing.T) {
+	db := newMemMetaTokenStore()
+	s := NewAssetStorage(db, db, newMemDataStore(), WithLifecyclePolicies(LifecyclePolicies{
+		Default: LifecyclePolicy{DeleteAfterIdleDays: 7},
+		Tenants: map[string]LifecyclePolicy{"reports": {KeepVersions: 2}},
+	}))
+	store := func(tenant, owner, name string, age int, expires int64) AssetMeta {
+		meta, err := s.Store(AssetMeta{ID: uuid.New().String(), Tenant: tenant, Owner: owner, Name: name, Expires: expires}, AssetToken{}, ioutil.NopCloser(strings.NewReader(name)))
+		assert.NoError(t, err)
+		meta.Created -= int64(days(age) / time.Second)
+		assert.NoError(t, db.StoreMeta(meta))
+		return meta
+	}
+	fresh := store("", "", "fresh.txt", 0, 0)
+	idle := store("", "", "idle.txt", 8, 0)
+	expired := store("", "", "expired.txt", 0, time.Now().Unix()-1)
+	//a report replaced nightly, with its three previous versions kept
+	nightly := store("reports", "alice", "nightly.csv", 3, 0)
+	for i, content := range []string{"tuesday", "wednesday", "thursday"} {
+		replaced, err := s.Replace(nightly.Key(), int64(i), ioutil.NopCloser(strings.NewReader(content)))
+		assert.NoError(t, err)
+		nightly = replaced
+	}
+	//assets with the same name aren't versions of each other
+	others := store("reports", "bob", "nightly.csv", 4, 0)
+
+	//expired assets can't be retrieved, even before they're deleted
+	_, _, err := s.GetByID(expired.Key())
+	assert.True(t, errors.Is(err, ErrNotFound))
+
+	//retrieving an asset records it, at most once a day
+	retrieve := func(meta AssetMeta) int64 {
+		_, asset, err := s.GetByID(meta.Key())
+		if assert.NoError(t, err) {
+			asset.Close()
+		}
+		return db.metas[meta.Key()].Accessed
+	}
+	assert.NotZero(t, retrieve(idle))
+	recent := db.metas[idle.Key()]
+	recent.Accessed -= 3600
+	assert.NoError(t, db.StoreMeta(recent))
+	assert.Equal(t, recent.Accessed, retrieve(idle))
+	stale := db.metas[idle.Key()]
+	stale.Accessed -= int64(days(8) / time.Second)
+	assert.NoError(t, db.StoreMeta(stale))
+
+	//keeping 2 versions keeps the current one and the newest previous one
+	w := NewLifecycleWorker(s, db)
+	w.PageSize = 2
+	report, err := w.DryRun("reports")
+	assert.NoError(t, err)
+	assert.True(t, report.DryRun)
+	assert.Equal(t, 2, report.Checked)
+	assert.Equal(t, []LifecycleAction{
+		{Key: nightly.Key(), Name: "nightly.csv", Version: 0, Rule: RuleVersions},
+		{Key: nightly.Key(), Name: "nightly.csv", Version: 1, Rule: RuleVersions},
+	}, report.Deleted)
+	assert.Len(t, db.metas, 5)
+	assert.Len(t, db.versions[nightly.Key()], 3)
+
+	report, err = w.Apply()
+	assert.NoError(t, err)
+	assert.Equal(t, 5, report.Checked)
+	assert.Len(t, report.Deleted, 4)
+	for _, meta := range []AssetMeta{idle, expired} {
+		assert.NotContains(t, db.metas, meta.Key())
+	}
+	for _, meta := range []AssetMeta{fresh, nightly, others} {
+		assert.Contains(t, db.metas, meta.Key())
+	}
+	if assert.Len(t, db.versions[nightly.Key()], 1) {
+		assert.Equal(t, 2, db.versions[nightly.Key()][0].Version)
+	}
+
+	//dry runs are reused for a while, as each is a pass over every asset
+	report, err = w.DryRun("reports")
+	assert.NoError(t, err)
+	assert.Len(t, report.Deleted, 2)
+	w.ReportTTL = 0
+	report, err = w.DryRun("reports")
+	assert.NoError(t, err)
+	assert.Empty(t, report.Deleted)
+}
+
+func TestAPI_GetLifecycleReport(t *testing.T) {
+	db := newMemMetaTokenStore()
+	s := NewAssetStorage(db, db, newMemDataStore(), WithLifecyclePolicies(LifecyclePolicies{
+		Default: LifecyclePolicy{DeleteAfterDays: 30},
+	}))
+	api := testAPI(s, WithLifecycleReports(NewLifecycleWorker(s, db)), WithAPIKeys(map[string]Principal{
+		"acme-key":  {Tenant: "acme", User: "alice"},
+		"admin-key": {User: "admin"},
+	}))
+
+	//reports need an api key, for the tenant or every tenant
+	tests := []struct {
+		name   string
+		path   string
+		apiKey string
+		want   int
+	}{
+		{"anonymous", "/t/acme/lifecycle/report", "", http.StatusUnauthorized},
+		{"tenant", "/lifecycle/report", "acme-key", http.StatusOK},
+		{"another tenant", "/t/other/lifecycle/report", "acme-key", http.StatusForbidden},
+		{"admin", "/t/other/lifecycle/report", "admin-key", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := serve(api, http.MethodGet, tt.path, tt.apiKey, nil)
+			assert.Equal(t, tt.want, w.Code, w.Body.String())
+		})
+	}
+}
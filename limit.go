@@ -0,0 +1,50 @@
+package assetstore
+
+import (
+	"errors"
+	"io"
+)
+
+//ErrUploadTooLarge is returned reading an upload which goes over its size limit
+var ErrUploadTooLarge = errors.New("upload exceeds maximum size")
+
+//limitedReadCloser fails with ErrUploadTooLarge as soon as more than its limit is read, so oversized uploads
+//are aborted while streaming, even when they don't declare a Content-Length
+type limitedReadCloser struct {
+	io.ReadCloser
+	remaining int64
+}
+
+//NewLimitedReadCloser limits r to n bytes.  n <= 0 is unlimited.
+func NewLimitedReadCloser(r io.ReadCloser, n int64) io.ReadCloser {
+	if n <= 0 {
+		return r
+	}
+	return &limitedReadCloser{ReadCloser: r, remaining: n}
+}
+
+func (l *limitedReadCloser) Read(p []byte) (n int, err error) {
+	if l.remaining < 0 {
+		return 0, ErrUploadTooLarge
+	}
+	//read one byte past the limit, to tell a body of exactly the limit from one that's over
+	if int64(len(p)) > l.remaining+1 {
+		p = p[:l.remaining+1]
+	}
+	n, err = l.ReadCloser.Read(p)
+	l.remaining -= int64(n)
+	if l.remaining < 0 {
+		return n - 1, ErrUploadTooLarge
+	}
+	return
+}
+
+//uploadLimit is the smallest non zero limit, or 0 (unlimited) if all are 0
+func uploadLimit(limits ...int64) (limit int64) {
+	for _, l := range limits {
+		if l > 0 && (limit == 0 || l < limit) {
+			limit = l
+		}
+	}
+	return
+}
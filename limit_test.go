@@ -0,0 +1,47 @@
+package assetstore
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewLimitedReadCloser(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		limit   int64
+		want    string
+		wantErr error
+	}{
+		{name: "under limit", data: "abc", limit: 5, want: "abc"},
+		{name: "exactly limit", data: "abcde", limit: 5, want: "abcde"},
+		{name: "over limit", data: "abcdef", limit: 5, want: "abcde", wantErr: ErrUploadTooLarge},
+		{name: "unlimited", data: "abcdef", limit: 0, want: "abcdef"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewLimitedReadCloser(ioutil.NopCloser(bytes.NewReader([]byte(tt.data))), tt.limit)
+			got, err := ioutil.ReadAll(r)
+			assert.Equal(t, tt.wantErr, err)
+			assert.Equal(t, tt.want, string(got))
+		})
+	}
+	assert.Equal(t, int64(5), uploadLimit(0, 10, 5))
+	assert.Equal(t, int64(0), uploadLimit(0, 0))
+}
+
+func TestAssetStorage_StoreTooLarge(t *testing.T) {
+	s, db, data := setupMemAssetStorage()
+
+	meta := AssetMeta{ID: uuid.New().String(), Name: "big.bin", Size: -1}
+	body := NewLimitedReadCloser(ioutil.NopCloser(bytes.NewReader(make([]byte, 100))), 10)
+	_, err := s.Store(meta, AssetToken{}, body)
+	assert.True(t, errors.Is(err, ErrUploadTooLarge))
+	assert.Empty(t, data.data)
+	assert.Empty(t, db.metas)
+}
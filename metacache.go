@@ -0,0 +1,269 @@
+package assetstore
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+//TokenRevoker revokes tokens, by their tenant scoped key, so they can no longer be used
+type TokenRevoker interface {
+	RevokeToken(token string) (err error)
+}
+
+//MetaTokenCache is an in process cache of meta and token lookups, including ones that found nothing.  Changes made
+//through it are seen immediately, but ones made elsewhere (e.g. by other servers) only once cached lookups expire,
+//so TTL bounds how long a token revoked elsewhere can still be used.
+type MetaTokenCache struct {
+	metaHandler AssetMetaHandler
+	tokenHandler AssetTokenHandler
+	//TTL is how long lookups are cached
+	TTL time.Duration
+	//NegativeTTL is how long lookups that found nothing are cached
+	NegativeTTL time.Duration
+	metas *lruCache
+	tokens *lruCache
+}
+
+//NewMetaTokenCache caches up to maxEntries each of meta and tokens
+func NewMetaTokenCache(metaHandler AssetMetaHandler, tokenHandler AssetTokenHandler, maxEntries int) *MetaTokenCache {
+	return &MetaTokenCache{
+		metaHandler: metaHandler,
+		tokenHandler: tokenHandler,
+		TTL: time.Minute,
+		NegativeTTL: 10 * time.Second,
+		metas: newLRUCache(maxEntries),
+		tokens: newLRUCache(maxEntries),
+	}
+}
+
+func (c *MetaTokenCache) GetMeta(id string) (meta AssetMeta, err error) {
+	if entry, ok := c.metas.get(id); ok {
+		meta, _ = entry.value.(AssetMeta)
+		return meta, entry.err
+	}
+	generation := c.metas.generation()
+	meta, err = c.metaHandler.GetMeta(id)
+	c.put(c.metas, generation, id, meta, err, time.Time{})
+	return
+}
+
+func (c *MetaTokenCache) StoreMeta(meta AssetMeta) (err error) {
+	err = c.metaHandler.StoreMeta(meta)
+	c.metas.remove(meta.Key())
+	return
+}
+
+func (c *MetaTokenCache) UpdateMeta(id string, update MetaUpdate, revision int64) (meta AssetMeta, err error) {
+	updater, ok := c.metaHandler.(MetaUpdater)
+	if !ok {
+		return meta, errors.New("meta can't be updated")
+	}
+	meta, err = updater.UpdateMeta(id, update, revision)
+	c.metas.remove(id)
+	return
+}
+
+func (c *MetaTokenCache) SwapMeta(meta AssetMeta, revision int64) (err error) {
+	swapper, ok := c.metaHandler.(MetaSwapper)
+	if !ok {
+		return errors.New("meta can't be swapped")
+	}
+	err = swapper.SwapMeta(meta, revision)
+	c.metas.remove(meta.Key())
+	return
+}
+
+func (c *MetaTokenCache) UpdateScanStatus(meta AssetMeta) (err error) {
+	updater, ok := c.metaHandler.(MetaStatusUpdater)
+	if !ok {
+		return errors.New("meta status can't be updated")
+	}
+	err = updater.UpdateScanStatus(meta)
+	c.metas.remove(meta.Key())
+	return
+}
+
+func (c *MetaTokenCache) UpdateState(meta AssetMeta) (err error) {
+	updater, ok := c.metaHandler.(MetaStatusUpdater)
+	if !ok {
+		return errors.New("meta status can't be updated")
+	}
+	err = updater.UpdateState(meta)
+	c.metas.remove(meta.Key())
+	return
+}
+
+func (c *MetaTokenCache) GetVersion(id string, version int) (meta AssetMeta, err error) {
+	handler, ok := c.metaHandler.(VersionHandler)
+	if !ok {
+		return meta, fmt.Errorf("%w: versions aren't kept", ErrNotFound)
+	}
+	return handler.GetVersion(id, version)
+}
+
+func (c *MetaTokenCache) ListVersions(id string) (metas []AssetMeta, err error) {
+	handler, ok := c.metaHandler.(VersionHandler)
+	if !ok {
+		return nil, nil
+	}
+	return handler.ListVersions(id)
+}
+
+func (c *MetaTokenCache) DeleteVersion(meta AssetMeta) (err error) {
+	handler, ok := c.metaHandler.(VersionHandler)
+	if !ok {
+		return errors.New("versions can't be deleted")
+	}
+	return handler.DeleteVersion(meta)
+}
+
+func (c *MetaTokenCache) UpdateVersionKey(meta AssetMeta) (err error) {
+	handler, ok := c.metaHandler.(VersionHandler)
+	if !ok {
+		return errors.New("version keys can't be updated")
+	}
+	return handler.UpdateVersionKey(meta)
+}
+
+func (c *MetaTokenCache) UpdateMetaKey(meta AssetMeta) (err error) {
+	updater, ok := c.metaHandler.(MetaKeyUpdater)
+	if !ok {
+		return errors.New("meta keys can't be updated")
+	}
+	err = updater.UpdateMetaKey(meta)
+	c.metas.remove(meta.Key())
+	return
+}
+
+func (c *MetaTokenCache) RecordAccess(meta AssetMeta, at int64) (err error) {
+	recorder, ok := c.metaHandler.(AccessRecorder)
+	if !ok {
+		return errors.New("access can't be recorded")
+	}
+	err = recorder.RecordAccess(meta, at)
+	c.metas.remove(meta.Key())
+	return
+}
+
+func (c *MetaTokenCache) DeleteMeta(id string) (err error) {
+	err = c.metaHandler.DeleteMeta(id)
+	c.metas.remove(id)
+	return
+}
+
+func (c *MetaTokenCache) GetToken(token string) (t AssetToken, err error) {
+	if entry, ok := c.tokens.get(token); ok {
+		t, _ = entry.value.(AssetToken)
+		return t, entry.err
+	}
+	generation := c.tokens.generation()
+	t, err = c.tokenHandler.GetToken(token)
+	//a token mustn't be cached past its own expiry
+	c.put(c.tokens, generation, token, t, err, time.Unix(t.Expiry, 0))
+	return
+}
+
+func (c *MetaTokenCache) StoreToken(token AssetToken) (err error) {
+	err = c.tokenHandler.StoreToken(token)
+	c.tokens.remove(token.Key())
+	return
+}
+
+func (c *MetaTokenCache) RevokeToken(token string) (err error) {
+	revoker, ok := c.tokenHandler.(TokenRevoker)
+	if !ok {
+		return errors.New("tokens can't be revoked")
+	}
+	err = revoker.RevokeToken(token)
+	c.tokens.remove(token)
+	return
+}
+
+//put caches a lookup, if it found something (before expires, if set) or found nothing.  Other errors aren't cached.
+func (c *MetaTokenCache) put(cache *lruCache, generation uint64, key string, value interface{}, err error, expires time.Time) {
+	ttl := c.TTL
+	if err != nil {
+		if !errors.Is(err, ErrNotFound) {
+			return
+		}
+		ttl = c.NegativeTTL
+	}
+	until := time.Now().Add(ttl)
+	if err == nil && !expires.IsZero() && expires.Before(until) {
+		until = expires
+	}
+	cache.put(generation, key, value, err, until)
+}
+
+//lruCache is a size bounded cache of values (or errors) that expire, evicting the least recently used
+type lruCache struct {
+	maxEntries int
+	mu sync.Mutex
+	entries map[string]*list.Element
+	lru *list.List
+	//incremented on every removal, so lookups that raced with one aren't cached
+	gen uint64
+}
+
+type lruEntry struct {
+	key string
+	value interface{}
+	err error
+	expires time.Time
+}
+
+func newLRUCache(maxEntries int) *lruCache {
+	return &lruCache{maxEntries: maxEntries, entries: map[string]*list.Element{}, lru: list.New()}
+}
+
+func (c *lruCache) get(key string) (entry *lruEntry, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry = el.Value.(*lruEntry)
+	if !time.Now().Before(entry.expires) {
+		c.lru.Remove(el)
+		delete(c.entries, key)
+		return nil, false
+	}
+	c.lru.MoveToFront(el)
+	return entry, true
+}
+
+func (c *lruCache) generation() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.gen
+}
+
+//put caches a value, unless anything's been removed since generation, as it may have been stale
+func (c *lruCache) put(generation uint64, key string, value interface{}, err error, expires time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if generation != c.gen || c.maxEntries <= 0 {
+		return
+	}
+	if el, ok := c.entries[key]; ok {
+		c.lru.Remove(el)
+	}
+	c.entries[key] = c.lru.PushFront(&lruEntry{key: key, value: value, err: err, expires: expires})
+	for c.lru.Len() > c.maxEntries {
+		delete(c.entries, c.lru.Remove(c.lru.Back()).(*lruEntry).key)
+	}
+}
+
+func (c *lruCache) remove(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gen++
+	if el, ok := c.entries[key]; ok {
+		c.lru.Remove(el)
+		delete(c.entries, key)
+	}
+}
@@ -0,0 +1,100 @@
+package assetstore
+
+import (
+	"errors"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+//countingMetaTokenStore counts lookups that reach the backend
+type countingMetaTokenStore struct {
+	*memMetaTokenStore
+	mu      sync.Mutex
+	lookups int
+}
+
+func (s *countingMetaTokenStore) count() {
+	s.mu.Lock()
+	s.lookups++
+	s.mu.Unlock()
+}
+
+func (s *countingMetaTokenStore) GetMeta(id string) (meta AssetMeta, err error) {
+	s.count()
+	return s.memMetaTokenStore.GetMeta(id)
+}
+
+func (s *countingMetaTokenStore) GetToken(token string) (t AssetToken, err error) {
+	s.count()
+	return s.memMetaTokenStore.GetToken(token)
+}
+
+func TestMetaTokenCache(t *testing.T) {
+	db := &countingMetaTokenStore{memMetaTokenStore: newMemMetaTokenStore()}
+	cache := NewMetaTokenCache(db, db, 2)
+	s := NewAssetStorage(cache, cache, newMemDataStore())
+
+	meta := AssetMeta{ID: uuid.New().String(), Name: "a.txt"}
+	token := AssetToken{Token: uuid.New().String(), AssetID: meta.ID, Expiry: time.Now().Add(time.Hour).Unix()}
+	_, err := s.Store(meta, token, ioutil.NopCloser(strings.NewReader("data")))
+	assert.NoError(t, err)
+
+	//repeated downloads are served from the cache
+	for i := 0; i < 3; i++ {
+		_, asset, err := s.GetByToken(token.Key())
+		assert.NoError(t, err)
+		assert.Equal(t, "data", readAll(t, asset))
+	}
+	assert.Equal(t, 2, db.lookups)
+
+	//as are lookups that found nothing, for a shorter time
+	for i := 0; i < 3; i++ {
+		_, err = cache.GetMeta("missing")
+		assert.True(t, errors.Is(err, ErrNotFound))
+	}
+	assert.Equal(t, 3, db.lookups)
+
+	//changes made through the cache are seen straight away
+	meta.Name = "b.txt"
+	meta.State = StateReady
+	assert.NoError(t, cache.StoreMeta(meta))
+	got, err := cache.GetMeta(meta.Key())
+	assert.NoError(t, err)
+	assert.Equal(t, "b.txt", got.Name)
+	assert.NoError(t, s.RevokeToken(token.Key()))
+	_, _, err = s.GetByToken(token.Key())
+	assert.True(t, errors.Is(err, ErrNotFound))
+
+	//but ones made elsewhere only once cached lookups expire
+	cache.TTL = 50 * time.Millisecond
+	other := AssetToken{Token: uuid.New().String(), AssetID: meta.ID, Expiry: time.Now().Add(time.Hour).Unix()}
+	assert.NoError(t, cache.StoreToken(other))
+	_, err = cache.GetToken(other.Key())
+	assert.NoError(t, err)
+	assert.NoError(t, db.RevokeToken(other.Key()))
+	_, err = cache.GetToken(other.Key())
+	assert.NoError(t, err)
+	time.Sleep(60 * time.Millisecond)
+	_, err = cache.GetToken(other.Key())
+	assert.True(t, errors.Is(err, ErrNotFound))
+
+	//tokens aren't cached past their expiry
+	expiring := AssetToken{Token: uuid.New().String(), AssetID: meta.ID, Expiry: time.Now().Add(time.Second).Unix()}
+	cache.TTL = time.Hour
+	assert.NoError(t, cache.StoreToken(expiring))
+	_, err = cache.GetToken(expiring.Key())
+	assert.NoError(t, err)
+	entry, ok := cache.tokens.get(expiring.Key())
+	assert.True(t, ok)
+	assert.False(t, entry.expires.After(time.Unix(expiring.Expiry, 0)))
+
+	//the least recently used entries are evicted
+	assert.True(t, cache.metas.lru.Len() <= 2)
+	assert.True(t, cache.tokens.lru.Len() <= 2)
+}
@@ -0,0 +1,109 @@
+package assetstore
+
+import (
+	"errors"
+	"fmt"
+	"mime"
+
+	log "github.com/sirupsen/logrus"
+)
+
+//An asset's name, content type and user metadata can be changed without re-uploading it.  Every change bumps the
+//meta's revision, and is only made if the meta's still at the revision it was made to, so concurrent changes can't
+//silently overwrite each other.
+
+//ErrRevisionMismatch is returned changing an asset that's been changed since the revision the change was made to
+var ErrRevisionMismatch = errors.New("asset has been changed")
+
+const (
+	//maxMetadataKeys is the most user metadata keys an asset can have
+	maxMetadataKeys = 32
+	maxMetadataKeyLength = 128
+	maxMetadataValueLength = 1024
+)
+
+//MetaUpdate is a change to an asset's meta.  Fields left nil are left as they are.
+type MetaUpdate struct {
+	Name *string `json:"name"`
+	ContentType *string `json:"content_type"`
+	//Metadata replaces all of the asset's user metadata, if set
+	Metadata map[string]string `json:"metadata"`
+}
+
+//apply makes an update to meta
+func (u MetaUpdate) apply(meta AssetMeta) AssetMeta {
+	if u.Name != nil {
+		meta.Name = *u.Name
+	}
+	if u.ContentType != nil {
+		meta.ContentType = *u.ContentType
+	}
+	if u.Metadata != nil {
+		meta.Metadata = u.Metadata
+	}
+	return meta
+}
+
+//MetaUpdater updates meta, by its tenant scoped id, only if it's at revision, bumping its revision, or returns
+//ErrRevisionMismatch
+type MetaUpdater interface {
+	UpdateMeta(id string, update MetaUpdate, revision int64) (meta AssetMeta, err error)
+}
+
+//validMetadata checks user metadata isn't too big
+func validMetadata(metadata map[string]string) error {
+	if len(metadata) > maxMetadataKeys {
+		return fmt.Errorf("metadata can have at most %d keys", maxMetadataKeys)
+	}
+	for k, v := range metadata {
+		if k == "" || len(k) > maxMetadataKeyLength || len(v) > maxMetadataValueLength {
+			return fmt.Errorf("metadata keys must be 1 to %d bytes, and values at most %d", maxMetadataKeyLength, maxMetadataValueLength)
+		}
+	}
+	return nil
+}
+
+//UpdateMeta changes the name, content type and/or user metadata of a retrievable asset, by its tenant scoped id, if
+//it's still at revision.  Changed names and content types are checked against the upload validator, as if the asset
+//was uploaded with them.
+func (s *AssetStorage) UpdateMeta(id string, update MetaUpdate, revision int64) (meta AssetMeta, err error) {
+	updater, ok := s.metaHandler.(MetaUpdater)
+	if !ok {
+		return meta, fmt.Errorf("meta can't be updated")
+	}
+	meta, err = s.retrievableMeta(id)
+	if err != nil {
+		return
+	}
+	if meta.Revision != revision {
+		return meta, fmt.Errorf("%w: it's at revision %d, not %d", ErrRevisionMismatch, meta.Revision, revision)
+	}
+	updated := update.apply(meta)
+	if !updated.Valid() {
+		return meta, fmt.Errorf("name can't be empty")
+	}
+	//an empty content type clears it
+	if update.ContentType != nil && updated.ContentType != "" {
+		if _, _, err = mime.ParseMediaType(updated.ContentType); err != nil {
+			return meta, fmt.Errorf("invalid content type: %w", err)
+		}
+	}
+	if err = validMetadata(updated.Metadata); err != nil {
+		return meta, err
+	}
+	if s.uploadValidator != nil && (update.Name != nil || update.ContentType != nil) {
+		if err = s.uploadValidator.ValidateUpload(updated, updated.ContentType); err != nil {
+			return meta, err
+		}
+	}
+	meta, err = updater.UpdateMeta(id, update, revision)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"context": "AssetStorage.UpdateMeta()",
+			"metaHandler": s.metaHandler,
+			"id": id,
+			"update": update,
+		}).Error(err)
+	}
+	return
+}
@@ -0,0 +1,77 @@
+package assetstore
+
+import (
+	"errors"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAssetStorage_UpdateMeta(t *testing.T) {
+	db := newMemMetaTokenStore()
+	s := NewAssetStorage(db, db, newMemDataStore(), WithUploadValidator(ContentPolicies{
+		Default: ContentPolicy{DenyExtensions: []string{".exe"}},
+	}))
+	meta, err := s.Store(AssetMeta{ID: uuid.New().String(), Name: "reprot.pdf"}, AssetToken{}, ioutil.NopCloser(strings.NewReader("%PDF-1.4")))
+	assert.NoError(t, err)
+	str := func(s string) *string { return &s }
+	tooMany := map[string]string{}
+	for i := 0; i <= maxMetadataKeys; i++ {
+		tooMany[uuid.New().String()] = ""
+	}
+
+	tests := []struct {
+		name    string
+		update  MetaUpdate
+		wantErr error
+	}{
+		{"empty name", MetaUpdate{Name: str("")}, nil},
+		{"bad content type", MetaUpdate{ContentType: str("not a type;;")}, nil},
+		{"too much metadata", MetaUpdate{Metadata: tooMany}, nil},
+		{"long metadata value", MetaUpdate{Metadata: map[string]string{"k": strings.Repeat("v", maxMetadataValueLength+1)}}, nil},
+		{"denied extension", MetaUpdate{Name: str("report.exe")}, ErrContentRejected},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := s.UpdateMeta(meta.Key(), tt.update, 0)
+			assert.Error(t, err)
+			if tt.wantErr != nil {
+				assert.True(t, errors.Is(err, tt.wantErr))
+			}
+		})
+	}
+
+	//fields left out are kept, and every update bumps the revision
+	updated, err := s.UpdateMeta(meta.Key(), MetaUpdate{Name: str("report.pdf"), Metadata: map[string]string{"quarter": "q3"}}, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, "report.pdf", updated.Name)
+	assert.Equal(t, "q3", updated.Metadata["quarter"])
+	assert.Equal(t, int64(1), updated.Revision)
+	updated, err = s.UpdateMeta(meta.Key(), MetaUpdate{ContentType: str("application/pdf")}, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, "report.pdf", updated.Name)
+	assert.Equal(t, "q3", updated.Metadata["quarter"])
+	assert.Equal(t, int64(2), updated.Revision)
+
+	//an empty content type clears it
+	updated, err = s.UpdateMeta(meta.Key(), MetaUpdate{ContentType: str("")}, 2)
+	assert.NoError(t, err)
+	assert.Equal(t, "", updated.ContentType)
+	assert.Equal(t, int64(3), updated.Revision)
+
+	//updates only apply to the revision they were made to
+	_, err = s.UpdateMeta(meta.Key(), MetaUpdate{Name: str("stale.pdf")}, 2)
+	assert.True(t, errors.Is(err, ErrRevisionMismatch))
+	_, err = s.UpdateMeta(uuid.New().String(), MetaUpdate{Name: str("missing.pdf")}, 0)
+	assert.True(t, errors.Is(err, ErrNotFound))
+}
+
+func TestDynamoAssetAttrMap_Metadata(t *testing.T) {
+	meta := AssetMeta{ID: "id", Name: "report.pdf", Metadata: map[string]string{"quarter": "q3"}, Revision: 4}
+	got := dynamoAssetAttrMapToMeta(assetMetaToDynamoAttrMap(meta))
+	assert.Equal(t, meta.Metadata, got.Metadata)
+	assert.Equal(t, meta.Revision, got.Revision)
+}
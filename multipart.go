@@ -0,0 +1,131 @@
+package assetstore
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+//Multipart uploads are reserved like direct uploads (see upload.go), but their parts are uploaded through us, in any
+//order and in parallel, and written straight to the storage backend's own multipart upload.  They're completed, and
+//expire, the same way.
+
+//ErrMultipartUnsupported is returned starting a multipart upload when data can't be written in parts
+var ErrMultipartUnsupported = errors.New("multipart uploads not supported by data storage")
+
+//MultipartWriter writes objects in numbered parts, which can be written in any order, and in parallel, then put
+//together once they've all been written
+type MultipartWriter interface {
+	AssetDataWriter
+	//StartMultipartWrite starts writing an object in parts
+	StartMultipartWrite(id string) (uploadID string, err error)
+	//WritePart writes part number (from 1) of an object, returning what's needed to complete it
+	WritePart(id, uploadID string, number int64, part io.ReadSeeker) (uploaded UploadPart, err error)
+	CompleteMultipartUpload(id, uploadID string, parts []UploadPart) (err error)
+	AbortMultipartUpload(id, uploadID string) (err error)
+}
+
+//MultipartUploader starts, uploads parts of, completes and aborts multipart uploads
+type MultipartUploader interface {
+	UploadCompleter
+	StartMultipart(meta AssetMeta, ttl time.Duration) (started AssetMeta, err error)
+	UploadPart(id string, number int64, part io.Reader, checksum *ChunkChecksum) (uploaded UploadPart, err error)
+	AbortUpload(id string) (err error)
+}
+
+//StartMultipart reserves the declared size of an asset, and starts a multipart upload of its data, which must be
+//completed within ttl.  A declared checksum is checked when the upload is completed.
+func (s *AssetStorage) StartMultipart(meta AssetMeta, ttl time.Duration) (started AssetMeta, err error) {
+	writer, ok := s.dataHandler.(MultipartWriter)
+	if !ok {
+		return meta, ErrMultipartUnsupported
+	}
+	return s.reserveUpload(meta, ttl, func(meta *AssetMeta) (err error) {
+		meta.UploadID, err = writer.StartMultipartWrite(stagingKey(*meta))
+		return
+	})
+}
+
+//UploadPart uploads part number (from 1) of a multipart upload, returning what's needed to complete it.  If checksum
+//is given, the part must match it.  Parts that aren't all received aren't uploaded.
+func (s *AssetStorage) UploadPart(id string, number int64, part io.Reader, checksum *ChunkChecksum) (uploaded UploadPart, err error) {
+	if number < 1 || number > maxUploadParts {
+		return uploaded, fmt.Errorf("part number must be from 1 to %d", maxUploadParts)
+	}
+	meta, err := s.metaHandler.GetMeta(id)
+	if err != nil {
+		return
+	}
+	if meta.Retrievable() || meta.ReservedUntil == 0 || meta.UploadID == "" || meta.Resumable {
+		return uploaded, fmt.Errorf("%w: no multipart upload for %s", ErrNotFound, id)
+	}
+	if time.Now().Unix() > meta.ReservedUntil {
+		return uploaded, ErrReservationExpired
+	}
+	writer, ok := s.dataHandler.(MultipartWriter)
+	if !ok {
+		return uploaded, ErrMultipartUnsupported
+	}
+
+	//parts are spooled, so they're checked before they're written, and can be re-read if writing them is retried
+	spool, err := ioutil.TempFile("", "part-")
+	if err != nil {
+		return
+	}
+	defer func() {
+		spool.Close()
+		os.Remove(spool.Name())
+	}()
+	hasher := sha256.New()
+	hashes := io.Writer(hasher)
+	if checksum != nil {
+		hashes = io.MultiWriter(hasher, checksum.Hash)
+	}
+	n, err := io.Copy(spool, io.TeeReader(io.LimitReader(part, int64(meta.Size)+1), hashes))
+	if err != nil {
+		return
+	}
+	if n > int64(meta.Size) {
+		return uploaded, fmt.Errorf("%w: part is larger than the upload", ErrUploadTooLarge)
+	}
+	if checksum != nil && !bytes.Equal(checksum.Hash.Sum(nil), checksum.Sum) {
+		return uploaded, ErrChecksumMismatch
+	}
+	if _, err = spool.Seek(0, io.SeekStart); err != nil {
+		return
+	}
+	uploaded, err = writer.WritePart(stagingKey(meta), meta.UploadID, number, spool)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"context": "AssetStorage.UploadPart()",
+			"dataHandler": s.dataHandler,
+			"meta": meta,
+			"part": number,
+		}).Error(err)
+		return
+	}
+	uploaded.Checksum = hex.EncodeToString(hasher.Sum(nil))
+	return uploaded, nil
+}
+
+//AbortUpload abandons a reserved upload that hasn't been completed, removing anything uploaded and releasing its
+//reservation
+func (s *AssetStorage) AbortUpload(id string) (err error) {
+	meta, err := s.metaHandler.GetMeta(id)
+	if err != nil {
+		return
+	}
+	if meta.Retrievable() || meta.ReservedUntil == 0 || meta.Resumable {
+		return fmt.Errorf("%w: no upload reserved for %s", ErrNotFound, id)
+	}
+	s.rollbackStore(meta, Usage{Bytes: int64(meta.Size), Objects: 1})
+	return nil
+}
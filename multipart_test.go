@@ -0,0 +1,109 @@
+package assetstore
+
+import (
+	"crypto/sha256"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAssetStorage_MultipartUpload(t *testing.T) {
+	db := newMemMetaTokenStore()
+	data := newUploadingDataStore()
+	//through a disk cache, which passes multipart writes through
+	cache, err := NewDiskCache(data, t.TempDir(), 1024)
+	assert.NoError(t, err)
+	s := NewAssetStorage(db, db, cache)
+
+	content := "0123456789"
+	meta := AssetMeta{ID: uuid.New().String(), Name: "parts.bin", Size: len(content), Checksum: sha256Hex(content)}
+	meta, err = s.StartMultipart(meta, time.Hour)
+	assert.NoError(t, err)
+	_, _, err = s.GetByID(meta.Key())
+	assert.True(t, errors.Is(err, ErrNotFound))
+
+	//parts can be uploaded in any order, in parallel
+	chunks := []string{"0123", "4567", "89"}
+	parts := make([]UploadPart, len(chunks))
+	var wg sync.WaitGroup
+	for i := len(chunks) - 1; i >= 0; i-- {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			sum := sha256.Sum256([]byte(chunks[i]))
+			part, err := s.UploadPart(meta.Key(), int64(i+1), strings.NewReader(chunks[i]), &ChunkChecksum{Hash: sha256.New(), Sum: sum[:]})
+			assert.NoError(t, err)
+			parts[i] = part
+		}(i)
+	}
+	wg.Wait()
+	assert.Equal(t, sha256Hex("89"), parts[2].Checksum)
+
+	tests := []struct {
+		name     string
+		number   int64
+		part     string
+		checksum *ChunkChecksum
+		wantErr  error
+	}{
+		{"bad part number", 0, "0123", nil, nil},
+		{"too many parts", maxUploadParts + 1, "0123", nil, nil},
+		{"part larger than the upload", 1, content + "!", nil, ErrUploadTooLarge},
+		{"part doesn't match its checksum", 1, "0123", &ChunkChecksum{Hash: sha256.New(), Sum: []byte("wrong")}, ErrChecksumMismatch},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := s.UploadPart(meta.Key(), tt.number, strings.NewReader(tt.part), tt.checksum)
+			assert.Error(t, err)
+			if tt.wantErr != nil {
+				assert.True(t, errors.Is(err, tt.wantErr))
+			}
+		})
+	}
+
+	token := AssetToken{Token: uuid.New().String(), AssetID: meta.ID, Expiry: time.Now().Add(time.Minute).Unix()}
+	stored, err := s.CompleteUpload(meta.Key(), parts, token)
+	assert.NoError(t, err)
+	assert.Equal(t, sha256Hex(content), stored.Checksum)
+	_, asset, err := s.GetByToken(token.Key())
+	assert.NoError(t, err)
+	assert.Equal(t, content, readAll(t, asset))
+	//parts can't be uploaded to, nor the upload aborted, once it's complete
+	_, err = s.UploadPart(meta.Key(), 1, strings.NewReader("0123"), nil)
+	assert.True(t, errors.Is(err, ErrNotFound))
+	assert.True(t, errors.Is(s.AbortUpload(meta.Key()), ErrNotFound))
+
+	//multipart writes of data that would be stored encrypted aren't possible
+	encrypted := NewAssetStorage(db, db, NewEncryptingDataHandler(data, testKeyProvider(t, "k1", "k1")))
+	_, err = encrypted.StartMultipart(AssetMeta{ID: uuid.New().String(), Name: "secret.bin", Size: 4}, time.Hour)
+	assert.True(t, errors.Is(err, ErrMultipartUnsupported))
+}
+
+func TestAssetStorage_AbortUpload(t *testing.T) {
+	db := newMemMetaTokenStore()
+	data := newUploadingDataStore()
+	s := NewAssetStorage(db, db, data, WithQuotas(newMemUsageTracker(), QuotaLimits{}))
+
+	meta, err := s.StartMultipart(AssetMeta{ID: uuid.New().String(), Name: "parts.bin", Size: 10}, time.Hour)
+	assert.NoError(t, err)
+	_, err = s.UploadPart(meta.Key(), 1, strings.NewReader("0123"), nil)
+	assert.NoError(t, err)
+	assert.NoError(t, s.AbortUpload(meta.Key()))
+	_, err = db.GetMeta(meta.Key())
+	assert.True(t, errors.Is(err, ErrNotFound))
+	assert.Empty(t, data.uploads)
+	report, err := s.Usage("", "")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), report.Tenant.Usage.Bytes)
+
+	//expired uploads can't be added to
+	expired, err := s.StartMultipart(AssetMeta{ID: uuid.New().String(), Name: "late.bin", Size: 10}, -time.Second)
+	assert.NoError(t, err)
+	_, err = s.UploadPart(expired.Key(), 1, strings.NewReader("0123"), nil)
+	assert.True(t, errors.Is(err, ErrReservationExpired))
+}
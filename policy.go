@@ -0,0 +1,164 @@
+package assetstore
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"strings"
+)
+
+//Content policies allow or deny uploads by their sniffed MIME type and file extension.  They're checked by
+//AssetStorage.Store once the data is written but before the meta is, and rejected uploads are deleted.
+
+//ErrContentRejected is returned storing an asset a content policy doesn't allow
+var ErrContentRejected = errors.New("content type not allowed")
+
+//sniffLen is how much of an upload is used to detect its content type, as per http.DetectContentType
+const sniffLen = 512
+
+//ContentPolicy allows or denies uploads by MIME type and extension.  Deny rules win, and when allow rules are
+//given uploads must match one.  Types may be wildcards like "image/*", extensions include the dot (".exe").
+type ContentPolicy struct {
+	AllowTypes      []string `json:"allow_types,omitempty"`
+	DenyTypes       []string `json:"deny_types,omitempty"`
+	AllowExtensions []string `json:"allow_extensions,omitempty"`
+	DenyExtensions  []string `json:"deny_extensions,omitempty"`
+}
+
+//Check checks an upload's name and sniffed content type against the policy
+func (p ContentPolicy) Check(name, contentType string) (err error) {
+	ext := strings.ToLower(path.Ext(name))
+	switch {
+	case matchesType(p.DenyTypes, contentType):
+		return fmt.Errorf("%w: %s", ErrContentRejected, contentType)
+	case matchesExtension(p.DenyExtensions, ext):
+		return fmt.Errorf("%w: %s", ErrContentRejected, ext)
+	case len(p.AllowTypes) > 0 && !matchesType(p.AllowTypes, contentType):
+		return fmt.Errorf("%w: %s", ErrContentRejected, contentType)
+	case len(p.AllowExtensions) > 0 && !matchesExtension(p.AllowExtensions, ext):
+		return fmt.Errorf("%w: %s", ErrContentRejected, ext)
+	}
+	return nil
+}
+
+func matchesType(patterns []string, contentType string) bool {
+	//ignore parameters like "; charset=utf-8"
+	contentType = strings.ToLower(strings.TrimSpace(strings.Split(contentType, ";")[0]))
+	for _, p := range patterns {
+		p = strings.ToLower(p)
+		if p == contentType || p == "*/*" ||
+			(strings.HasSuffix(p, "/*") && strings.HasPrefix(contentType, strings.TrimSuffix(p, "*"))) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchesExtension(exts []string, ext string) bool {
+	for _, e := range exts {
+		if strings.ToLower(e) == ext {
+			return true
+		}
+	}
+	return false
+}
+
+//ContentPolicies picks the policy for an upload.  The owner's (api key user's) policy wins over the tenant's,
+//which wins over the default.
+type ContentPolicies struct {
+	Default ContentPolicy `json:"default"`
+	//Policies by tenant
+	Tenants map[string]ContentPolicy `json:"tenants,omitempty"`
+	//Policies by owner, keyed "tenant/user" (or just "user" in the default tenant)
+	Owners map[string]ContentPolicy `json:"owners,omitempty"`
+}
+
+//LoadContentPolicies reads ContentPolicies from a json file
+func LoadContentPolicies(file string) (policies ContentPolicies, err error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(b, &policies)
+	return
+}
+
+func (p ContentPolicies) policyFor(meta AssetMeta) ContentPolicy {
+	if policy, ok := p.Owners[ScopedKey(meta.Tenant, meta.Owner)]; ok && meta.Owner != "" {
+		return policy
+	}
+	if policy, ok := p.Tenants[meta.Tenant]; ok {
+		return policy
+	}
+	return p.Default
+}
+
+//UploadValidator decides whether an upload may be stored, given its meta and the content type sniffed from it
+type UploadValidator interface {
+	ValidateUpload(meta AssetMeta, sniffedType string) (err error)
+}
+
+func (p ContentPolicies) ValidateUpload(meta AssetMeta, sniffedType string) (err error) {
+	return p.policyFor(meta).Check(meta.Name, sniffedType)
+}
+
+//WithUploadValidator checks uploads before their meta is stored, deleting any that are rejected
+func WithUploadValidator(v UploadValidator) AssetStorageOption {
+	return func(s *AssetStorage) {
+		s.uploadValidator = v
+	}
+}
+
+//executable signatures http.DetectContentType doesn't know, which would otherwise be application/octet-stream
+var executableSignatures = []struct {
+	magic       []byte
+	contentType string
+}{
+	{[]byte("MZ"), "application/x-msdownload"},
+	{[]byte("\x7fELF"), "application/x-executable"},
+	{[]byte("\xfe\xed\xfa\xce"), "application/x-mach-binary"},
+	{[]byte("\xfe\xed\xfa\xcf"), "application/x-mach-binary"},
+	{[]byte("\xce\xfa\xed\xfe"), "application/x-mach-binary"},
+	{[]byte("\xcf\xfa\xed\xfe"), "application/x-mach-binary"},
+	{[]byte("#!"), "text/x-shellscript"},
+}
+
+//SniffContentType detects the MIME type of data from (up to) its first 512 bytes
+func SniffContentType(head []byte) string {
+	for _, sig := range executableSignatures {
+		if bytes.HasPrefix(head, sig.magic) {
+			return sig.contentType
+		}
+	}
+	return http.DetectContentType(head)
+}
+
+//sniffReader keeps the start of what's read through it, to sniff the content type of streamed data
+type sniffReader struct {
+	io.ReadCloser
+	head []byte
+}
+
+func newSniffReader(r io.ReadCloser) *sniffReader {
+	return &sniffReader{ReadCloser: r, head: make([]byte, 0, sniffLen)}
+}
+
+func (r *sniffReader) Read(p []byte) (n int, err error) {
+	n, err = r.ReadCloser.Read(p)
+	if need := sniffLen - len(r.head); need > 0 {
+		if n < need {
+			need = n
+		}
+		r.head = append(r.head, p[:need]...)
+	}
+	return
+}
+
+func (r *sniffReader) ContentType() string {
+	return SniffContentType(r.head)
+}
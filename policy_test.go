@@ -0,0 +1,70 @@
+package assetstore
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestContentPolicy_Check(t *testing.T) {
+	policy := ContentPolicy{
+		AllowTypes:     []string{"image/*", "text/plain"},
+		DenyExtensions: []string{".exe"},
+	}
+	tests := []struct {
+		name        string
+		file        string
+		contentType string
+		wantErr     bool
+	}{
+		{name: "allowed wildcard", file: "cat.png", contentType: "image/png"},
+		{name: "allowed with params", file: "notes.txt", contentType: "text/plain; charset=utf-8"},
+		{name: "not allowed", file: "page.html", contentType: "text/html; charset=utf-8", wantErr: true},
+		{name: "denied extension", file: "setup.EXE", contentType: "text/plain", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := policy.Check(tt.file, tt.contentType)
+			assert.Equal(t, tt.wantErr, errors.Is(err, ErrContentRejected))
+		})
+	}
+}
+
+func TestSniffContentType(t *testing.T) {
+	assert.Equal(t, "application/x-msdownload", SniffContentType([]byte("MZ\x90\x00")))
+	assert.Equal(t, "application/x-executable", SniffContentType([]byte("\x7fELF\x02\x01")))
+	assert.Equal(t, "image/png", SniffContentType([]byte("\x89PNG\x0D\x0A\x1A\x0A")))
+}
+
+func TestAssetStorage_UploadValidator(t *testing.T) {
+	db := newMemMetaTokenStore()
+	data := newMemDataStore()
+	s := NewAssetStorage(db, db, data, WithUploadValidator(ContentPolicies{
+		Tenants: map[string]ContentPolicy{
+			"public": {DenyTypes: []string{"application/x-msdownload", "application/x-executable"}},
+		},
+	}))
+
+	store := func(tenant string, content string) (AssetMeta, error) {
+		meta := AssetMeta{ID: uuid.New().String(), Tenant: tenant, Name: "tool.bin"}
+		_, err := s.Store(meta, AssetToken{}, ioutil.NopCloser(bytes.NewReader([]byte(content))))
+		return meta, err
+	}
+
+	//rejected uploads are removed from the data backend, and get no meta
+	_, err := store("public", "MZ\x90\x00 not really a program")
+	assert.True(t, errors.Is(err, ErrContentRejected))
+	assert.Empty(t, data.data)
+	assert.Empty(t, db.metas)
+
+	//other tenants have the (empty) default policy
+	meta, err := store("internal", "MZ\x90\x00 not really a program")
+	assert.NoError(t, err)
+	stored, err := s.GetMeta(meta.Key())
+	assert.NoError(t, err)
+	assert.Equal(t, "application/x-msdownload", stored.ContentType)
+}
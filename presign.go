@@ -0,0 +1,62 @@
+package assetstore
+
+import (
+	"errors"
+	"mime"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+//Downloads can be redirected to presigned urls of the storage backend, so data doesn't stream through us.  Only data
+//stored as is can be, anything compressed or encrypted still has to be decoded by us.
+
+//ErrSigningUnsupported is returned by URLSigners that can't sign urls for the data asked for
+var ErrSigningUnsupported = errors.New("url signing is not supported")
+
+//URLSigner signs short lived urls data can be downloaded from directly, as an attachment with the given filename
+type URLSigner interface {
+	SignURL(id string, filename string, ttl time.Duration) (url string, err error)
+}
+
+//attachmentDisposition is a Content-Disposition for downloading as filename
+func attachmentDisposition(filename string) string {
+	return mime.FormatMediaType("attachment", map[string]string{"filename": filename})
+}
+
+func (s *AssetStorage) SignedURLByID(id string, ttl time.Duration) (meta AssetMeta, url string, err error) {
+	meta, err = s.retrievableMeta(id)
+	if err != nil {
+		return
+	}
+	s.recordAccess(meta)
+	return meta, s.signURL(meta, ttl), nil
+}
+
+func (s *AssetStorage) SignedURLByToken(token string, ttl time.Duration) (meta AssetMeta, url string, err error) {
+	meta, err = s.retrievableMetaByToken(token)
+	if err != nil {
+		return
+	}
+	s.recordAccess(meta)
+	return meta, s.signURL(meta, ttl), nil
+}
+
+//signURL signs a url for an asset's data, "" if it can't be downloaded directly
+func (s *AssetStorage) signURL(meta AssetMeta, ttl time.Duration) string {
+	signer, ok := s.dataHandler.(URLSigner)
+	if !ok || meta.Encoding != "" || meta.WrappedKey != "" {
+		return ""
+	}
+	url, err := signer.SignURL(meta.DataKey(), meta.Name, ttl)
+	if err != nil {
+		if !errors.Is(err, ErrSigningUnsupported) {
+			log.WithFields(log.Fields{
+				"context": "AssetStorage.signURL()",
+				"meta": meta,
+			}).Error(err)
+		}
+		return ""
+	}
+	return url
+}
@@ -0,0 +1,73 @@
+package assetstore
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+//signingDataStore signs fake urls for its data
+type signingDataStore struct {
+	*memDataStore
+}
+
+func (s *signingDataStore) SignURL(id, filename string, ttl time.Duration) (string, error) {
+	return "https://bucket.example/" + url.PathEscape(id) + "?response-content-disposition=" +
+		url.QueryEscape(attachmentDisposition(filename)) + "&expires=" + ttl.String(), nil
+}
+
+func TestAssetStorage_SignedURL(t *testing.T) {
+	db := newMemMetaTokenStore()
+	data := &signingDataStore{memDataStore: newMemDataStore()}
+	store := func(s *AssetStorage, name string) (AssetMeta, AssetToken) {
+		meta := AssetMeta{ID: uuid.New().String(), Name: name}
+		token := AssetToken{Token: uuid.New().String(), AssetID: meta.ID, Expiry: time.Now().Add(time.Minute).Unix()}
+		stored, err := s.Store(meta, token, ioutil.NopCloser(strings.NewReader(strings.Repeat("data ", 100))))
+		assert.NoError(t, err)
+		return stored, token
+	}
+
+	//plain data is signed, by id or token
+	s := NewAssetStorage(db, db, data)
+	meta, token := store(s, "firmware v1.bin")
+	_, signed, err := s.SignedURLByID(meta.Key(), time.Minute)
+	assert.NoError(t, err)
+	assert.Contains(t, signed, url.PathEscape(meta.Key()))
+	assert.Contains(t, signed, url.QueryEscape(`attachment; filename="firmware v1.bin"`))
+	_, byToken, err := s.SignedURLByToken(token.Key(), time.Minute)
+	assert.NoError(t, err)
+	assert.Equal(t, signed, byToken)
+
+	//retrieval is still checked
+	pending := AssetMeta{ID: uuid.New().String(), Name: "p.bin", State: StateUploading}
+	assert.NoError(t, db.StoreMeta(pending))
+	_, _, err = s.SignedURLByID(pending.Key(), time.Minute)
+	assert.True(t, errors.Is(err, ErrNotFound))
+
+	//data that has to be decoded isn't signed, through decorators or not
+	compressed := NewAssetStorage(db, db, NewCompressingDataHandler(data))
+	meta, _ = store(compressed, "logs.txt")
+	assert.Equal(t, GzipEncoding, meta.Encoding)
+	_, signed, err = compressed.SignedURLByID(meta.Key(), time.Minute)
+	assert.NoError(t, err)
+	assert.Equal(t, "", signed)
+
+	//and neither is data in storage that can't sign urls
+	unsigned := NewAssetStorage(db, db, NewCompressingDataHandler(newMemDataStore()))
+	meta, _ = store(unsigned, "image.png")
+	_, signed, err = unsigned.SignedURLByID(meta.Key(), time.Minute)
+	assert.NoError(t, err)
+	assert.Equal(t, "", signed)
+}
+
+func TestAttachmentDisposition(t *testing.T) {
+	assert.Equal(t, `attachment; filename=report.pdf`, attachmentDisposition("report.pdf"))
+	assert.Equal(t, `attachment; filename="a \"quoted\" name.txt"`, attachmentDisposition(`a "quoted" name.txt`))
+	assert.Equal(t, `attachment; filename*=utf-8''r%C3%A9sum%C3%A9.pdf`, attachmentDisposition("résumé.pdf"))
+}
@@ -0,0 +1,223 @@
+package assetstore
+
+import (
+	"errors"
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+)
+
+//Storage usage is tracked per tenant, and per owner within a tenant, and can be capped by quotas
+
+//ErrQuotaExceeded is returned when storing an asset would exceed a tenant or owner's quota
+var ErrQuotaExceeded = errors.New("storage quota exceeded")
+
+//QuotaError describes which quota an upload would exceed
+type QuotaError struct {
+	Scope string
+	Quota Quota
+	Used  Usage
+	//Size of the upload
+	Size int64
+}
+
+func (e *QuotaError) Error() string {
+	return fmt.Sprintf("%s for %s", ErrQuotaExceeded, e.Scope)
+}
+
+func (e *QuotaError) Unwrap() error {
+	return ErrQuotaExceeded
+}
+
+//TooLarge reports whether the upload could never fit in the quota, even with nothing else stored
+func (e *QuotaError) TooLarge() bool {
+	return e.Quota.MaxBytes > 0 && e.Size > e.Quota.MaxBytes
+}
+
+//Usage is the storage used by a tenant or owner
+type Usage struct {
+	//Bytes stored
+	Bytes int64 `json:"bytes"`
+	//Number of assets stored
+	Objects int64 `json:"objects"`
+}
+
+//Quota caps Usage.  Zero values are unlimited.
+type Quota struct {
+	MaxBytes   int64 `json:"max_bytes,omitempty"`
+	MaxObjects int64 `json:"max_objects,omitempty"`
+}
+
+//Allows reports whether adding delta to used stays within the quota
+func (q Quota) Allows(used Usage, delta Usage) bool {
+	if q.MaxBytes > 0 && delta.Bytes > 0 && used.Bytes+delta.Bytes > q.MaxBytes {
+		return false
+	}
+	if q.MaxObjects > 0 && delta.Objects > 0 && used.Objects+delta.Objects > q.MaxObjects {
+		return false
+	}
+	return true
+}
+
+//QuotaLimits configures the quotas applied to tenants and owners
+type QuotaLimits struct {
+	//Default quota of every tenant
+	Tenant Quota
+	//Default quota of every owner
+	Owner Quota
+	//Per tenant overrides of the default tenant quota
+	Tenants map[string]Quota
+}
+
+func (l QuotaLimits) tenantQuota(tenant string) Quota {
+	if q, ok := l.Tenants[tenant]; ok {
+		return q
+	}
+	return l.Tenant
+}
+
+//UsageTracker atomically tracks usage per scope (see TenantUsageScope and OwnerUsageScope)
+type UsageTracker interface {
+	//AddUsage adds delta to a scope's usage.  Increases fail with ErrQuotaExceeded, and change nothing,
+	//if they would exceed quota.  Decreases always succeed.
+	AddUsage(scope string, delta Usage, quota Quota) (err error)
+	GetUsage(scope string) (usage Usage, err error)
+}
+
+//UsageReporter reports usage and checks uploads against quotas before they are stored
+type UsageReporter interface {
+	Usage(tenant, owner string) (report UsageReport, err error)
+	CheckQuota(meta AssetMeta, size int64) (err error)
+}
+
+//UsageReport is the usage and quota of a tenant, and optionally an owner in it
+type UsageReport struct {
+	Tenant UsageQuota  `json:"tenant"`
+	Owner  *UsageQuota `json:"owner,omitempty"`
+}
+
+type UsageQuota struct {
+	Usage Usage `json:"usage"`
+	Quota Quota `json:"quota"`
+}
+
+//TenantUsageScope is the scope a tenant's usage is tracked under
+func TenantUsageScope(tenant string) string {
+	return "T#" + tenant
+}
+
+//OwnerUsageScope is the scope an owner's usage within a tenant is tracked under.  Tenants can't contain the separator,
+//unlike owners, so it always ends the tenant, even the default one, and owners in different tenants can't collide.
+func OwnerUsageScope(tenant, owner string) string {
+	return "O#" + tenant + tenantSeparator + owner
+}
+
+type usageScope struct {
+	scope string
+	quota Quota
+}
+
+//usageScopes are the scopes (and their quotas) an asset counts against
+func (l QuotaLimits) usageScopes(meta AssetMeta) []usageScope {
+	scopes := []usageScope{{scope: TenantUsageScope(meta.Tenant), quota: l.tenantQuota(meta.Tenant)}}
+	if meta.Owner != "" {
+		scopes = append(scopes, usageScope{scope: OwnerUsageScope(meta.Tenant, meta.Owner), quota: l.Owner})
+	}
+	return scopes
+}
+
+//WithQuotas tracks usage of stored assets, and enforces limits
+func WithQuotas(tracker UsageTracker, limits QuotaLimits) AssetStorageOption {
+	return func(s *AssetStorage) {
+		s.usageTracker = tracker
+		s.quotaLimits = limits
+	}
+}
+
+//addUsage adds delta to every scope an asset counts against, or none of them if any quota would be exceeded
+func (s *AssetStorage) addUsage(meta AssetMeta, delta Usage) (err error) {
+	if s.usageTracker == nil {
+		return nil
+	}
+	scopes := s.quotaLimits.usageScopes(meta)
+	for i, sc := range scopes {
+		if err = s.usageTracker.AddUsage(sc.scope, delta, sc.quota); err != nil {
+			//undo the scopes already added to
+			for _, added := range scopes[:i] {
+				s.releaseUsage(added.scope, delta)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+//removeUsage removes delta from every scope an asset counts against
+func (s *AssetStorage) removeUsage(meta AssetMeta, delta Usage) {
+	if s.usageTracker == nil {
+		return
+	}
+	for _, sc := range s.quotaLimits.usageScopes(meta) {
+		s.releaseUsage(sc.scope, delta)
+	}
+}
+
+//restoreUsage adds delta back to every scope an asset counts against, whatever their quotas, undoing a removeUsage
+func (s *AssetStorage) restoreUsage(meta AssetMeta, delta Usage) {
+	if s.usageTracker == nil {
+		return
+	}
+	for _, sc := range s.quotaLimits.usageScopes(meta) {
+		if err := s.usageTracker.AddUsage(sc.scope, delta, Quota{}); err != nil {
+			logUsageError(sc.scope, delta, err)
+		}
+	}
+}
+
+func (s *AssetStorage) releaseUsage(scope string, delta Usage) {
+	if err := s.usageTracker.AddUsage(scope, Usage{Bytes: -delta.Bytes, Objects: -delta.Objects}, Quota{}); err != nil {
+		logUsageError(scope, delta, err)
+	}
+}
+
+//CheckQuota checks whether an upload of size bytes would fit in the quotas of the asset's tenant and owner.
+//It's an early check only, Store enforces quotas atomically.
+func (s *AssetStorage) CheckQuota(meta AssetMeta, size int64) (err error) {
+	if s.usageTracker == nil {
+		return nil
+	}
+	for _, sc := range s.quotaLimits.usageScopes(meta) {
+		used, err := s.usageTracker.GetUsage(sc.scope)
+		if err != nil {
+			return err
+		}
+		if !sc.quota.Allows(used, Usage{Bytes: size, Objects: 1}) {
+			return &QuotaError{Scope: sc.scope, Quota: sc.quota, Used: used, Size: size}
+		}
+	}
+	return nil
+}
+
+//Usage reports the usage and quotas of a tenant, and of an owner in it when owner isn't ""
+func (s *AssetStorage) Usage(tenant, owner string) (report UsageReport, err error) {
+	if s.usageTracker == nil {
+		return report, fmt.Errorf("usage is not tracked")
+	}
+	report.Tenant.Quota = s.quotaLimits.tenantQuota(tenant)
+	if report.Tenant.Usage, err = s.usageTracker.GetUsage(TenantUsageScope(tenant)); err != nil {
+		return
+	}
+	if owner != "" {
+		report.Owner = &UsageQuota{Quota: s.quotaLimits.Owner}
+		report.Owner.Usage, err = s.usageTracker.GetUsage(OwnerUsageScope(tenant, owner))
+	}
+	return
+}
+
+func logUsageError(scope string, delta Usage, err error) {
+	log.WithFields(log.Fields{
+		"context": "AssetStorage.releaseUsage()",
+		"scope":   scope,
+		"delta":   delta,
+	}).Error(err)
+}
@@ -0,0 +1,86 @@
+package assetstore
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"sync"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+type memUsageTracker struct {
+	mu    sync.Mutex
+	usage map[string]Usage
+}
+
+func newMemUsageTracker() *memUsageTracker {
+	return &memUsageTracker{usage: map[string]Usage{}}
+}
+
+func (m *memUsageTracker) AddUsage(scope string, delta Usage, quota Quota) (err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	used := m.usage[scope]
+	if !quota.Allows(used, delta) {
+		return ErrQuotaExceeded
+	}
+	m.usage[scope] = Usage{Bytes: used.Bytes + delta.Bytes, Objects: used.Objects + delta.Objects}
+	return nil
+}
+
+func (m *memUsageTracker) GetUsage(scope string) (usage Usage, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.usage[scope], nil
+}
+
+func TestAssetStorage_Quotas(t *testing.T) {
+	db := newMemMetaTokenStore()
+	data := newMemDataStore()
+	tracker := newMemUsageTracker()
+	s := NewAssetStorage(db, db, data, WithQuotas(tracker, QuotaLimits{
+		Tenant: Quota{MaxBytes: 100},
+		Owner:  Quota{MaxObjects: 2},
+	}))
+
+	store := func(owner string, size int, declared int) error {
+		meta := AssetMeta{ID: uuid.New().String(), Tenant: "team", Owner: owner, Name: "f", Size: declared}
+		_, err := s.Store(meta, AssetToken{}, ioutil.NopCloser(bytes.NewReader(make([]byte, size))))
+		return err
+	}
+
+	assert.NoError(t, store("ann", 40, 40))
+	//undeclared (chunked) sizes are settled after streaming
+	assert.NoError(t, store("ann", 30, -1))
+	//owner object quota
+	assert.True(t, errors.Is(store("ann", 1, 1), ErrQuotaExceeded))
+	//tenant byte quota, found only once streamed, leaves nothing behind
+	assert.True(t, errors.Is(store("bob", 50, 0), ErrQuotaExceeded))
+	assert.Len(t, data.data, 2)
+
+	report, err := s.Usage("team", "ann")
+	assert.NoError(t, err)
+	assert.Equal(t, Usage{Bytes: 70, Objects: 2}, report.Tenant.Usage)
+	assert.Equal(t, Usage{Bytes: 70, Objects: 2}, report.Owner.Usage)
+	assert.Equal(t, Usage{}, tracker.usage[OwnerUsageScope("team", "bob")])
+
+	var qerr *QuotaError
+	assert.True(t, errors.As(s.CheckQuota(AssetMeta{Tenant: "team"}, 200), &qerr))
+	assert.True(t, qerr.TooLarge())
+
+	//deleting releases usage
+	for key := range db.metas {
+		assert.NoError(t, s.Delete(key))
+	}
+	assert.Empty(t, data.data)
+	assert.Equal(t, Usage{}, tracker.usage[TenantUsageScope("team")])
+}
+
+func TestOwnerUsageScope(t *testing.T) {
+	//owners can contain the tenant separator, but never collide with another tenant's
+	assert.NotEqual(t, OwnerUsageScope("", "team/ann"), OwnerUsageScope("team", "ann"))
+	assert.NotEqual(t, OwnerUsageScope("", "ann"), OwnerUsageScope("ann", ""))
+}
@@ -0,0 +1,254 @@
+package assetstore
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+//The Reconciler finds and removes what failed or abandoned stores leave behind: pending markers that never
+//completed, data objects with no meta, and meta with no data.  It also scans assets again that have been left pending
+//a malware scan.
+
+//Data keys for anything other than an asset's data (temp files, blobs etc) start with this, which is not valid
+//in a tenant or id, so they're never mistaken for an asset's data.
+const internalKeyPrefix = "."
+
+//DataObject describes a stored data object
+type DataObject struct {
+	Key      string    `json:"key"`
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+}
+
+//MetaLister pages through the meta of every asset, in every tenant.  next is "" after the last page.
+type MetaLister interface {
+	ListMeta(cursor string, limit int) (metas []AssetMeta, next string, err error)
+}
+
+//AssetDataLister pages through every stored data object.  next is "" after the last page.
+type AssetDataLister interface {
+	List(cursor string, limit int) (objects []DataObject, next string, err error)
+}
+
+//AssetDataStatter describes a data object, returning an error wrapping ErrNotFound if it doesn't exist
+type AssetDataStatter interface {
+	Stat(id string) (obj DataObject, err error)
+}
+
+type AssetDataInventory interface {
+	AssetDataLister
+	AssetDataStatter
+}
+
+//isAssetDataKey reports whether a data key is an asset's data, rather than internal
+func isAssetDataKey(key string) bool {
+	tenant, id := SplitScopedKey(key)
+	return ValidTenant(tenant) && id != "" && !strings.HasPrefix(id, internalKeyPrefix) &&
+		!strings.Contains(id, tenantSeparator)
+}
+
+type ReconcileReport struct {
+	//Pending markers (and any data) of uploads that never completed
+	StaleUploads int `json:"stale_uploads"`
+	//Meta whose data is missing
+	OrphanedMeta int `json:"orphaned_meta"`
+	//Data with no meta
+	OrphanedData int `json:"orphaned_data"`
+	//Assets left pending a malware scan that were scanned again
+	Rescanned int `json:"rescanned"`
+	Errors int `json:"errors"`
+}
+
+type Reconciler struct {
+	storage *AssetStorage
+	metaLister MetaLister
+	data AssetDataInventory
+	//Grace is how old pending markers and data without meta must be before they're removed, so uploads in
+	//progress are left alone
+	Grace time.Duration
+	//RescanAfter is how long assets must have been pending a malware scan before they're scanned again, so scans in
+	//progress are left alone
+	RescanAfter time.Duration
+	PageSize int
+}
+
+func NewReconciler(storage *AssetStorage, metaLister MetaLister, data AssetDataInventory) *Reconciler {
+	return &Reconciler{
+		storage: storage,
+		metaLister: metaLister,
+		data: data,
+		Grace: 24 * time.Hour,
+		RescanAfter: 15 * time.Minute,
+		PageSize: 500,
+	}
+}
+
+//Run reconciles every interval until stop is closed
+func (r *Reconciler) Run(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			report, err := r.Reconcile()
+			entry := log.WithFields(log.Fields{
+				"context": "Reconciler.Run()",
+				"report": report,
+			})
+			if err != nil {
+				entry.Error(err)
+			} else {
+				entry.Info("reconciled")
+			}
+		}
+	}
+}
+
+//Reconcile makes one pass over all meta and all data
+func (r *Reconciler) Reconcile() (report ReconcileReport, err error) {
+	cutoff := time.Now().Add(-r.Grace)
+	if err = r.reconcileMeta(cutoff, &report); err != nil {
+		return
+	}
+	err = r.reconcileData(cutoff, &report)
+	return
+}
+
+func (r *Reconciler) reconcileMeta(cutoff time.Time, report *ReconcileReport) (err error) {
+	cursor := ""
+	for {
+		metas, next, err := r.metaLister.ListMeta(cursor, r.PageSize)
+		if err != nil {
+			return err
+		}
+		for _, meta := range metas {
+			r.reconcileAssetMeta(meta, cutoff, report)
+		}
+		if next == "" {
+			return nil
+		}
+		cursor = next
+	}
+}
+
+func (r *Reconciler) reconcileAssetMeta(meta AssetMeta, cutoff time.Time, report *ReconcileReport) {
+	s := r.storage
+	if !meta.Retrievable() {
+		stale := time.Unix(meta.Created, 0).Before(cutoff)
+		if meta.ReservedUntil != 0 {
+			//reserved uploads are stale as soon as their reservation expires
+			stale = time.Now().Unix() > meta.ReservedUntil
+		}
+		if stale {
+			usage := Usage{Bytes: int64(meta.Size), Objects: 1}
+			if usage.Bytes < 0 {
+				usage.Bytes = 0
+			}
+			s.rollbackStore(meta, usage)
+			report.StaleUploads++
+		}
+		return
+	}
+	_, err := r.data.Stat(meta.DataKey())
+	if err == nil {
+		r.rescan(meta, report)
+		return
+	}
+	if !errors.Is(err, ErrNotFound) {
+		report.Errors++
+		return
+	}
+	if err = s.metaHandler.DeleteMeta(meta.Key()); err != nil {
+		report.Errors++
+		log.WithFields(log.Fields{
+			"context": "Reconciler.reconcileAssetMeta()",
+			"meta": meta,
+		}).Error(err)
+		return
+	}
+	//released as Delete releases it, so the blob it shared isn't counted as still referenced by it
+	s.removeUsage(meta, Usage{Bytes: int64(meta.Size), Objects: 1})
+	s.deleteData(meta)
+	report.OrphanedMeta++
+	log.WithFields(log.Fields{
+		"context": "Reconciler.reconcileAssetMeta()",
+		"meta": meta,
+	}).Warn("removed meta with no data")
+}
+
+//rescan scans an asset again if it's been left pending, because its scan failed, or the asset was changed before
+//the result could be recorded
+func (r *Reconciler) rescan(meta AssetMeta, report *ReconcileReport) {
+	s := r.storage
+	if s.scanner == nil || meta.ScanStatus != ScanPending || time.Since(time.Unix(meta.Created, 0)) < r.RescanAfter {
+		return
+	}
+	if _, err := s.scan(meta); err != nil && !errors.Is(err, ErrAssetInfected) {
+		report.Errors++
+		return
+	}
+	report.Rescanned++
+}
+
+func (r *Reconciler) reconcileData(cutoff time.Time, report *ReconcileReport) (err error) {
+	cursor := ""
+	for {
+		objects, next, err := r.data.List(cursor, r.PageSize)
+		if err != nil {
+			return err
+		}
+		for _, obj := range objects {
+			if obj.Modified.After(cutoff) {
+				continue
+			}
+			//staged data left behind once its asset's been stored (e.g. uploaded again after a direct upload was
+			//completed) is removed, as is replacement data no asset or previous version uses, other internal data
+			//is left alone
+			if assetKey, staged := stagedAssetKey(obj.Key); staged {
+				meta, err := r.storage.metaHandler.GetMeta(assetKey)
+				if err != nil || !meta.Retrievable() {
+					continue
+				}
+			} else if assetKey, replaced := replacedAssetKey(obj.Key); replaced {
+				meta, err := r.storage.metaHandler.GetMeta(assetKey)
+				if err == nil && meta.DataKey() == obj.Key {
+					continue
+				} else if err != nil && !errors.Is(err, ErrNotFound) {
+					report.Errors++
+					continue
+				}
+				if kept, err := r.storage.versionUses(assetKey, obj.Key); kept {
+					continue
+				} else if err != nil {
+					report.Errors++
+					continue
+				}
+			} else if !isAssetDataKey(obj.Key) {
+				continue
+			} else if _, err := r.storage.metaHandler.GetMeta(obj.Key); err == nil {
+				continue
+			} else if !errors.Is(err, ErrNotFound) {
+				report.Errors++
+				continue
+			}
+			if err = r.storage.dataHandler.Delete(obj.Key); err != nil {
+				report.Errors++
+				continue
+			}
+			report.OrphanedData++
+			log.WithFields(log.Fields{
+				"context": "Reconciler.reconcileData()",
+				"object": obj,
+			}).Warn("removed data with no meta")
+		}
+		if next == "" {
+			return nil
+		}
+		cursor = next
+	}
+}
@@ -0,0 +1,209 @@
+package assetstore
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+//An asset's data can be replaced in place, keeping its id, name, tokens and aliases.  The new data is written under a
+//key of its own, then the asset's meta is swapped to point at it, only if the meta's still at the revision the
+//replacement was made to, so readers see either the old data or the new, and concurrent replacements can't silently
+//overwrite each other.  Every replacement is a new version of the asset, so its version is bumped along with its
+//revision.  The version replaced is kept, data and all, so aliases pinned to it still resolve, until the asset's
+//deleted or a lifecycle policy's KeepVersions deletes it.  Kept versions count towards quotas.
+
+//MetaSwapper stores meta, by its tenant scoped key, in place of the stored meta, even at another version, only if the
+//stored meta is still at revision, or returns ErrRevisionMismatch.  Stored meta replaced by meta at another version is
+//kept as a previous version of the asset (see VersionHandler).
+type MetaSwapper interface {
+	SwapMeta(meta AssetMeta, revision int64) (err error)
+}
+
+//VersionHandler gets and deletes the meta of assets' previous versions, by their assets' tenant scoped keys
+type VersionHandler interface {
+	GetVersion(id string, version int) (meta AssetMeta, err error)
+	//ListVersions lists every previous version of an asset, oldest first
+	ListVersions(id string) (metas []AssetMeta, err error)
+	//DeleteVersion deletes a previous version, or returns ErrNotFound if it's already been deleted
+	DeleteVersion(meta AssetMeta) (err error)
+	//UpdateVersionKey sets the data key of a previous version, leaving its other fields as they are, or returns
+	//ErrNotFound if it's been deleted
+	UpdateVersionKey(meta AssetMeta) (err error)
+}
+
+//AssetReplacer replaces the data of assets
+type AssetReplacer interface {
+	Replace(id string, revision int64, asset io.ReadCloser) (meta AssetMeta, err error)
+}
+
+//replacementKey is where the data written by an asset's replacement is stored
+func replacementKey(meta AssetMeta) string {
+	return ScopedKey(meta.Tenant, internalKeyPrefix+"data/"+meta.ID+"/"+meta.DataID)
+}
+
+//replacedAssetKey is the key of the asset whose replacement data is stored under key, if key is a replacement key
+func replacedAssetKey(key string) (assetKey string, ok bool) {
+	prefix := internalKeyPrefix + "data/"
+	tenant := ""
+	if !strings.HasPrefix(key, prefix) {
+		tenant, key = SplitScopedKey(key)
+	}
+	if !strings.HasPrefix(key, prefix) {
+		return "", false
+	}
+	id := strings.TrimPrefix(key, prefix)
+	i := strings.Index(id, "/")
+	if i <= 0 {
+		return "", false
+	}
+	return ScopedKey(tenant, id[:i]), true
+}
+
+//Replace replaces the data of a retrievable asset, by its tenant scoped id, if it's still at revision.  Its size,
+//checksum and content type are those of the new data, which is checked like any upload, and its version and revision
+//are bumped.  The version replaced is kept.
+func (s *AssetStorage) Replace(id string, revision int64, asset io.ReadCloser) (meta AssetMeta, err error) {
+	swapper, ok := s.metaHandler.(MetaSwapper)
+	if _, versioned := s.metaHandler.(VersionHandler); !ok || !versioned {
+		asset.Close()
+		return meta, fmt.Errorf("assets can't be replaced")
+	}
+	old, err := s.retrievableMeta(id)
+	if err != nil {
+		asset.Close()
+		return old, err
+	}
+	if old.Revision != revision {
+		asset.Close()
+		return old, fmt.Errorf("%w: it's at revision %d, not %d", ErrRevisionMismatch, old.Revision, revision)
+	}
+	//the new data is encoded afresh, and its content type sniffed
+	meta = old
+	meta.Blob, meta.Encoding, meta.EncodedSize, meta.KeyID, meta.WrappedKey = "", "", 0, "", ""
+	meta.ContentType, meta.ScanStatus = "", ""
+	meta.DataID = uuid.New().String()
+
+	hasher := newHashReadCloser(asset)
+	sniffer := newSniffReader(hasher)
+	n, err := writeEncoded(s.dataHandler, &meta, meta.DataKey(), sniffer)
+	if err != nil {
+		s.deleteKey(meta.DataKey())
+		log.WithFields(log.Fields{
+			"context": "AssetStorage.Replace()",
+			"dataHandler": s.dataHandler,
+			"meta": meta,
+		}).Error(err)
+		return old, err
+	}
+	meta.Size = int(n)
+	meta.Checksum = hasher.Checksum()
+	meta.ContentType = sniffer.ContentType()
+	meta.Version = old.Version + 1
+	meta.Revision = revision + 1
+	if s.scanner != nil {
+		meta.ScanStatus = ScanPending
+	}
+	meta, err = s.commitReplace(swapper, old, meta)
+	if err != nil {
+		return old, err
+	}
+	if s.scanner != nil {
+		if s.scanPolicy.Async {
+			go s.scan(meta)
+		} else if scanned, scanErr := s.scan(meta); scanErr == nil || errors.Is(scanErr, ErrAssetInfected) {
+			meta, err = scanned, scanErr
+		}
+	}
+	return meta, err
+}
+
+//commitReplace checks written replacement data, adds its size to its quota, as the version replaced is kept, and
+//swaps it in.  The replacement data is removed if it can't be.
+func (s *AssetStorage) commitReplace(swapper MetaSwapper, old, meta AssetMeta) (AssetMeta, error) {
+	delta := Usage{Bytes: int64(meta.Size)}
+	fail := func(err error) (AssetMeta, error) {
+		s.deleteData(meta)
+		log.WithFields(log.Fields{
+			"context": "AssetStorage.commitReplace()",
+			"meta": meta,
+		}).Error(err)
+		return meta, err
+	}
+	if s.uploadValidator != nil {
+		if err := s.uploadValidator.ValidateUpload(meta, meta.ContentType); err != nil {
+			return fail(err)
+		}
+	}
+	if s.blobs != nil && meta.WrappedKey == "" {
+		promoted, err := s.promoteBlob(meta, meta.DataKey())
+		if err != nil {
+			return fail(err)
+		}
+		meta = promoted
+	}
+	if err := s.addUsage(meta, delta); err != nil {
+		return fail(err)
+	}
+	if err := swapper.SwapMeta(meta, old.Revision); err != nil {
+		s.removeUsage(meta, delta)
+		return fail(err)
+	}
+	return meta, nil
+}
+
+//Versions lists the previous versions of an asset, by its tenant scoped id, oldest first
+func (s *AssetStorage) Versions(id string) (versions []AssetMeta, err error) {
+	handler, ok := s.metaHandler.(VersionHandler)
+	if !ok {
+		return nil, nil
+	}
+	versions, err = handler.ListVersions(id)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"context": "AssetStorage.Versions()",
+			"metaHandler": s.metaHandler,
+			"id": id,
+		}).Error(err)
+	}
+	return
+}
+
+//DeleteVersion removes a previous version of an asset, then its data, and releases the quota it used, unless it's
+//already been deleted
+func (s *AssetStorage) DeleteVersion(version AssetMeta) (err error) {
+	handler, ok := s.metaHandler.(VersionHandler)
+	if !ok {
+		return fmt.Errorf("versions can't be deleted")
+	}
+	if err = handler.DeleteVersion(version); err != nil {
+		log.WithFields(log.Fields{
+			"context": "AssetStorage.DeleteVersion()",
+			"metaHandler": s.metaHandler,
+			"version": version,
+		}).Error(err)
+		return
+	}
+	s.removeUsage(version, Usage{Bytes: int64(version.Size)})
+	s.deleteData(version)
+	return
+}
+
+//versionUses is whether a previous version of the asset with a tenant scoped key keeps its data under dataKey
+func (s *AssetStorage) versionUses(assetKey, dataKey string) (bool, error) {
+	handler, ok := s.metaHandler.(VersionHandler)
+	if !ok {
+		return false, nil
+	}
+	versions, err := handler.ListVersions(assetKey)
+	for _, version := range versions {
+		if version.DataKey() == dataKey {
+			return true, nil
+		}
+	}
+	return false, err
+}
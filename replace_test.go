@@ -0,0 +1,171 @@
+package assetstore
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAssetStorage_Replace(t *testing.T) {
+	tests := []struct {
+		name  string
+		dedup bool
+	}{
+		{"plain", false},
+		{"dedup", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := newMemMetaTokenStore()
+			data := newMemDataStore()
+			blobs := newMemBlobRefs()
+			opts := []AssetStorageOption{WithUploadValidator(ContentPolicies{
+				Default: ContentPolicy{DenyTypes: []string{"application/x-msdownload"}},
+			})}
+			if tt.dedup {
+				opts = append(opts, WithDedup(blobs))
+			}
+			s := NewAssetStorage(db, db, data, opts...)
+			meta := AssetMeta{ID: uuid.New().String(), Tenant: "acme", Name: "nightly.txt"}
+			token := AssetToken{Token: uuid.New().String(), AssetID: meta.ID, Tenant: "acme", Expiry: time.Now().Add(time.Minute).Unix()}
+			meta, err := s.Store(meta, token, ioutil.NopCloser(strings.NewReader("monday")))
+			assert.NoError(t, err)
+			replace := func(revision int64, content string) (AssetMeta, error) {
+				return s.Replace(meta.Key(), revision, ioutil.NopCloser(strings.NewReader(content)))
+			}
+
+			//the asset keeps its id and token, and the version replaced is kept, data and all
+			replaced, err := replace(0, "tuesday's report")
+			assert.NoError(t, err)
+			assert.Equal(t, meta.ID, replaced.ID)
+			assert.Equal(t, len("tuesday's report"), replaced.Size)
+			assert.NotEqual(t, meta.Checksum, replaced.Checksum)
+			assert.Equal(t, int64(1), replaced.Revision)
+			assert.Equal(t, meta.Version+1, replaced.Version)
+			_, asset, err := s.GetByToken(token.Key())
+			if assert.NoError(t, err) {
+				assert.Equal(t, "tuesday's report", readAll(t, asset))
+			}
+			assert.Len(t, data.data, 2)
+			if tt.dedup {
+				assert.Equal(t, int64(1), blobs.refs[meta.DataKey()])
+				assert.Equal(t, int64(1), blobs.refs[replaced.DataKey()])
+			}
+			versions, err := s.Versions(meta.Key())
+			assert.NoError(t, err)
+			if assert.Len(t, versions, 1) {
+				assert.Equal(t, meta.Version, versions[0].Version)
+				assert.Equal(t, meta.Checksum, versions[0].Checksum)
+				asset, _, err := readDecoded(data, versions[0], versions[0].DataKey())
+				if assert.NoError(t, err) {
+					assert.Equal(t, "monday", readAll(t, asset))
+				}
+			}
+
+			//replacements only apply to the revision they were made to, and rejected ones leave the asset as it was
+			_, err = replace(0, "stale")
+			assert.True(t, errors.Is(err, ErrRevisionMismatch))
+			_, err = replace(1, "MZ\x90\x00 not really a program")
+			assert.True(t, errors.Is(err, ErrContentRejected))
+			current, asset, err := s.GetByID(meta.Key())
+			if assert.NoError(t, err) {
+				assert.Equal(t, replaced, current)
+				assert.Equal(t, "tuesday's report", readAll(t, asset))
+			}
+			assert.Len(t, data.data, 2)
+
+			//deleting the asset deletes its previous versions too
+			assert.NoError(t, s.Delete(meta.Key()))
+			assert.Len(t, data.data, 0)
+			versions, err = s.Versions(meta.Key())
+			assert.NoError(t, err)
+			assert.Len(t, versions, 0)
+
+			_, err = s.Replace("acme/"+uuid.New().String(), 0, ioutil.NopCloser(strings.NewReader("missing")))
+			assert.True(t, errors.Is(err, ErrNotFound))
+		})
+	}
+}
+
+func TestReplacedAssetKey(t *testing.T) {
+	meta := AssetMeta{ID: "report", Tenant: "acme", DataID: "abc"}
+	tests := []struct {
+		key      string
+		assetKey string
+		ok       bool
+	}{
+		{replacementKey(meta), "acme/report", true},
+		{replacementKey(AssetMeta{ID: "report", DataID: "abc"}), "report", true},
+		{"acme/report", "", false},
+		{stagingKey(meta), "", false},
+		{"acme/.data/report", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.key, func(t *testing.T) {
+			assetKey, ok := replacedAssetKey(tt.key)
+			assert.Equal(t, tt.ok, ok)
+			assert.Equal(t, tt.assetKey, assetKey)
+		})
+	}
+}
+
+func TestDynamoAssetAttrMap_Versions(t *testing.T) {
+	meta := AssetMeta{ID: "report", Tenant: "acme", Name: "report.pdf", Version: 12, Revision: 14}
+	got := dynamoAssetAttrMapToMeta(assetMetaToDynamoAttrMap(meta))
+	assert.Equal(t, meta.Key(), got.Key())
+	assert.Equal(t, meta.Version, got.Version)
+	got = dynamoAssetAttrMapToMeta(versionToDynamoAttrMap(meta))
+	assert.Equal(t, meta.Key(), got.Key())
+	assert.Equal(t, meta.Version, got.Version)
+	assert.Equal(t, VERSION_KEY_PREFIX+"acme/report", *versionToDynamoAttrMap(meta)["ObjID"].S)
+	assert.Equal(t, "0000000012", *versionToDynamoAttrMap(meta)["ObjSort"].S)
+}
+
+func TestAPI_ReplaceAsset(t *testing.T) {
+	db := newMemMetaTokenStore()
+	data := newMemDataStore()
+	s := NewAssetStorage(db, db, data)
+	api := testAPI(s, WithAssetReplacer(s, s), WithAPIKeys(map[string]Principal{
+		"alice-key": {User: "alice"},
+		"bob-key":   {User: "bob"},
+	}))
+	store := func(owner string) AssetMeta {
+		meta, err := s.Store(AssetMeta{ID: uuid.New().String(), Owner: owner, Name: "a.txt"}, AssetToken{}, ioutil.NopCloser(strings.NewReader("old")))
+		assert.NoError(t, err)
+		return meta
+	}
+	owned, unowned := store("alice"), store("")
+
+	//replacing an asset needs an api key, and the owner's if there is one
+	tests := []struct {
+		name   string
+		meta   AssetMeta
+		apiKey string
+		want   int
+	}{
+		{"anonymous, unowned", unowned, "", http.StatusUnauthorized},
+		{"anonymous, owned", owned, "", http.StatusUnauthorized},
+		{"someone else", owned, "bob-key", http.StatusForbidden},
+		{"owner", owned, "alice-key", http.StatusOK},
+		{"anyone with a key, unowned", unowned, "bob-key", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := serve(api, http.MethodPut, "/asset/"+tt.meta.ID, tt.apiKey, strings.NewReader("new"))
+			assert.Equal(t, tt.want, w.Code)
+			_, asset, err := s.GetByID(tt.meta.Key())
+			assert.NoError(t, err)
+			want := "old"
+			if tt.want == http.StatusOK {
+				want = "new"
+			}
+			assert.Equal(t, want, readAll(t, asset))
+		})
+	}
+}
@@ -0,0 +1,369 @@
+package assetstore
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+//Resumable uploads (see tus.go) are built up a chunk at a time, so a dropped connection only loses the chunk in
+//flight.  Their progress is kept in a pending marker, like a reserved upload's, which expires if the upload isn't
+//finished in time and is then removed by the Reconciler.  Once all the data's arrived it's stored as Store would.
+
+var (
+	//ErrOffsetMismatch is returned (wrapped) appending to a resumable upload at anywhere but its current offset
+	ErrOffsetMismatch = errors.New("upload offset does not match")
+	//ErrChecksumMismatch is returned appending a chunk, or uploading a part, that doesn't match its checksum.  None of
+	//it is kept.
+	ErrChecksumMismatch = errors.New("chunk checksum does not match")
+)
+
+//resumableChunkBytes is the most data appended as one chunk, so larger requests are appended in pieces
+var resumableChunkBytes int64 = 16 * 1024 * 1024
+
+//ChunkAppender builds objects up a chunk at a time, e.g. as multipart uploads or by appending to a file
+type ChunkAppender interface {
+	//StartAppend starts building an object, returning an id to append to it with
+	StartAppend(key string) (appendID string, err error)
+	//AppendChunk appends chunk number (from 1) at offset, returning a reference to it that's needed to complete the
+	//object
+	AppendChunk(key, appendID string, number int, offset int64, chunk io.ReadSeeker) (ref string, err error)
+	//MinChunkBytes is the smallest chunk that can be appended, bar the last
+	MinChunkBytes() int64
+	//CompleteAppend completes an object from its chunks' references, returning its data
+	CompleteAppend(key, appendID string, refs []string) (data io.ReadCloser, err error)
+	//AbortAppend removes an object, whether or not it was completed
+	AbortAppend(key, appendID string) (err error)
+}
+
+//ResumableUploader creates, appends to and terminates resumable uploads
+type ResumableUploader interface {
+	MetaRetriever
+	CreateResumable(meta AssetMeta, token AssetToken) (created AssetMeta, err error)
+	AppendResumable(id string, offset int64, chunk io.Reader, checksum *ChunkChecksum) (meta AssetMeta, err error)
+	TerminateResumable(id string) (err error)
+}
+
+//ChunkChecksum is what a chunk must hash to with Hash
+type ChunkChecksum struct {
+	Hash hash.Hash
+	Sum []byte
+}
+
+type resumableUploads struct {
+	appender ChunkAppender
+	//how long uploads can go without being appended to before they expire
+	ttl time.Duration
+	//serializes appends to each upload
+	locks [64]sync.Mutex
+}
+
+func (r *resumableUploads) lock(key string) (unlock func()) {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	l := &r.locks[h.Sum32()%uint32(len(r.locks))]
+	l.Lock()
+	return l.Unlock
+}
+
+//WithChunkAppender enables resumable uploads, built up with appender, which expire if they're not appended to
+//within ttl
+func WithChunkAppender(appender ChunkAppender, ttl time.Duration) AssetStorageOption {
+	return func(s *AssetStorage) {
+		s.resumable = &resumableUploads{appender: appender, ttl: ttl}
+	}
+}
+
+//resumableKey is the key a resumable upload's data is built up under
+func resumableKey(meta AssetMeta) string {
+	return ScopedKey(meta.Tenant, internalKeyPrefix+"tus/"+meta.ID)
+}
+
+//resumableTailKey is the key of data received for a resumable upload that's too small to append yet
+func resumableTailKey(meta AssetMeta) string {
+	return resumableKey(meta) + ".tail"
+}
+
+//CreateResumable starts a resumable upload of meta.Size bytes, reserving them, and stores its token, which can be
+//used once the upload's complete.  An empty upload is stored straight away.
+func (s *AssetStorage) CreateResumable(meta AssetMeta, token AssetToken) (created AssetMeta, err error) {
+	if s.resumable == nil {
+		return meta, fmt.Errorf("resumable uploads are not enabled")
+	}
+	if !meta.Valid() || meta.Size < 0 {
+		return meta, fmt.Errorf("meta invalid")
+	}
+	if meta.Size == 0 {
+		return s.Store(meta, token, ioutil.NopCloser(bytes.NewReader(nil)))
+	}
+	usage := Usage{Bytes: int64(meta.Size), Objects: 1}
+	err = s.addUsage(meta, usage)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"context": "AssetStorage.CreateResumable()",
+			"usageTracker": s.usageTracker,
+			"meta": meta,
+		}).Error(err)
+		return meta, err
+	}
+	meta.UploadID, err = s.resumable.appender.StartAppend(resumableKey(meta))
+	if err != nil {
+		s.removeUsage(meta, usage)
+		log.WithFields(log.Fields{
+			"context": "AssetStorage.CreateResumable()",
+			"appender": s.resumable.appender,
+			"meta": meta,
+		}).Error(err)
+		return meta, err
+	}
+	now := time.Now()
+	meta.State = StateUploading
+	meta.Created = now.Unix()
+	meta.ReservedUntil = now.Add(s.resumable.ttl).Unix()
+	meta.Resumable = true
+	err = s.metaHandler.StoreMeta(meta)
+	if err == nil && token.Valid() {
+		token.Tenant = meta.Tenant
+		err = s.tokenHandler.StoreToken(token)
+	}
+	if err != nil {
+		s.rollbackStore(meta, usage)
+		log.WithFields(log.Fields{
+			"context": "AssetStorage.CreateResumable()",
+			"metaHandler": s.metaHandler,
+			"tokenHandler": s.tokenHandler,
+			"meta": meta,
+		}).Error(err)
+		return meta, err
+	}
+	return meta, nil
+}
+
+//AppendResumable appends a chunk to a resumable upload at offset, which must be the upload's current offset.  If
+//checksum is given, the chunk must match it, and is only appended if it was all received.  Otherwise as much as was
+//received is kept, even if reading the chunk fails.  The upload is stored once it's complete.
+func (s *AssetStorage) AppendResumable(id string, offset int64, chunk io.Reader, checksum *ChunkChecksum) (meta AssetMeta, err error) {
+	if s.resumable == nil {
+		return meta, fmt.Errorf("resumable uploads are not enabled")
+	}
+	unlock := s.resumable.lock(id)
+	defer unlock()
+	meta, err = s.metaHandler.GetMeta(id)
+	if err != nil {
+		return
+	}
+	if meta.Retrievable() {
+		//already complete, so it can only be appended nothing
+		if offset != int64(meta.Size) {
+			return meta, fmt.Errorf("%w: upload is complete", ErrOffsetMismatch)
+		}
+		return meta, nil
+	}
+	if !meta.Resumable {
+		return meta, fmt.Errorf("%w: no resumable upload %s", ErrNotFound, id)
+	}
+	if time.Now().Unix() > meta.ReservedUntil {
+		return meta, ErrReservationExpired
+	}
+	if offset != meta.Offset {
+		return meta, fmt.Errorf("%w: upload is at offset %d", ErrOffsetMismatch, meta.Offset)
+	}
+
+	spool, err := ioutil.TempFile("", "resumable-")
+	if err != nil {
+		return
+	}
+	defer func() {
+		spool.Close()
+		os.Remove(spool.Name())
+	}()
+	n, readErr := s.spoolChunk(meta, spool, chunk, checksum)
+	if checksum != nil && readErr == nil && !bytes.Equal(checksum.Hash.Sum(nil), checksum.Sum) {
+		return meta, ErrChecksumMismatch
+	}
+	if readErr != nil && (checksum != nil || errors.Is(readErr, ErrUploadTooLarge) || n < 0) {
+		return meta, readErr
+	}
+	if n > 0 {
+		meta, err = s.appendSpooled(meta, spool, n)
+		if err != nil {
+			return
+		}
+	}
+	if meta.Offset == int64(meta.Size) {
+		return s.completeResumable(meta)
+	}
+	return meta, readErr
+}
+
+//spoolChunk spools any tail of a resumable upload, then as much of chunk as can be read, returning how much of the
+//chunk was.  n is -1 if the tail couldn't be read.
+func (s *AssetStorage) spoolChunk(meta AssetMeta, spool *os.File, chunk io.Reader, checksum *ChunkChecksum) (n int64, err error) {
+	if meta.TailSize > 0 {
+		tail, err := s.dataHandler.Reader(resumableTailKey(meta))
+		if err != nil {
+			return -1, err
+		}
+		_, err = io.Copy(spool, tail)
+		tail.Close()
+		if err != nil {
+			return -1, err
+		}
+	}
+	remaining := int64(meta.Size) - meta.Offset
+	if checksum != nil {
+		chunk = io.TeeReader(chunk, checksum.Hash)
+	}
+	n, err = io.Copy(spool, io.LimitReader(chunk, remaining+1))
+	if n > remaining {
+		return n, fmt.Errorf("%w: more data than the upload's length", ErrUploadTooLarge)
+	}
+	return n, err
+}
+
+//appendSpooled appends spooled data (the upload's tail, then n bytes received) to a resumable upload in chunks,
+//keeping whatever's too small to append yet as its new tail.  Its meta is updated with what was appended, even if
+//appending fails part way.
+func (s *AssetStorage) appendSpooled(meta AssetMeta, spool *os.File, n int64) (AssetMeta, error) {
+	appender := s.resumable.appender
+	key := resumableKey(meta)
+	//bytes appended before this
+	base := meta.Offset - meta.TailSize
+	total := meta.TailSize + n
+	finished := meta.Offset+n == int64(meta.Size)
+	var appended, tail int64
+	var err error
+	for appended < total {
+		size := total - appended
+		if size > resumableChunkBytes {
+			size = resumableChunkBytes
+		}
+		section := io.NewSectionReader(spool, appended, size)
+		if !finished && appended+size == total && size < appender.MinChunkBytes() {
+			_, err = s.dataHandler.Writer(resumableTailKey(meta), ioutil.NopCloser(section))
+			if err == nil {
+				tail = size
+			}
+			break
+		}
+		var ref string
+		ref, err = appender.AppendChunk(key, meta.UploadID, len(meta.Chunks)+1, base+appended, section)
+		if err != nil {
+			break
+		}
+		meta.Chunks = append(meta.Chunks, ref)
+		appended += size
+	}
+	if err != nil {
+		log.WithFields(log.Fields{
+			"context": "AssetStorage.appendSpooled()",
+			"appender": appender,
+			"meta": meta,
+		}).Error(err)
+		if appended == 0 {
+			//nothing's changed, the old tail's still there
+			return meta, err
+		}
+	}
+	if meta.TailSize > 0 && tail == 0 {
+		s.deleteKey(resumableTailKey(meta))
+	}
+	meta.Offset = base + appended + tail
+	meta.TailSize = tail
+	meta.ReservedUntil = time.Now().Add(s.resumable.ttl).Unix()
+	if storeErr := s.metaHandler.StoreMeta(meta); storeErr != nil {
+		log.WithFields(log.Fields{
+			"context": "AssetStorage.appendSpooled()",
+			"metaHandler": s.metaHandler,
+			"meta": meta,
+		}).Error(storeErr)
+		if err == nil {
+			err = storeErr
+		}
+	}
+	return meta, err
+}
+
+//completeResumable stores a resumable upload's data as Store would, then removes the chunks it was built from.  If
+//storing fails for any reason but the data being rejected, the upload's marker is restored instead, so completing it
+//can be retried.
+func (s *AssetStorage) completeResumable(meta AssetMeta) (AssetMeta, error) {
+	data, err := s.resumable.appender.CompleteAppend(resumableKey(meta), meta.UploadID, meta.Chunks)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"context": "AssetStorage.completeResumable()",
+			"appender": s.resumable.appender,
+			"meta": meta,
+		}).Error(err)
+		return meta, err
+	}
+	//Store reserves the size again
+	s.removeUsage(meta, Usage{Bytes: int64(meta.Size), Objects: 1})
+	stored, err := s.Store(AssetMeta{
+		ID: meta.ID,
+		Tenant: meta.Tenant,
+		Owner: meta.Owner,
+		Name: meta.Name,
+		ContentType: meta.ContentType,
+		Size: meta.Size,
+	}, AssetToken{}, data)
+	if err == nil || errors.Is(err, ErrContentRejected) || errors.Is(err, ErrAssetInfected) {
+		s.discardResumable(meta)
+		return stored, err
+	}
+	//Store's rollback removed the marker and the usage reserved for it
+	if storeErr := s.metaHandler.StoreMeta(meta); storeErr != nil {
+		log.WithFields(log.Fields{
+			"context": "AssetStorage.completeResumable()",
+			"metaHandler": s.metaHandler,
+			"meta": meta,
+		}).Error(storeErr)
+		s.discardResumable(meta)
+		return stored, err
+	}
+	s.restoreUsage(meta, Usage{Bytes: int64(meta.Size), Objects: 1})
+	return meta, err
+}
+
+//TerminateResumable abandons an incomplete resumable upload, removing everything received
+func (s *AssetStorage) TerminateResumable(id string) (err error) {
+	if s.resumable == nil {
+		return fmt.Errorf("resumable uploads are not enabled")
+	}
+	unlock := s.resumable.lock(id)
+	defer unlock()
+	meta, err := s.metaHandler.GetMeta(id)
+	if err != nil {
+		return
+	}
+	if meta.Retrievable() || !meta.Resumable {
+		return fmt.Errorf("%w: no resumable upload %s", ErrNotFound, id)
+	}
+	s.rollbackStore(meta, Usage{Bytes: int64(meta.Size), Objects: 1})
+	return nil
+}
+
+//discardResumable removes a resumable upload's chunks and tail
+func (s *AssetStorage) discardResumable(meta AssetMeta) {
+	if s.resumable != nil {
+		if err := s.resumable.appender.AbortAppend(resumableKey(meta), meta.UploadID); err != nil {
+			log.WithFields(log.Fields{
+				"context": "AssetStorage.discardResumable()",
+				"appender": s.resumable.appender,
+				"meta": meta,
+			}).Error(err)
+		}
+	}
+	if meta.TailSize > 0 {
+		s.deleteKey(resumableTailKey(meta))
+	}
+}
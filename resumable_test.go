@@ -0,0 +1,206 @@
+package assetstore
+
+import (
+	"crypto/sha1"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+//minChunkAppender appends to files, but like s3 won't take chunks smaller than min, bar the last
+type minChunkAppender struct {
+	*FileChunkAppender
+	min int64
+}
+
+func (a *minChunkAppender) MinChunkBytes() int64 {
+	return a.min
+}
+
+//brokenReader reads data, then fails like a dropped connection
+func brokenReader(data string) io.Reader {
+	return io.MultiReader(strings.NewReader(data), &failingReader{})
+}
+
+type failingReader struct{}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	return 0, io.ErrUnexpectedEOF
+}
+
+func TestAssetStorage_Resumable(t *testing.T) {
+	defer func(chunkBytes int64) { resumableChunkBytes = chunkBytes }(resumableChunkBytes)
+	resumableChunkBytes = 4
+	tests := []struct {
+		name string
+		min  int64
+	}{
+		{"appended as received", 0},
+		{"held back until chunks are big enough", 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := newMemMetaTokenStore()
+			data := newMemDataStore()
+			dir := t.TempDir()
+			files, err := NewFileChunkAppender(dir)
+			assert.NoError(t, err)
+			s := NewAssetStorage(db, db, data, WithChunkAppender(&minChunkAppender{FileChunkAppender: files, min: tt.min}, time.Hour))
+
+			content := "0123456789abcdefghij"
+			meta := AssetMeta{ID: uuid.New().String(), Name: "field.log", Size: len(content)}
+			token := AssetToken{Token: uuid.New().String(), AssetID: meta.ID, Expiry: time.Now().Add(time.Minute).Unix()}
+			meta, err = s.CreateResumable(meta, token)
+			assert.NoError(t, err)
+			_, _, err = s.GetByToken(token.Key())
+			assert.True(t, errors.Is(err, ErrNotFound))
+
+			//a dropped connection keeps what was received
+			meta, err = s.AppendResumable(meta.Key(), 0, brokenReader("01234"), nil)
+			assert.True(t, errors.Is(err, io.ErrUnexpectedEOF))
+			assert.Equal(t, int64(5), meta.Offset)
+
+			//appends have to carry on where the upload's got to
+			_, err = s.AppendResumable(meta.Key(), 3, strings.NewReader("3456"), nil)
+			assert.True(t, errors.Is(err, ErrOffsetMismatch))
+
+			//a chunk that doesn't match its checksum isn't kept
+			checksum := &ChunkChecksum{Hash: sha1.New(), Sum: []byte("wrong")}
+			_, err = s.AppendResumable(meta.Key(), 5, strings.NewReader("56789"), checksum)
+			assert.True(t, errors.Is(err, ErrChecksumMismatch))
+			sum := sha1.Sum([]byte("56789"))
+			meta, err = s.AppendResumable(meta.Key(), 5, strings.NewReader("56789"), &ChunkChecksum{Hash: sha1.New(), Sum: sum[:]})
+			assert.NoError(t, err)
+			assert.Equal(t, int64(10), meta.Offset)
+
+			//nor is more data than the upload's length
+			_, err = s.AppendResumable(meta.Key(), 10, strings.NewReader(content), nil)
+			assert.True(t, errors.Is(err, ErrUploadTooLarge))
+
+			meta, err = s.AppendResumable(meta.Key(), 10, strings.NewReader("abc"), nil)
+			assert.NoError(t, err)
+			meta, err = s.AppendResumable(meta.Key(), 13, strings.NewReader("defghij"), nil)
+			assert.NoError(t, err)
+			assert.True(t, meta.Retrievable())
+			assert.Equal(t, sha256Hex(content), meta.Checksum)
+			_, asset, err := s.GetByToken(token.Key())
+			assert.NoError(t, err)
+			assert.Equal(t, content, readAll(t, asset))
+
+			//only the asset's data is left behind
+			assert.Len(t, data.data, 1)
+			leftovers, _ := ioutil.ReadDir(dir)
+			assert.Empty(t, leftovers)
+			//and completing it again is a no-op
+			_, err = s.AppendResumable(meta.Key(), int64(len(content)), strings.NewReader(""), nil)
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestAssetStorage_TerminateResumable(t *testing.T) {
+	db := newMemMetaTokenStore()
+	data := newMemDataStore()
+	dir := t.TempDir()
+	files, err := NewFileChunkAppender(dir)
+	assert.NoError(t, err)
+	s := NewAssetStorage(db, db, data, WithChunkAppender(&minChunkAppender{FileChunkAppender: files, min: 100}, time.Hour))
+
+	terminated, err := s.CreateResumable(AssetMeta{ID: uuid.New().String(), Name: "a.log", Size: 10}, AssetToken{})
+	assert.NoError(t, err)
+	_, err = s.AppendResumable(terminated.Key(), 0, strings.NewReader("0123"), nil)
+	assert.NoError(t, err)
+	assert.NoError(t, s.TerminateResumable(terminated.Key()))
+	_, err = db.GetMeta(terminated.Key())
+	assert.True(t, errors.Is(err, ErrNotFound))
+	assert.Empty(t, data.data)
+
+	//uploads that aren't appended to in time expire, and are removed by the reconciler
+	expired, err := s.CreateResumable(AssetMeta{ID: uuid.New().String(), Name: "b.log", Size: 10}, AssetToken{})
+	assert.NoError(t, err)
+	_, err = s.AppendResumable(expired.Key(), 0, strings.NewReader("0123"), nil)
+	assert.NoError(t, err)
+	s.resumable.ttl = -time.Second
+	_, err = s.AppendResumable(expired.Key(), 4, strings.NewReader("4567"), nil)
+	assert.NoError(t, err)
+	_, err = s.AppendResumable(expired.Key(), 8, strings.NewReader("89"), nil)
+	assert.True(t, errors.Is(err, ErrReservationExpired))
+	report, err := NewReconciler(s, db, data).Reconcile()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, report.StaleUploads)
+	assert.Empty(t, data.data)
+	leftovers, _ := ioutil.ReadDir(dir)
+	assert.Empty(t, leftovers)
+}
+
+func TestAssetStorage_CompleteResumableFails(t *testing.T) {
+	db := &flakyMetaTokenStore{memMetaTokenStore: newMemMetaTokenStore()}
+	data := newMemDataStore()
+	dir := t.TempDir()
+	files, err := NewFileChunkAppender(dir)
+	assert.NoError(t, err)
+	tracker := newMemUsageTracker()
+	s := NewAssetStorage(db, db, data, WithChunkAppender(files, time.Hour), WithQuotas(tracker, QuotaLimits{}),
+		WithUploadValidator(ContentPolicies{Default: ContentPolicy{DenyExtensions: []string{".exe"}}}))
+	create := func(name string) AssetMeta {
+		meta, err := s.CreateResumable(AssetMeta{ID: uuid.New().String(), Name: name, Size: 10}, AssetToken{})
+		assert.NoError(t, err)
+		return meta
+	}
+
+	//failing to store the finished upload leaves it resumable, with its chunks and usage
+	meta := create("field.log")
+	db.failMeta = true
+	_, err = s.AppendResumable(meta.Key(), 0, strings.NewReader("0123456789"), nil)
+	assert.Error(t, err)
+	pending, err := db.GetMeta(meta.Key())
+	if assert.NoError(t, err) {
+		assert.True(t, pending.Resumable)
+		assert.Equal(t, int64(10), pending.Offset)
+	}
+	assert.Equal(t, Usage{Bytes: 10, Objects: 1}, tracker.usage[TenantUsageScope("")])
+
+	//so completing it can be retried
+	db.failMeta = false
+	meta, err = s.AppendResumable(meta.Key(), 10, strings.NewReader(""), nil)
+	assert.NoError(t, err)
+	assert.True(t, meta.Retrievable())
+	_, asset, err := s.GetByID(meta.Key())
+	if assert.NoError(t, err) {
+		assert.Equal(t, "0123456789", readAll(t, asset))
+	}
+	assert.Equal(t, Usage{Bytes: 10, Objects: 1}, tracker.usage[TenantUsageScope("")])
+
+	//rejected uploads are discarded
+	rejected := create("setup.exe")
+	_, err = s.AppendResumable(rejected.Key(), 0, strings.NewReader("0123456789"), nil)
+	assert.True(t, errors.Is(err, ErrContentRejected))
+	_, err = db.GetMeta(rejected.Key())
+	assert.True(t, errors.Is(err, ErrNotFound))
+	assert.Equal(t, Usage{Bytes: 10, Objects: 1}, tracker.usage[TenantUsageScope("")])
+	leftovers, _ := ioutil.ReadDir(dir)
+	assert.Empty(t, leftovers)
+}
+
+func TestParseTusHeaders(t *testing.T) {
+	metadata, err := parseTusMetadata("filename d29ybGRfZG9taW5hdGlvbl9wbGFuLnBkZg==,is_confidential,token dHJ1ZQ==")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"filename": "world_domination_plan.pdf", "is_confidential": "", "token": "true"}, metadata)
+	_, err = parseTusMetadata("filename not-base64!")
+	assert.Error(t, err)
+
+	checksum, err := parseTusChecksum("sha1 Kq5sNclPz7QV2+lfQIuc6R7oRu0=")
+	assert.NoError(t, err)
+	assert.Len(t, checksum.Sum, 20)
+	checksum, err = parseTusChecksum("")
+	assert.NoError(t, err)
+	assert.Nil(t, checksum)
+	_, err = parseTusChecksum("crc32 AAAA")
+	assert.Error(t, err)
+}
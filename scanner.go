@@ -0,0 +1,223 @@
+package assetstore
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+//Uploads can be scanned for malware before they may be downloaded.  The scan status is kept in the asset's meta, and
+//only recorded if the asset hasn't been changed since it was scanned.  Assets left pending, because their scan failed
+//or was outdated, are scanned again by the Reconciler.
+
+type ScanStatus string
+
+const (
+	//ScanPending assets have been stored but not (successfully) scanned yet
+	ScanPending ScanStatus = "pending"
+	ScanClean ScanStatus = "clean"
+	ScanInfected ScanStatus = "infected"
+)
+
+var (
+	//ErrAssetPending is returned retrieving an asset which hasn't been scanned yet
+	ErrAssetPending = errors.New("asset has not been scanned yet")
+	//ErrAssetInfected is returned retrieving (or storing) an asset which failed a malware scan
+	ErrAssetInfected = errors.New("asset is infected")
+)
+
+type ScanResult struct {
+	Infected bool `json:"infected"`
+	//Name of the malware found
+	Signature string `json:"signature,omitempty"`
+}
+
+//Scanner scans data for malware
+type Scanner interface {
+	Scan(r io.Reader) (result ScanResult, err error)
+}
+
+//ScanPolicy configures when uploads are scanned, and which assets may be retrieved.  The zero value scans
+//during Store, and refuses pending and infected assets.
+type ScanPolicy struct {
+	//Async scans in the background after Store returns, leaving the asset pending until then
+	Async bool
+	//AllowPending allows retrieving assets that haven't been scanned yet
+	AllowPending bool
+	//AllowInfected allows retrieving assets that failed their scan
+	AllowInfected bool
+}
+
+//check checks an asset's scan status against the policy.  Assets stored before scanning was enabled have no
+//status, and are allowed.
+func (p ScanPolicy) check(meta AssetMeta) (err error) {
+	switch {
+	case meta.ScanStatus == ScanPending && !p.AllowPending:
+		return ErrAssetPending
+	case meta.ScanStatus == ScanInfected && !p.AllowInfected:
+		return ErrAssetInfected
+	}
+	return nil
+}
+
+//MetaStatusUpdater records the results of checking assets' meta, by their tenant scoped keys, only if they're still at
+//meta's revision, or returns ErrRevisionMismatch.  Each only sets the field it's named for, so the scanner and the
+//scrubber (see Scrubber) can't overwrite each other's results, and neither bumps the revision, as neither is a change
+//to the asset.
+type MetaStatusUpdater interface {
+	//UpdateScanStatus sets an asset's scan status to meta's
+	UpdateScanStatus(meta AssetMeta) (err error)
+	//UpdateState sets an asset's state to meta's
+	UpdateState(meta AssetMeta) (err error)
+}
+
+//statusUpdater is the meta handler, if it can record the results of checking assets
+func (s *AssetStorage) statusUpdater() (MetaStatusUpdater, error) {
+	updater, ok := s.metaHandler.(MetaStatusUpdater)
+	if !ok {
+		return nil, fmt.Errorf("meta status can't be updated")
+	}
+	return updater, nil
+}
+
+//WithScanner scans every upload, and refuses retrieving assets according to policy
+func WithScanner(scanner Scanner, policy ScanPolicy) AssetStorageOption {
+	return func(s *AssetStorage) {
+		s.scanner = scanner
+		s.scanPolicy = policy
+	}
+}
+
+//scan scans a stored asset and records the result in its meta
+func (s *AssetStorage) scan(meta AssetMeta) (AssetMeta, error) {
+	reader, _, err := readDecoded(s.dataHandler, meta, meta.DataKey())
+	if err != nil {
+		return meta, err
+	}
+	defer reader.Close()
+	result, err := s.scanner.Scan(reader)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"context": "AssetStorage.scan()",
+			"scanner": s.scanner,
+			"meta": meta,
+		}).Error(err)
+		return meta, err
+	}
+	meta.ScanStatus = ScanClean
+	if result.Infected {
+		meta.ScanStatus = ScanInfected
+		log.WithFields(log.Fields{
+			"context": "AssetStorage.scan()",
+			"signature": result.Signature,
+			"meta": meta,
+		}).Warn("infected asset")
+	}
+	updater, err := s.statusUpdater()
+	if err == nil {
+		err = updater.UpdateScanStatus(meta)
+	}
+	if err != nil {
+		log.WithFields(log.Fields{
+			"context": "AssetStorage.scan()",
+			"metaHandler": s.metaHandler,
+			"meta": meta,
+		}).Error(err)
+		return meta, err
+	}
+	if result.Infected {
+		return meta, ErrAssetInfected
+	}
+	return meta, nil
+}
+
+//ClamdScanner scans data with a clamd daemon, via its INSTREAM command
+type ClamdScanner struct {
+	network string
+	address string
+	//Timeout for a whole scan
+	Timeout time.Duration
+}
+
+//NewClamdScanner scans via the clamd listening on address, a url like unix:///var/run/clamd.ctl or
+//tcp://localhost:3310
+func NewClamdScanner(address string) (*ClamdScanner, error) {
+	u, err := url.Parse(address)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "unix":
+		return &ClamdScanner{network: "unix", address: u.Path, Timeout: 5 * time.Minute}, nil
+	case "tcp":
+		return &ClamdScanner{network: "tcp", address: u.Host, Timeout: 5 * time.Minute}, nil
+	}
+	return nil, fmt.Errorf("unsupported clamd address %s", address)
+}
+
+//clamd's default StreamMaxLength is 25M, but chunks can be much smaller
+const clamdChunkSize = 64 * 1024
+
+func (s *ClamdScanner) Scan(r io.Reader) (result ScanResult, err error) {
+	conn, err := net.DialTimeout(s.network, s.address, 10*time.Second)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	if s.Timeout > 0 {
+		conn.SetDeadline(time.Now().Add(s.Timeout))
+	}
+	if _, err = conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		return
+	}
+	//data is sent in chunks prefixed by their length, ending with a zero length chunk
+	buf := make([]byte, clamdChunkSize)
+	size := make([]byte, 4)
+	for {
+		n, rerr := io.ReadFull(r, buf)
+		if n > 0 {
+			binary.BigEndian.PutUint32(size, uint32(n))
+			if _, err = conn.Write(size); err != nil {
+				return
+			}
+			if _, err = conn.Write(buf[:n]); err != nil {
+				return
+			}
+		}
+		if rerr == io.EOF || rerr == io.ErrUnexpectedEOF {
+			break
+		}
+		if rerr != nil {
+			return result, rerr
+		}
+	}
+	if _, err = conn.Write([]byte{0, 0, 0, 0}); err != nil {
+		return
+	}
+	reply, err := bufio.NewReader(conn).ReadBytes(0)
+	if err != nil {
+		return
+	}
+	return parseClamdReply(string(bytes.TrimRight(reply, "\x00")))
+}
+
+//parseClamdReply parses replies like "stream: OK" or "stream: Eicar-Signature FOUND"
+func parseClamdReply(reply string) (result ScanResult, err error) {
+	reply = strings.TrimSpace(strings.TrimPrefix(reply, "stream:"))
+	switch {
+	case reply == "OK":
+		return result, nil
+	case strings.HasSuffix(reply, " FOUND"):
+		return ScanResult{Infected: true, Signature: strings.TrimSuffix(reply, " FOUND")}, nil
+	}
+	return result, fmt.Errorf("clamd: %s", reply)
+}
@@ -0,0 +1,218 @@
+package assetstore
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+//fakeClamd is a local stand in for clamd's INSTREAM command, flagging any stream containing "EICAR"
+func fakeClamd(t *testing.T) (address string, closer func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				cmd, err := r.ReadString(0)
+				if err != nil || cmd != "zINSTREAM\x00" {
+					conn.Write([]byte("UNKNOWN COMMAND\x00"))
+					return
+				}
+				var data bytes.Buffer
+				for {
+					var size uint32
+					if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+						return
+					}
+					if size == 0 {
+						break
+					}
+					io.CopyN(&data, r, int64(size))
+				}
+				if strings.Contains(data.String(), "EICAR") {
+					conn.Write([]byte("stream: Eicar-Test-Signature FOUND\x00"))
+				} else {
+					conn.Write([]byte("stream: OK\x00"))
+				}
+			}(conn)
+		}
+	}()
+	return "tcp://" + l.Addr().String(), func() { l.Close() }
+}
+
+func TestClamdScanner_Scan(t *testing.T) {
+	address, closer := fakeClamd(t)
+	defer closer()
+	scanner, err := NewClamdScanner(address)
+	assert.NoError(t, err)
+
+	result, err := scanner.Scan(bytes.NewReader(bytes.Repeat([]byte("clean "), clamdChunkSize)))
+	assert.NoError(t, err)
+	assert.False(t, result.Infected)
+
+	result, err = scanner.Scan(strings.NewReader("X5O!P%@AP[4\\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*"))
+	assert.NoError(t, err)
+	assert.Equal(t, ScanResult{Infected: true, Signature: "Eicar-Test-Signature"}, result)
+}
+
+func TestAssetStorage_Scanning(t *testing.T) {
+	address, closer := fakeClamd(t)
+	defer closer()
+	scanner, err := NewClamdScanner(address)
+	assert.NoError(t, err)
+	db := newMemMetaTokenStore()
+	s := NewAssetStorage(db, db, newMemDataStore(), WithScanner(scanner, ScanPolicy{}))
+
+	clean := AssetMeta{ID: uuid.New().String(), Name: "clean.txt"}
+	stored, err := s.Store(clean, AssetToken{}, ioutil.NopCloser(strings.NewReader("hello")))
+	assert.NoError(t, err)
+	assert.Equal(t, ScanClean, stored.ScanStatus)
+	meta, asset, err := s.GetByID(clean.Key())
+	assert.NoError(t, err)
+	assert.Equal(t, ScanClean, meta.ScanStatus)
+	assert.Equal(t, "hello", readAll(t, asset))
+
+	infected := AssetMeta{ID: uuid.New().String(), Name: "eicar.com"}
+	_, err = s.Store(infected, AssetToken{}, ioutil.NopCloser(strings.NewReader("EICAR")))
+	assert.True(t, errors.Is(err, ErrAssetInfected))
+	_, _, err = s.GetByID(infected.Key())
+	assert.True(t, errors.Is(err, ErrAssetInfected))
+
+	//a scan that couldn't happen leaves the asset pending
+	closer()
+	pending := AssetMeta{ID: uuid.New().String(), Name: "later.txt"}
+	_, err = s.Store(pending, AssetToken{}, ioutil.NopCloser(strings.NewReader("hello")))
+	assert.NoError(t, err)
+	_, _, err = s.GetByID(pending.Key())
+	assert.True(t, errors.Is(err, ErrAssetPending))
+}
+
+//stubScanner scans with a func, so tests can fail scans, or change assets while they're scanned
+type stubScanner struct {
+	scan func(r io.Reader) (ScanResult, error)
+}
+
+func (s stubScanner) Scan(r io.Reader) (result ScanResult, err error) {
+	return s.scan(r)
+}
+
+func TestAssetStorage_ScanOutdated(t *testing.T) {
+	db := newMemMetaTokenStore()
+	data := newMemDataStore()
+	var during func()
+	scanner := stubScanner{func(r io.Reader) (ScanResult, error) {
+		if during != nil {
+			during()
+		}
+		return ScanResult{}, nil
+	}}
+	s := NewAssetStorage(db, db, data, WithScanner(scanner, ScanPolicy{}))
+	store := func(name string) AssetMeta {
+		meta, err := s.Store(AssetMeta{ID: uuid.New().String(), Name: name}, AssetToken{}, ioutil.NopCloser(strings.NewReader(name)))
+		assert.NoError(t, err)
+		return meta
+	}
+	meta := store("reprot.txt")
+
+	//a scan finishing after the asset's changed leaves the change alone, and the asset pending
+	name := "report.txt"
+	during = func() {
+		_, err := db.UpdateMeta(meta.Key(), MetaUpdate{Name: &name}, meta.Revision)
+		assert.NoError(t, err)
+	}
+	pending := db.metas[meta.Key()]
+	pending.ScanStatus = ScanPending
+	assert.NoError(t, db.StoreMeta(pending))
+	_, err := s.scan(pending)
+	assert.True(t, errors.Is(err, ErrRevisionMismatch))
+	assert.Equal(t, name, db.metas[meta.Key()].Name)
+	assert.Equal(t, int64(1), db.metas[meta.Key()].Revision)
+	assert.Equal(t, ScanPending, db.metas[meta.Key()].ScanStatus)
+
+	//and one finishing after it's deleted doesn't bring it back
+	during = nil
+	deleted := store("deleted.txt")
+	during = func() {
+		assert.NoError(t, s.Delete(deleted.Key()))
+	}
+	_, err = s.scan(deleted)
+	assert.Error(t, err)
+	assert.NotContains(t, db.metas, deleted.Key())
+
+	//a scan and the scrubber only record their own results, so neither undoes the other's
+	during = nil
+	checked := store("checked.txt")
+	during = func() {
+		corrupt := checked
+		corrupt.State = StateCorrupt
+		assert.NoError(t, db.UpdateState(corrupt))
+	}
+	_, err = s.scan(checked)
+	assert.NoError(t, err)
+	assert.Equal(t, StateCorrupt, db.metas[checked.Key()].State)
+	assert.Equal(t, ScanClean, db.metas[checked.Key()].ScanStatus)
+	infected := checked
+	infected.ScanStatus = ScanInfected
+	assert.NoError(t, db.UpdateScanStatus(infected))
+	corrupt := checked
+	corrupt.State, corrupt.ScanStatus = StateCorrupt, ScanClean
+	assert.NoError(t, db.UpdateState(corrupt))
+	assert.Equal(t, ScanInfected, db.metas[checked.Key()].ScanStatus)
+}
+
+func TestReconciler_Rescan(t *testing.T) {
+	db := newMemMetaTokenStore()
+	data := newMemDataStore()
+	var scanErr error
+	scanner := stubScanner{func(r io.Reader) (ScanResult, error) {
+		b, _ := ioutil.ReadAll(r)
+		return ScanResult{Infected: strings.Contains(string(b), "EICAR")}, scanErr
+	}}
+	s := NewAssetStorage(db, db, data, WithScanner(scanner, ScanPolicy{}))
+
+	//assets left pending by failed scans are scanned again, once they've been pending a while
+	scanErr = errors.New("scanner unavailable")
+	clean, err := s.Store(AssetMeta{ID: uuid.New().String(), Name: "clean.txt"}, AssetToken{}, ioutil.NopCloser(strings.NewReader("hello")))
+	assert.NoError(t, err)
+	infected, err := s.Store(AssetMeta{ID: uuid.New().String(), Name: "eicar.com"}, AssetToken{}, ioutil.NopCloser(strings.NewReader("EICAR")))
+	assert.NoError(t, err)
+	_, _, err = s.GetByID(clean.Key())
+	assert.True(t, errors.Is(err, ErrAssetPending))
+	scanErr = nil
+
+	r := NewReconciler(s, db, data)
+	report, err := r.Reconcile()
+	assert.NoError(t, err)
+	assert.Equal(t, 0, report.Rescanned)
+
+	r.RescanAfter = 0
+	report, err = r.Reconcile()
+	assert.NoError(t, err)
+	assert.Equal(t, 2, report.Rescanned)
+	assert.Equal(t, 0, report.Errors)
+	_, asset, err := s.GetByID(clean.Key())
+	if assert.NoError(t, err) {
+		assert.Equal(t, "hello", readAll(t, asset))
+	}
+	_, _, err = s.GetByID(infected.Key())
+	assert.True(t, errors.Is(err, ErrAssetInfected))
+
+	report, err = r.Reconcile()
+	assert.NoError(t, err)
+	assert.Equal(t, 0, report.Rescanned)
+}
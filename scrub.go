@@ -0,0 +1,263 @@
+package assetstore
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+//The Scrubber walks every asset, re-reading its data to check its size and checksum still match its meta, to
+//catch bit rot and data deleted outside the api.  Damaged assets are marked corrupt, unless they've been changed since
+//they were checked.
+
+//ErrAssetCorrupt is returned retrieving an asset whose data no longer matches its meta
+var ErrAssetCorrupt = errors.New("asset is corrupt")
+
+//hashReadCloser hashes what's read through it
+type hashReadCloser struct {
+	io.ReadCloser
+	hash hash.Hash
+}
+
+func newHashReadCloser(r io.ReadCloser) *hashReadCloser {
+	return &hashReadCloser{ReadCloser: r, hash: sha256.New()}
+}
+
+func (r *hashReadCloser) Read(p []byte) (n int, err error) {
+	n, err = r.ReadCloser.Read(p)
+	r.hash.Write(p[:n])
+	return
+}
+
+//Checksum is the hex sha256 of everything read so far
+func (r *hashReadCloser) Checksum() string {
+	return hex.EncodeToString(r.hash.Sum(nil))
+}
+
+//CheckpointStore keeps named progress markers, so long running jobs can resume where they left off
+type CheckpointStore interface {
+	LoadCheckpoint(name string) (value string, err error)
+	SaveCheckpoint(name, value string) (err error)
+}
+
+//FileCheckpointStore keeps checkpoints as files in a directory
+type FileCheckpointStore struct {
+	dir string
+}
+
+func NewFileCheckpointStore(dir string) *FileCheckpointStore {
+	return &FileCheckpointStore{dir: dir}
+}
+
+func (f *FileCheckpointStore) LoadCheckpoint(name string) (value string, err error) {
+	b, err := ioutil.ReadFile(filepath.Join(f.dir, name))
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	return string(b), err
+}
+
+func (f *FileCheckpointStore) SaveCheckpoint(name, value string) (err error) {
+	if err = os.MkdirAll(f.dir, 0755); err != nil {
+		return
+	}
+	//write then rename, so a crash never leaves a half written checkpoint
+	tmp := filepath.Join(f.dir, "."+name+".tmp")
+	if err = ioutil.WriteFile(tmp, []byte(value), 0644); err != nil {
+		return
+	}
+	return os.Rename(tmp, filepath.Join(f.dir, name))
+}
+
+//rateLimitedReader reads at no more than bytesPerSecond on average
+type rateLimitedReader struct {
+	io.Reader
+	bytesPerSecond int64
+	start time.Time
+	read int64
+}
+
+func newRateLimitedReader(r io.Reader, bytesPerSecond int64) io.Reader {
+	if bytesPerSecond <= 0 {
+		return r
+	}
+	return &rateLimitedReader{Reader: r, bytesPerSecond: bytesPerSecond, start: time.Now()}
+}
+
+func (r *rateLimitedReader) Read(p []byte) (n int, err error) {
+	//never read more than a second's worth at once, so sleeps stay short
+	if int64(len(p)) > r.bytesPerSecond {
+		p = p[:r.bytesPerSecond]
+	}
+	n, err = r.Reader.Read(p)
+	r.read += int64(n)
+	due := r.start.Add(time.Duration(float64(r.read) / float64(r.bytesPerSecond) * float64(time.Second)))
+	if wait := time.Until(due); wait > 0 {
+		time.Sleep(wait)
+	}
+	return
+}
+
+type ScrubReport struct {
+	Checked int `json:"checked"`
+	Bytes int64 `json:"bytes"`
+	//Keys of assets found corrupt (or missing data) this pass
+	Corrupt []string `json:"corrupt,omitempty"`
+	Errors int `json:"errors"`
+	//Whether the pass got through every asset
+	Complete bool `json:"complete"`
+}
+
+//scrubCheckpoint is the name the scrubber's progress is saved under
+const scrubCheckpoint = "scrubber"
+
+type Scrubber struct {
+	storage *AssetStorage
+	metaLister MetaLister
+	checkpoints CheckpointStore
+	data AssetDataHandler
+	//BytesPerSecond limits how fast data is read, 0 for unlimited
+	BytesPerSecond int64
+	PageSize int
+}
+
+//NewScrubber scrubs storage's assets, reading their data through data, which should decode it like storage's data
+//handler, but read it from where it's stored, rather than through any cache
+func NewScrubber(storage *AssetStorage, metaLister MetaLister, checkpoints CheckpointStore, data AssetDataHandler) *Scrubber {
+	return &Scrubber{
+		storage: storage,
+		metaLister: metaLister,
+		checkpoints: checkpoints,
+		data: data,
+		PageSize: 100,
+	}
+}
+
+//Run scrubs continuously, pausing for interval after each complete pass, until stop is closed
+func (s *Scrubber) Run(interval time.Duration, stop <-chan struct{}) {
+	for {
+		report, err := s.Scrub(stop)
+		entry := log.WithFields(log.Fields{
+			"context": "Scrubber.Run()",
+			"report": report,
+		})
+		if err != nil {
+			entry.Error(err)
+		} else {
+			entry.Info("scrubbed")
+		}
+		select {
+		case <-stop:
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+//Scrub checks every asset, resuming from the last checkpoint.  Closing stop ends the pass early, at the next
+//page, with progress saved.
+func (s *Scrubber) Scrub(stop <-chan struct{}) (report ScrubReport, err error) {
+	cursor, err := s.checkpoints.LoadCheckpoint(scrubCheckpoint)
+	if err != nil {
+		return
+	}
+	for {
+		metas, next, err := s.metaLister.ListMeta(cursor, s.PageSize)
+		if err != nil {
+			return report, err
+		}
+		for _, meta := range metas {
+			s.scrubAsset(meta, &report)
+		}
+		//a full pass starts over from the beginning
+		if err = s.checkpoints.SaveCheckpoint(scrubCheckpoint, next); err != nil {
+			return report, err
+		}
+		if next == "" {
+			report.Complete = true
+			return report, nil
+		}
+		cursor = next
+		select {
+		case <-stop:
+			return report, nil
+		default:
+		}
+	}
+}
+
+func (s *Scrubber) scrubAsset(meta AssetMeta, report *ScrubReport) {
+	if !meta.Retrievable() || meta.State == StateCorrupt {
+		return
+	}
+	report.Checked++
+	size, checksum, err := s.readAsset(meta)
+	report.Bytes += size
+	switch {
+	case errors.Is(err, ErrNotFound):
+		err = fmt.Errorf("data is missing")
+	case errors.Is(err, ErrAssetCorrupt):
+	case err != nil:
+		report.Errors++
+		log.WithFields(log.Fields{
+			"context": "Scrubber.scrubAsset()",
+			"meta": meta,
+		}).Error(err)
+		return
+	case size != int64(meta.Size):
+		err = fmt.Errorf("size is %d, expected %d", size, meta.Size)
+	case meta.Checksum != "" && checksum != meta.Checksum:
+		err = fmt.Errorf("checksum is %s, expected %s", checksum, meta.Checksum)
+	default:
+		return
+	}
+	corrupt := meta
+	corrupt.State = StateCorrupt
+	updater, markErr := s.storage.statusUpdater()
+	if markErr == nil {
+		markErr = updater.UpdateState(corrupt)
+	}
+	if markErr != nil {
+		//assets changed or deleted since they were listed are checked again next pass
+		if !errors.Is(markErr, ErrRevisionMismatch) && !errors.Is(markErr, ErrNotFound) {
+			report.Errors++
+			log.WithFields(log.Fields{
+				"context": "Scrubber.scrubAsset()",
+				"meta": meta,
+			}).Error(markErr)
+		}
+		return
+	}
+	report.Corrupt = append(report.Corrupt, meta.Key())
+	log.WithFields(log.Fields{
+		"context": "Scrubber.scrubAsset()",
+		"meta": meta,
+	}).Warn("corrupt asset: ", err)
+}
+
+//readAsset streams an asset's data, returning its size and checksum
+func (s *Scrubber) readAsset(meta AssetMeta) (size int64, checksum string, err error) {
+	if statter, ok := s.data.(AssetDataStatter); ok {
+		//readers of missing data don't always say why they failed, so check first
+		if _, err = statter.Stat(meta.DataKey()); err != nil {
+			return
+		}
+	}
+	reader, _, err := readDecoded(s.data, meta, meta.DataKey())
+	if err != nil {
+		return
+	}
+	hasher := newHashReadCloser(reader)
+	defer hasher.Close()
+	size, err = io.Copy(ioutil.Discard, newRateLimitedReader(hasher, s.BytesPerSecond))
+	return size, hasher.Checksum(), err
+}
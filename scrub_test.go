@@ -0,0 +1,91 @@
+package assetstore
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestScrubber_Scrub(t *testing.T) {
+	s, db, data := setupMemAssetStorage()
+	store := func(content string) AssetMeta {
+		meta, err := s.Store(AssetMeta{ID: uuid.New().String(), Name: "f.txt"}, AssetToken{},
+			ioutil.NopCloser(bytes.NewReader([]byte(content))))
+		assert.NoError(t, err)
+		return meta
+	}
+	good := store("all good")
+	rotted := store("bit rot")
+	truncated := store("truncated")
+	missing := store("deleted outside the api")
+	assert.Len(t, good.Checksum, 64)
+
+	data.data[rotted.Key()] = []byte("bit rut")
+	data.data[truncated.Key()] = []byte("trunc")
+	delete(data.data, missing.Key())
+
+	checkpoints := NewFileCheckpointStore(t.TempDir())
+	scrubber := NewScrubber(s, db, checkpoints, data)
+	scrubber.PageSize = 1
+
+	//stopping part way saves progress, and the next pass picks up from there
+	stop := make(chan struct{})
+	close(stop)
+	report, err := scrubber.Scrub(stop)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, report.Checked)
+	assert.False(t, report.Complete)
+	cursor, err := checkpoints.LoadCheckpoint(scrubCheckpoint)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, cursor)
+
+	report, err = scrubber.Scrub(nil)
+	assert.NoError(t, err)
+	assert.True(t, report.Complete)
+	assert.Equal(t, 3, report.Checked)
+	cursor, _ = checkpoints.LoadCheckpoint(scrubCheckpoint)
+	assert.Equal(t, "", cursor)
+
+	for _, meta := range []AssetMeta{rotted, truncated, missing} {
+		_, _, err = s.GetByID(meta.Key())
+		assert.True(t, errors.Is(err, ErrAssetCorrupt), meta.Name)
+	}
+	_, asset, err := s.GetByID(good.Key())
+	assert.NoError(t, err)
+	assert.Equal(t, "all good", readAll(t, asset))
+}
+
+func TestScrubber_ReadsStoredData(t *testing.T) {
+	db := newMemMetaTokenStore()
+	data := newMemDataStore()
+	cache, err := NewDiskCache(data, t.TempDir(), 1<<20)
+	assert.NoError(t, err)
+	s := NewAssetStorage(db, db, cache)
+	meta, err := s.Store(AssetMeta{ID: uuid.New().String(), Name: "f.txt"}, AssetToken{},
+		ioutil.NopCloser(bytes.NewReader([]byte("cached"))))
+	assert.NoError(t, err)
+	_, asset, err := s.GetByID(meta.Key())
+	if assert.NoError(t, err) {
+		assert.Equal(t, "cached", readAll(t, asset))
+	}
+
+	//damage where the data's stored is found even while the cached copy's fine
+	data.data[meta.Key()] = []byte("cachet")
+	report, err := NewScrubber(s, db, NewFileCheckpointStore(t.TempDir()), data).Scrub(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{meta.Key()}, report.Corrupt)
+	assert.Equal(t, StateCorrupt, db.metas[meta.Key()].State)
+}
+
+func TestRateLimitedReader(t *testing.T) {
+	start := time.Now()
+	n, err := ioutil.ReadAll(newRateLimitedReader(bytes.NewReader(make([]byte, 300)), 1000))
+	assert.NoError(t, err)
+	assert.Len(t, n, 300)
+	assert.True(t, time.Since(start) >= 250*time.Millisecond)
+}
@@ -0,0 +1,271 @@
+package assetstore
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+//The tus 1.0 resumable upload protocol (https://tus.io/protocols/resumable-upload.html), with the creation,
+//termination, checksum and expiration extensions, served under /files.  Uploads are created with their filename (and
+//optionally filetype, token and expiry) in Upload-Metadata, and once complete are assets with the upload's id.
+
+const tusVersion = "1.0.0"
+
+const tusExtensions = "creation,termination,checksum,expiration"
+
+//StatusChecksumMismatch is tus' status for a chunk that doesn't match its Upload-Checksum
+const StatusChecksumMismatch = 460
+
+//tusChecksums are the Upload-Checksum algorithms supported
+var tusChecksums = map[string]func() hash.Hash{
+	"md5": md5.New,
+	"sha1": sha1.New,
+	"sha256": sha256.New,
+}
+
+//tusResumable adds the Tus-Resumable header, reporting whether the request is for a version of tus we speak
+func tusResumable(c *gin.Context) bool {
+	c.Header("Tus-Resumable", tusVersion)
+	if c.GetHeader("Tus-Resumable") != tusVersion {
+		c.Header("Tus-Version", tusVersion)
+		c.JSON(http.StatusPreconditionFailed, "unsupported tus version")
+		return false
+	}
+	return true
+}
+
+//tusOptions describes what the server supports
+func tusOptions(c *gin.Context) {
+	c.Header("Tus-Resumable", tusVersion)
+	c.Header("Tus-Version", tusVersion)
+	c.Header("Tus-Extension", tusExtensions)
+	c.Header("Tus-Checksum-Algorithm", "md5,sha1,sha256")
+	p, _ := requestPrincipal(c)
+	if limit := uploadLimit(maxUploadBytes, p.MaxUploadBytes); limit > 0 {
+		c.Header("Tus-Max-Size", strconv.FormatInt(limit, 10))
+	}
+	c.Status(http.StatusNoContent)
+}
+
+//tusCreate creates an upload of Upload-Length bytes
+func tusCreate(c *gin.Context) {
+	if !tusResumable(c) {
+		return
+	}
+	length, err := strconv.ParseInt(c.GetHeader("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		c.JSON(http.StatusBadRequest, "Upload-Length not specified")
+		return
+	}
+	p, ok := requestPrincipal(c)
+	if limit := uploadLimit(maxUploadBytes, p.MaxUploadBytes); limit > 0 && length > limit {
+		c.JSON(http.StatusRequestEntityTooLarge, ErrUploadTooLarge.Error())
+		return
+	}
+	metadata, err := parseTusMetadata(c.GetHeader("Upload-Metadata"))
+	if err != nil || metadata["filename"] == "" {
+		c.JSON(http.StatusBadRequest, "filename not specified in Upload-Metadata")
+		return
+	}
+	id, err := newAssetID(requestTenant(c))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, err.Error())
+		return
+	}
+	meta := AssetMeta{
+		ID: id,
+		Tenant: requestTenant(c),
+		Name: metadata["filename"],
+		ContentType: metadata["filetype"],
+		Size: int(length),
+	}
+	if ok {
+		meta.Owner = p.User
+	}
+
+	token := AssetToken{}
+	expiry, _ := strconv.Atoi(metadata["expiry"])
+	if wantToken, _ := strconv.ParseBool(metadata["token"]); wantToken && expiry != 0 {
+		if token.Token, err = newToken(meta.Tenant); err != nil {
+			c.JSON(http.StatusInternalServerError, err.Error())
+			return
+		}
+		token.Expiry = time.Now().Add(time.Minute * time.Duration(expiry)).Unix()
+		token.AssetID = meta.ID
+		token.Tenant = meta.Tenant
+	}
+
+	meta, err = resumableUploader.CreateResumable(meta, token)
+	if err != nil {
+		c.JSON(tusErrorStatus(err), err.Error())
+		return
+	}
+	c.Header("Location", strings.TrimSuffix(c.Request.URL.Path, "/")+"/"+meta.ID)
+	setTusUploadHeaders(c, meta)
+	if token.Valid() {
+		c.Header("Asset-Token", token.Token)
+	}
+	c.Status(http.StatusCreated)
+}
+
+//tusHead reports how much of an upload has been received
+func tusHead(c *gin.Context) {
+	if !tusResumable(c) {
+		return
+	}
+	meta, ok := tusUpload(c)
+	if !ok {
+		return
+	}
+	c.Header("Cache-Control", "no-store")
+	c.Header("Upload-Length", strconv.Itoa(meta.Size))
+	setTusUploadHeaders(c, meta)
+	c.Status(http.StatusOK)
+}
+
+//tusPatch appends a chunk to an upload at Upload-Offset
+func tusPatch(c *gin.Context) {
+	if !tusResumable(c) {
+		return
+	}
+	if c.ContentType() != "application/offset+octet-stream" {
+		c.JSON(http.StatusUnsupportedMediaType, "Content-Type must be application/offset+octet-stream")
+		return
+	}
+	offset, err := strconv.ParseInt(c.GetHeader("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		c.JSON(http.StatusBadRequest, "Upload-Offset not specified")
+		return
+	}
+	checksum, err := parseTusChecksum(c.GetHeader("Upload-Checksum"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, err.Error())
+		return
+	}
+	meta, ok := tusUpload(c)
+	if !ok {
+		return
+	}
+	meta, err = resumableUploader.AppendResumable(meta.Key(), offset, c.Request.Body, checksum)
+	if err != nil {
+		c.JSON(tusErrorStatus(err), err.Error())
+		return
+	}
+	setTusUploadHeaders(c, meta)
+	c.Status(http.StatusNoContent)
+}
+
+//tusTerminate abandons an incomplete upload
+func tusTerminate(c *gin.Context) {
+	if !tusResumable(c) {
+		return
+	}
+	meta, ok := tusUpload(c)
+	if !ok {
+		return
+	}
+	if err := resumableUploader.TerminateResumable(meta.Key()); err != nil {
+		c.JSON(tusErrorStatus(err), err.Error())
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+//tusUpload gets the meta of the upload a request is for, which the principal must own if it has an owner,
+//responding with an error if it can't
+func tusUpload(c *gin.Context) (meta AssetMeta, ok bool) {
+	meta, err := resumableUploader.GetMeta(scopedParam(c, "id"))
+	if err == nil && !meta.Retrievable() && !meta.Resumable {
+		err = ErrNotFound
+	}
+	if err != nil {
+		c.JSON(http.StatusNotFound, err.Error())
+		return meta, false
+	}
+	if meta.Owner != "" {
+		if p, ok := requestPrincipal(c); !ok || p.User != meta.Owner {
+			c.JSON(http.StatusForbidden, "only the owner may access this upload")
+			return meta, false
+		}
+	}
+	if !meta.Retrievable() && time.Now().Unix() > meta.ReservedUntil {
+		c.JSON(http.StatusGone, ErrReservationExpired.Error())
+		return meta, false
+	}
+	return meta, true
+}
+
+//setTusUploadHeaders reports an upload's offset, and when it expires if it's incomplete
+func setTusUploadHeaders(c *gin.Context, meta AssetMeta) {
+	if meta.Retrievable() {
+		c.Header("Upload-Offset", strconv.Itoa(meta.Size))
+		return
+	}
+	c.Header("Upload-Offset", strconv.FormatInt(meta.Offset, 10))
+	c.Header("Upload-Expires", time.Unix(meta.ReservedUntil, 0).UTC().Format(http.TimeFormat))
+}
+
+//tusErrorStatus maps errors handling resumable uploads to http statuses
+func tusErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrOffsetMismatch):
+		return http.StatusConflict
+	case errors.Is(err, ErrChecksumMismatch):
+		return StatusChecksumMismatch
+	case errors.Is(err, ErrReservationExpired):
+		return http.StatusGone
+	default:
+		return storeErrorStatus(err)
+	}
+}
+
+//parseTusMetadata parses an Upload-Metadata header: comma separated keys, each followed by a space and its base64
+//value, if it has one
+func parseTusMetadata(header string) (metadata map[string]string, err error) {
+	metadata = map[string]string{}
+	for _, pair := range strings.Split(header, ",") {
+		fields := strings.Fields(pair)
+		if len(fields) == 0 || len(fields) > 2 {
+			continue
+		}
+		value := []byte{}
+		if len(fields) == 2 {
+			if value, err = base64.StdEncoding.DecodeString(fields[1]); err != nil {
+				return nil, err
+			}
+		}
+		metadata[fields[0]] = string(value)
+	}
+	return metadata, nil
+}
+
+//parseTusChecksum parses an Upload-Checksum header: an algorithm, a space, and the chunk's base64 checksum
+func parseTusChecksum(header string) (checksum *ChunkChecksum, err error) {
+	if header == "" {
+		return nil, nil
+	}
+	fields := strings.Fields(header)
+	if len(fields) != 2 {
+		return nil, fmt.Errorf("Upload-Checksum malformed")
+	}
+	newHash, ok := tusChecksums[fields[0]]
+	if !ok {
+		return nil, fmt.Errorf("unsupported checksum algorithm %s", fields[0])
+	}
+	sum, err := base64.StdEncoding.DecodeString(fields[1])
+	if err != nil {
+		return nil, fmt.Errorf("Upload-Checksum malformed")
+	}
+	return &ChunkChecksum{Hash: newHash(), Sum: sum}, nil
+}
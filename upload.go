@@ -0,0 +1,255 @@
+package assetstore
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+//Large uploads can go straight to the storage backend, so they don't stream through us.  An upload is reserved,
+//which stores a pending marker and signs urls its data can be PUT to, in one request or in parts.  Once it's been
+//uploaded, completing the upload checks the data, and commits it as if it had been stored through us.  Reservations
+//that are never completed expire, and are removed by the Reconciler.
+
+var (
+	//ErrReservationExpired is returned completing an upload that wasn't completed in time
+	ErrReservationExpired = errors.New("upload reservation expired")
+	//ErrUploadMismatch is returned (wrapped) completing an upload whose data isn't the size or checksum reserved
+	ErrUploadMismatch = errors.New("uploaded data does not match the reservation")
+)
+
+//multipartUploadBytes is the size above which uploads are reserved as multipart uploads
+var multipartUploadBytes int64 = 100 * 1024 * 1024
+
+//uploadPartBytes is the size of each part of a multipart upload, bar the last
+var uploadPartBytes int64 = 64 * 1024 * 1024
+
+//maxUploadParts is the most parts an upload can have, more than which the parts are made bigger
+const maxUploadParts = 10000
+
+//UploadPart is a part of a multipart upload, as reported by the storage backend when it was uploaded
+type UploadPart struct {
+	Number int64 `json:"number"`
+	ETag string `json:"etag"`
+	//hex sha256 of the part, if it was uploaded through us
+	Checksum string `json:"checksum,omitempty"`
+}
+
+//UploadSigner signs short lived urls data can be uploaded to directly
+type UploadSigner interface {
+	//SignUpload signs a PUT of all of an object
+	SignUpload(id string, ttl time.Duration) (url string, err error)
+	//StartMultipartUpload starts uploading an object in parts, signing a PUT of each part, in order
+	StartMultipartUpload(id string, parts int, ttl time.Duration) (uploadID string, urls []string, err error)
+	CompleteMultipartUpload(id, uploadID string, parts []UploadPart) (err error)
+	AbortMultipartUpload(id, uploadID string) (err error)
+}
+
+//UploadReservation tells a client where to upload a reserved asset's data: all of it to URL, or each PartSize
+//bytes of it to the next of PartURLs
+type UploadReservation struct {
+	Meta AssetMeta `json:"asset"`
+	URL string `json:"url,omitempty"`
+	PartSize int64 `json:"part_size,omitempty"`
+	PartURLs []string `json:"part_urls,omitempty"`
+	//Unix timestamp the upload must be completed by
+	Expires int64 `json:"expires"`
+}
+
+//multipartCompleter completes and aborts multipart uploads, however their parts were uploaded
+type multipartCompleter interface {
+	CompleteMultipartUpload(id, uploadID string, parts []UploadPart) (err error)
+	AbortMultipartUpload(id, uploadID string) (err error)
+}
+
+//UploadCompleter checks and commits reserved uploads
+type UploadCompleter interface {
+	MetaRetriever
+	CompleteUpload(id string, parts []UploadPart, token AssetToken) (meta AssetMeta, err error)
+}
+
+type DirectUploader interface {
+	UploadCompleter
+	ReserveUpload(meta AssetMeta, ttl time.Duration) (reservation UploadReservation, err error)
+}
+
+//uploadParts is how many parts of what size an upload of size bytes is made in
+func uploadParts(size int64) (parts int, partSize int64) {
+	partSize = uploadPartBytes
+	if size > partSize*maxUploadParts {
+		partSize = (size + maxUploadParts - 1) / maxUploadParts
+	}
+	return int((size + partSize - 1) / partSize), partSize
+}
+
+//ReserveUpload reserves the declared size of an asset, and signs urls valid for ttl to upload its data to.  A
+//declared checksum is checked when the upload is completed.
+func (s *AssetStorage) ReserveUpload(meta AssetMeta, ttl time.Duration) (reservation UploadReservation, err error) {
+	signer, ok := s.dataHandler.(UploadSigner)
+	if !ok {
+		return reservation, ErrSigningUnsupported
+	}
+	//data's uploaded to the staging key, where the signed urls can't overwrite it once it's been checked
+	meta, err = s.reserveUpload(meta, ttl, func(meta *AssetMeta) (err error) {
+		if int64(meta.Size) > multipartUploadBytes {
+			var parts int
+			parts, reservation.PartSize = uploadParts(int64(meta.Size))
+			meta.UploadID, reservation.PartURLs, err = signer.StartMultipartUpload(stagingKey(*meta), parts, ttl)
+			return
+		}
+		reservation.URL, err = signer.SignUpload(stagingKey(*meta), ttl)
+		return
+	})
+	if err != nil {
+		return reservation, err
+	}
+	reservation.Meta = meta
+	reservation.Expires = meta.ReservedUntil
+	return reservation, nil
+}
+
+//reserveUpload reserves the declared size (and checksum) of an asset, starts its upload with start, and stores a
+//pending marker for it that expires after ttl
+func (s *AssetStorage) reserveUpload(meta AssetMeta, ttl time.Duration, start func(meta *AssetMeta) error) (AssetMeta, error) {
+	if !meta.Valid() || meta.Size < 0 {
+		return meta, fmt.Errorf("meta invalid")
+	}
+	meta.Checksum = strings.ToLower(meta.Checksum)
+	if _, hexErr := hex.DecodeString(meta.Checksum); hexErr != nil || (meta.Checksum != "" && len(meta.Checksum) != 64) {
+		return meta, fmt.Errorf("checksum must be a hex sha256")
+	}
+	usage := Usage{Bytes: int64(meta.Size), Objects: 1}
+	err := s.addUsage(meta, usage)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"context": "AssetStorage.reserveUpload()",
+			"usageTracker": s.usageTracker,
+			"meta": meta,
+		}).Error(err)
+		return meta, err
+	}
+	now := time.Now()
+	meta.State = StateUploading
+	meta.Created = now.Unix()
+	meta.ReservedUntil = now.Add(ttl).Unix()
+	err = start(&meta)
+	if err != nil {
+		s.removeUsage(meta, usage)
+		log.WithFields(log.Fields{
+			"context": "AssetStorage.reserveUpload()",
+			"dataHandler": s.dataHandler,
+			"meta": meta,
+		}).Error(err)
+		return meta, err
+	}
+	err = s.metaHandler.StoreMeta(meta)
+	if err != nil {
+		s.rollbackStore(meta, usage)
+		log.WithFields(log.Fields{
+			"context": "AssetStorage.reserveUpload()",
+			"metaHandler": s.metaHandler,
+			"meta": meta,
+		}).Error(err)
+		return meta, err
+	}
+	return meta, nil
+}
+
+//CompleteUpload checks a reserved asset's uploaded data is the size (and checksum) reserved, then commits it as Store
+//would, with token.  Data that doesn't match, or is rejected, is removed with its reservation.  If nothing's been
+//uploaded yet, the reservation is left to be completed later.
+func (s *AssetStorage) CompleteUpload(id string, parts []UploadPart, token AssetToken) (stored AssetMeta, err error) {
+	meta, err := s.metaHandler.GetMeta(id)
+	if err != nil {
+		return
+	}
+	if meta.Retrievable() || meta.ReservedUntil == 0 || meta.Resumable {
+		return meta, fmt.Errorf("%w: no upload reserved for %s", ErrNotFound, id)
+	}
+	if time.Now().Unix() > meta.ReservedUntil {
+		return meta, ErrReservationExpired
+	}
+	staged := stagingKey(meta)
+	if meta.UploadID != "" {
+		completer, ok := s.dataHandler.(multipartCompleter)
+		if !ok {
+			return meta, ErrMultipartUnsupported
+		}
+		err = completer.CompleteMultipartUpload(staged, meta.UploadID, parts)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"context": "AssetStorage.CompleteUpload()",
+				"dataHandler": s.dataHandler,
+				"meta": meta,
+			}).Error(err)
+			return meta, err
+		}
+		//so completing again, e.g. after the copy below fails, doesn't try to complete it twice
+		meta.UploadID = ""
+		if err = s.metaHandler.StoreMeta(meta); err != nil {
+			return meta, err
+		}
+	}
+	//the data's checked once it's been copied out of reach of the upload urls, so it can't change afterwards
+	err = s.copyData(staged, meta.Key())
+	if err != nil {
+		log.WithFields(log.Fields{
+			"context": "AssetStorage.CompleteUpload()",
+			"dataHandler": s.dataHandler,
+			"meta": meta,
+		}).Error(err)
+		return meta, err
+	}
+	token.Tenant = meta.Tenant
+	usage := Usage{Bytes: int64(meta.Size), Objects: 1}
+	committed := false
+	defer func() {
+		if !committed {
+			s.rollbackStore(meta, usage)
+		}
+	}()
+	s.deleteKey(staged)
+
+	reader, _, err := readDecoded(s.dataHandler, meta, meta.Key())
+	if err != nil {
+		return meta, err
+	}
+	hasher := newHashReadCloser(reader)
+	sniffer := newSniffReader(hasher)
+	n, err := io.Copy(ioutil.Discard, sniffer)
+	sniffer.Close()
+	if err != nil {
+		return meta, err
+	}
+	if n != int64(meta.Size) {
+		return meta, fmt.Errorf("%w: %d bytes were uploaded, %d reserved", ErrUploadMismatch, n, meta.Size)
+	}
+	if meta.Checksum != "" && meta.Checksum != hasher.Checksum() {
+		return meta, fmt.Errorf("%w: checksum is %s", ErrUploadMismatch, hasher.Checksum())
+	}
+	meta.Checksum = hasher.Checksum()
+	meta.ReservedUntil = 0
+	meta, err = s.commitStore(meta, token, &usage, sniffer.ContentType(), false, &committed)
+	return meta, err
+}
+
+//abortUpload abandons a reserved asset's multipart upload, so its parts don't linger in storage
+func (s *AssetStorage) abortUpload(meta AssetMeta) {
+	completer, ok := s.dataHandler.(multipartCompleter)
+	if !ok {
+		return
+	}
+	if err := completer.AbortMultipartUpload(stagingKey(meta), meta.UploadID); err != nil {
+		log.WithFields(log.Fields{
+			"context": "AssetStorage.abortUpload()",
+			"dataHandler": s.dataHandler,
+			"meta": meta,
+		}).Error(err)
+	}
+}
@@ -0,0 +1,246 @@
+package assetstore
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+//uploadingDataStore signs fake upload urls, keeping multipart uploads' parts until they're completed
+type uploadingDataStore struct {
+	*memDataStore
+	//parts of each multipart upload in progress, by upload id then part number
+	uploads map[string]map[int64][]byte
+	mu sync.Mutex
+}
+
+func newUploadingDataStore() *uploadingDataStore {
+	return &uploadingDataStore{memDataStore: newMemDataStore(), uploads: map[string]map[int64][]byte{}}
+}
+
+func (s *uploadingDataStore) SignUpload(id string, ttl time.Duration) (string, error) {
+	return "https://bucket.example/" + url.PathEscape(id), nil
+}
+
+func (s *uploadingDataStore) StartMultipartUpload(id string, parts int, ttl time.Duration) (uploadID string, urls []string, err error) {
+	uploadID, _ = s.StartMultipartWrite(id)
+	for part := 1; part <= parts; part++ {
+		urls = append(urls, fmt.Sprintf("https://bucket.example/%s?uploadId=%s&partNumber=%d", url.PathEscape(id), uploadID, part))
+	}
+	return
+}
+
+func (s *uploadingDataStore) StartMultipartWrite(id string) (uploadID string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	uploadID = uuid.New().String()
+	s.uploads[uploadID] = map[int64][]byte{}
+	return uploadID, nil
+}
+
+//uploadPart stands in for a client PUTting a part, returning its etag
+func (s *uploadingDataStore) uploadPart(uploadID string, number int64, data string) UploadPart {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.uploads[uploadID][number] = []byte(data)
+	return UploadPart{Number: number, ETag: fmt.Sprintf("etag-%d", number)}
+}
+
+func (s *uploadingDataStore) WritePart(id, uploadID string, number int64, part io.ReadSeeker) (UploadPart, error) {
+	data, err := ioutil.ReadAll(part)
+	if err != nil {
+		return UploadPart{}, err
+	}
+	return s.uploadPart(uploadID, number, string(data)), nil
+}
+
+func (s *uploadingDataStore) CompleteMultipartUpload(id, uploadID string, parts []UploadPart) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	uploaded, ok := s.uploads[uploadID]
+	if !ok {
+		return fmt.Errorf("no such upload %s", uploadID)
+	}
+	var data []byte
+	for _, part := range parts {
+		if part.ETag != fmt.Sprintf("etag-%d", part.Number) {
+			return fmt.Errorf("bad etag for part %d", part.Number)
+		}
+		data = append(data, uploaded[part.Number]...)
+	}
+	delete(s.uploads, uploadID)
+	_, err := s.Writer(id, ioutil.NopCloser(bytes.NewReader(data)))
+	return err
+}
+
+func (s *uploadingDataStore) AbortMultipartUpload(id, uploadID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.uploads, uploadID)
+	return nil
+}
+
+func sha256Hex(data string) string {
+	sum := sha256.Sum256([]byte(data))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestAssetStorage_DirectUpload(t *testing.T) {
+	db := newMemMetaTokenStore()
+	data := newUploadingDataStore()
+	s := NewAssetStorage(db, db, data)
+	content := "directly uploaded data"
+	put := func(r UploadReservation, data *uploadingDataStore, content string) {
+		key, _ := url.PathUnescape(strings.TrimPrefix(r.URL, "https://bucket.example/"))
+		_, err := data.Writer(key, ioutil.NopCloser(strings.NewReader(content)))
+		assert.NoError(t, err)
+	}
+
+	tests := []struct {
+		name     string
+		checksum string
+		uploaded string
+		wantErr  error
+	}{
+		{"uploaded as reserved", "", content, nil},
+		{"declared checksum", strings.ToUpper(sha256Hex(content)), content, nil},
+		{"wrong size", "", content + "!", ErrUploadMismatch},
+		{"wrong checksum", sha256Hex("something else"), strings.ToUpper(content), ErrUploadMismatch},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			meta := AssetMeta{ID: uuid.New().String(), Name: "big.bin", Size: len(content), Checksum: tt.checksum}
+			r, err := s.ReserveUpload(meta, time.Hour)
+			assert.NoError(t, err)
+			assert.NotEmpty(t, r.URL)
+			assert.Empty(t, r.PartURLs)
+			//the reservation can't be retrieved until it's completed
+			_, _, err = s.GetByID(meta.Key())
+			assert.True(t, errors.Is(err, ErrNotFound))
+
+			put(r, data, tt.uploaded)
+			token := AssetToken{Token: uuid.New().String(), AssetID: meta.ID, Expiry: time.Now().Add(time.Minute).Unix()}
+			stored, err := s.CompleteUpload(meta.Key(), nil, token)
+			if tt.wantErr != nil {
+				assert.True(t, errors.Is(err, tt.wantErr))
+				_, err = db.GetMeta(meta.Key())
+				assert.True(t, errors.Is(err, ErrNotFound))
+				assert.Empty(t, data.data)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, sha256Hex(content), stored.Checksum)
+			assert.Equal(t, "text/plain; charset=utf-8", stored.ContentType)
+			_, asset, err := s.GetByToken(token.Key())
+			assert.NoError(t, err)
+			assert.Equal(t, content, readAll(t, asset))
+			//the upload url can't change the data any more
+			_, ok := data.data[stagingKey(meta)]
+			assert.False(t, ok)
+			//and it can't be completed twice
+			_, err = s.CompleteUpload(meta.Key(), nil, AssetToken{})
+			assert.True(t, errors.Is(err, ErrNotFound))
+			assert.NoError(t, s.Delete(meta.Key()))
+		})
+	}
+
+	//completing before anything's uploaded leaves the reservation to be completed later
+	meta := AssetMeta{ID: uuid.New().String(), Name: "later.bin", Size: 4}
+	r, err := s.ReserveUpload(meta, time.Hour)
+	assert.NoError(t, err)
+	_, err = s.CompleteUpload(meta.Key(), nil, AssetToken{})
+	assert.Error(t, err)
+	put(r, data, "data")
+	_, err = s.CompleteUpload(meta.Key(), nil, AssetToken{})
+	assert.NoError(t, err)
+
+	//direct uploads of data that would be stored encrypted aren't possible
+	encrypted := NewAssetStorage(db, db, NewEncryptingDataHandler(data, testKeyProvider(t, "k1", "k1")))
+	_, err = encrypted.ReserveUpload(AssetMeta{ID: uuid.New().String(), Name: "secret.bin", Size: 4}, time.Hour)
+	assert.True(t, errors.Is(err, ErrSigningUnsupported))
+}
+
+func TestAssetStorage_DirectMultipartUpload(t *testing.T) {
+	defer func(threshold, partSize int64) { multipartUploadBytes, uploadPartBytes = threshold, partSize }(multipartUploadBytes, uploadPartBytes)
+	multipartUploadBytes, uploadPartBytes = 8, 4
+	db := newMemMetaTokenStore()
+	data := newUploadingDataStore()
+	//through a disk cache, which passes upload signing through
+	cache, err := NewDiskCache(data, t.TempDir(), 1024)
+	assert.NoError(t, err)
+	s := NewAssetStorage(db, db, cache)
+
+	meta := AssetMeta{ID: uuid.New().String(), Name: "parts.bin", Size: 10}
+	r, err := s.ReserveUpload(meta, time.Hour)
+	assert.NoError(t, err)
+	assert.Equal(t, "", r.URL)
+	assert.Equal(t, int64(4), r.PartSize)
+	assert.Len(t, r.PartURLs, 3)
+
+	uploadID := r.Meta.UploadID
+	parts := []UploadPart{
+		data.uploadPart(uploadID, 3, "89"),
+		data.uploadPart(uploadID, 1, "0123"),
+		data.uploadPart(uploadID, 2, "4567"),
+	}
+	_, err = s.CompleteUpload(meta.Key(), []UploadPart{{Number: 1, ETag: "wrong"}}, AssetToken{})
+	assert.Error(t, err)
+	stored, err := s.CompleteUpload(meta.Key(), []UploadPart{parts[1], parts[2], parts[0]}, AssetToken{})
+	assert.NoError(t, err)
+	assert.Equal(t, sha256Hex("0123456789"), stored.Checksum)
+	_, asset, err := s.GetByID(meta.Key())
+	assert.NoError(t, err)
+	assert.Equal(t, "0123456789", readAll(t, asset))
+}
+
+func TestReconciler_ExpiredReservations(t *testing.T) {
+	db := newMemMetaTokenStore()
+	data := newUploadingDataStore()
+	s := NewAssetStorage(db, db, data)
+	defer func(threshold int64) { multipartUploadBytes = threshold }(multipartUploadBytes)
+	multipartUploadBytes = 8
+
+	expired, err := s.ReserveUpload(AssetMeta{ID: uuid.New().String(), Name: "parts.bin", Size: 10}, -time.Second)
+	assert.NoError(t, err)
+	data.uploadPart(expired.Meta.UploadID, 1, "0123")
+	current, err := s.ReserveUpload(AssetMeta{ID: uuid.New().String(), Name: "small.bin", Size: 4}, time.Hour)
+	assert.NoError(t, err)
+	_, err = data.Writer(stagingKey(current.Meta), ioutil.NopCloser(strings.NewReader("data")))
+	assert.NoError(t, err)
+
+	_, err = s.CompleteUpload(expired.Meta.Key(), nil, AssetToken{})
+	assert.True(t, errors.Is(err, ErrReservationExpired))
+
+	r := NewReconciler(s, db, data)
+	r.Grace = 0
+	report, err := r.Reconcile()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, report.StaleUploads)
+	_, err = db.GetMeta(expired.Meta.Key())
+	assert.True(t, errors.Is(err, ErrNotFound))
+	assert.Empty(t, data.uploads)
+	//uploads still in progress are left alone, however old their staged data
+	_, err = s.CompleteUpload(current.Meta.Key(), nil, AssetToken{})
+	assert.NoError(t, err)
+
+	//but staged data that's outlived its upload is removed
+	_, err = data.Writer(stagingKey(current.Meta), ioutil.NopCloser(strings.NewReader("late")))
+	assert.NoError(t, err)
+	report, err = r.Reconcile()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, report.OrphanedData)
+	assert.Len(t, data.data, 1)
+	assert.Contains(t, data.data, current.Meta.Key())
+}